@@ -21,12 +21,14 @@ type TopologyClient interface {
 
 type topologyClient struct {
 	nodes           map[string]*NodeInfo
+	nodesLock       *sync.RWMutex // nodes are updated by the watch of zookeeper while requests read them
 	currentNodeName string
 	config          *config.Config
 	zkFactory       ZookeeperClientFactory
 	zkClient        ZookeeperClient
 	zkEvents        <-chan zk.Event
 	zkPath          string
+	zkNodesPath     string
 	childrenEvent   <-chan zk.Event
 	dispatcher      Dispatcher
 	zkClientLock    *sync.RWMutex
@@ -62,21 +64,32 @@ func NewTopologyClientWithZookeperClientFactory(config *config.Config, factory Z
 		zkClient:        nil,
 		zkEvents:        nil,
 		zkPath:          path.Join("/flocons", config.Namespace, config.Node.Name),
+		zkNodesPath:     path.Join("/flocons", config.Namespace),
 		dispatcher:      dispatcher,
 		zkClientLock:    &sync.RWMutex{},
+		nodesLock:       &sync.RWMutex{},
 		cancel:          cancel,
 	}
 	go client.connect(ctx)
 	return &client
 }
 
+// Copy of the known nodes, which can be read while the topology changes
 func (c *topologyClient) Nodes() map[string]*NodeInfo {
-	return c.nodes
+	c.nodesLock.RLock()
+	defer c.nodesLock.RUnlock()
+	nodes := make(map[string]*NodeInfo, len(c.nodes))
+	for name, node := range c.nodes {
+		nodes[name] = node
+	}
+	return nodes
 }
 
 func (c *topologyClient) GetNodeForObject(p string) *NodeInfo {
 	nodeName, _ := c.dispatcher.Get(p)
 	if nodeName != "" {
+		c.nodesLock.RLock()
+		defer c.nodesLock.RUnlock()
 		node, _ := c.nodes[nodeName]
 		return node
 	}
@@ -103,8 +116,8 @@ func (c *topologyClient) connect(ctx context.Context) {
 }
 
 func (c *topologyClient) doConnect() error {
-	c.zkClientLock.RLock()
-	defer c.zkClientLock.RUnlock()
+	c.zkClientLock.Lock()
+	defer c.zkClientLock.Unlock()
 	zkClient, zkEvents, err := c.zkFactory(c.config.Zookeeper, time.Second)
 	if err != nil {
 		logger.Errorf("Could not create zookeeper connection %s\n", err)
@@ -161,12 +174,15 @@ func (c *topologyClient) startNodeManagement() error {
 		}
 		return nil
 	}
-	if err := createPath(path.Dir(c.zkPath)); err != nil {
+	if err := createPath(c.zkNodesPath); err != nil {
 		return err
 	}
-	if err := c.updateNodeInfo(); err != nil {
-		logger.Errorf("Could not create node %s: %s", c.zkPath, err)
-		return err
+	// Clients which are not nodes, like mounts, only watch the nodes
+	if c.config.Node.Name != "" {
+		if err := c.updateNodeInfo(); err != nil {
+			logger.Errorf("Could not create node %s: %s", c.zkPath, err)
+			return err
+		}
 	}
 	go c.watchNodes()
 	return nil
@@ -209,7 +225,7 @@ func (c *topologyClient) getNodesAndWatch() (<-chan zk.Event, error) {
 	c.zkClientLock.RLock()
 	defer c.zkClientLock.RUnlock()
 
-	dir := path.Dir(c.zkPath)
+	dir := c.zkNodesPath
 	if c.zkClient == nil {
 		return nil, zk.ErrConnectionClosed
 	}
@@ -226,6 +242,8 @@ func (c *topologyClient) getNodesAndWatch() (<-chan zk.Event, error) {
 }
 
 func (c *topologyClient) updateNodes(names []string) {
+	c.nodesLock.Lock()
+	defer c.nodesLock.Unlock()
 delLoop:
 	for key, _ := range c.nodes {
 		for _, name := range names {
@@ -255,7 +273,7 @@ func (c *topologyClient) addNode(name string) {
 	}
 	logger.Infof("Client for node %s has detected client for node %s", c.currentNodeName, name)
 	var node NodeInfo
-	data, _, _ := c.zkClient.Get(path.Join(path.Dir(c.zkPath), name))
+	data, _, _ := c.zkClient.Get(path.Join(c.zkNodesPath, name))
 	json.Unmarshal(data, &node)
 	logger.Debugf("Client %s is in shard %s with address %s", node.Name, node.Shard, node.Address)
 	c.nodes[name] = &node
@@ -270,6 +288,8 @@ func (c *topologyClient) removeNode(name string) {
 }
 
 func (c *topologyClient) clear() {
+	c.nodesLock.Lock()
+	defer c.nodesLock.Unlock()
 	for key, _ := range c.nodes {
 		delete(c.nodes, key)
 	}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"regexp"
 	"strconv"
+	"time"
 
 	. "github.com/docker/go-units"
 
@@ -17,6 +18,23 @@ import (
 
 const DEFAULT_PORT int = 62116
 
+// Well below the usual limit of 1024 open files, leaving room for write containers, indexes and sockets
+const DEFAULT_MAX_OPEN_FILES int = 256
+const DEFAULT_WRITE_CONTAINERS int = 1
+
+// Placement policies of new containers when storage has several paths
+const (
+	PLACEMENT_ROUND_ROBIN string = "round_robin" // containers are created on each path in turn
+	PLACEMENT_FREE_SPACE  string = "free_space"  // containers are created on the path with the most free space
+)
+
+// Durability modes of writes
+const (
+	DURABILITY_SYNC  string = "sync"  // data and index are synced on disk for each write
+	DURABILITY_GROUP string = "group" // concurrent writes are synced on disk together every group commit interval
+	DURABILITY_NONE  string = "none"  // writes are never explicitely synced on disk
+)
+
 type Config struct {
 	Namespace string   `json:"namespace"`
 	Zookeeper []string `json:"zookeeper"`
@@ -25,13 +43,47 @@ type Config struct {
 		Port            int    `json:"port"`
 		ExternalAddress string `json:"external_address"`
 		Shard           string `json:"shard"`
+		P9Port          int    `json:"9p_port"`   // port of the 9P2000.L server, which is not started if not set
+		GrpcPort        int    `json:"grpc_port"` // port of the gRPC server, which is not started if not set
 	} `json:"node"`
 	Storage struct {
-		Path                   string `json:"path"`
-		MaxSize                string `json:"max_size"`
-		MaxContainerSize       string `json:"max_container_size"`
-		MaxSizeInByes          int64
-		MaxContainerSizeInByes int64
+		Path                        string   `json:"path"`
+		Paths                       []string `json:"paths"`
+		Placement                   string   `json:"placement"`
+		ColdPath                    string   `json:"cold_path"`
+		TieringAge                  string   `json:"tiering_age"`
+		TieringInterval             string   `json:"tiering_interval"`
+		MaxSize                     string   `json:"max_size"`
+		MaxContainerSize            string   `json:"max_container_size"`
+		MaxFileSize                 string   `json:"max_file_size"`
+		MaxOpenFiles                int      `json:"max_open_files"`
+		WriteContainers             int      `json:"write_containers"`
+		DataCacheSize               string   `json:"data_cache_size"`
+		DataCacheMaxFileSize        string   `json:"data_cache_max_file_size"`
+		Durability                  string   `json:"durability"`
+		GroupCommitInterval         string   `json:"group_commit_interval"`
+		JournalPath                 string   `json:"journal_path"`
+		JournalSegmentSize          string   `json:"journal_segment_size"`
+		JournalRetention            string   `json:"journal_retention"`
+		MaxSizeInByes               int64
+		MaxContainerSizeInByes      int64
+		MaxFileSizeInBytes          int64
+		DataCacheSizeInBytes        int64
+		DataCacheMaxFileSizeInBytes int64
+		GroupCommitIntervalDuration time.Duration
+		TieringAgeDuration          time.Duration
+		TieringIntervalDuration     time.Duration
+		JournalSegmentSizeInBytes   int64
+		JournalRetentionDuration    time.Duration
+		Offload                     struct {
+			Endpoint  string `json:"endpoint"`
+			Region    string `json:"region"`
+			Bucket    string `json:"bucket"`
+			Prefix    string `json:"prefix"`
+			AccessKey string `json:"access_key"`
+			SecretKey string `json:"secret_key"`
+			Evict     bool   `json:"evict"`
+		} `json:"offload"`
 	} `json:"storage"`
 	Sync struct {
 		DataTimeout     string `json:"data_timeout"`
@@ -92,15 +144,42 @@ func sanitizeConfig(config *Config) error {
 	}
 
 	isNodeConfig := config.Node.Name != "" || config.Node.Port != 0 || config.Node.ExternalAddress != "" || config.Node.Shard != "" ||
-		config.Storage.Path != ""
+		config.Storage.Path != "" || len(config.Storage.Paths) > 0
 
 	if isNodeConfig {
+		// The first path is the main one, the others are additional disks
+		if config.Storage.Path == "" && len(config.Storage.Paths) > 0 {
+			config.Storage.Path = config.Storage.Paths[0]
+		}
 		if config.Storage.Path == "" {
 			return NewConfigError("node config without storage specified")
 		}
+		paths := []string{config.Storage.Path}
+		for _, p := range config.Storage.Paths {
+			if p == "" {
+				return NewConfigError("storage path is empty")
+			}
+			if p != config.Storage.Path {
+				paths = append(paths, p)
+			}
+		}
+		config.Storage.Paths = paths
+		switch config.Storage.Placement {
+		case "":
+			config.Storage.Placement = PLACEMENT_ROUND_ROBIN
+		case PLACEMENT_ROUND_ROBIN, PLACEMENT_FREE_SPACE:
+		default:
+			return NewConfigError(fmt.Sprintf("placement %s is not valid", config.Storage.Placement))
+		}
 		if config.Node.Port == 0 {
 			config.Node.Port = DEFAULT_PORT
 		}
+		if config.Node.P9Port < 0 || config.Node.P9Port > 65535 || (config.Node.P9Port != 0 && config.Node.P9Port == config.Node.Port) {
+			return NewConfigError(fmt.Sprintf("9P port %d is not valid", config.Node.P9Port))
+		}
+		if config.Node.GrpcPort < 0 || config.Node.GrpcPort > 65535 || (config.Node.GrpcPort != 0 && (config.Node.GrpcPort == config.Node.Port || config.Node.GrpcPort == config.Node.P9Port)) {
+			return NewConfigError(fmt.Sprintf("gRPC port %d is not valid", config.Node.GrpcPort))
+		}
 
 		if config.Node.Name == "" {
 			hostname, err := os.Hostname()
@@ -130,6 +209,86 @@ func sanitizeConfig(config *Config) error {
 		if config.Storage.MaxContainerSizeInByes == -1 {
 			config.Storage.MaxContainerSizeInByes, _ = FromHumanSize("100MB")
 		}
+		if config.Storage.MaxFileSize == "" {
+			config.Storage.MaxFileSize = "1GB"
+		}
+		maxFileSize, err := FromHumanSize(config.Storage.MaxFileSize)
+		if err != nil || maxFileSize <= 0 {
+			return NewConfigError(fmt.Sprintf("max file size %s is not valid", config.Storage.MaxFileSize))
+		}
+		config.Storage.MaxFileSizeInBytes = maxFileSize
+		if config.Storage.MaxOpenFiles <= 0 {
+			config.Storage.MaxOpenFiles = DEFAULT_MAX_OPEN_FILES
+		}
+		if config.Storage.WriteContainers < 0 {
+			return NewConfigError(fmt.Sprintf("number of write containers %d is not valid", config.Storage.WriteContainers))
+		} else if config.Storage.WriteContainers == 0 {
+			config.Storage.WriteContainers = DEFAULT_WRITE_CONTAINERS
+		}
+		if config.Storage.DataCacheSize != "" {
+			size, err := FromHumanSize(config.Storage.DataCacheSize)
+			if err != nil {
+				return NewConfigError(fmt.Sprintf("data cache size %s is not valid", config.Storage.DataCacheSize))
+			}
+			config.Storage.DataCacheSizeInBytes = size
+		}
+		config.Storage.DataCacheMaxFileSizeInBytes, _ = FromHumanSize(config.Storage.DataCacheMaxFileSize)
+		if config.Storage.DataCacheMaxFileSizeInBytes == -1 {
+			config.Storage.DataCacheMaxFileSizeInBytes, _ = FromHumanSize("1MB")
+		}
+
+		switch config.Storage.Durability {
+		case "":
+			config.Storage.Durability = DURABILITY_SYNC
+		case DURABILITY_SYNC, DURABILITY_GROUP, DURABILITY_NONE:
+		default:
+			return NewConfigError(fmt.Sprintf("durability %s is not valid", config.Storage.Durability))
+		}
+		if config.Storage.GroupCommitInterval == "" {
+			config.Storage.GroupCommitInterval = "10ms"
+		}
+		interval, err := time.ParseDuration(config.Storage.GroupCommitInterval)
+		if err != nil || interval <= 0 {
+			return NewConfigError(fmt.Sprintf("group commit interval %s is not valid", config.Storage.GroupCommitInterval))
+		}
+		config.Storage.GroupCommitIntervalDuration = interval
+
+		if config.Storage.TieringAge == "" {
+			config.Storage.TieringAge = "720h"
+		}
+		if config.Storage.TieringAgeDuration, err = time.ParseDuration(config.Storage.TieringAge); err != nil || config.Storage.TieringAgeDuration <= 0 {
+			return NewConfigError(fmt.Sprintf("tiering age %s is not valid", config.Storage.TieringAge))
+		}
+		if config.Storage.Offload.Endpoint != "" {
+			if u, err := url.Parse(config.Storage.Offload.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+				return NewConfigError(fmt.Sprintf("offload endpoint %s is not a valid url", config.Storage.Offload.Endpoint))
+			}
+			if config.Storage.Offload.Bucket == "" {
+				return NewConfigError("offload endpoint without bucket specified")
+			}
+			if config.Storage.Offload.Region == "" {
+				config.Storage.Offload.Region = "us-east-1"
+			}
+		}
+		if config.Storage.TieringInterval == "" {
+			config.Storage.TieringInterval = "1h"
+		}
+		if config.Storage.TieringIntervalDuration, err = time.ParseDuration(config.Storage.TieringInterval); err != nil || config.Storage.TieringIntervalDuration <= 0 {
+			return NewConfigError(fmt.Sprintf("tiering interval %s is not valid", config.Storage.TieringInterval))
+		}
+
+		if config.Storage.JournalSegmentSize == "" {
+			config.Storage.JournalSegmentSize = "64MB"
+		}
+		if config.Storage.JournalSegmentSizeInBytes, err = FromHumanSize(config.Storage.JournalSegmentSize); err != nil || config.Storage.JournalSegmentSizeInBytes <= 0 {
+			return NewConfigError(fmt.Sprintf("journal segment size %s is not valid", config.Storage.JournalSegmentSize))
+		}
+		if config.Storage.JournalRetention == "" {
+			config.Storage.JournalRetention = "168h"
+		}
+		if config.Storage.JournalRetentionDuration, err = time.ParseDuration(config.Storage.JournalRetention); err != nil || config.Storage.JournalRetentionDuration <= 0 {
+			return NewConfigError(fmt.Sprintf("journal retention %s is not valid", config.Storage.JournalRetention))
+		}
 	}
 
 	return nil
@@ -14,6 +14,14 @@ func NewIsNotDirError(path string) error {
 	return &os.PathError{Op: "stat", Path: path, Err: syscall.ENOTDIR}
 }
 
+func NewNotEmptyError(path string) error {
+	return &os.PathError{Op: "remove", Path: path, Err: syscall.ENOTEMPTY}
+}
+
+func NewInvalidPathError(op string, path string) error {
+	return &os.PathError{Op: op, Path: path, Err: os.ErrInvalid}
+}
+
 func IsIsDirError(err error) bool {
 	pathError, ok := err.(*os.PathError)
 	return ok && pathError.Err == syscall.EISDIR
@@ -24,6 +32,16 @@ func IsIsNotDirError(err error) bool {
 	return ok && pathError.Err == syscall.ENOTDIR
 }
 
+func IsNotEmptyError(err error) bool {
+	pathError, ok := err.(*os.PathError)
+	return ok && pathError.Err == syscall.ENOTEMPTY
+}
+
+func IsInvalidPathError(err error) bool {
+	pathError, ok := err.(*os.PathError)
+	return ok && pathError.Err == os.ErrInvalid
+}
+
 type ConfigError struct {
 	Message string
 }
@@ -49,6 +67,11 @@ func NewHttpError(status string, code int) error {
 	return &HttpError{Status: status, StatusCode: code}
 }
 
+func IsHttpError(err error, code int) bool {
+	httpError, ok := err.(*HttpError)
+	return ok && httpError.StatusCode == code
+}
+
 type InternalError struct {
 	Reason string
 }
@@ -60,3 +83,20 @@ func (e *InternalError) Error() string {
 func NewInternalError(reason string) error {
 	return &InternalError{Reason: reason}
 }
+
+type EventsLostError struct {
+	Sequence uint64
+}
+
+func (e *EventsLostError) Error() string {
+	return fmt.Sprintf("Events after sequence %d are not available anymore", e.Sequence)
+}
+
+func NewEventsLostError(sequence uint64) error {
+	return &EventsLostError{Sequence: sequence}
+}
+
+func IsEventsLostError(err error) bool {
+	_, ok := err.(*EventsLostError)
+	return ok
+}
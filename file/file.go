@@ -1,7 +1,11 @@
 package file
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"os"
+	"strings"
 	"time"
 
 	. "github.com/t-mind/flocons/error"
@@ -12,7 +16,10 @@ type FileDataSource struct {
 	Shard     string
 	Container string
 	Address   int64
+	ETag      string // entity tag given by a server, computed from the other fields if empty
+	Digest    string // md5 of the data in hexadecimal, empty if it was not computed when the file was written
 	Data      func() ([]byte, error)
+	Open      func() (*io.SectionReader, func(), error) // positional access to the data, if supported
 }
 
 type FileInfo struct {
@@ -60,9 +67,18 @@ func (i *FileInfo) UpdateDataSource(s FileDataSource) {
 	if s.Address != 0 {
 		i.sys.Address = s.Address
 	}
+	if s.ETag != "" {
+		i.sys.ETag = s.ETag
+	}
+	if s.Digest != "" {
+		i.sys.Digest = s.Digest
+	}
 	if s.Data != nil {
 		i.sys.Data = s.Data
 	}
+	if s.Open != nil {
+		i.sys.Open = s.Open
+	}
 }
 
 // base name of the file
@@ -110,6 +126,30 @@ func (i *FileInfo) Container() string {
 	return i.sys.Container
 }
 
+func (i *FileInfo) Digest() string {
+	return i.sys.Digest
+}
+
+// Strong entity tag of a regular file, empty for directories
+// It is the md5 of the data when it is known, as S3 clients expect.
+// Otherwise a file at an address of a container never changes, so it is tagged by them.
+// Files without container are tagged by their size and modification time
+func (i *FileInfo) ETag() string {
+	if i.sys.ETag != "" {
+		return i.sys.ETag
+	}
+	if i.IsDir() {
+		return ""
+	}
+	if i.sys.Digest != "" {
+		return fmt.Sprintf("\"%s\"", i.sys.Digest)
+	}
+	if i.sys.Container != "" {
+		return fmt.Sprintf("\"%s-%x\"", strings.TrimSuffix(i.sys.Container, ".tar"), i.sys.Address)
+	}
+	return fmt.Sprintf("\"%x-%x\"", i.size, i.modTime.UnixNano())
+}
+
 func (i *FileInfo) IsDataAvailable() bool {
 	return i.sys.Data != nil
 }
@@ -120,3 +160,16 @@ func (i *FileInfo) Data() ([]byte, error) {
 	}
 	return i.sys.Data()
 }
+
+// Open the data for positional reads, to read only some parts of it
+// The returned function must be called once reads are done. Without positional access, the whole data is read
+func (i *FileInfo) OpenData() (*io.SectionReader, func(), error) {
+	if i.sys.Open != nil {
+		return i.sys.Open()
+	}
+	data, err := i.Data()
+	if err != nil {
+		return nil, nil, err
+	}
+	return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), func() {}, nil
+}
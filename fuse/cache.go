@@ -0,0 +1,137 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package fuse
+
+import (
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// Number of cached entries above which expired ones are dropped
+const CACHE_PURGE_THRESHOLD int = 10000
+
+// Attributes of files and entries of directories, kept for a while so that each system call doesn't need a request
+type metadataCache struct {
+	timeout     time.Duration
+	files       map[string]cachedFile
+	directories map[string]cachedDirectory
+	mutex       *sync.Mutex
+}
+
+type cachedFile struct {
+	fi      os.FileInfo
+	expires time.Time
+}
+
+type cachedDirectory struct {
+	files   []os.FileInfo
+	expires time.Time
+}
+
+func newMetadataCache(timeout time.Duration) *metadataCache {
+	return &metadataCache{
+		timeout:     timeout,
+		files:       make(map[string]cachedFile),
+		directories: make(map[string]cachedDirectory),
+		mutex:       &sync.Mutex{},
+	}
+}
+
+func (c *metadataCache) getFile(p string) (os.FileInfo, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, found := c.files[p]
+	if !found || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.fi, true
+}
+
+func (c *metadataCache) putFile(p string, fi os.FileInfo) {
+	if c.timeout <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.purge()
+	c.files[p] = cachedFile{fi: fi, expires: time.Now().Add(c.timeout)}
+}
+
+func (c *metadataCache) getDirectory(p string) ([]os.FileInfo, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, found := c.directories[p]
+	if !found || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.files, true
+}
+
+// Cache the entries of a directory, with their attributes which are needed right after by listings like ls -l
+func (c *metadataCache) putDirectory(p string, files []os.FileInfo) {
+	if c.timeout <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.purge()
+	expires := time.Now().Add(c.timeout)
+	c.directories[p] = cachedDirectory{files: files, expires: expires}
+	for _, f := range files {
+		c.files[path.Join(p, f.Name())] = cachedFile{fi: f, expires: expires}
+	}
+}
+
+// Forget a changed file, with the listing of its directory and its own listing
+func (c *metadataCache) invalidate(p string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.files, p)
+	delete(c.directories, p)
+	delete(c.directories, path.Dir(p))
+}
+
+// Forget a renamed or removed directory with all its descendants
+func (c *metadataCache) invalidateTree(p string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for cached := range c.files {
+		if cached == p || isDescendant(cached, p) {
+			delete(c.files, cached)
+		}
+	}
+	for cached := range c.directories {
+		if cached == p || isDescendant(cached, p) {
+			delete(c.directories, cached)
+		}
+	}
+	delete(c.directories, path.Dir(p))
+}
+
+// Drop expired entries once there are many of them, must be called with the lock held
+func (c *metadataCache) purge() {
+	if len(c.files)+len(c.directories) < CACHE_PURGE_THRESHOLD {
+		return
+	}
+	now := time.Now()
+	for p, entry := range c.files {
+		if now.After(entry.expires) {
+			delete(c.files, p)
+		}
+	}
+	for p, entry := range c.directories {
+		if now.After(entry.expires) {
+			delete(c.directories, p)
+		}
+	}
+}
+
+func isDescendant(p string, directory string) bool {
+	if directory == "/" {
+		return p != "/"
+	}
+	return len(p) > len(directory) && p[:len(directory)] == directory && p[len(directory)] == '/'
+}
@@ -0,0 +1,143 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package fuse
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"syscall"
+
+	fuselib "bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	. "github.com/t-mind/flocons/error"
+	flhttp "github.com/t-mind/flocons/http"
+)
+
+type Dir struct {
+	fs   *FileSystem
+	path string
+}
+
+var _ fs.Node = (*Dir)(nil)
+var _ fs.NodeRequestLookuper = (*Dir)(nil)
+var _ fs.HandleReadDirAller = (*Dir)(nil)
+var _ fs.NodeMkdirer = (*Dir)(nil)
+var _ fs.NodeCreater = (*Dir)(nil)
+var _ fs.NodeRemover = (*Dir)(nil)
+var _ fs.NodeRenamer = (*Dir)(nil)
+var _ fs.NodeSetattrer = (*Dir)(nil)
+
+func (d *Dir) Attr(ctx context.Context, a *fuselib.Attr) error {
+	fi, err := d.fs.stat(d.path)
+	if err != nil {
+		return toErrno(err)
+	}
+	d.fs.fillAttr(d.path, fi, a)
+	return nil
+}
+
+func (d *Dir) Lookup(ctx context.Context, req *fuselib.LookupRequest, resp *fuselib.LookupResponse) (fs.Node, error) {
+	p := path.Join(d.path, req.Name)
+	fi, err := d.fs.stat(p)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	// Entries are cached by the kernel as long as attributes, so that changes of other clients are seen
+	resp.EntryValid = d.fs.timeout
+	return d.fs.node(p, fi), nil
+}
+
+func (d *Dir) ReadDirAll(ctx context.Context) ([]fuselib.Dirent, error) {
+	files, err := d.fs.readDir(d.path)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	dirents := make([]fuselib.Dirent, 0, len(files))
+	for _, f := range files {
+		dirent := fuselib.Dirent{Name: f.Name(), Type: fuselib.DT_File}
+		if f.IsDir() {
+			dirent.Type = fuselib.DT_Dir
+		}
+		dirents = append(dirents, dirent)
+	}
+	return dirents, nil
+}
+
+func (d *Dir) Mkdir(ctx context.Context, req *fuselib.MkdirRequest) (fs.Node, error) {
+	p := path.Join(d.path, req.Name)
+	fi, err := d.fs.router.Client(p).CreateDirectory(p, (req.Mode &^ req.Umask).Perm())
+	d.fs.cache.invalidate(p)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	d.fs.cache.putFile(p, fi)
+	return d.fs.node(p, fi), nil
+}
+
+// Create an empty file, which is written when its handle is flushed
+func (d *Dir) Create(ctx context.Context, req *fuselib.CreateRequest, resp *fuselib.CreateResponse) (fs.Node, fs.Handle, error) {
+	p := path.Join(d.path, req.Name)
+	conditions := flhttp.Conditions{}
+	if req.Flags&fuselib.OpenExclusive != 0 {
+		conditions.IfNoneMatch = "*"
+	}
+	fi, err := d.fs.router.Client(p).CreateRegularFileWithConditions(p, (req.Mode &^ req.Umask).Perm(), []byte{}, conditions)
+	d.fs.cache.invalidate(p)
+	if err != nil {
+		return nil, nil, toErrno(err)
+	}
+	d.fs.cache.putFile(p, fi)
+	resp.EntryValid = d.fs.timeout
+	handle := newFileHandle(d.fs, p)
+	handle.data = []byte{}
+	return d.fs.node(p, fi), handle, nil
+}
+
+func (d *Dir) Remove(ctx context.Context, req *fuselib.RemoveRequest) error {
+	p := path.Join(d.path, req.Name)
+	fi, err := d.fs.stat(p)
+	if err != nil {
+		return toErrno(err)
+	}
+	// Directories and regular files are removed the same way by the nodes
+	if req.Dir && !fi.IsDir() {
+		return fuselib.Errno(syscall.ENOTDIR)
+	}
+	if !req.Dir && fi.IsDir() {
+		return fuselib.Errno(syscall.EISDIR)
+	}
+	err = d.fs.router.Client(p).RemoveFile(p)
+	d.fs.cache.invalidateTree(p)
+	if err != nil {
+		if req.Dir && IsHttpError(err, http.StatusConflict) {
+			return fuselib.Errno(syscall.ENOTEMPTY)
+		}
+		return toErrno(err)
+	}
+	return nil
+}
+
+func (d *Dir) Rename(ctx context.Context, req *fuselib.RenameRequest, newDir fs.Node) error {
+	target, ok := newDir.(*Dir)
+	if !ok {
+		return fuselib.Errno(syscall.ENOTDIR)
+	}
+	p := path.Join(d.path, req.OldName)
+	targetPath := path.Join(target.path, req.NewName)
+	_, err := d.fs.router.Client(p).RenameFile(p, targetPath)
+	d.fs.cache.invalidateTree(p)
+	d.fs.cache.invalidateTree(targetPath)
+	return toErrno(err)
+}
+
+func (d *Dir) Setattr(ctx context.Context, req *fuselib.SetattrRequest, resp *fuselib.SetattrResponse) error {
+	fi, err := d.fs.update(d.path, req)
+	if err != nil {
+		return toErrno(err)
+	}
+	d.fs.fillAttr(d.path, fi, &resp.Attr)
+	return nil
+}
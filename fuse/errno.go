@@ -0,0 +1,48 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package fuse
+
+import (
+	"net/http"
+	"os"
+	"syscall"
+
+	fuselib "bazil.org/fuse"
+
+	. "github.com/t-mind/flocons/error"
+)
+
+// Convert an error of the client to the errno returned to the kernel
+// Errors which have no better match, like network failures, are I/O errors
+func toErrno(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errno, ok := err.(fuselib.Errno); ok {
+		return errno
+	}
+	switch {
+	case os.IsNotExist(err) || IsHttpError(err, http.StatusNotFound):
+		return fuselib.Errno(syscall.ENOENT)
+	case os.IsPermission(err) || IsHttpError(err, http.StatusForbidden):
+		return fuselib.Errno(syscall.EACCES)
+	case IsNotEmptyError(err):
+		return fuselib.Errno(syscall.ENOTEMPTY)
+	case IsIsDirError(err):
+		return fuselib.Errno(syscall.EISDIR)
+	case IsIsNotDirError(err):
+		return fuselib.Errno(syscall.ENOTDIR)
+	case os.IsExist(err) || IsHttpError(err, http.StatusConflict) || IsHttpError(err, http.StatusPreconditionFailed):
+		return fuselib.Errno(syscall.EEXIST)
+	case IsInvalidPathError(err) || IsHttpError(err, http.StatusBadRequest) || IsHttpError(err, http.StatusRequestedRangeNotSatisfiable):
+		return fuselib.Errno(syscall.EINVAL)
+	case IsHttpError(err, http.StatusMethodNotAllowed):
+		return fuselib.Errno(syscall.ENOTSUP)
+	case IsHttpError(err, http.StatusServiceUnavailable) || IsHttpError(err, http.StatusGatewayTimeout):
+		return fuselib.Errno(syscall.EAGAIN)
+	default:
+		logger.Warnf("Request failed: %s", err)
+		return fuselib.Errno(syscall.EIO)
+	}
+}
@@ -0,0 +1,212 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package fuse
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	fuselib "bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// Mode of files written without known mode
+const DEFAULT_FILE_MODE os.FileMode = 0644
+
+type File struct {
+	fs   *FileSystem
+	path string
+}
+
+// Handle of an open file
+// Reads are sent to the nodes until the file is written, then the whole data is kept by the handle until it is flushed
+type FileHandle struct {
+	fs    *FileSystem
+	path  string
+	data  []byte // nil while nothing has been written
+	dirty bool
+	mutex *sync.Mutex
+}
+
+var _ fs.Node = (*File)(nil)
+var _ fs.NodeOpener = (*File)(nil)
+var _ fs.NodeSetattrer = (*File)(nil)
+var _ fs.HandleReader = (*FileHandle)(nil)
+var _ fs.HandleWriter = (*FileHandle)(nil)
+var _ fs.HandleFlusher = (*FileHandle)(nil)
+var _ fs.HandleReleaser = (*FileHandle)(nil)
+
+func newFileHandle(fs *FileSystem, p string) *FileHandle {
+	return &FileHandle{fs: fs, path: p, mutex: &sync.Mutex{}}
+}
+
+func (f *File) Attr(ctx context.Context, a *fuselib.Attr) error {
+	fi, err := f.fs.stat(f.path)
+	if err != nil {
+		return toErrno(err)
+	}
+	f.fs.fillAttr(f.path, fi, a)
+	return nil
+}
+
+func (f *File) Open(ctx context.Context, req *fuselib.OpenRequest, resp *fuselib.OpenResponse) (fs.Handle, error) {
+	handle := newFileHandle(f.fs, f.path)
+	if req.Flags&fuselib.OpenTruncate != 0 && !req.Flags.IsReadOnly() {
+		handle.data = []byte{}
+		handle.dirty = true
+		f.fs.setWriter(f.path, handle)
+	}
+	return handle, nil
+}
+
+// Change the size, the mode or the modification time of a file
+// Files are truncated in the handle writing them if any, otherwise they are written again
+func (f *File) Setattr(ctx context.Context, req *fuselib.SetattrRequest, resp *fuselib.SetattrResponse) error {
+	if req.Valid.Size() {
+		if writer := f.fs.writer(f.path); writer != nil {
+			writer.truncate(req.Size)
+		} else if err := f.truncate(req.Size); err != nil {
+			return toErrno(err)
+		}
+	}
+	fi, err := f.fs.update(f.path, req)
+	if err != nil {
+		return toErrno(err)
+	}
+	f.fs.fillAttr(f.path, fi, &resp.Attr)
+	return nil
+}
+
+func (f *File) truncate(size uint64) error {
+	fi, err := f.fs.stat(f.path)
+	if err != nil {
+		return err
+	}
+	if uint64(fi.Size()) == size {
+		return nil
+	}
+	client := f.fs.router.Client(f.path)
+	data := []byte{}
+	if size > 0 {
+		if data, err = client.GetRegularFileData(f.path); err != nil {
+			return err
+		}
+	}
+	data = resize(data, size)
+	fi, err = client.PutRegularFile(f.path, fi.Mode().Perm(), data)
+	f.fs.cache.invalidate(f.path)
+	if err != nil {
+		return err
+	}
+	f.fs.cache.putFile(f.path, fi)
+	return nil
+}
+
+func (h *FileHandle) Read(ctx context.Context, req *fuselib.ReadRequest, resp *fuselib.ReadResponse) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.data == nil {
+		data, err := h.fs.router.Client(h.path).ReadRange(h.path, req.Offset, int64(req.Size))
+		if err != nil {
+			return toErrno(err)
+		}
+		resp.Data = data
+		return nil
+	}
+	if req.Offset >= int64(len(h.data)) {
+		return nil
+	}
+	end := req.Offset + int64(req.Size)
+	if end > int64(len(h.data)) {
+		end = int64(len(h.data))
+	}
+	resp.Data = h.data[req.Offset:end]
+	return nil
+}
+
+// Write in the buffer of the handle, the first write loading the whole data of the file
+func (h *FileHandle) Write(ctx context.Context, req *fuselib.WriteRequest, resp *fuselib.WriteResponse) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.data == nil {
+		data, err := h.fs.router.Client(h.path).GetRegularFileData(h.path)
+		if err != nil {
+			return toErrno(err)
+		}
+		h.data = data
+	}
+	end := uint64(req.Offset) + uint64(len(req.Data))
+	if end > uint64(len(h.data)) {
+		h.data = resize(h.data, end)
+	}
+	copy(h.data[req.Offset:], req.Data)
+	h.dirty = true
+	h.fs.setWriter(h.path, h)
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (h *FileHandle) Flush(ctx context.Context, req *fuselib.FlushRequest) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return toErrno(h.flush())
+}
+
+func (h *FileHandle) Release(ctx context.Context, req *fuselib.ReleaseRequest) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	err := h.flush()
+	h.fs.removeWriter(h.path, h)
+	return toErrno(err)
+}
+
+// Send the written data to the node responsible for the file, must be called with the lock held
+func (h *FileHandle) flush() error {
+	if !h.dirty {
+		return nil
+	}
+	mode := DEFAULT_FILE_MODE
+	if fi, err := h.fs.stat(h.path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	fi, err := h.fs.router.Client(h.path).PutRegularFile(h.path, mode, h.data)
+	h.fs.cache.invalidate(h.path)
+	if err != nil {
+		return err
+	}
+	h.fs.cache.putFile(h.path, fi)
+	h.dirty = false
+	return nil
+}
+
+func (h *FileHandle) size() uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return uint64(len(h.data))
+}
+
+func (h *FileHandle) truncate(size uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.data = resize(h.data, size)
+	h.dirty = true
+}
+
+// Data cut or extended with zeros to a size
+func resize(data []byte, size uint64) []byte {
+	if size <= uint64(len(data)) {
+		return data[:size]
+	}
+	if size <= uint64(cap(data)) {
+		extended := data[:size]
+		for i := len(data); i < len(extended); i++ {
+			extended[i] = 0
+		}
+		return extended
+	}
+	extended := make([]byte, size)
+	copy(extended, data)
+	return extended
+}
@@ -0,0 +1,196 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package fuse
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	fuselib "bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"github.com/t-mind/flocons/http"
+	"github.com/t-mind/flocons/storage"
+)
+
+// Time during which attributes and directory entries are cached, by the kernel and by the file system
+const DEFAULT_METADATA_TIMEOUT time.Duration = time.Second
+
+// File system giving access to the files of a cluster through its http api
+// Files being written are buffered by their handles and sent whole when they are flushed, since containers are append only
+type FileSystem struct {
+	router  *http.Router
+	cache   *metadataCache
+	timeout time.Duration
+	uid     uint32
+	gid     uint32
+	writers map[string]*FileHandle // handles with written data, which give the current size of their file
+	mutex   *sync.Mutex
+}
+
+// File system mounted on a directory
+type MountPoint struct {
+	path   string
+	conn   *fuselib.Conn
+	served chan error
+}
+
+var _ fs.FS = (*FileSystem)(nil)
+
+// Create a file system caching metadata for timeout, which can be 0 to always ask the nodes
+func NewFileSystem(router *http.Router, timeout time.Duration) *FileSystem {
+	return &FileSystem{
+		router:  router,
+		cache:   newMetadataCache(timeout),
+		timeout: timeout,
+		uid:     uint32(os.Getuid()),
+		gid:     uint32(os.Getgid()),
+		writers: make(map[string]*FileHandle),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+func (f *FileSystem) Root() (fs.Node, error) {
+	return &Dir{fs: f, path: "/"}, nil
+}
+
+// Mount the file system on a directory and serve it until it is unmounted
+func (f *FileSystem) Mount(mountpoint string, options ...fuselib.MountOption) (*MountPoint, error) {
+	options = append([]fuselib.MountOption{fuselib.FSName("flocons"), fuselib.Subtype("flocons")}, options...)
+	conn, err := fuselib.Mount(mountpoint, options...)
+	if err != nil {
+		return nil, err
+	}
+	mountPoint := &MountPoint{path: mountpoint, conn: conn, served: make(chan error, 1)}
+	go func() {
+		mountPoint.served <- fs.Serve(conn, f)
+	}()
+	<-conn.Ready
+	if conn.MountError != nil {
+		conn.Close()
+		return nil, conn.MountError
+	}
+	logger.Infof("File system mounted on %s", mountpoint)
+	return mountPoint, nil
+}
+
+// Unmount the file system, once it is not used anymore
+func (m *MountPoint) Unmount() error {
+	if err := fuselib.Unmount(m.path); err != nil {
+		return err
+	}
+	err := <-m.served
+	m.conn.Close()
+	return err
+}
+
+// Attributes of a file, from the cache if they are fresh enough
+func (f *FileSystem) stat(p string) (os.FileInfo, error) {
+	if fi, found := f.cache.getFile(p); found {
+		return fi, nil
+	}
+	fi, err := f.router.Client(p).GetFile(p)
+	if err != nil {
+		return nil, err
+	}
+	f.cache.putFile(p, fi)
+	return fi, nil
+}
+
+// Entries of a directory, from the cache if they are fresh enough
+func (f *FileSystem) readDir(p string) ([]os.FileInfo, error) {
+	if files, found := f.cache.getDirectory(p); found {
+		return files, nil
+	}
+	files, err := f.router.Client(p).ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	f.cache.putDirectory(p, files)
+	return files, nil
+}
+
+// Change the mode or the modification time of a file
+func (f *FileSystem) update(p string, req *fuselib.SetattrRequest) (os.FileInfo, error) {
+	fi, err := f.stat(p)
+	if err != nil {
+		return nil, err
+	}
+	changes := storageFileChanges(fi, req)
+	if changes.Mode == nil && changes.ModTime == nil {
+		return fi, nil
+	}
+	fi, err = f.router.Client(p).UpdateFile(p, changes)
+	f.cache.invalidate(p)
+	if err != nil {
+		return nil, err
+	}
+	f.cache.putFile(p, fi)
+	return fi, nil
+}
+
+func (f *FileSystem) node(p string, fi os.FileInfo) fs.Node {
+	if fi.IsDir() {
+		return &Dir{fs: f, path: p}
+	}
+	return &File{fs: f, path: p}
+}
+
+func (f *FileSystem) fillAttr(p string, fi os.FileInfo, a *fuselib.Attr) {
+	a.Valid = f.timeout
+	a.Mode = fi.Mode()
+	a.Size = uint64(fi.Size())
+	if writer := f.writer(p); writer != nil {
+		a.Size = writer.size()
+	}
+	a.Blocks = (a.Size + 511) / 512
+	a.Atime = fi.ModTime()
+	a.Mtime = fi.ModTime()
+	a.Ctime = fi.ModTime()
+	a.Nlink = 1
+	if fi.IsDir() {
+		a.Nlink = 2
+	}
+	a.Uid = f.uid
+	a.Gid = f.gid
+}
+
+// Handle with written data of a file, nil if there is none
+func (f *FileSystem) writer(p string) *FileHandle {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.writers[p]
+}
+
+func (f *FileSystem) setWriter(p string, handle *FileHandle) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.writers[p] = handle
+}
+
+func (f *FileSystem) removeWriter(p string, handle *FileHandle) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.writers[p] == handle {
+		delete(f.writers, p)
+	}
+}
+
+// Changes of the mode and modification time asked by a request, the type of the file being kept
+func storageFileChanges(fi os.FileInfo, req *fuselib.SetattrRequest) storage.FileChanges {
+	changes := storage.FileChanges{}
+	if req.Valid.Mode() {
+		mode := fi.Mode()&os.ModeType | req.Mode.Perm()
+		changes.Mode = &mode
+	}
+	if req.Valid.MtimeNow() {
+		modTime := time.Now()
+		changes.ModTime = &modTime
+	} else if req.Valid.Mtime() {
+		modTime := req.Mtime
+		changes.ModTime = &modTime
+	}
+	return changes
+}
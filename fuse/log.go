@@ -0,0 +1,12 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package fuse
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+var logger *log.Entry = log.WithFields(log.Fields{
+	"package": "fuse",
+})
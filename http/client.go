@@ -2,23 +2,67 @@ package http
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	. "github.com/t-mind/flocons/error"
 	"github.com/t-mind/flocons/file"
+	"github.com/t-mind/flocons/storage"
 )
 
+const WALK_PAGE_SIZE int = 1000
+
 type Client struct {
 	host       string
 	httpClient *http.Client
 }
 
+// Result of the read of one file by GetRegularFiles
+// If the file could be read, FileInfo holds its data, otherwise Err holds the reason
+type RegularFileResult struct {
+	Path     string
+	FileInfo os.FileInfo
+	Err      error
+}
+
+// Conditions of a request on the current version of a regular file
+// Failed conditions are returned as http errors: 304 for reads and 412 for writes
+type Conditions struct {
+	IfMatch         string    // entity tag the file must have, "*" for any existing file
+	IfNoneMatch     string    // entity tag the file must not have, "*" to only create absent files
+	IfModifiedSince time.Time // for reads, only return files modified after this time
+}
+
+func (c Conditions) setHeaders(h http.Header) {
+	if c.IfMatch != "" {
+		h.Set(IF_MATCH, c.IfMatch)
+	}
+	if c.IfNoneMatch != "" {
+		h.Set(IF_NONE_MATCH, c.IfNoneMatch)
+	}
+	if !c.IfModifiedSince.IsZero() {
+		h.Set(IF_MODIFIED, c.IfModifiedSince.UTC().Format(http.TimeFormat))
+	}
+}
+
+// Entity tag of a file returned by the client, to use in conditions
+func ETag(fi os.FileInfo) string {
+	return fileInfoETag(fi)
+}
+
 func NewClient(host string) (*Client, error) {
 	if _, err := url.Parse(host); err != nil {
 		return nil, err
@@ -31,7 +75,9 @@ func NewClient(host string) (*Client, error) {
 }
 
 func (c *Client) pathToURL(p string) *url.URL {
-	uri, _ := url.Parse(c.host + path.Join(FILES_PREFIX, filepath.ToSlash(p)))
+	uri, _ := url.Parse(c.host)
+	// Names of files may contain characters having a meaning in urls, like ? or #
+	uri.Path += path.Join(FILES_PREFIX, filepath.ToSlash(p))
 	return uri
 }
 
@@ -52,6 +98,11 @@ func (c *Client) CreateDirectory(p string, mode os.FileMode) (os.FileInfo, error
 }
 
 func (c *Client) CreateRegularFile(p string, mode os.FileMode, data []byte) (os.FileInfo, error) {
+	return c.CreateRegularFileWithConditions(p, mode, data, Conditions{})
+}
+
+// Create or overwrite a regular file only if its current version matches the conditions
+func (c *Client) CreateRegularFileWithConditions(p string, mode os.FileMode, data []byte, conditions Conditions) (os.FileInfo, error) {
 	uri := c.pathToURL(p)
 
 	req, err := http.NewRequest("POST", uri.String(), bytes.NewReader(data))
@@ -59,6 +110,22 @@ func (c *Client) CreateRegularFile(p string, mode os.FileMode, data []byte) (os.
 		return nil, err
 	}
 	req.Header.Set(CONTENT_MODE, strconv.FormatUint((uint64)(mode), 8))
+	conditions.setHeaders(req.Header)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return responseToFileInfo(uri, resp)
+}
+
+// Create or replace a file with a PUT request
+func (c *Client) PutRegularFile(p string, mode os.FileMode, data []byte) (os.FileInfo, error) {
+	uri := c.pathToURL(p)
+	req, err := http.NewRequest("PUT", uri.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(CONTENT_MODE, strconv.FormatUint((uint64)(mode), 8))
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
@@ -66,13 +133,82 @@ func (c *Client) CreateRegularFile(p string, mode os.FileMode, data []byte) (os.
 	return responseToFileInfo(uri, resp)
 }
 
+// Remove a regular file, or a directory if it is empty
+func (c *Client) RemoveFile(p string) error {
+	req, err := http.NewRequest("DELETE", c.pathToURL(p).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return statusToError(p, resp.StatusCode, getResponseBodyString(resp))
+	}
+	return nil
+}
+
+// Change the mode or the modification time of a file
+func (c *Client) UpdateFile(p string, changes storage.FileChanges) (os.FileInfo, error) {
+	body, err := fileChangesToBody(changes)
+	if err != nil {
+		return nil, err
+	}
+	uri := c.pathToURL(p)
+	req, err := http.NewRequest("PATCH", uri.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(CONTENT_TYPE, JSON_MIME_TYPE)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return responseToFileInfo(uri, resp)
+}
+
+// Move a file to another path, replacing the regular file at this path if any
+func (c *Client) RenameFile(p string, target string) (os.FileInfo, error) {
+	return c.copyOrRenameFile("MOVE", p, target)
+}
+
+// Copy a regular file to another path, replacing the regular file at this path if any
+func (c *Client) CopyFile(p string, target string) (os.FileInfo, error) {
+	return c.copyOrRenameFile("COPY", p, target)
+}
+
+func (c *Client) copyOrRenameFile(method string, p string, target string) (os.FileInfo, error) {
+	req, err := http.NewRequest(method, c.pathToURL(p).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(DESTINATION, c.pathToURL(target).String())
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, statusToError(p, resp.StatusCode, getResponseBodyString(resp))
+	}
+	// The response has no body, so its headers don't give the size of the file
+	return c.GetFile(target)
+}
+
 func (c *Client) GetFile(p string) (os.FileInfo, error) {
+	return c.GetFileWithConditions(p, Conditions{})
+}
+
+func (c *Client) GetFileWithConditions(p string, conditions Conditions) (os.FileInfo, error) {
 	uri := c.pathToURL(p)
 
 	req, err := http.NewRequest("HEAD", uri.String(), nil)
 	if err != nil {
 		return nil, err
 	}
+	conditions.setHeaders(req.Header)
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
@@ -81,12 +217,18 @@ func (c *Client) GetFile(p string) (os.FileInfo, error) {
 }
 
 func (c *Client) GetFileData(p string) (os.FileInfo, []byte, error) {
+	return c.GetFileDataWithConditions(p, Conditions{})
+}
+
+// Read a file only if its current version matches the conditions, for instance to revalidate a cached copy
+func (c *Client) GetFileDataWithConditions(p string, conditions Conditions) (os.FileInfo, []byte, error) {
 	uri := c.pathToURL(p)
 
 	req, err := http.NewRequest("GET", uri.String(), nil)
 	if err != nil {
 		return nil, nil, err
 	}
+	conditions.setHeaders(req.Header)
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, nil, err
@@ -95,17 +237,63 @@ func (c *Client) GetFileData(p string) (os.FileInfo, []byte, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	size := resp.ContentLength
-	buffer := make([]byte, size)
-	if size > 0 {
-		_, err := resp.Body.Read(buffer)
-		if err != nil && err != io.EOF {
-			return nil, nil, err
-		}
+	defer resp.Body.Close()
+	// Large files come in several reads
+	buffer, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
 	}
 	return fi, buffer, nil
 }
 
+// Read length bytes of a regular file from offset, less if the file ends before
+// Only the asked bytes are sent by servers supporting ranges
+func (c *Client) ReadRange(p string, offset int64, length int64) ([]byte, error) {
+	return c.ReadRangeWithConditions(p, offset, length, Conditions{})
+}
+
+// Read a part of a regular file, only if it meets the conditions
+// Reads of several parts of the same version give its entity tag in IfMatch
+func (c *Client) ReadRangeWithConditions(p string, offset int64, length int64, conditions Conditions) ([]byte, error) {
+	if length <= 0 {
+		return []byte{}, nil
+	}
+	uri := c.pathToURL(p)
+	req, err := http.NewRequest("GET", uri.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	conditions.setHeaders(req.Header)
+	req.Header.Set(RANGE, fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// The range starts after the end of the file
+		return []byte{}, nil
+	}
+	if _, err := responseToFileInfo(uri, resp); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		return data, nil
+	}
+	// The whole file was sent
+	if offset >= int64(len(data)) {
+		return []byte{}, nil
+	}
+	if offset+length > int64(len(data)) {
+		length = int64(len(data)) - offset
+	}
+	return data[offset : offset+length], nil
+}
+
 func (c *Client) GetDirectory(p string) (os.FileInfo, error) {
 	fi, err := c.GetFile(p)
 	if err != nil {
@@ -163,12 +351,284 @@ func (c *Client) GetRegularFileWithData(p string) (os.FileInfo, error) {
 }
 
 func (c *Client) ReadDir(p string) ([]os.FileInfo, error) {
-	fi, data, err := c.GetFileData(p)
+	files, _, err := c.ReadDirPage(p, storage.ReadDirOptions{})
+	return files, err
+}
+
+// Read one page of a directory, with only the entries matching the options
+// It also returns the cursor to give as After option to read the next page, which is empty if this page was the last one
+func (c *Client) ReadDirPage(p string, options storage.ReadDirOptions) ([]os.FileInfo, string, error) {
+	uri := c.pathToURL(p)
+	uri.RawQuery = readDirOptionsToQuery(options).Encode()
+
+	req, err := http.NewRequest("GET", uri.String(), nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	req.Header.Set(ACCEPT, NDJSON_MIME_TYPE)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	fi, err := responseToFileInfo(uri, resp)
+	if err != nil {
+		return nil, "", err
 	}
 	if !fi.Mode().IsDir() {
-		return nil, NewIsNotDirError(p)
+		return nil, "", NewIsNotDirError(p)
+	}
+	files, err := listingToFilesInfo(resp.Body, resp.Header.Get(CONTENT_TYPE))
+	if err != nil {
+		return nil, "", err
+	}
+	// Complete listings are streamed in storage order, let's sort them like pages
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].IsDir() != files[j].IsDir() {
+			return files[i].IsDir()
+		}
+		return files[i].Name() < files[j].Name()
+	})
+	return files, resp.Header.Get(NEXT_AFTER), nil
+}
+
+// Read several regular files in one request
+// Results are returned in the same order as the paths and each one holds either the file with its data or an error
+func (c *Client) GetRegularFiles(paths []string) ([]RegularFileResult, error) {
+	body, err := json.Marshal(paths)
+	if err != nil {
+		return nil, err
+	}
+	uri, _ := url.Parse(c.host + BATCH_PREFIX)
+	req, err := http.NewRequest("POST", uri.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(CONTENT_TYPE, JSON_MIME_TYPE)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, NewHttpError(fmt.Sprintf("%s: %s", resp.Status, getResponseBodyString(resp)), resp.StatusCode)
+	}
+	_, params, err := mime.ParseMediaType(resp.Header.Get(CONTENT_TYPE))
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]RegularFileResult, 0, len(paths))
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		p := part.Header.Get(CONTENT_PATH)
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		status, _ := strconv.Atoi(part.Header.Get(CONTENT_STATUS))
+		if status != http.StatusOK {
+			results = append(results, RegularFileResult{Path: p, Err: statusToError(p, status, string(data))})
+			continue
+		}
+		dataFileInfo, _ := headerToFileInfo(path.Base(p), http.Header(part.Header), int64(len(data))).(*file.FileInfo)
+		dataFileInfo.UpdateDataSource(file.FileDataSource{
+			Data: func() ([]byte, error) {
+				return data, nil
+			},
+		})
+		results = append(results, RegularFileResult{Path: p, FileInfo: dataFileInfo})
+	}
+	return results, nil
+}
+
+// Walk all descendants of a directory, see storage.Storage.Walk
+func (c *Client) Walk(root string, fn storage.WalkFunc) error {
+	return c.WalkWithOptions(root, storage.WalkOptions{}, fn)
+}
+
+// Walk descendants of a directory matching the options, see storage.Storage.WalkWithOptions
+// The walk is read by pages of WALK_PAGE_SIZE entries
+func (c *Client) WalkWithOptions(root string, options storage.WalkOptions, fn storage.WalkFunc) error {
+	var skippedDirectory string
+	var skippedFilesDirectory string
+	for {
+		uri := c.pathToURL(root)
+		query := url.Values{}
+		query.Set(RECURSIVE_PARAMETER, "true")
+		query.Set(LIMIT_PARAMETER, strconv.Itoa(WALK_PAGE_SIZE))
+		if options.MaxDepth > 0 {
+			query.Set(DEPTH_PARAMETER, strconv.Itoa(options.MaxDepth))
+		}
+		if options.After != "" {
+			query.Set(AFTER_PARAMETER, options.After)
+		}
+		uri.RawQuery = query.Encode()
+
+		req, err := http.NewRequest("GET", uri.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(ACCEPT, NDJSON_MIME_TYPE)
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		fi, err := responseToFileInfo(uri, resp)
+		if err != nil {
+			resp.Body.Close()
+			return err
+		}
+		if !fi.Mode().IsDir() {
+			resp.Body.Close()
+			return NewIsNotDirError(root)
+		}
+
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var entry listingEntry
+			err := decoder.Decode(&entry)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				resp.Body.Close()
+				return err
+			}
+			// Emulate the effect of filepath.SkipDir as the server already sent the entries
+			if skippedDirectory != "" && strings.HasPrefix(entry.Path, skippedDirectory+"/") {
+				continue
+			}
+			if skippedFilesDirectory != "" && path.Dir(entry.Path) == skippedFilesDirectory {
+				continue
+			}
+			entryFileInfo := listingEntryToFileInfo(&entry)
+			err = fn(entry.Path, entryFileInfo)
+			if err == filepath.SkipDir {
+				if entryFileInfo.IsDir() {
+					skippedDirectory = entry.Path
+				} else {
+					skippedFilesDirectory = path.Dir(entry.Path)
+				}
+			} else if err != nil {
+				resp.Body.Close()
+				return err
+			}
+		}
+		resp.Body.Close()
+
+		next := resp.Header.Get(NEXT_AFTER)
+		if next == "" {
+			return nil
+		}
+		options.After = next
+	}
+}
+
+// Get statistics of the regular files of a directory, and of all its sub directories if recursive
+func (c *Client) DirectoryStats(p string, recursive bool) (*storage.DirectoryStats, error) {
+	uri, _ := url.Parse(c.host + path.Join(STATS_PREFIX, filepath.ToSlash(p)))
+	if recursive {
+		uri.RawQuery = RECURSIVE_PARAMETER + "=true"
+	}
+	resp, err := c.httpClient.Get(uri.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, statusToError(p, resp.StatusCode, string(body))
+	}
+	var stats storage.DirectoryStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Get counters of the data cache of the node
+func (c *Client) DataCacheStats() (*storage.DataCacheStats, error) {
+	resp, err := c.httpClient.Get(c.host + CACHE_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, statusToError(CACHE_PREFIX, resp.StatusCode, string(body))
+	}
+	var stats storage.DataCacheStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Wait for change events of a directory of the node with a long poll
+// Without options.After, only the events coming after the request are returned.
+// It returns the events and the sequence number to resume from in the next call
+func (c *Client) Watch(p string, options storage.WatchOptions) ([]storage.Event, uint64, error) {
+	uri, _ := url.Parse(c.host + path.Join(WATCH_PREFIX, filepath.ToSlash(p)))
+	query := url.Values{}
+	if options.After > 0 {
+		query.Set(AFTER_PARAMETER, strconv.FormatUint(options.After, 10))
+	}
+	if options.Recursive {
+		query.Set(RECURSIVE_PARAMETER, "true")
+	}
+	if options.Timeout > 0 {
+		query.Set(TIMEOUT_PARAMETER, options.Timeout.String())
+	}
+	uri.RawQuery = query.Encode()
+	resp, err := c.httpClient.Get(uri.String())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, 0, statusToError(p, resp.StatusCode, string(body))
+	}
+	var response watchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, 0, err
+	}
+	return response.Events, response.Sequence, nil
+}
+
+// Read the journal of the node after a sequence number
+// It returns the records and the sequence number to resume from in the next call
+func (c *Client) ReadJournal(options storage.JournalReadOptions) ([]storage.JournalRecord, uint64, error) {
+	uri, _ := url.Parse(c.host + JOURNAL_PREFIX)
+	query := url.Values{}
+	query.Set(AFTER_PARAMETER, strconv.FormatUint(options.After, 10))
+	if options.Limit > 0 {
+		query.Set(LIMIT_PARAMETER, strconv.Itoa(options.Limit))
+	}
+	if options.Timeout > 0 {
+		query.Set(TIMEOUT_PARAMETER, options.Timeout.String())
+	}
+	uri.RawQuery = query.Encode()
+	resp, err := c.httpClient.Get(uri.String())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, 0, statusToError(JOURNAL_PREFIX, resp.StatusCode, string(body))
+	}
+	var response journalResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, 0, err
 	}
-	return csvToFilesInfo(data)
+	return response.Records, response.Sequence, nil
 }
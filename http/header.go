@@ -1,9 +1,33 @@
 package http
 
 const (
+	ACCEPT         string = "Accept"
+	ACCEPT_RANGES  string = "Accept-Ranges"
+	ALLOW          string = "Allow"
+	AMZ_COPY       string = "X-Amz-Copy-Source"
+	AMZ_DECODED    string = "X-Amz-Decoded-Content-Length"
+	AMZ_SHA256     string = "X-Amz-Content-Sha256"
+	CONTENT_CODING string = "Content-Encoding"
 	CONTENT_TYPE   string = "Content-Type"
 	CONTENT_LENGTH string = "Content-Length"
+	CONTENT_MD5    string = "Content-MD5"
 	CONTENT_MODE   string = "X-Content-Mode"
+	CONTENT_PATH   string = "X-Content-Path"
+	DESTINATION    string = "Destination"
+	CONTENT_STATUS string = "X-Content-Status"
+	DAV            string = "DAV"
+	DEPTH          string = "Depth"
+	ETAG           string = "ETag"
+	FILE_TYPE      string = "X-File-Type"
+	IF_MATCH       string = "If-Match"
+	IF_MODIFIED    string = "If-Modified-Since"
+	IF_NONE_MATCH  string = "If-None-Match"
+	LAST_EVENT_ID  string = "Last-Event-ID"
 	LAST_MODIFIED  string = "Last-Modified"
 	LOCATION       string = "Location"
+	LOCK_TOKEN     string = "Lock-Token"
+	MS_AUTHOR_VIA  string = "MS-Author-Via"
+	NEXT_AFTER     string = "X-Next-After"
+	OVERWRITE      string = "Overwrite"
+	RANGE          string = "Range"
 )
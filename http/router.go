@@ -0,0 +1,67 @@
+package http
+
+import (
+	"sync"
+
+	"github.com/t-mind/flocons/cluster"
+)
+
+// Clients of the nodes of a cluster, choosing for each path the node responsible for it
+// Requests sent to another node would be redirected there, routing them first saves a round trip
+type Router struct {
+	defaultClient  *Client
+	topologyClient cluster.TopologyClient
+	clients        map[string]*Client
+	mutex          *sync.Mutex
+}
+
+// Create a router sending requests to host when the topology is unknown or has no node for a path
+// The topology client may be nil
+func NewRouter(host string, topologyClient cluster.TopologyClient) (*Router, error) {
+	defaultClient, err := NewClient(host)
+	if err != nil {
+		return nil, err
+	}
+	return &Router{
+		defaultClient:  defaultClient,
+		topologyClient: topologyClient,
+		clients:        make(map[string]*Client),
+		mutex:          &sync.Mutex{},
+	}, nil
+}
+
+// Client of the node responsible for a path
+func (r *Router) Client(p string) *Client {
+	if r.topologyClient == nil {
+		return r.defaultClient
+	}
+	return r.NodeClient(r.topologyClient.GetNodeForObject(p))
+}
+
+// Client of a node, or of the host if the node is unknown
+func (r *Router) NodeClient(node *cluster.NodeInfo) *Client {
+	if node == nil || node.Address == "" {
+		return r.defaultClient
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	client, found := r.clients[node.Address]
+	if !found {
+		var err error
+		if client, err = NewClient(node.Address); err != nil {
+			logger.Warnf("Invalid address %s of node %s: %s", node.Address, node.Name, err)
+			return r.defaultClient
+		}
+		r.clients[node.Address] = client
+	}
+	return client
+}
+
+func (r *Router) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.defaultClient.Close()
+	for _, client := range r.clients {
+		client.Close()
+	}
+}
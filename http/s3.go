@@ -0,0 +1,806 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	. "github.com/t-mind/flocons/error"
+	"github.com/t-mind/flocons/storage"
+)
+
+const S3_NAMESPACE string = "http://s3.amazonaws.com/doc/2006-03-01/"
+const S3_XML_MIME_TYPE string = "application/xml"
+const S3_TIME_FORMAT string = "2006-01-02T15:04:05.000Z"
+const S3_MAX_KEYS int = 1000
+
+// Owner of all the buckets, requests are not authenticated
+const S3_OWNER string = "flocons"
+
+// Sub resources of objects which are not supported, like multipart uploads or acls
+var s3UnsupportedSubResources = []string{"acl", "tagging", "uploads", "uploadId", "versionId", "retention", "legal-hold"}
+
+var errS3EntityTooLarge = errors.New("object is bigger than the max file size")
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	EncodingType          string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type s3CopyObjectResult struct {
+	XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult"`
+	LastModified string
+	ETag         string
+}
+
+// Serve a subset of the S3 api with path style urls
+// Buckets are the top level directories, keys are the paths of the files in them
+func (s *Server) ServeS3(w http.ResponseWriter, r *http.Request) {
+	bucket, key := s3RequestToBucketAndKey(r)
+	if bucket == "." || bucket == ".." {
+		writeS3Error(w, http.StatusBadRequest, "InvalidBucketName", "Bucket name is not valid", r.URL.Path)
+		return
+	}
+	if !isMappableS3Key(key) {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "Key can't be mapped to a path", r.URL.Path)
+		return
+	}
+	query := r.URL.Query()
+	for _, subResource := range s3UnsupportedSubResources {
+		if _, found := query[subResource]; found {
+			writeS3Error(w, http.StatusNotImplemented, "NotImplemented", fmt.Sprintf("Sub resource %s is not supported", subResource), r.URL.Path)
+			return
+		}
+	}
+
+	switch {
+	case bucket == "" && r.Method == "GET":
+		s.ListS3Buckets(w, r)
+	case bucket == "":
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "Method is not allowed on the service", r.URL.Path)
+	case key == "" && (r.Method == "GET" || r.Method == "HEAD"):
+		s.ListS3Objects(w, r, bucket)
+	case key == "" && r.Method == "PUT":
+		s.CreateS3Bucket(w, r, bucket)
+	case key == "" && r.Method == "DELETE":
+		s.RemoveS3Bucket(w, r, bucket)
+	case r.Method == "GET" || r.Method == "HEAD":
+		s.GetS3Object(w, r)
+	case r.Method == "PUT" && r.Header.Get(AMZ_COPY) != "":
+		s.CopyS3Object(w, r, bucket)
+	case r.Method == "PUT":
+		s.PutS3Object(w, r, bucket, key)
+	case r.Method == "DELETE":
+		s.RemoveS3Object(w, r, key)
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "Method is not allowed on objects", r.URL.Path)
+	}
+}
+
+// List the top level directories as buckets
+func (s *Server) ListS3Buckets(w http.ResponseWriter, r *http.Request) {
+	files, err := s.storage.ReadDir("/")
+	if err != nil {
+		returnS3Error(err, w, r.URL.Path)
+		return
+	}
+	result := s3ListAllMyBucketsResult{Owner: s3Owner{ID: S3_OWNER, DisplayName: S3_OWNER}}
+	for _, f := range files {
+		if f.IsDir() {
+			result.Buckets = append(result.Buckets, s3Bucket{Name: f.Name(), CreationDate: f.ModTime().UTC().Format(S3_TIME_FORMAT)})
+		}
+	}
+	writeS3Result(w, http.StatusOK, &result)
+}
+
+// List the objects of a bucket with version 2 of the api, or only check that it exists for HEAD requests
+// Keys are listed in order, those containing the delimiter after the prefix being rolled up in common prefixes
+func (s *Server) ListS3Objects(w http.ResponseWriter, r *http.Request, bucket string) {
+	if !s.checkS3Bucket(w, r, bucket) {
+		return
+	}
+	if r.Method == "HEAD" {
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", "Only version 2 of object listings is supported", r.URL.Path)
+		return
+	}
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	maxKeys := S3_MAX_KEYS
+	if value := query.Get("max-keys"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			writeS3Error(w, http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("Invalid max-keys '%s'", value), r.URL.Path)
+			return
+		}
+		if parsed < maxKeys {
+			maxKeys = parsed
+		}
+	}
+	marker := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		decoded, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "Invalid continuation token", r.URL.Path)
+			return
+		}
+		marker = string(decoded)
+	}
+	encode := query.Get("encoding-type") == "url"
+
+	result := s3ListBucketResult{
+		Name:              bucket,
+		Prefix:            encodeS3Key(prefix, encode),
+		Delimiter:         encodeS3Key(delimiter, encode),
+		MaxKeys:           maxKeys,
+		ContinuationToken: query.Get("continuation-token"),
+		StartAfter:        encodeS3Key(query.Get("start-after"), encode),
+	}
+	if encode {
+		result.EncodingType = "url"
+	}
+	last := ""
+	// Sub directories are rolled up without being walked when keys are rolled up at the first slash
+	err := s.walkS3Keys(bucket, prefix, marker, delimiter == "/", func(key string, fi os.FileInfo) error {
+		commonPrefix := ""
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			commonPrefix = key[:len(prefix)+i+len(delimiter)]
+			// Keys of a common prefix returned in a previous page come after it
+			if commonPrefix <= marker || commonPrefix == last {
+				return nil
+			}
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			return errPageFull
+		}
+		result.KeyCount++
+		if commonPrefix != "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encodeS3Key(commonPrefix, encode)})
+			last = commonPrefix
+			return nil
+		}
+		result.Contents = append(result.Contents, s3Object{
+			Key:          encodeS3Key(key, encode),
+			LastModified: fi.ModTime().UTC().Format(S3_TIME_FORMAT),
+			ETag:         fileInfoETag(fi),
+			Size:         fi.Size(),
+			StorageClass: "STANDARD",
+		})
+		last = key
+		return nil
+	})
+	if err != nil && err != errPageFull {
+		returnS3Error(err, w, r.URL.Path)
+		return
+	}
+	if result.IsTruncated && last != "" {
+		result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+	}
+	writeS3Result(w, http.StatusOK, &result)
+}
+
+func (s *Server) CreateS3Bucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	if s.distributeRequestIfPossible(w, r) {
+		return
+	}
+	if _, err := s.storage.GetFile("/" + bucket); err == nil {
+		writeS3Error(w, http.StatusConflict, "BucketAlreadyOwnedByYou", "Bucket already exists", r.URL.Path)
+		return
+	}
+	if _, err := s.storage.CreateDirectory("/"+bucket, os.ModeDir|0755); err != nil {
+		returnS3Error(err, w, r.URL.Path)
+		return
+	}
+	w.Header().Set(LOCATION, "/"+bucket)
+}
+
+func (s *Server) RemoveS3Bucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	if !s.checkS3Bucket(w, r, bucket) {
+		return
+	}
+	if err := s.storage.RemoveFile("/" + bucket); err != nil {
+		if IsNotEmptyError(err) {
+			writeS3Error(w, http.StatusConflict, "BucketNotEmpty", "Bucket is not empty", r.URL.Path)
+		} else {
+			returnS3Error(err, w, r.URL.Path)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Read an object, with the same ranges, conditions and redirections as reads of files
+func (s *Server) GetS3Object(w http.ResponseWriter, r *http.Request) {
+	fi, err := s.storage.GetFile(requestPath(r))
+	if err != nil {
+		if !s.distributeRequestIfPossible(w, r) {
+			returnS3Error(err, w, r.URL.Path)
+		}
+		return
+	}
+	if fi.IsDir() {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "Key is a prefix of other keys", r.URL.Path)
+		return
+	}
+	// Errors of reads, like unsatisfiable ranges, are answered in the S3 format too
+	writer := &s3ResponseWriter{ResponseWriter: w, resource: r.URL.Path}
+	if r.Method == "HEAD" {
+		s.GetFile(writer, r)
+	} else {
+		s.GetFileWithData(writer, r)
+	}
+}
+
+// Write an object, creating the directories of its key
+// Empty objects with a key ending with a slash only create directories
+func (s *Server) PutS3Object(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	if s.distributeRequestIfPossible(w, r) {
+		return
+	}
+	data, err := readS3Body(w, r, s.config.Storage.MaxFileSizeInBytes)
+	if err == errS3EntityTooLarge {
+		writeS3Error(w, http.StatusRequestEntityTooLarge, "EntityTooLarge", "Object is bigger than the max file size", r.URL.Path)
+		return
+	}
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error(), r.URL.Path)
+		return
+	}
+	if expected := r.Header.Get(CONTENT_MD5); expected != "" {
+		digest := md5.Sum(data)
+		if decoded, err := base64.StdEncoding.DecodeString(expected); err != nil || !bytes.Equal(decoded, digest[:]) {
+			writeS3Error(w, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received", r.URL.Path)
+			return
+		}
+	}
+	p := requestPath(r)
+	if strings.HasSuffix(key, "/") {
+		if len(data) > 0 {
+			writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "Keys ending with a slash can't have data", r.URL.Path)
+			return
+		}
+		s.runWithWorker(func() {
+			if !s.checkS3Bucket(w, r, bucket) {
+				return
+			}
+			if _, err := s.storage.GetDirectory(p); err != nil {
+				if _, err := s.storage.CreateDirectoryAndParents(p, os.ModeDir|0755); err != nil {
+					returnS3Error(err, w, r.URL.Path)
+				}
+			}
+		})
+		return
+	}
+
+	var fi os.FileInfo
+	var replaced, answered bool
+	s.runWithWorker(func() {
+		if answered = !s.checkS3Bucket(w, r, bucket); answered {
+			return
+		}
+		if err = s.createS3Parents(p); err != nil {
+			return
+		}
+		lock := s.pathLock(p)
+		lock.Lock()
+		defer lock.Unlock()
+		current := s.currentRegularFile(p)
+		if r.Header.Get(IF_MATCH) != "" || r.Header.Get(IF_NONE_MATCH) != "" {
+			if answered = s.failPreconditions(w, r, current); answered {
+				return
+			}
+		}
+		replaced = current != nil
+		fi, err = s.storage.CreateRegularFile(p, 0644, data)
+	})
+	if answered {
+		return
+	}
+	if err != nil {
+		returnS3Error(err, w, r.URL.Path)
+		return
+	}
+	if replaced && !s.removeS3ObjectVersions(w, r, p) {
+		return
+	}
+	w.Header().Set(ETAG, fileInfoETag(fi))
+}
+
+// Copy the object of the copy source header, which is given as an url encoded bucket and key
+func (s *Server) CopyS3Object(w http.ResponseWriter, r *http.Request, bucket string) {
+	if s.distributeRequestIfPossible(w, r) {
+		return
+	}
+	source := r.Header.Get(AMZ_COPY)
+	if i := strings.Index(source, "?"); i >= 0 {
+		source = source[:i]
+	}
+	source, err := url.PathUnescape(source)
+	if err != nil || !isMappableS3Key(strings.TrimPrefix(source, "/")) {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "Invalid copy source", r.URL.Path)
+		return
+	}
+	source = path.Join("/", source)
+	p := requestPath(r)
+	var copied os.FileInfo
+	var replaced, answered bool
+	s.runWithWorker(func() {
+		if answered = !s.checkS3Bucket(w, r, bucket); answered {
+			return
+		}
+		if fi, err := s.storage.GetFile(source); err != nil || fi.IsDir() {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", "Copy source doesn't exist", source)
+			answered = true
+			return
+		}
+		if err = s.createS3Parents(p); err != nil {
+			return
+		}
+		lock := s.pathLock(p)
+		lock.Lock()
+		defer lock.Unlock()
+		replaced = s.currentRegularFile(p) != nil
+		copied, err = s.storage.CopyFile(source, p)
+	})
+	if answered {
+		return
+	}
+	if err != nil {
+		returnS3Error(err, w, r.URL.Path)
+		return
+	}
+	if replaced && !s.removeS3ObjectVersions(w, r, p) {
+		return
+	}
+	writeS3Result(w, http.StatusOK, &s3CopyObjectResult{
+		LastModified: copied.ModTime().UTC().Format(S3_TIME_FORMAT),
+		ETag:         fileInfoETag(copied),
+	})
+}
+
+// Remove an object, succeeding if it doesn't exist
+// Keys ending with a slash remove their directory if it is empty
+func (s *Server) RemoveS3Object(w http.ResponseWriter, r *http.Request, key string) {
+	p := requestPath(r)
+	var fi os.FileInfo
+	var err error
+	s.runWithWorker(func() { fi, err = s.storage.GetFile(p) })
+	if err != nil || fi.IsDir() != strings.HasSuffix(key, "/") {
+		if err == nil || !s.distributeRequestIfPossible(w, r) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+	// Like the removals of files, the versions written by other nodes are removed through them
+	if !fi.IsDir() && !s.removeS3ObjectVersions(w, r, p) {
+		return
+	}
+
+	s.runWithWorker(func() {
+		lock := s.pathLock(p)
+		lock.Lock()
+		defer lock.Unlock()
+		if fi, err = s.storage.GetFile(p); err == nil && (fi.IsDir() || s.hasLocalVersion(p)) {
+			err = s.storage.RemoveFile(p)
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		returnS3Error(err, w, r.URL.Path)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Remove the versions of an object written by other nodes, which would hide the version of this node
+// The path is not locked meanwhile, as the other nodes may be removing it too and wait for this one
+// It returns false if the request has been answered with an error
+func (s *Server) removeS3ObjectVersions(w http.ResponseWriter, r *http.Request, p string) bool {
+	if _, err := s.removeOtherVersions(p, s.traversedNodes(r)); err != nil {
+		returnS3Error(err, w, r.URL.Path)
+		return false
+	}
+	return true
+}
+
+// Wrap the S3 handler like handleWithWorker, except for the writes and removals of objects
+// They may remove versions through other nodes, so their handlers take a file worker for each storage operation instead
+func (s *Server) handleS3WithWorker(handler http.HandlerFunc) http.HandlerFunc {
+	withWorker := s.handleWithWorker(handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if bucket, key := s3RequestToBucketAndKey(r); bucket != "" && key != "" && (r.Method == "PUT" || r.Method == "DELETE") {
+			logger.Debugf("Handle S3 request %s on node %s for ressource %s", r.Method, s.config.Node.Name, r.URL.Path)
+			handler(w, r)
+		} else {
+			withWorker(w, r)
+		}
+	}
+}
+
+// Check that a bucket exists, fetching it from the node responsible for it if needed
+// It returns false if the request has been answered with an error
+func (s *Server) checkS3Bucket(w http.ResponseWriter, r *http.Request, bucket string) bool {
+	if _, err := s.storage.GetDirectory("/" + bucket); err == nil || s.tryRecoverMissingDirectory("/"+bucket) {
+		return true
+	}
+	writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "Bucket doesn't exist", "/"+bucket)
+	return false
+}
+
+// Create the missing directories of the key of an object
+func (s *Server) createS3Parents(p string) error {
+	directory := path.Dir(p)
+	if _, err := s.storage.GetDirectory(directory); err == nil {
+		return nil
+	}
+	_, err := s.storage.CreateDirectoryAndParents(directory, os.ModeDir|0755)
+	return err
+}
+
+// Walk the objects of a bucket whose key starts with a prefix, in the order of their keys and after a marker
+// Sub directories are given as keys ending with a slash instead of being walked if rollUp is set.
+// Directories are read by pages from the marker, so that listings don't depend on the size of the bucket
+func (s *Server) walkS3Keys(bucket string, prefix string, marker string, rollUp bool, fn func(key string, fi os.FileInfo) error) error {
+	directoryKey := ""
+	namePrefix := prefix
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		directoryKey, namePrefix = prefix[:i+1], prefix[i+1:]
+	}
+	if !isMappableS3Key(directoryKey) {
+		return nil
+	}
+	after := ""
+	if strings.HasPrefix(marker, directoryKey) {
+		after = marker[len(directoryKey):]
+	} else if marker > directoryKey {
+		return nil
+	}
+	err := s.walkS3Directory(path.Join("/", bucket, directoryKey), directoryKey, namePrefix, after, rollUp, fn)
+	if os.IsNotExist(err) || IsIsNotDirError(err) {
+		return nil
+	}
+	return err
+}
+
+// Walk the keys of a directory after a key relative to it, regular files and sub directories being merged by key
+func (s *Server) walkS3Directory(directory string, directoryKey string, namePrefix string, after string, rollUp bool, fn func(key string, fi os.FileInfo) error) error {
+	// Names after the first segment of the marker are read, the previous ones can't have a greater key
+	first := after
+	if i := strings.Index(after, "/"); i >= 0 {
+		first = after[:i]
+	}
+	files := &s3DirectoryReader{storage: s.storage, directory: directory, options: storage.ReadDirOptions{
+		Limit: storage.READ_DIR_BATCH_SIZE, Prefix: namePrefix, Type: storage.REGULAR_FILE_TYPE, After: first,
+	}}
+	subDirectories := &s3SubDirectories{reader: &s3DirectoryReader{storage: s.storage, directory: directory, options: storage.ReadDirOptions{
+		Limit: storage.READ_DIR_BATCH_SIZE, Prefix: namePrefix, Type: storage.DIRECTORY_FILE_TYPE,
+	}}}
+	// A sub directory can have a greater key than the marker while having a lower name, if the marker extends its
+	// name with a character lower than a slash. Sub directories are read from the name before the first of them
+	if i := strings.IndexFunc(first, func(c rune) bool { return c < '/' }); first != "" && i != 0 {
+		if i < 0 {
+			i = len(first)
+		}
+		subDirectories.reader.options.After = first[:i]
+		if fi, err := s.storage.GetDirectory(path.Join(directory, first[:i])); err == nil && strings.HasPrefix(first[:i], namePrefix) {
+			subDirectories.reader.page = []os.FileInfo{fi}
+		}
+	}
+
+	for {
+		f, err := files.peek()
+		if err != nil {
+			return err
+		}
+		d, err := subDirectories.peek()
+		if err != nil {
+			return err
+		}
+		if f == nil && d == nil {
+			return nil
+		}
+		if d == nil || (f != nil && f.Name() < d.Name()+"/") {
+			files.next()
+			if f.Name() > after {
+				if err := fn(directoryKey+f.Name(), f); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		subDirectories.next()
+		key := d.Name() + "/"
+		if rollUp {
+			if key > after {
+				if err := fn(directoryKey+key, d); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		subAfter := ""
+		if strings.HasPrefix(after, key) {
+			subAfter = after[len(key):]
+		} else if key < after {
+			continue
+		}
+		// Sub directories removed meanwhile have no key anymore
+		err = s.walkS3Directory(path.Join(directory, d.Name()), directoryKey+key, "", subAfter, false, fn)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+}
+
+// Entries of one type of a directory, read by pages
+type s3DirectoryReader struct {
+	storage   storage.Storage
+	directory string
+	options   storage.ReadDirOptions
+	page      []os.FileInfo
+	done      bool
+}
+
+// Next entry, nil after the last one
+func (r *s3DirectoryReader) peek() (os.FileInfo, error) {
+	if len(r.page) == 0 && !r.done {
+		page, err := r.storage.ReadDirPage(r.directory, r.options)
+		if err != nil {
+			return nil, err
+		}
+		r.page = page
+		r.done = len(page) < r.options.Limit
+		if len(page) > 0 {
+			r.options.After = page[len(page)-1].Name()
+		}
+	}
+	if len(r.page) == 0 {
+		return nil, nil
+	}
+	return r.page[0], nil
+}
+
+func (r *s3DirectoryReader) next() {
+	r.page = r.page[1:]
+}
+
+// Sub directories of a directory in the order of their keys, which is not the order of their names:
+// a name extended with a character lower than a slash comes first, like "a-b/" before "a/"
+type s3SubDirectories struct {
+	reader  *s3DirectoryReader
+	pending []os.FileInfo // read sub directories, each one being extended by the next one
+	head    os.FileInfo
+}
+
+// Next sub directory, nil after the last one
+func (d *s3SubDirectories) peek() (os.FileInfo, error) {
+	for d.head == nil {
+		fi, err := d.reader.peek()
+		if err != nil {
+			return nil, err
+		}
+		last := len(d.pending) - 1
+		if last >= 0 && (fi == nil || !extendsS3Name(fi.Name(), d.pending[last].Name())) {
+			// Names extending the last pending one come right after it, so it has no more names to wait for
+			d.head, d.pending = d.pending[last], d.pending[:last]
+		} else if fi == nil {
+			return nil, nil
+		} else {
+			d.pending = append(d.pending, fi)
+			d.reader.next()
+		}
+	}
+	return d.head, nil
+}
+
+func (d *s3SubDirectories) next() {
+	d.head = nil
+}
+
+// Check that a name is another one followed by a character lower than a slash
+func extendsS3Name(name string, prefix string) bool {
+	return len(name) > len(prefix) && strings.HasPrefix(name, prefix) && name[len(prefix)] < '/'
+}
+
+// Bucket and key of a request, both empty for requests on the service
+func s3RequestToBucketAndKey(r *http.Request) (string, string) {
+	p := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, S3_PREFIX), "/")
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+// Only keys without empty, . or .. segments have a path of their own, a trailing slash being allowed for directories
+func isMappableS3Key(key string) bool {
+	segments := strings.Split(strings.TrimSuffix(key, "/"), "/")
+	for i, segment := range segments {
+		if segment == "." || segment == ".." || (segment == "" && (i > 0 || key != "")) {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeS3Key(key string, encode bool) string {
+	if encode {
+		return url.QueryEscape(key)
+	}
+	return key
+}
+
+// Read the body of an upload up to a max size, decoding the chunks of streaming signatures
+func readS3Body(w http.ResponseWriter, r *http.Request, maxSize int64) ([]byte, error) {
+	if strings.HasPrefix(r.Header.Get(AMZ_SHA256), "STREAMING-") || strings.Contains(r.Header.Get(CONTENT_CODING), "aws-chunked") {
+		if size, err := strconv.ParseInt(r.Header.Get(AMZ_DECODED), 10, 64); err == nil && size > maxSize {
+			return nil, errS3EntityTooLarge
+		}
+		return readAwsChunks(r.Body, maxSize)
+	}
+	if r.ContentLength > maxSize {
+		return nil, errS3EntityTooLarge
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSize))
+	if err != nil && bodyErrorToHttpStatus(err) == http.StatusRequestEntityTooLarge {
+		return nil, errS3EntityTooLarge
+	}
+	return data, err
+}
+
+// Each chunk is its size in hexadecimal followed by optional extensions, and then its data, until an empty chunk
+// Lines longer than the buffer of the reader are refused, like chunks beyond the max size
+func readAwsChunks(body io.Reader, maxSize int64) ([]byte, error) {
+	reader := bufio.NewReader(body)
+	data := make([]byte, 0)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err != nil {
+			return nil, err
+		}
+		header := strings.TrimSpace(string(line))
+		if i := strings.Index(header, ";"); i >= 0 {
+			header = header[:i]
+		}
+		size, err := strconv.ParseInt(header, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid chunk size '%s'", header)
+		}
+		if size == 0 {
+			// Trailing checksums are ignored
+			return data, nil
+		}
+		if size < 0 || size > maxSize-int64(len(data)) {
+			return nil, errS3EntityTooLarge
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func writeS3Result(w http.ResponseWriter, status int, result interface{}) {
+	data, err := xml.Marshal(result)
+	if err != nil {
+		returnS3Error(err, w, "")
+		return
+	}
+	w.Header().Set(CONTENT_TYPE, S3_XML_MIME_TYPE)
+	w.Header().Set(CONTENT_LENGTH, strconv.Itoa(len(xml.Header)+len(data)))
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+// Response writer answering the errors of the handlers of files as S3 errors, their own body being dropped
+type s3ResponseWriter struct {
+	http.ResponseWriter
+	resource string
+	failed   bool
+}
+
+func (w *s3ResponseWriter) WriteHeader(status int) {
+	if status < http.StatusBadRequest {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.failed = true
+	writeS3Error(w.ResponseWriter, status, s3ErrorCode(status), http.StatusText(status), w.resource)
+}
+
+func (w *s3ResponseWriter) Write(data []byte) (int, error) {
+	if w.failed {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string, message string, resource string) {
+	writeS3Result(w, status, &s3Error{Code: code, Message: message, Resource: resource})
+}
+
+func returnS3Error(err error, w http.ResponseWriter, resource string) {
+	status := errorToHttpStatus(err)
+	writeS3Error(w, status, s3ErrorCode(status), err.Error(), resource)
+}
+
+func s3ErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "InvalidArgument"
+	case http.StatusForbidden:
+		return "AccessDenied"
+	case http.StatusNotFound:
+		return "NoSuchKey"
+	case http.StatusConflict:
+		return "OperationAborted"
+	case http.StatusPreconditionFailed:
+		return "PreconditionFailed"
+	case http.StatusRequestedRangeNotSatisfiable:
+		return "InvalidRange"
+	default:
+		return "InternalError"
+	}
+}
@@ -1,13 +1,20 @@
 package http
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"os"
 	"path"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,22 +29,33 @@ import (
 
 const FILE_WORKER_POOL_SIZE int = 10
 
+// Max size of the json list of paths of a batch read
+const MAX_BATCH_REQUEST_SIZE int64 = 1024 * 1024
+
+// Number of locks serializing the writes of paths, so that conditional writes are atomic
+const PATH_LOCK_STRIPES int = 64
+
+// Maximum time of the requests sent to other nodes to remove their versions of a file
+const NODE_REQUEST_TIMEOUT time.Duration = 30 * time.Second
+
+var errPageFull = errors.New("page is full")
+
 type Server struct {
 	config         *config.Config
-	storage        *storage.Storage
+	storage        storage.Storage
 	topologyClient cluster.TopologyClient
 	httpServer     *http.Server
 	fileJobs       chan serverJob
 	httpClient     *http.Client
+	pathLocks      []*sync.Mutex
 }
 
 type serverJob struct {
-	writer  http.ResponseWriter
-	request *http.Request
-	barrier *sync.Cond
+	work func()
+	done chan bool
 }
 
-func NewServer(config *config.Config, storage *storage.Storage, topologyClient cluster.TopologyClient) (*Server, error) {
+func NewServer(config *config.Config, storage storage.Storage, topologyClient cluster.TopologyClient) (*Server, error) {
 	if config.Node.Port == 0 {
 		return nil, NewInternalError("No port configured")
 	}
@@ -59,7 +77,11 @@ func NewServer(config *config.Config, storage *storage.Storage, topologyClient c
 		topologyClient: topologyClient,
 		httpServer:     httpServer,
 		fileJobs:       make(chan serverJob),
-		httpClient:     &http.Client{},
+		httpClient:     &http.Client{Timeout: NODE_REQUEST_TIMEOUT},
+		pathLocks:      make([]*sync.Mutex, PATH_LOCK_STRIPES),
+	}
+	for i := range server.pathLocks {
+		server.pathLocks[i] = &sync.Mutex{}
 	}
 	server.start()
 	return &server, nil
@@ -72,15 +94,16 @@ func (s *Server) start() {
 	}
 
 	httpHandler, _ := s.httpServer.Handler.(*http.ServeMux)
-	httpHandler.HandleFunc(FILES_PREFIX+"/", func(w http.ResponseWriter, r *http.Request) {
-		logger.Debugf("Handle file request %s on node %s for ressource %s", r.Method, s.config.Node.Name, r.URL.Path)
-		mutex := sync.Mutex{}
-		barrier := sync.NewCond(&mutex)
-		mutex.Lock()
-		s.fileJobs <- serverJob{writer: w, request: r, barrier: barrier}
-		barrier.Wait()
-		mutex.Unlock()
-	})
+	httpHandler.HandleFunc(FILES_PREFIX+"/", s.handleWithWorkerExceptRemovals(s.ServeFile))
+	httpHandler.HandleFunc(DAV_PREFIX+"/", s.handleWithWorkerExceptRemovals(s.ServeDav))
+	httpHandler.HandleFunc(S3_PREFIX+"/", s.handleS3WithWorker(s.ServeS3))
+	// Batches read local files with file workers, but fetch files of other nodes without holding them
+	httpHandler.HandleFunc(BATCH_PREFIX, s.GetRegularFiles)
+	httpHandler.HandleFunc(STATS_PREFIX+"/", s.handleWithWorker(s.GetDirectoryStats))
+	httpHandler.HandleFunc(CACHE_PREFIX, s.GetDataCacheStats)
+	// Watches wait for a long time, they must not hold file workers
+	httpHandler.HandleFunc(WATCH_PREFIX+"/", s.Watch)
+	httpHandler.HandleFunc(JOURNAL_PREFIX, s.ReadJournal)
 	httpHandler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		logger.Warnf("Unhandled URL request %s", r.URL.Path)
 		w.WriteHeader(400)
@@ -99,12 +122,40 @@ func (s *Server) start() {
 	}()
 }
 
+// Wrap a handler so that the request is processed by the pool of file workers
+func (s *Server) handleWithWorker(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger.Debugf("Handle file request %s on node %s for ressource %s", r.Method, s.config.Node.Name, r.URL.Path)
+		s.runWithWorker(func() { handler(w, r) })
+	}
+}
+
+// Wrap a handler like handleWithWorker, except for the requests which may remove files through other nodes
+// Their handlers take a file worker for each storage operation instead, so that they don't hold one while waiting
+func (s *Server) handleWithWorkerExceptRemovals(handler http.HandlerFunc) http.HandlerFunc {
+	withWorker := s.handleWithWorker(handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "DELETE", "MOVE", "COPY":
+			logger.Debugf("Handle file request %s on node %s for ressource %s", r.Method, s.config.Node.Name, r.URL.Path)
+			handler(w, r)
+		default:
+			withWorker(w, r)
+		}
+	}
+}
+
+// Run a function with one of the file workers and wait for it to be done
+func (s *Server) runWithWorker(work func()) {
+	done := make(chan bool)
+	s.fileJobs <- serverJob{work: work, done: done}
+	<-done
+}
+
 func (s *Server) waitForFileWork() {
 	for job := range s.fileJobs {
-		job.barrier.L.Lock()
-		s.ServeFile(job.writer, job.request)
-		job.barrier.Broadcast()
-		job.barrier.L.Unlock()
+		job.work()
+		close(job.done)
 	}
 }
 
@@ -120,10 +171,19 @@ func (s *Server) ServeFile(w http.ResponseWriter, r *http.Request) {
 		s.GetFile(w, r)
 	case method == "GET":
 		s.GetFileWithData(w, r)
-	case method == "POST" && mimeType == file.DIRECTORY_MIME_TYPE:
+	case (method == "POST" || method == "PUT") && mimeType == file.DIRECTORY_MIME_TYPE:
 		s.CreateDirectory(w, r)
-	case method == "POST":
+	case method == "POST" || method == "PUT":
 		s.CreateRegularFile(w, r)
+	case method == "DELETE":
+		s.RemoveFile(w, r)
+	case method == "PATCH":
+		s.UpdateFile(w, r)
+	case method == "MOVE" || method == "COPY":
+		s.CopyOrRenameFile(w, r)
+	default:
+		w.Header().Set(ALLOW, ALLOWED_FILE_METHODS)
+		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
@@ -131,7 +191,7 @@ func (s *Server) CreateDirectory(w http.ResponseWriter, r *http.Request) {
 	if s.distributeRequestIfPossible(w, r) {
 		return
 	}
-	p := r.URL.Path[len(FILES_PREFIX):]
+	p := requestPath(r)
 	mode := headerToFileMode(r.Header)
 	fi, err := s.storage.CreateDirectory(p, mode)
 	if err != nil && os.IsNotExist(err) {
@@ -150,14 +210,33 @@ func (s *Server) CreateRegularFile(w http.ResponseWriter, r *http.Request) {
 	if s.distributeRequestIfPossible(w, r) {
 		return
 	}
-	p := r.URL.Path[len(FILES_PREFIX):]
+	p := requestPath(r)
 	mode := headerToFileMode(r.Header)
-	size := r.ContentLength
-	buffer := make([]byte, size)
-	if size > 0 {
-		_, err := r.Body.Read(buffer)
-		if err != nil && err != io.EOF {
-			w.WriteHeader(400)
+	maxSize := s.config.Storage.MaxFileSizeInBytes
+	if r.ContentLength > maxSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	var buffer []byte
+	var err error
+	if size := r.ContentLength; size >= 0 {
+		buffer = make([]byte, size)
+		_, err = io.ReadFull(r.Body, buffer)
+	} else {
+		// Chunked uploads, as sent by most WebDAV clients, don't tell their size
+		buffer, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSize))
+	}
+	if err != nil {
+		w.WriteHeader(bodyErrorToHttpStatus(err))
+		return
+	}
+
+	lock := s.pathLock(p)
+	lock.Lock()
+	defer lock.Unlock()
+	// Looking up the current file is only needed for conditional writes
+	if r.Header.Get(IF_MATCH) != "" || r.Header.Get(IF_NONE_MATCH) != "" {
+		if s.failPreconditions(w, r, s.currentRegularFile(p)) {
 			return
 		}
 	}
@@ -175,8 +254,302 @@ func (s *Server) CreateRegularFile(w http.ResponseWriter, r *http.Request) {
 	fileInfoToHeader(fi, w.Header())
 }
 
+// Remove a directory, or all the versions of a regular file including the ones written by other nodes
+func (s *Server) RemoveFile(w http.ResponseWriter, r *http.Request) {
+	p := requestPath(r)
+	var fi os.FileInfo
+	var err error
+	s.runWithWorker(func() { fi, err = s.storage.GetFile(p) })
+	if err != nil {
+		// If it was created, it is certainly on the node responsible for it
+		if !s.distributeRequestIfPossible(w, r) {
+			returnError(err, w)
+		}
+		return
+	}
+	if s.failPreconditions(w, r, fi) {
+		return
+	}
+	if !fi.IsDir() {
+		// The path is not locked meanwhile, as the other nodes may be removing it too and wait for this one
+		local, err := s.removeOtherVersions(p, s.traversedNodes(r))
+		if err != nil {
+			returnError(err, w)
+			return
+		}
+		if !local {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	// The file may have been replaced while other nodes removed their versions
+	answered := false
+	s.runWithWorker(func() {
+		lock := s.pathLock(p)
+		lock.Lock()
+		defer lock.Unlock()
+		if fi, err = s.storage.GetFile(p); err != nil {
+			return
+		}
+		if answered = s.failPreconditions(w, r, fi); !answered && (fi.IsDir() || s.hasLocalVersion(p)) {
+			err = s.storage.RemoveFile(p)
+		}
+	})
+	if answered {
+		return
+	}
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Remove the versions of a regular file written by other nodes through them, as only they can change their containers
+// Traversed nodes have already removed their versions. It returns whether this node has a version to remove itself
+// It must be called without file worker, as other nodes need theirs to answer
+func (s *Server) removeOtherVersions(p string, traversedNodes []string) (bool, error) {
+	versioning, ok := s.storage.(storage.VersioningStorage)
+	if !ok {
+		return true, nil
+	}
+	var versions []os.FileInfo
+	var err error
+	s.runWithWorker(func() { versions, err = versioning.GetRegularFileVersions(p) })
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	local := false
+	nodes := make([]string, 0)
+	for _, version := range versions {
+		node := version.(*file.FileInfo).Node()
+		if node == s.config.Node.Name {
+			local = true
+		} else if !containsNode(traversedNodes, node) && !containsNode(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	// Nodes removing their versions don't forward the request to the others
+	forwardedNodes := append(append([]string{}, traversedNodes...), nodes...)
+	for _, node := range nodes {
+		if err := s.removeFileOnNode(p, node, forwardedNodes); err != nil {
+			return false, err
+		}
+	}
+	return local, nil
+}
+
+// Whether this node has a version of a regular file, which may have been removed by another node meanwhile
+func (s *Server) hasLocalVersion(p string) bool {
+	versioning, ok := s.storage.(storage.VersioningStorage)
+	if !ok {
+		return true
+	}
+	versions, err := versioning.GetRegularFileVersions(p)
+	if err != nil {
+		return false
+	}
+	for _, version := range versions {
+		if version.(*file.FileInfo).Node() == s.config.Node.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the versions of a regular file written by a node, through the files prefix of this node
+func (s *Server) removeFileOnNode(p string, nodeName string, traversedNodes []string) error {
+	node, found := s.topologyClient.Nodes()[nodeName]
+	if !found {
+		return NewInternalError(fmt.Sprintf("File %s is owned by node %s which is not available", p, nodeName))
+	}
+	query := url.Values{TRAVERSED_NODE_PARAMETER: traversedNodes}
+	uri := node.Address + FILES_PREFIX + (&url.URL{Path: p}).EscapedPath() + "?" + query.Encode()
+	req, err := http.NewRequest("DELETE", uri, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The node may have removed its versions since they were listed here
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return statusToError(p, resp.StatusCode, getResponseBodyString(resp))
+	}
+	return nil
+}
+
+// Change the mode or the modification time of a file, given in a json body
+func (s *Server) UpdateFile(w http.ResponseWriter, r *http.Request) {
+	p := requestPath(r)
+	changes, err := bodyToFileChanges(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	lock := s.pathLock(p)
+	lock.Lock()
+	defer lock.Unlock()
+	if s.fileToChange(w, r, p) == nil {
+		return
+	}
+	fi, err := s.storage.UpdateFile(p, changes)
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	fileInfoToHeader(fi, w.Header())
+}
+
+// Copy or move a file to the path of the Destination header
+// The file at the destination is replaced unless Overwrite is F. Answers 201 if it didn't exist, 204 otherwise
+func (s *Server) CopyOrRenameFile(w http.ResponseWriter, r *http.Request) {
+	p := requestPath(r)
+	target, err := requestToDestination(r)
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	var fi os.FileInfo
+	var exists bool
+	s.runWithWorker(func() {
+		unlock := s.lockPaths(p, target)
+		defer unlock()
+		fi, exists = s.copyOrRenameLocalFile(w, r, p, target)
+	})
+	if fi == nil {
+		return
+	}
+	// Versions of the target written by other nodes would hide the new one
+	// The paths are not locked meanwhile, as the other nodes may be removing the target too and wait for this one
+	if exists && !fi.IsDir() {
+		if _, err := s.removeOtherVersions(target, s.traversedNodes(r)); err != nil {
+			returnError(err, w)
+			return
+		}
+	}
+	fileInfoToHeader(fi, w.Header())
+	w.Header().Set(CONTENT_LENGTH, "0")
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// Copy or move a file with the storage of this node, returning the new file and whether it replaced one
+// The returned file is nil if the request has been answered instead
+func (s *Server) copyOrRenameLocalFile(w http.ResponseWriter, r *http.Request, p string, target string) (os.FileInfo, bool) {
+	if s.fileToChange(w, r, p) == nil {
+		return nil, false
+	}
+	_, err := s.storage.GetFile(target)
+	exists := err == nil
+	if exists && r.Header.Get(OVERWRITE) == "F" {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return nil, exists
+	}
+
+	var fi os.FileInfo
+	if r.Method == "MOVE" {
+		fi, err = s.storage.RenameFile(p, target)
+	} else {
+		fi, err = s.storage.CopyFile(p, target)
+	}
+	if err != nil {
+		returnError(err, w)
+		return nil, exists
+	}
+	return fi, exists
+}
+
+// Find the file changed by a request, nil if the request has been answered instead
+// Files written by other nodes can only be changed by them, so requests are redirected there
+func (s *Server) fileToChange(w http.ResponseWriter, r *http.Request, p string) os.FileInfo {
+	fi, err := s.storage.GetFile(p)
+	if err != nil {
+		// If it was created, it is certainly on the node responsible for it
+		if !s.distributeRequestIfPossible(w, r) {
+			returnError(err, w)
+		}
+		return nil
+	}
+	if storageFileInfo, ok := fi.(*file.FileInfo); ok && !fi.IsDir() && storageFileInfo.Node() != s.config.Node.Name {
+		if !s.tryRedirectToNode(w, r, storageFileInfo.Node(), storageFileInfo.Shard()) {
+			returnError(NewInternalError(fmt.Sprintf("File %s is owned by node %s which is not available", p, storageFileInfo.Node())), w)
+		}
+		return nil
+	}
+	if s.failPreconditions(w, r, fi) {
+		return nil
+	}
+	return fi
+}
+
+// Lock serializing the writes of a path with the other writes of this node
+func (s *Server) pathLock(p string) *sync.Mutex {
+	return s.pathLocks[s.pathLockIndex(p)]
+}
+
+func (s *Server) pathLockIndex(p string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(path.Clean(p)))
+	return int(hash.Sum32() % uint32(len(s.pathLocks)))
+}
+
+// Lock the writes of two paths, always in the same order so that concurrent requests on them can't deadlock
+// The returned function unlocks them
+func (s *Server) lockPaths(p string, other string) func() {
+	first, second := s.pathLockIndex(p), s.pathLockIndex(other)
+	if first > second {
+		first, second = second, first
+	}
+	s.pathLocks[first].Lock()
+	if second == first {
+		return s.pathLocks[first].Unlock
+	}
+	s.pathLocks[second].Lock()
+	return func() {
+		s.pathLocks[second].Unlock()
+		s.pathLocks[first].Unlock()
+	}
+}
+
+// Regular file at a path to evaluate conditions, nil if it doesn't exist
+func (s *Server) currentRegularFile(p string) os.FileInfo {
+	fi, err := s.storage.GetRegularFile(p)
+	if err != nil {
+		return nil
+	}
+	return fi
+}
+
+// Answer a request whose conditions are not met by the current state of a file, nil if absent
+// It returns false if the request can go on
+func (s *Server) failPreconditions(w http.ResponseWriter, r *http.Request, fi os.FileInfo) bool {
+	status := checkPreconditions(r, fi)
+	if status == 0 {
+		return false
+	}
+	if status == http.StatusNotModified {
+		if etag := fileInfoETag(fi); etag != "" {
+			w.Header().Set(ETAG, etag)
+		}
+		w.Header().Set(LAST_MODIFIED, fi.ModTime().UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT"))
+	}
+	w.WriteHeader(status)
+	return true
+}
+
 func (s *Server) GetFile(w http.ResponseWriter, r *http.Request) {
-	p := r.URL.Path[len(FILES_PREFIX):]
+	p := requestPath(r)
 	fi, err := s.storage.GetFile(p)
 	if err != nil {
 		// We didn't find the file, maybe it is not still synchronized but
@@ -187,11 +560,14 @@ func (s *Server) GetFile(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if s.failPreconditions(w, r, fi) {
+		return
+	}
 	fileInfoToHeader(fi, w.Header())
 }
 
 func (s *Server) GetFileWithData(w http.ResponseWriter, r *http.Request) {
-	p := r.URL.Path[len(FILES_PREFIX):]
+	p := requestPath(r)
 	fi, err := s.storage.GetFile(p)
 	if err != nil {
 		logger.Debugf("File %s not found try to redirect the request\n", p)
@@ -203,43 +579,414 @@ func (s *Server) GetFileWithData(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	var data []byte
-	if fi.Mode().IsRegular() {
-		logger.Debugf("Read regular file %s\n", p)
-		storageFileInfo, _ := fi.(*file.FileInfo)
-		data, err = storageFileInfo.Data()
+	// Conditions are checked before reading data, which may be on another node
+	if s.failPreconditions(w, r, fi) {
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		s.listDirectory(w, r, p, fi)
+		return
+	}
+	logger.Debugf("Read regular file %s\n", p)
+	storageFileInfo, _ := fi.(*file.FileInfo)
+	section, release, err := storageFileInfo.OpenData()
+	if err != nil {
+		// We don't have the data, let's try to redirect to the node responsible
+		// or any other node in the same shard
+		if !s.tryRedirectToNode(w, r, storageFileInfo.Node(), storageFileInfo.Shard()) {
+			returnError(err, w)
+		}
+		return
+	}
+	defer release()
+	// Only the served bytes are read from the container, ServeContent handling ranges and conditions with the ETag set here
+	// The section is copied through a buffer: net/http only uses sendfile for a whole *os.File
+	fileInfoToHeader(fi, w.Header())
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), section)
+}
+
+// Write the entries of a directory in the format negotiated with the Accept header
+// NDJSON listings without limit nor cursor are streamed entry by entry, other listings are written in one block
+func (s *Server) listDirectory(w http.ResponseWriter, r *http.Request, p string, fi os.FileInfo) {
+	logger.Debugf("Read directory %s\n", p)
+	options, err := queryToReadDirOptions(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	format := acceptToListingFormat(r.Header.Get(ACCEPT))
+	if recursive, _ := strconv.ParseBool(r.URL.Query().Get(RECURSIVE_PARAMETER)); recursive {
+		s.walkDirectory(w, r, p, fi, format)
+		return
+	}
+
+	if format == NDJSON_MIME_TYPE && options.Limit == 0 && options.After == "" {
+		fileInfoToHeader(fi, w.Header())
+		w.Header().Del(CONTENT_LENGTH)
+		w.Header().Set(CONTENT_TYPE, format)
+		writer := newListingWriter(w, format)
+		err := s.storage.StreamDir(p, options, func(f os.FileInfo) error {
+			return writer.Write("", f)
+		})
 		if err != nil {
-			// We don't have the data, let's try to redirect to the node responsible
-			// or any other node in the same shard
-			if !s.tryRedirectToNode(w, r, storageFileInfo.Node(), storageFileInfo.Shard()) {
-				returnError(err, w)
-			}
-			return
+			logger.Warnf("Could not stream directory %s: %s", p, err)
+		}
+		return
+	}
+
+	files, err := s.storage.ReadDirPage(p, options)
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	logger.Debugf("Directory %s contains %v\n", p, files)
+	data, err := filesInfoToListing(files, format)
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	fileInfoToHeader(fi, w.Header())
+	if format != CSV_MIME_TYPE {
+		w.Header().Set(CONTENT_TYPE, format)
+	}
+	if options.Limit > 0 && len(files) == options.Limit {
+		last := files[len(files)-1]
+		w.Header().Set(NEXT_AFTER, storage.ListingCursor(last.Name(), last))
+	}
+	w.Header().Set(CONTENT_LENGTH, strconv.FormatInt((int64)(len(data)), 10))
+	w.Write(data)
+}
+
+// Write all descendants of a directory, named by their path relative to it
+// Without limit, entries are streamed. With a limit, the X-Next-After header gives the cursor of the next page when the page is full
+func (s *Server) walkDirectory(w http.ResponseWriter, r *http.Request, p string, fi os.FileInfo, format string) {
+	logger.Debugf("Walk directory %s\n", p)
+	options, limit, err := queryToWalkOptions(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	fileInfoToHeader(fi, w.Header())
+	w.Header().Del(CONTENT_LENGTH)
+	if format != CSV_MIME_TYPE {
+		w.Header().Set(CONTENT_TYPE, format)
+	}
+
+	if limit == 0 {
+		writer := newListingWriter(w, format)
+		err := s.storage.WalkWithOptions(p, options, func(rel string, f os.FileInfo) error {
+			return writer.Write(rel, f)
+		})
+		if err == nil {
+			err = writer.Close()
 		}
-	} else {
-		logger.Debugf("Read directory %s\n", p)
-		files, err := s.storage.ReadDir(p)
 		if err != nil {
-			returnError(err, w)
+			logger.Warnf("Could not walk directory %s: %s", p, err)
+		}
+		return
+	}
+
+	output := bytes.Buffer{}
+	writer := newListingWriter(&output, format)
+	var last string
+	err = s.storage.WalkWithOptions(p, options, func(rel string, f os.FileInfo) error {
+		if writer.numEntries == limit {
+			return errPageFull
+		}
+		last = storage.ListingCursor(rel, f)
+		return writer.Write(rel, f)
+	})
+	if err == nil || err == errPageFull {
+		err = writer.Close()
+	}
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	if writer.numEntries == limit {
+		w.Header().Set(NEXT_AFTER, last)
+	}
+	w.Header().Set(CONTENT_LENGTH, strconv.Itoa(output.Len()))
+	w.Write(output.Bytes())
+}
+
+// Read a list of regular files in one request
+// The body is a json array of paths and the response is a multipart stream with one part per path,
+// in the same order, containing either the file data or the error met while reading it
+func (s *Server) GetRegularFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var paths []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_BATCH_REQUEST_SIZE)).Decode(&paths); err != nil {
+		w.WriteHeader(bodyErrorToHttpStatus(err))
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writer := multipart.NewWriter(w)
+	w.Header().Set(CONTENT_TYPE, "multipart/mixed; boundary="+writer.Boundary())
+	traversedNodes := s.traversedNodes(r)
+	for _, p := range paths {
+		partHeader := textproto.MIMEHeader{}
+		fi, data, err := s.readRegularFile(p, traversedNodes)
+		if err != nil {
+			logger.Debugf("Could not read file %s in batch: %s", p, err)
+			data = []byte(err.Error())
+			partHeader.Set(CONTENT_STATUS, strconv.Itoa(errorToHttpStatus(err)))
+		} else {
+			fileInfoToHeader(fi, http.Header(partHeader))
+			partHeader.Set(CONTENT_STATUS, strconv.Itoa(http.StatusOK))
+		}
+		partHeader.Set(CONTENT_PATH, p)
+		partHeader.Set(CONTENT_LENGTH, strconv.Itoa(len(data)))
+		part, err := writer.CreatePart(partHeader)
+		if err != nil {
+			logger.Warnf("Could not write batch response: %s", err)
 			return
 		}
-		logger.Debugf("Directory %s contains %v\n", p, files)
-		data, err = filesInfoToCsv(files)
+		if _, err := part.Write(data); err != nil {
+			logger.Warnf("Could not write batch response: %s", err)
+			return
+		}
+	}
+	writer.Close()
+}
+
+// Read a regular file and its data, from the local storage if possible
+// or from the node responsible for it otherwise
+// Local reads are done by a file worker, which is released before fetching the file from another node
+func (s *Server) readRegularFile(p string, traversedNodes []string) (os.FileInfo, []byte, error) {
+	var fi os.FileInfo
+	var data []byte
+	var err error
+	var node *cluster.NodeInfo
+	s.runWithWorker(func() {
+		fi, err = s.storage.GetRegularFile(p)
 		if err != nil {
-			returnError(err, w)
+			// We didn't find the file, maybe it is not still synchronized but
+			// if it was created, it is certainly on the node reponsible for it
+			if node = s.topologyClient.GetNodeForObject(p); node != nil && containsNode(traversedNodes, node.Name) {
+				node = nil
+			}
 			return
 		}
+		storageFileInfo, _ := fi.(*file.FileInfo)
+		if data, err = storageFileInfo.Data(); err != nil {
+			// We don't have the data, let's try to fetch it from the node responsible
+			// or any other node in the same shard
+			node = s.findNodeForData(storageFileInfo.Node(), storageFileInfo.Shard(), traversedNodes)
+		}
+	})
+	if err == nil {
+		return fi, data, nil
 	}
-	fileInfoToHeader(fi, w.Header())
-	w.Header().Set(CONTENT_LENGTH, strconv.FormatInt((int64)(len(data)), 10))
+	if node == nil {
+		return nil, nil, err
+	}
+	return s.fetchRegularFileFromNode(node, p, traversedNodes)
+}
+
+func (s *Server) fetchRegularFileFromNode(node *cluster.NodeInfo, p string, traversedNodes []string) (os.FileInfo, []byte, error) {
+	uri, err := url.Parse(node.Address + path.Join(FILES_PREFIX, p))
+	if err != nil {
+		return nil, nil, err
+	}
+	query := uri.Query()
+	for _, traversedNode := range traversedNodes {
+		query.Add(TRAVERSED_NODE_PARAMETER, traversedNode)
+	}
+	uri.RawQuery = query.Encode()
+	logger.Debugf("Fetch file %s from node %s", p, node.Name)
+
+	resp, err := s.httpClient.Get(uri.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	fi, err := responseToFileInfo(uri, resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, nil, NewIsDirError(p)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fi, data, nil
+}
+
+// Write statistics of a directory computed by the storage as json, for all sub directories if recursive
+func (s *Server) GetDirectoryStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p := r.URL.Path[len(STATS_PREFIX):]
+	recursive, _ := strconv.ParseBool(r.URL.Query().Get(RECURSIVE_PARAMETER))
+	stats, err := s.storage.DirectoryStats(p, recursive)
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	data, err := json.Marshal(directoryStatsResponse{DirectoryStats: stats, DeadBytesRatio: stats.DeadBytesRatio()})
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	w.Header().Set(CONTENT_TYPE, JSON_MIME_TYPE)
+	w.Header().Set(CONTENT_LENGTH, strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// Write counters of the data cache of the storage as json
+func (s *Server) GetDataCacheStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// Storages without data cache have no counters
+	var stats storage.DataCacheStats
+	if cachingStorage, ok := s.storage.(storage.CachingStorage); ok {
+		stats = cachingStorage.DataCacheStats()
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	w.Header().Set(CONTENT_TYPE, JSON_MIME_TYPE)
+	w.Header().Set(CONTENT_LENGTH, strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// Wait for change events of a directory of this node
+// Events are sent as Server-Sent Events if accepted by the client, until it disconnects.
+// Otherwise the request is a long poll answered with a json object as soon as there are events or at timeout
+func (s *Server) Watch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p := r.URL.Path[len(WATCH_PREFIX):]
+	options, err := requestToWatchOptions(r, s.storage.LastEventSequence())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if strings.Contains(r.Header.Get(ACCEPT), EVENT_STREAM_MIME_TYPE) {
+		s.streamEvents(w, r, p, options)
+		return
+	}
+
+	events, sequence, err := s.storage.Watch(p, options)
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	response := watchResponse{Events: events, Sequence: sequence}
+	data, err := json.Marshal(response)
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	w.Header().Set(CONTENT_TYPE, JSON_MIME_TYPE)
+	w.Header().Set(CONTENT_LENGTH, strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// Read the journal of this node after a sequence number, as json
+// With a timeout, followers tailing the journal wait for new records when they have read all of them
+func (s *Server) ReadJournal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	options, err := queryToJournalReadOptions(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	journalingStorage, ok := s.storage.(storage.JournalingStorage)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("storage has no journal"))
+		return
+	}
+	options.Cancel = r.Context().Done()
+	records, err := journalingStorage.ReadJournal(options)
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	response := journalResponse{Records: records, Sequence: options.After}
+	if len(records) > 0 {
+		response.Sequence = records[len(records)-1].Sequence
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	w.Header().Set(CONTENT_TYPE, JSON_MIME_TYPE)
+	w.Header().Set(CONTENT_LENGTH, strconv.Itoa(len(data)))
 	w.Write(data)
 }
 
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, p string, options storage.WatchOptions) {
+	// Check the directory and the sequence number before starting the stream, to be able to return an error
+	options.Timeout = 0
+	events, sequence, err := s.storage.Watch(p, options)
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	w.Header().Set(CONTENT_TYPE, EVENT_STREAM_MIME_TYPE)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	options.Timeout = EVENT_STREAM_KEEPALIVE_INTERVAL
+	for {
+		for _, event := range events {
+			data, _ := json.Marshal(event)
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Sequence, event.Type, data); err != nil {
+				return
+			}
+		}
+		options.After = sequence
+		if len(events) == 0 {
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		default:
+		}
+		if events, sequence, err = s.storage.Watch(p, options); err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+			return
+		}
+	}
+}
+
 func (s *Server) distributeRequestIfPossible(w http.ResponseWriter, r *http.Request) bool {
 	if _, alreadyTraversed := r.URL.Query()[TRAVERSED_NODE_PARAMETER]; alreadyTraversed {
 		return false
 	}
-	p := r.URL.Path[len(FILES_PREFIX):]
+	p := requestPath(r)
 	node := s.topologyClient.GetNodeForObject(p)
 	if node == nil || node.Name == s.config.Node.Name {
 		return false
@@ -250,10 +997,10 @@ func (s *Server) distributeRequestIfPossible(w http.ResponseWriter, r *http.Requ
 
 func (s *Server) tryRecoverMissingDirectory(directory string) bool {
 	node := s.topologyClient.GetNodeForObject(directory)
-	logger.Debugf("Directory %s has not been found on %s, let's try find it on %s", directory, s.config.Node.Name, node.Name)
 	if node == nil || node.Name == s.config.Node.Name {
 		return false
 	}
+	logger.Debugf("Directory %s has not been found on %s, let's try find it on %s", directory, s.config.Node.Name, node.Name)
 	uri, _ := url.Parse(node.Address + path.Join(FILES_PREFIX, directory))
 	logger.Debugf("Url is %s", uri.String())
 	req, err := http.NewRequest("HEAD", uri.String(), nil)
@@ -276,14 +1023,29 @@ func (s *Server) tryRecoverMissingDirectory(directory string) bool {
 
 func (s *Server) tryRedirectToNode(w http.ResponseWriter, r *http.Request, nodeName string, shard string) bool {
 	logger.Debugf("Try to redirect query to node %s of shard %s", nodeName, shard)
-	var node *cluster.NodeInfo
+	node := s.findNodeForData(nodeName, shard, s.traversedNodes(r))
+	if node != nil {
+		s.redirectToNode(w, r, node)
+		return true
+	}
+	return false
+}
+
+// List the nodes which already tried to serve this request, including the current one
+func (s *Server) traversedNodes(r *http.Request) []string {
 	traversedNodes := []string{s.config.Node.Name}
 	query := r.URL.Query()
 	if nodes, ok := query[TRAVERSED_NODE_PARAMETER]; ok {
 		traversedNodes = append(traversedNodes, nodes...)
 	}
-	nodeAlreadyTraversed := sort.SearchStrings(traversedNodes, nodeName) != len(traversedNodes)
-	if !nodeAlreadyTraversed {
+	return traversedNodes
+}
+
+// Find the node which should own the data of a file: the node itself if it is online and not yet traversed,
+// otherwise any other not traversed node of the same shard
+func (s *Server) findNodeForData(nodeName string, shard string, traversedNodes []string) *cluster.NodeInfo {
+	var node *cluster.NodeInfo
+	if !containsNode(traversedNodes, nodeName) {
 		logger.Debugf("Not not %s yed traversed, let's try to find info online", nodeName)
 		// We didn't tried this node yet, let's see if it is online
 		if nodeInfo, found := s.topologyClient.Nodes()[nodeName]; found {
@@ -294,22 +1056,27 @@ func (s *Server) tryRedirectToNode(w http.ResponseWriter, r *http.Request, nodeN
 		// We already tried this node or it is not online, let's look for another node in the same shard
 		logger.Debugf("Look in shard %s for node not in %v", shard, traversedNodes)
 		for _, nodeInfo := range s.topologyClient.Nodes() {
-			if nodeInfo.Shard == shard && sort.SearchStrings(traversedNodes, nodeInfo.Name) == len(traversedNodes) {
+			if nodeInfo.Shard == shard && !containsNode(traversedNodes, nodeInfo.Name) {
 				node = nodeInfo
 				break
 			}
 		}
 	}
-	if node != nil {
-		s.redirectToNode(w, r, node)
-		return true
+	return node
+}
+
+// Traversed nodes are in the order of the request, not sorted
+func containsNode(nodes []string, name string) bool {
+	for _, node := range nodes {
+		if node == name {
+			return true
+		}
 	}
 	return false
 }
 
 func (s *Server) redirectToNode(w http.ResponseWriter, r *http.Request, node *cluster.NodeInfo) {
-	uri := r.URL.String()
-	uri = node.Address + uri[strings.Index(uri, FILES_PREFIX):]
+	uri := node.Address + r.URL.RequestURI()
 	if strings.Index(uri, "?") == -1 {
 		uri += "?"
 	} else {
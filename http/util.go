@@ -3,8 +3,11 @@ package http
 import (
 	"bytes"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net/http"
 	"net/url"
@@ -12,28 +15,81 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	. "github.com/t-mind/flocons/error"
 	"github.com/t-mind/flocons/file"
+	"github.com/t-mind/flocons/storage"
 )
 
+const CSV_MIME_TYPE string = "text/csv"
+const JSON_MIME_TYPE string = "application/json"
+const NDJSON_MIME_TYPE string = "application/x-ndjson"
+const EVENT_STREAM_MIME_TYPE string = "text/event-stream"
+
+const DIRECTORY_FILE_TYPE_NAME string = "directory"
+const REGULAR_FILE_TYPE_NAME string = "file"
+
 const FILES_PREFIX string = "/files"
+const BATCH_PREFIX string = "/batch"
+const STATS_PREFIX string = "/stats"
+const CACHE_PREFIX string = "/cache"
+const WATCH_PREFIX string = "/watch"
+const JOURNAL_PREFIX string = "/journal"
+const DAV_PREFIX string = "/dav"
+const S3_PREFIX string = "/s3"
 const TRAVERSED_NODE_PARAMETER string = "traversed-node"
+const LIMIT_PARAMETER string = "limit"
+const AFTER_PARAMETER string = "after"
+const PREFIX_PARAMETER string = "prefix"
+const GLOB_PARAMETER string = "glob"
+const TYPE_PARAMETER string = "type"
+const RECURSIVE_PARAMETER string = "recursive"
+const DEPTH_PARAMETER string = "depth"
+const TIMEOUT_PARAMETER string = "timeout"
+
+// Methods accepted on files and directories
+const ALLOWED_FILE_METHODS string = "GET, HEAD, POST, PUT, DELETE, PATCH, MOVE, COPY"
+
+// Methods accepted on files and directories under the WebDAV prefix
+const ALLOWED_DAV_METHODS string = "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, PROPFIND, MOVE, COPY, LOCK, UNLOCK"
+
+// Time a long poll waits for events when no timeout is given
+const DEFAULT_WATCH_TIMEOUT time.Duration = 30 * time.Second
+
+// Interval of the comments sent on event streams without events, so that proxies don't close them
+const EVENT_STREAM_KEEPALIVE_INTERVAL time.Duration = 15 * time.Second
 
 func errorToHttpStatus(err error) int {
+	if httpError, ok := err.(*HttpError); ok {
+		return httpError.StatusCode
+	}
 	switch {
 	case os.IsNotExist(err):
 		return http.StatusNotFound
 	case os.IsPermission(err):
 		return http.StatusForbidden
-	case os.IsExist(err) || IsIsDirError(err) || IsIsNotDirError(err):
+	case os.IsExist(err) || IsIsDirError(err) || IsIsNotDirError(err) || IsNotEmptyError(err):
 		return http.StatusConflict
+	case IsInvalidPathError(err):
+		return http.StatusBadRequest
+	case IsEventsLostError(err):
+		return http.StatusGone
 	default:
 		return http.StatusInternalServerError
 	}
 }
 
+// Status of an error met while reading a request body limited with http.MaxBytesReader
+func bodyErrorToHttpStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
 func getResponseBodyString(resp *http.Response) string {
 	var body []byte
 	if resp.ContentLength > 0 {
@@ -56,20 +112,34 @@ func responseToFileInfo(uri *url.URL, resp *http.Response) (os.FileInfo, error)
 		return nil, NewHttpError(fmt.Sprintf("%s: %s", resp.Status, getResponseBodyString(resp)), resp.StatusCode)
 	}
 
-	h := resp.Header
+	return headerToFileInfo(path.Base(uri.Path), resp.Header, resp.ContentLength), nil
+}
 
-	modified, err := strconv.ParseInt(h.Get(LAST_MODIFIED), 10, 64)
+func headerToFileInfo(name string, h http.Header, size int64) os.FileInfo {
+	modified, err := http.ParseTime(h.Get(LAST_MODIFIED))
 	if err != nil {
-		modified = 0
+		modified = time.Unix(0, 0)
 	}
 
 	return file.NewFileInfo(
-		path.Base(uri.Path),
+		name,
 		headerToFileMode(h),
-		resp.ContentLength,
-		time.Unix(modified, 0),
-		file.FileDataSource{},
-	), nil
+		size,
+		modified,
+		file.FileDataSource{ETag: h.Get(ETAG)},
+	)
+}
+
+// Convert the status and body of a failed response (or response part) to an error
+func statusToError(p string, status int, message string) error {
+	switch {
+	case status == http.StatusNotFound:
+		return NewFileNotFoundError(p)
+	case status == http.StatusInternalServerError:
+		return NewInternalError(fmt.Sprintf("%d %s: %s", status, http.StatusText(status), message))
+	default:
+		return NewHttpError(fmt.Sprintf("%d %s: %s", status, http.StatusText(status), message), status)
+	}
 }
 
 func headerToFileMode(h http.Header) os.FileMode {
@@ -87,12 +157,22 @@ func headerToFileMode(h http.Header) os.FileMode {
 		}
 	}
 	fileMode := (os.FileMode)(parsedFileMode)
-	if mimeType == file.DIRECTORY_MIME_TYPE {
+	if mimeType == file.DIRECTORY_MIME_TYPE || h.Get(FILE_TYPE) == DIRECTORY_FILE_TYPE_NAME {
 		fileMode |= os.ModeDir
 	}
 	return fileMode
 }
 
+func fileInfoToMimeType(fi os.FileInfo) string {
+	if fi.Mode().IsDir() {
+		return file.DIRECTORY_MIME_TYPE
+	}
+	if mimeType := mime.TypeByExtension(filepath.Ext(fi.Name())); mimeType != "" {
+		return mimeType
+	}
+	return file.DEFAULT_FILE_MIME_TYPE
+}
+
 func fileInfoToHeader(fi os.FileInfo, h http.Header) {
 	mode := (uint32)(fi.Mode())
 	// Remove all information about type of file in sent mode because it is OS dependant
@@ -101,36 +181,482 @@ func fileInfoToHeader(fi os.FileInfo, h http.Header) {
 
 	h.Set(CONTENT_MODE, strconv.FormatUint((uint64)(mode), 8))
 	h.Set(LAST_MODIFIED, fi.ModTime().UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT"))
+	if etag := fileInfoETag(fi); etag != "" {
+		h.Set(ETAG, etag)
+	}
+	h.Set(CONTENT_TYPE, fileInfoToMimeType(fi))
 	if fi.Mode().IsDir() {
-		h.Set(CONTENT_TYPE, file.DIRECTORY_MIME_TYPE)
+		h.Set(FILE_TYPE, DIRECTORY_FILE_TYPE_NAME)
 		h.Set(CONTENT_LENGTH, "0")
 	} else {
-		h.Set(CONTENT_TYPE, mime.TypeByExtension(filepath.Ext(fi.Name())))
+		h.Set(FILE_TYPE, REGULAR_FILE_TYPE_NAME)
 		h.Set(CONTENT_LENGTH, strconv.FormatInt(fi.Size(), 10))
+		h.Set(ACCEPT_RANGES, "bytes")
+	}
+}
+
+func fileInfoETag(fi os.FileInfo) string {
+	if storageFileInfo, ok := fi.(*file.FileInfo); ok {
+		return storageFileInfo.ETag()
+	}
+	return ""
+}
+
+// Evaluate the conditional headers of a request against the current state of a regular file, nil if absent
+// It returns the status to answer instead of processing the request, or 0 if the request can go on.
+// Directories have no entity tag, conditions are ignored for them
+func checkPreconditions(r *http.Request, fi os.FileInfo) int {
+	if fi != nil && fi.IsDir() {
+		return 0
+	}
+	var etag string
+	if fi != nil {
+		etag = fileInfoETag(fi)
+	}
+	read := r.Method == "GET" || r.Method == "HEAD"
+	if condition := r.Header.Get(IF_MATCH); condition != "" {
+		if fi == nil || !etagMatches(condition, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	if condition := r.Header.Get(IF_NONE_MATCH); condition != "" {
+		if fi != nil && etagMatches(condition, etag, true) {
+			if read {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+		// If-Modified-Since is ignored when there is an If-None-Match
+		return 0
+	}
+	if condition := r.Header.Get(IF_MODIFIED); condition != "" && read && fi != nil {
+		// Last-Modified has a precision of one second
+		if since, err := http.ParseTime(condition); err == nil && !fi.ModTime().Truncate(time.Second).After(since) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// Check if an entity tag is in the list of a condition, "*" matching any of them
+// Weak comparison ignores the weakness indicator while strong comparison never matches weak tags
+func etagMatches(condition string, etag string, weak bool) bool {
+	if strings.TrimSpace(condition) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(condition, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Changes of a PATCH request, named like the fields of listing entries
+type fileChangesEntry struct {
+	Mode    *uint32 `json:"mode,omitempty"`
+	ModTime *int64  `json:"mtime,omitempty"`
+}
+
+func bodyToFileChanges(body io.Reader) (storage.FileChanges, error) {
+	entry := fileChangesEntry{}
+	changes := storage.FileChanges{}
+	if err := json.NewDecoder(body).Decode(&entry); err != nil {
+		return changes, err
+	}
+	if entry.Mode != nil {
+		mode := (os.FileMode)(*entry.Mode) & os.ModePerm
+		changes.Mode = &mode
+	}
+	if entry.ModTime != nil {
+		modTime := time.Unix(*entry.ModTime, 0)
+		changes.ModTime = &modTime
+	}
+	return changes, nil
+}
+
+func fileChangesToBody(changes storage.FileChanges) ([]byte, error) {
+	entry := fileChangesEntry{}
+	if changes.Mode != nil {
+		mode := (uint32)(*changes.Mode & os.ModePerm)
+		entry.Mode = &mode
+	}
+	if changes.ModTime != nil {
+		modTime := changes.ModTime.Unix()
+		entry.ModTime = &modTime
+	}
+	return json.Marshal(&entry)
+}
+
+// Path of a file in the storage, from the url of a request under the files, the WebDAV or the S3 prefix
+func requestPath(r *http.Request) string {
+	return urlPathToStoragePath(r.URL.Path)
+}
+
+func urlPathToStoragePath(p string) string {
+	if strings.HasPrefix(p, DAV_PREFIX+"/") {
+		return p[len(DAV_PREFIX):]
+	}
+	if strings.HasPrefix(p, S3_PREFIX+"/") {
+		return p[len(S3_PREFIX):]
+	}
+	return strings.TrimPrefix(p, FILES_PREFIX)
+}
+
+// Path of the destination of a MOVE or a COPY, given as an url or an absolute path under the files or the WebDAV prefix
+func requestToDestination(r *http.Request) (string, error) {
+	destination := r.Header.Get(DESTINATION)
+	uri, err := url.Parse(destination)
+	if destination == "" || err != nil || !(strings.HasPrefix(uri.Path, FILES_PREFIX+"/") || strings.HasPrefix(uri.Path, DAV_PREFIX+"/")) {
+		return "", NewHttpError(fmt.Sprintf("Invalid destination '%s'", destination), http.StatusBadRequest)
+	}
+	return urlPathToStoragePath(uri.Path), nil
+}
+
+// Parse the query parameters of a directory listing
+// type is either 'f' for regular files or 'd' for directories
+func queryToReadDirOptions(query url.Values) (storage.ReadDirOptions, error) {
+	options := storage.ReadDirOptions{
+		After:  query.Get(AFTER_PARAMETER),
+		Prefix: query.Get(PREFIX_PARAMETER),
+		Glob:   query.Get(GLOB_PARAMETER),
+	}
+	if limit := query.Get(LIMIT_PARAMETER); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 0 {
+			return options, fmt.Errorf("invalid limit %s", limit)
+		}
+		options.Limit = value
+	}
+	switch query.Get(TYPE_PARAMETER) {
+	case "":
+		options.Type = storage.ANY_FILE_TYPE
+	case "f":
+		options.Type = storage.REGULAR_FILE_TYPE
+	case "d":
+		options.Type = storage.DIRECTORY_FILE_TYPE
+	default:
+		return options, fmt.Errorf("invalid type %s", query.Get(TYPE_PARAMETER))
+	}
+	return options, options.Validate()
+}
+
+// Parse the query parameters of a recursive listing, which are the walk options and the limit of the page
+func queryToWalkOptions(query url.Values) (storage.WalkOptions, int, error) {
+	options := storage.WalkOptions{
+		After: query.Get(AFTER_PARAMETER),
+	}
+	var limit int
+	if value := query.Get(LIMIT_PARAMETER); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return options, 0, fmt.Errorf("invalid limit %s", value)
+		}
+		limit = parsed
+	}
+	if value := query.Get(DEPTH_PARAMETER); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return options, 0, fmt.Errorf("invalid depth %s", value)
+		}
+		options.MaxDepth = parsed
+	}
+	return options, limit, nil
+}
+
+// Read watch options from the query, resuming after the Last-Event-ID of an event stream if any
+// Without sequence number, only the events coming after the request are watched
+func requestToWatchOptions(r *http.Request, lastSequence uint64) (storage.WatchOptions, error) {
+	query := r.URL.Query()
+	options := storage.WatchOptions{
+		After:   lastSequence,
+		Timeout: DEFAULT_WATCH_TIMEOUT,
+		Cancel:  r.Context().Done(),
+	}
+	after := query.Get(AFTER_PARAMETER)
+	if after == "" {
+		after = r.Header.Get(LAST_EVENT_ID)
+	}
+	if after != "" {
+		parsed, err := strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			return options, fmt.Errorf("invalid sequence number %s", after)
+		}
+		options.After = parsed
+	}
+	if value := query.Get(RECURSIVE_PARAMETER); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, fmt.Errorf("invalid recursive %s", value)
+		}
+		options.Recursive = parsed
+	}
+	if value := query.Get(TIMEOUT_PARAMETER); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return options, fmt.Errorf("invalid timeout %s", value)
+		}
+		options.Timeout = parsed
+	}
+	return options, nil
+}
+
+func queryToJournalReadOptions(query url.Values) (storage.JournalReadOptions, error) {
+	options := storage.JournalReadOptions{}
+	if value := query.Get(AFTER_PARAMETER); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return options, fmt.Errorf("invalid sequence number %s", value)
+		}
+		options.After = parsed
+	}
+	if value := query.Get(LIMIT_PARAMETER); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return options, fmt.Errorf("invalid limit %s", value)
+		}
+		options.Limit = parsed
+	}
+	if value := query.Get(TIMEOUT_PARAMETER); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return options, fmt.Errorf("invalid timeout %s", value)
+		}
+		options.Timeout = parsed
+	}
+	return options, nil
+}
+
+func readDirOptionsToQuery(options storage.ReadDirOptions) url.Values {
+	query := url.Values{}
+	if options.Limit > 0 {
+		query.Set(LIMIT_PARAMETER, strconv.Itoa(options.Limit))
+	}
+	if options.After != "" {
+		query.Set(AFTER_PARAMETER, options.After)
+	}
+	if options.Prefix != "" {
+		query.Set(PREFIX_PARAMETER, options.Prefix)
+	}
+	if options.Glob != "" {
+		query.Set(GLOB_PARAMETER, options.Glob)
+	}
+	switch options.Type {
+	case storage.REGULAR_FILE_TYPE:
+		query.Set(TYPE_PARAMETER, "f")
+	case storage.DIRECTORY_FILE_TYPE:
+		query.Set(TYPE_PARAMETER, "d")
+	}
+	return query
+}
+
+// Events returned by a long poll, with the sequence number to resume from
+type watchResponse struct {
+	Events   []storage.Event `json:"events"`
+	Sequence uint64          `json:"seq"`
+}
+
+// Records of the journal, with the sequence number to resume from
+type journalResponse struct {
+	Records  []storage.JournalRecord `json:"records"`
+	Sequence uint64                  `json:"seq"`
+}
+
+type directoryStatsResponse struct {
+	*storage.DirectoryStats
+	DeadBytesRatio float64 `json:"dead_bytes_ratio"`
+}
+
+// Entry of a directory listing in json and ndjson formats
+type listingEntry struct {
+	Path        string `json:"path,omitempty"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Mode        uint32 `json:"mode"`
+	Size        int64  `json:"size"`
+	ModTime     int64  `json:"mtime"`
+	ContentType string `json:"content_type"`
+	Node        string `json:"node,omitempty"`
+	Shard       string `json:"shard,omitempty"`
+	Container   string `json:"container,omitempty"`
+}
+
+func fileInfoToListingEntry(fi os.FileInfo) *listingEntry {
+	entry := listingEntry{
+		Name:        fi.Name(),
+		Type:        REGULAR_FILE_TYPE_NAME,
+		Mode:        (uint32)(fi.Mode()) & ^((uint32)(os.ModeType)),
+		Size:        fi.Size(),
+		ModTime:     fi.ModTime().Unix(),
+		ContentType: fileInfoToMimeType(fi),
+	}
+	if fi.IsDir() {
+		entry.Type = DIRECTORY_FILE_TYPE_NAME
+	}
+	if storageFileInfo, ok := fi.(*file.FileInfo); ok {
+		entry.Node = storageFileInfo.Node()
+		entry.Shard = storageFileInfo.Shard()
+		entry.Container = storageFileInfo.Container()
+	}
+	return &entry
+}
+
+// Writes entries of a listing one by one in the given format
+type listingWriter struct {
+	format     string
+	writer     io.Writer
+	csvWriter  *csv.Writer
+	encoder    *json.Encoder
+	numEntries int
+}
+
+func newListingWriter(w io.Writer, format string) *listingWriter {
+	return &listingWriter{
+		format:    format,
+		writer:    w,
+		csvWriter: csv.NewWriter(w),
+		encoder:   json.NewEncoder(w),
+	}
+}
+
+// Write an entry, named by its path if not empty
+func (l *listingWriter) Write(p string, fi os.FileInfo) error {
+	l.numEntries++
+	switch l.format {
+	case JSON_MIME_TYPE, NDJSON_MIME_TYPE:
+		if l.format == JSON_MIME_TYPE {
+			separator := ","
+			if l.numEntries == 1 {
+				separator = "["
+			}
+			if _, err := io.WriteString(l.writer, separator); err != nil {
+				return err
+			}
+		}
+		entry := fileInfoToListingEntry(fi)
+		entry.Path = p
+		return l.encoder.Encode(entry)
+	default:
+		name := fi.Name()
+		if p != "" {
+			name = p
+		}
+		if err := l.csvWriter.Write(fileInfoToCsvRecord(name, fi)); err != nil {
+			return err
+		}
+		l.csvWriter.Flush()
+		return l.csvWriter.Error()
+	}
+}
+
+func (l *listingWriter) Close() error {
+	if l.format == JSON_MIME_TYPE {
+		closing := "]"
+		if l.numEntries == 0 {
+			closing = "[]"
+		}
+		_, err := io.WriteString(l.writer, closing)
+		return err
+	}
+	return nil
+}
+
+func listingEntryToFileInfo(entry *listingEntry) os.FileInfo {
+	mode := (os.FileMode)(entry.Mode)
+	if entry.Type == DIRECTORY_FILE_TYPE_NAME {
+		mode |= os.ModeDir
+	}
+	return file.NewFileInfo(entry.Name, mode, entry.Size, time.Unix(entry.ModTime, 0),
+		file.FileDataSource{Node: entry.Node, Shard: entry.Shard, Container: entry.Container})
+}
+
+// Choose the directory listing format from an Accept header: the first supported one, csv by default
+func acceptToListingFormat(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case CSV_MIME_TYPE, JSON_MIME_TYPE, NDJSON_MIME_TYPE:
+			return mediaType
+		}
+	}
+	return CSV_MIME_TYPE
+}
+
+func filesInfoToListing(files []os.FileInfo, format string) ([]byte, error) {
+	switch format {
+	case JSON_MIME_TYPE:
+		entries := make([]*listingEntry, 0, len(files))
+		for _, fi := range files {
+			entries = append(entries, fileInfoToListingEntry(fi))
+		}
+		return json.Marshal(entries)
+	case NDJSON_MIME_TYPE:
+		output := bytes.Buffer{}
+		encoder := json.NewEncoder(&output)
+		for _, fi := range files {
+			if err := encoder.Encode(fileInfoToListingEntry(fi)); err != nil {
+				return nil, err
+			}
+		}
+		return output.Bytes(), nil
+	default:
+		return filesInfoToCsv(files)
+	}
+}
+
+// Parse a directory listing, in the format given by the content type of the response
+func listingToFilesInfo(reader io.Reader, contentType string) ([]os.FileInfo, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case JSON_MIME_TYPE:
+		entries := make([]*listingEntry, 0)
+		if err := json.NewDecoder(reader).Decode(&entries); err != nil {
+			return nil, err
+		}
+		output := make([]os.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			output = append(output, listingEntryToFileInfo(entry))
+		}
+		return output, nil
+	case NDJSON_MIME_TYPE:
+		output := make([]os.FileInfo, 0)
+		decoder := json.NewDecoder(reader)
+		for {
+			var entry listingEntry
+			err := decoder.Decode(&entry)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			output = append(output, listingEntryToFileInfo(&entry))
+		}
+		return output, nil
+	default:
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		return csvToFilesInfo(data)
 	}
 }
 
 func filesInfoToCsv(files []os.FileInfo) ([]byte, error) {
 	output := bytes.Buffer{}
 	writer := csv.NewWriter(&output)
-	// Mask to remove all information about type of file in sent mode because it is OS dependant
-	modeTypeSuppressMask := ^((uint32)(os.ModeType))
 	for _, fi := range files {
-		var fileTypeIdentifier string
-		if fi.Mode().IsDir() {
-			fileTypeIdentifier = "d"
-		} else {
-			fileTypeIdentifier = "-"
-		}
-		mode := (uint32)(fi.Mode()) & modeTypeSuppressMask
-		err := writer.Write([]string{
-			fileTypeIdentifier,
-			fi.Name(),
-			strconv.FormatUint((uint64)(mode), 8),
-			strconv.FormatInt(fi.Size(), 10),
-			strconv.FormatInt(fi.ModTime().Unix(), 10),
-		})
-		if err != nil {
+		if err := writer.Write(fileInfoToCsvRecord(fi.Name(), fi)); err != nil {
 			return nil, err
 		}
 	}
@@ -138,6 +664,25 @@ func filesInfoToCsv(files []os.FileInfo) ([]byte, error) {
 	return output.Bytes(), nil
 }
 
+func fileInfoToCsvRecord(name string, fi os.FileInfo) []string {
+	// Mask to remove all information about type of file in sent mode because it is OS dependant
+	modeTypeSuppressMask := ^((uint32)(os.ModeType))
+	var fileTypeIdentifier string
+	if fi.Mode().IsDir() {
+		fileTypeIdentifier = "d"
+	} else {
+		fileTypeIdentifier = "-"
+	}
+	mode := (uint32)(fi.Mode()) & modeTypeSuppressMask
+	return []string{
+		fileTypeIdentifier,
+		name,
+		strconv.FormatUint((uint64)(mode), 8),
+		strconv.FormatInt(fi.Size(), 10),
+		strconv.FormatInt(fi.ModTime().Unix(), 10),
+	}
+}
+
 func csvToFilesInfo(data []byte) ([]os.FileInfo, error) {
 	output := make([]os.FileInfo, 0)
 	input := bytes.NewReader(data)
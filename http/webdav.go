@@ -0,0 +1,469 @@
+package http
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	. "github.com/t-mind/flocons/error"
+	"github.com/t-mind/flocons/file"
+	"github.com/t-mind/flocons/storage"
+)
+
+const DAV_XML_MIME_TYPE string = "application/xml; charset=utf-8"
+const DAV_NAMESPACE string = "DAV:"
+
+// Depth of PROPFIND and COPY requests which go through the whole tree
+const DAV_INFINITE_DEPTH string = "infinity"
+
+// Locks are not enforced, they are only granted so that clients requiring them can write
+const DAV_LOCK_TIMEOUT string = "Second-3600"
+
+// Time waited for the removals of files by other nodes to be visible, before removing their collection
+const REMOTE_REMOVAL_TIMEOUT time.Duration = 5 * time.Second
+const REMOTE_REMOVAL_POLL_INTERVAL time.Duration = 100 * time.Millisecond
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	ETag          string          `xml:"D:getetag,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+type davLockDiscovery struct {
+	XMLName   xml.Name `xml:"D:prop"`
+	Namespace string   `xml:"xmlns:D,attr"`
+	LockType  string   `xml:"D:lockdiscovery>D:activelock>D:locktype>D:write"`
+	LockScope string   `xml:"D:lockdiscovery>D:activelock>D:lockscope>D:exclusive"`
+	Depth     string   `xml:"D:lockdiscovery>D:activelock>D:depth"`
+	Timeout   string   `xml:"D:lockdiscovery>D:activelock>D:timeout"`
+	LockToken string   `xml:"D:lockdiscovery>D:activelock>D:locktoken>D:href"`
+	LockRoot  string   `xml:"D:lockdiscovery>D:activelock>D:lockroot>D:href"`
+}
+
+// Writer remembering the status answered by a handler, 0 if it didn't answer any yet
+type davResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *davResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *davResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Serve the files and directories as WebDAV resources and collections
+// Requests go through the same storage operations and redirections as the ones on the files prefix
+func (s *Server) ServeDav(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set(DAV, "1, 2")
+		w.Header().Set(MS_AUTHOR_VIA, "DAV")
+		w.Header().Set(ALLOW, ALLOWED_DAV_METHODS)
+		w.Header().Set(CONTENT_LENGTH, "0")
+	case "HEAD":
+		s.GetFile(w, r)
+	case "GET":
+		s.GetFileWithData(w, r)
+	case "PUT":
+		s.PutDavResource(w, r)
+	case "MKCOL":
+		s.MakeDavCollection(w, r)
+	case "DELETE":
+		s.RemoveDavResource(w, r)
+	case "MOVE", "COPY":
+		s.CopyOrRenameDavResource(w, r)
+	case "PROPFIND":
+		s.FindDavProperties(w, r)
+	case "LOCK":
+		s.LockDavResource(w, r)
+	case "UNLOCK":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set(ALLOW, ALLOWED_DAV_METHODS)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Write a regular file, answering 201 if it is new and 204 if it has been replaced
+func (s *Server) PutDavResource(w http.ResponseWriter, r *http.Request) {
+	if s.distributeRequestIfPossible(w, r) {
+		return
+	}
+	p := requestPath(r)
+	if !s.davParentExists(p) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	fi, err := s.storage.GetFile(p)
+	if err == nil && fi.IsDir() {
+		w.Header().Set(ALLOW, ALLOWED_DAV_METHODS)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	exists := err == nil
+
+	writer := &davResponseWriter{ResponseWriter: w}
+	// The content type of a resource is a mime type, not the kind of file to create
+	r.Header.Del(CONTENT_TYPE)
+	s.CreateRegularFile(writer, r)
+	if writer.status != 0 {
+		return
+	}
+	w.Header().Set(CONTENT_LENGTH, "0")
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// Create a directory, the parent must exist and the request can't have a body
+func (s *Server) MakeDavCollection(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > 0 {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	if s.distributeRequestIfPossible(w, r) {
+		return
+	}
+	p := requestPath(r)
+	if _, err := s.storage.GetFile(p); err == nil {
+		w.Header().Set(ALLOW, ALLOWED_DAV_METHODS)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.davParentExists(p) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	fi, err := s.storage.CreateDirectory(p, os.ModeDir|0755)
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	fileInfoToHeader(fi, w.Header())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Remove a regular file or a directory with all its content
+func (s *Server) RemoveDavResource(w http.ResponseWriter, r *http.Request) {
+	p := requestPath(r)
+	var fi os.FileInfo
+	var err error
+	s.runWithWorker(func() { fi, err = s.storage.GetFile(p) })
+	if err != nil {
+		if !s.distributeRequestIfPossible(w, r) {
+			returnError(err, w)
+		}
+		return
+	}
+	// Files written by other nodes are not redirected, as their versions are removed through them
+	if s.failPreconditions(w, r, fi) {
+		return
+	}
+	if err := s.removeDavTree(p, fi); err != nil {
+		returnError(err, w)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Copy or move a resource to the path of the Destination header, collections with their content
+// The resource at the destination is replaced unless Overwrite is F. Answers 201 if it didn't exist, 204 otherwise
+// Regular files replace each other atomically, but a collection has to be removed before being replaced or replacing a file
+func (s *Server) CopyOrRenameDavResource(w http.ResponseWriter, r *http.Request) {
+	p := requestPath(r)
+	target, err := requestToDestination(r)
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	if path.Clean(p) == path.Clean(target) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	// The paths are not locked while a replaced target is removed, as other nodes may be removing it too and wait for this one
+	var fi, targetFileInfo os.FileInfo
+	answered := false
+	s.runWithWorker(func() {
+		unlock := s.lockPaths(p, target)
+		defer unlock()
+		if fi = s.fileToChange(w, r, p); fi == nil {
+			answered = true
+		} else if !s.davParentExists(target) {
+			w.WriteHeader(http.StatusConflict)
+			answered = true
+		} else if targetFileInfo, err = s.storage.GetFile(target); err != nil {
+			targetFileInfo = nil
+		}
+	})
+	if answered {
+		return
+	}
+	exists := targetFileInfo != nil
+	if exists && r.Header.Get(OVERWRITE) == "F" {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	removeFirst := exists && (fi.IsDir() || targetFileInfo.IsDir())
+	if removeFirst {
+		if err := s.removeDavTree(target, targetFileInfo); err != nil {
+			returnError(err, w)
+			return
+		}
+	}
+
+	s.runWithWorker(func() {
+		unlock := s.lockPaths(p, target)
+		defer unlock()
+		if r.Method == "MOVE" {
+			_, err = s.storage.RenameFile(p, target)
+		} else {
+			err = s.copyDavTree(p, target, fi, r.Header.Get(DEPTH) != "0")
+		}
+	})
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	// Versions of a replaced file written by other nodes would hide the new one
+	if exists && !removeFirst {
+		if _, err := s.removeOtherVersions(target, []string{s.config.Node.Name}); err != nil {
+			returnError(err, w)
+			return
+		}
+	}
+	w.Header().Set(CONTENT_LENGTH, "0")
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// Answer the properties of a resource, and of the entries of a collection with a depth of 1
+// All the properties are always sent, whatever the body asks for
+func (s *Server) FindDavProperties(w http.ResponseWriter, r *http.Request) {
+	depth := r.Header.Get(DEPTH)
+	if depth == "" {
+		depth = DAV_INFINITE_DEPTH
+	}
+	if depth != "0" && depth != "1" {
+		w.Header().Set(CONTENT_TYPE, DAV_XML_MIME_TYPE)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(xml.Header + `<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`))
+		return
+	}
+
+	p := requestPath(r)
+	fi, err := s.storage.GetFile(p)
+	if err != nil {
+		if !s.distributeRequestIfPossible(w, r) {
+			returnError(err, w)
+		}
+		return
+	}
+	// The entries of a collection are streamed, so that large directories are not held in memory
+	w.Header().Set(CONTENT_TYPE, DAV_XML_MIME_TYPE)
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(xml.Header))
+	encoder := xml.NewEncoder(w)
+	multistatus := xml.StartElement{
+		Name: xml.Name{Local: "D:multistatus"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns:D"}, Value: DAV_NAMESPACE}},
+	}
+	writeResponse := func(p string, f os.FileInfo) error {
+		return encoder.EncodeElement(fileInfoToDavResponse(p, f), xml.StartElement{Name: xml.Name{Local: "D:response"}})
+	}
+	err = encoder.EncodeToken(multistatus)
+	if err == nil {
+		err = writeResponse(p, fi)
+	}
+	if err == nil && fi.IsDir() && depth == "1" {
+		err = s.storage.StreamDir(p, storage.ReadDirOptions{}, func(f os.FileInfo) error {
+			return writeResponse(path.Join(p, f.Name()), f)
+		})
+	}
+	if err != nil {
+		logger.Warnf("Could not stream properties of %s: %s", p, err)
+	}
+	// The document is ended even if the listing has been cut short
+	encoder.EncodeToken(multistatus.End())
+	encoder.Flush()
+}
+
+// Grant an exclusive write lock which is never enforced
+func (s *Server) LockDavResource(w http.ResponseWriter, r *http.Request) {
+	p := requestPath(r)
+	depth := r.Header.Get(DEPTH)
+	if depth == "" {
+		depth = DAV_INFINITE_DEPTH
+	}
+	token := fmt.Sprintf("opaquelocktoken:%s-%x", s.config.Node.Name, time.Now().UnixNano())
+	data, err := xml.Marshal(&davLockDiscovery{
+		Namespace: DAV_NAMESPACE,
+		Depth:     depth,
+		Timeout:   DAV_LOCK_TIMEOUT,
+		LockToken: token,
+		LockRoot:  storagePathToDavHref(p, false),
+	})
+	if err != nil {
+		returnError(err, w)
+		return
+	}
+	w.Header().Set(LOCK_TOKEN, "<"+token+">")
+	w.Header().Set(CONTENT_TYPE, DAV_XML_MIME_TYPE)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+// Check that the parent directory of a resource exists, fetching it from the node responsible for it if needed
+func (s *Server) davParentExists(p string) bool {
+	directory := path.Dir(path.Clean(p))
+	if _, err := s.storage.GetDirectory(directory); err == nil {
+		return true
+	}
+	return s.tryRecoverMissingDirectory(directory)
+}
+
+// Remove a file, or a directory after its content
+// Regular files written by other nodes are removed by them, so it must be called without file worker
+func (s *Server) removeDavTree(p string, fi os.FileInfo) error {
+	var err error
+	if fi.IsDir() {
+		var files []os.FileInfo
+		s.runWithWorker(func() { files, err = s.storage.ReadDir(p) })
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if err := s.removeDavTree(path.Join(p, f.Name()), f); err != nil {
+				return err
+			}
+		}
+		return s.removeDavCollection(p)
+	}
+	// The path is only locked while this node removes its version, as the other nodes may be removing it too and wait for this one
+	if local, err := s.removeOtherVersions(p, []string{s.config.Node.Name}); err != nil || !local {
+		return err
+	}
+	s.runWithWorker(func() {
+		lock := s.pathLock(p)
+		lock.Lock()
+		defer lock.Unlock()
+		if s.hasLocalVersion(p) {
+			err = s.storage.RemoveFile(p)
+		}
+	})
+	return err
+}
+
+// Remove a collection whose content has been removed
+// Files removed by other nodes are still listed until their removal is visible in their indexes, so it is waited for
+func (s *Server) removeDavCollection(p string) error {
+	deadline := time.Now().Add(REMOTE_REMOVAL_TIMEOUT)
+	for {
+		var err error
+		var remaining []os.FileInfo
+		s.runWithWorker(func() {
+			if err = s.storage.RemoveFile(p); IsNotEmptyError(err) {
+				remaining, _ = s.storage.ReadDir(p)
+			}
+		})
+		if !IsNotEmptyError(err) || !s.ownedByOtherNodes(remaining) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(REMOTE_REMOVAL_POLL_INTERVAL)
+	}
+}
+
+// Check that files are all regular files written by other nodes
+func (s *Server) ownedByOtherNodes(files []os.FileInfo) bool {
+	for _, fi := range files {
+		storageFileInfo, ok := fi.(*file.FileInfo)
+		if !ok || fi.IsDir() || storageFileInfo.Node() == s.config.Node.Name {
+			return false
+		}
+	}
+	return len(files) > 0
+}
+
+// Copy a regular file, or a directory with its content if recursive
+func (s *Server) copyDavTree(p string, target string, fi os.FileInfo, recursive bool) error {
+	if !fi.IsDir() {
+		_, err := s.storage.CopyFile(p, target)
+		return err
+	}
+	if _, err := s.storage.CreateDirectory(target, fi.Mode()); err != nil {
+		return err
+	}
+	if !recursive {
+		return nil
+	}
+	files, err := s.storage.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := s.copyDavTree(path.Join(p, f.Name()), path.Join(target, f.Name()), f, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fileInfoToDavResponse(p string, fi os.FileInfo) davResponse {
+	prop := davProp{
+		DisplayName:  fi.Name(),
+		LastModified: fi.ModTime().UTC().Format(http.TimeFormat),
+		ContentType:  fileInfoToMimeType(fi),
+		ETag:         fileInfoETag(fi),
+	}
+	if fi.IsDir() {
+		prop.ResourceType.Collection = &struct{}{}
+	} else {
+		size := fi.Size()
+		prop.ContentLength = &size
+	}
+	return davResponse{
+		Href:     storagePathToDavHref(p, fi.IsDir()),
+		Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"},
+	}
+}
+
+// Escaped url path of a file under the WebDAV prefix, collections ending with a slash
+func storagePathToDavHref(p string, collection bool) string {
+	p = path.Clean("/" + p)
+	if collection && p != "/" {
+		p += "/"
+	}
+	return DAV_PREFIX + (&url.URL{Path: p}).EscapedPath()
+}
@@ -11,11 +11,17 @@ import (
 	. "github.com/t-mind/flocons/cluster"
 	. "github.com/t-mind/flocons/config"
 	. "github.com/t-mind/flocons/http"
+	"github.com/t-mind/flocons/p9"
+	"github.com/t-mind/flocons/rpc"
 	. "github.com/t-mind/flocons/storage"
 )
 
 func main() {
 	log.SetLevel(log.DebugLevel)
+	if len(os.Args) > 1 && os.Args[1] == "mount" {
+		mount(os.Args[2:])
+		return
+	}
 	var configFile string
 	flag.StringVar(&configFile, "config", "", "Configuration file")
 
@@ -31,13 +37,35 @@ func main() {
 		logger.Fatal(err)
 	}
 
-	server, _ := NewServer(config, storage, NewSingleTopologyNodeClient(config))
+	storage.StartTiering()
+
+	topologyClient := NewSingleTopologyNodeClient(config)
+	server, _ := NewServer(config, storage, topologyClient)
 	if err != nil {
 		logger.Fatal(err)
 	}
+	var p9Server *p9.Server
+	if config.Node.P9Port != 0 {
+		if p9Server, err = p9.NewServer(config, storage, topologyClient); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	var rpcServer *rpc.Server
+	if config.Node.GrpcPort != 0 {
+		if rpcServer, err = rpc.NewServer(config, storage, topologyClient); err != nil {
+			logger.Fatal(err)
+		}
+	}
 	waitForInterruption()
 	logger.Info("Received interruption")
 	server.Close()
+	if p9Server != nil {
+		p9Server.Close()
+	}
+	if rpcServer != nil {
+		rpcServer.Close()
+	}
+	storage.StopTiering()
 }
 
 func waitForInterruption() {
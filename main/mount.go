@@ -0,0 +1,61 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/t-mind/flocons/cluster"
+	. "github.com/t-mind/flocons/config"
+	"github.com/t-mind/flocons/fuse"
+	. "github.com/t-mind/flocons/http"
+)
+
+// Mount the files of a cluster on a directory until interruption
+// Usage: flocons mount [-host <url>] [-config <file>] [-timeout <duration>] <mountpoint>
+func mount(args []string) {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	var host, configFile string
+	var timeout time.Duration
+	flags.StringVar(&host, "host", fmt.Sprintf("http://localhost:%d", DEFAULT_PORT), "Address of a node")
+	flags.StringVar(&configFile, "config", "", "Configuration file giving the zookeeper servers, to send requests to the nodes responsible for files")
+	flags.DurationVar(&timeout, "timeout", fuse.DEFAULT_METADATA_TIMEOUT, "Time during which attributes and directory entries are cached")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: flocons mount [-host <url>] [-config <file>] [-timeout <duration>] <mountpoint>")
+		os.Exit(2)
+	}
+
+	var topologyClient TopologyClient
+	if configFile != "" {
+		config, err := NewConfigFromFile(configFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		dispatcher, err := NewMaglevDispatcher()
+		if err != nil {
+			logger.Fatal(err)
+		}
+		topologyClient = NewTopologyClient(config, dispatcher)
+		defer topologyClient.Close()
+	}
+	router, err := NewRouter(host, topologyClient)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer router.Close()
+
+	mountPoint, err := fuse.NewFileSystem(router, timeout).Mount(flags.Arg(0))
+	if err != nil {
+		logger.Fatal(err)
+	}
+	waitForInterruption()
+	logger.Info("Received interruption")
+	if err := mountPoint.Unmount(); err != nil {
+		logger.Errorf("Could not unmount %s: %s", flags.Arg(0), err)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+// FUSE mounts are only available on Linux and macOS
+func mount(args []string) {
+	logger.Fatal("Mounting with FUSE is not supported on this platform")
+}
@@ -0,0 +1,363 @@
+package p9
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	. "github.com/t-mind/flocons/error"
+)
+
+// Client of a 9P2000.L server, sending its requests one after the other
+type Client struct {
+	conn    net.Conn
+	msize   uint32
+	mutex   *sync.Mutex
+	nextFid uint32
+}
+
+// File of the server designated by a fid of the client
+type File struct {
+	client *Client
+	fid    uint32
+	Qid    Qid
+	IOUnit uint32 // maximum size of data read or written in one message, once opened
+}
+
+func Dial(address string) (*Client, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Create a client on a connection, negotiating the version of the protocol
+func NewClient(conn net.Conn) (*Client, error) {
+	c := &Client{conn: conn, msize: MAX_MESSAGE_SIZE, mutex: &sync.Mutex{}}
+	e := &encoder{}
+	e.u32(MAX_MESSAGE_SIZE)
+	e.str(VERSION)
+	d, err := c.rpcWithTag(TVERSION, NO_TAG, e)
+	if err != nil {
+		return nil, err
+	}
+	msize, version := d.u32(), d.str()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if version != VERSION {
+		return nil, NewInternalError("9P server does not support " + VERSION)
+	}
+	c.msize = msize
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Attach to the root of the namespace or to one of its directories
+func (c *Client) Attach(aname string) (*File, error) {
+	f := c.newFile()
+	e := &encoder{}
+	e.u32(f.fid)
+	e.u32(NO_FID)
+	e.str("")
+	e.str(aname)
+	e.u32(NO_UID)
+	d, err := c.rpc(TATTACH, e)
+	if err != nil {
+		return nil, err
+	}
+	f.Qid = d.qid()
+	return f, d.err
+}
+
+func (c *Client) newFile() *File {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.nextFid++
+	return &File{client: c, fid: c.nextFid}
+}
+
+func (c *Client) rpc(messageType uint8, e *encoder) (*decoder, error) {
+	return c.rpcWithTag(messageType, 0, e)
+}
+
+// Send a request and wait for its response, errors of the server being returned as an Errno
+func (c *Client) rpcWithTag(messageType uint8, tag uint16, e *encoder) (*decoder, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := writeMessage(c.conn, messageType, tag, e.buffer); err != nil {
+		return nil, err
+	}
+	responseType, _, body, err := readMessage(c.conn, c.msize)
+	if err != nil {
+		return nil, err
+	}
+	d := &decoder{buffer: body}
+	if responseType == RLERROR {
+		return nil, Errno(d.u32())
+	}
+	if responseType != messageType+1 {
+		return nil, EPROTO
+	}
+	return d, nil
+}
+
+// Walk to a descendant of the file, or clone it when no names are given
+func (f *File) Walk(names ...string) (*File, error) {
+	if len(names) > MAX_WALK_ELEMENTS {
+		return nil, EINVAL
+	}
+	walked := f.client.newFile()
+	e := &encoder{}
+	e.u32(f.fid)
+	e.u32(walked.fid)
+	e.u16(uint16(len(names)))
+	for _, name := range names {
+		e.str(name)
+	}
+	d, err := f.client.rpc(TWALK, e)
+	if err != nil {
+		return nil, err
+	}
+	qids := make([]Qid, d.u16())
+	for i := range qids {
+		qids[i] = d.qid()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(qids) < len(names) {
+		return nil, ENOENT
+	}
+	walked.Qid = f.Qid
+	if len(qids) > 0 {
+		walked.Qid = qids[len(qids)-1]
+	}
+	return walked, nil
+}
+
+func (f *File) Open(flags uint32) error {
+	e := &encoder{}
+	e.u32(f.fid)
+	e.u32(flags)
+	d, err := f.client.rpc(TLOPEN, e)
+	if err != nil {
+		return err
+	}
+	f.Qid, f.IOUnit = d.qid(), d.u32()
+	return d.err
+}
+
+// Create and open a regular file in the directory, which the file then designates as in the protocol
+func (f *File) Create(name string, flags uint32, mode uint32) error {
+	e := &encoder{}
+	e.u32(f.fid)
+	e.str(name)
+	e.u32(flags)
+	e.u32(mode)
+	e.u32(0)
+	d, err := f.client.rpc(TLCREATE, e)
+	if err != nil {
+		return err
+	}
+	f.Qid, f.IOUnit = d.qid(), d.u32()
+	return d.err
+}
+
+func (f *File) Mkdir(name string, mode uint32) (Qid, error) {
+	e := &encoder{}
+	e.u32(f.fid)
+	e.str(name)
+	e.u32(mode)
+	e.u32(0)
+	d, err := f.client.rpc(TMKDIR, e)
+	if err != nil {
+		return Qid{}, err
+	}
+	return d.qid(), d.err
+}
+
+func (f *File) ReadAt(p []byte, offset int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		e := &encoder{}
+		e.u32(f.fid)
+		e.u64(uint64(offset) + uint64(read))
+		e.u32(f.chunkSize(len(p) - read))
+		d, err := f.client.rpc(TREAD, e)
+		if err != nil {
+			return read, err
+		}
+		data := d.bytes()
+		if d.err != nil {
+			return read, d.err
+		}
+		if len(data) == 0 {
+			return read, io.EOF
+		}
+		read += copy(p[read:], data)
+	}
+	return read, nil
+}
+
+func (f *File) WriteAt(p []byte, offset int64) (int, error) {
+	written := 0
+	for written < len(p) {
+		e := &encoder{}
+		e.u32(f.fid)
+		e.u64(uint64(offset) + uint64(written))
+		e.bytes(p[written : written+int(f.chunkSize(len(p)-written))])
+		d, err := f.client.rpc(TWRITE, e)
+		if err != nil {
+			return written, err
+		}
+		count := d.u32()
+		if d.err != nil {
+			return written, d.err
+		}
+		if count == 0 {
+			return written, io.ErrShortWrite
+		}
+		written += int(count)
+	}
+	return written, nil
+}
+
+// Read all the entries of an opened directory
+func (f *File) ReadDir() ([]Dirent, error) {
+	var entries []Dirent
+	offset := uint64(0)
+	for {
+		e := &encoder{}
+		e.u32(f.fid)
+		e.u64(offset)
+		e.u32(f.chunkSize(int(f.client.msize)))
+		d, err := f.client.rpc(TREADDIR, e)
+		if err != nil {
+			return entries, err
+		}
+		data := &decoder{buffer: d.bytes()}
+		if d.err != nil {
+			return entries, d.err
+		}
+		if len(data.buffer) == 0 {
+			return entries, nil
+		}
+		for len(data.buffer) > 0 {
+			entry := data.dirent()
+			if data.err != nil {
+				return entries, data.err
+			}
+			entries = append(entries, entry)
+			offset = entry.Offset
+		}
+	}
+}
+
+func (f *File) GetAttr() (*Attr, error) {
+	e := &encoder{}
+	e.u32(f.fid)
+	e.u64(GETATTR_BASIC)
+	d, err := f.client.rpc(TGETATTR, e)
+	if err != nil {
+		return nil, err
+	}
+	attr := &Attr{
+		Valid:       d.u64(),
+		Qid:         d.qid(),
+		Mode:        d.u32(),
+		Uid:         d.u32(),
+		Gid:         d.u32(),
+		Nlink:       d.u64(),
+		Rdev:        d.u64(),
+		Size:        d.u64(),
+		Blksize:     d.u64(),
+		Blocks:      d.u64(),
+		Atime:       d.time(),
+		Mtime:       d.time(),
+		Ctime:       d.time(),
+		Btime:       d.time(),
+		Gen:         d.u64(),
+		DataVersion: d.u64(),
+	}
+	return attr, d.err
+}
+
+func (f *File) SetAttr(attr SetAttr) error {
+	e := &encoder{}
+	e.u32(f.fid)
+	e.u32(attr.Valid)
+	e.u32(attr.Mode)
+	e.u32(attr.Uid)
+	e.u32(attr.Gid)
+	e.u64(attr.Size)
+	e.time(attr.Atime)
+	e.time(attr.Mtime)
+	_, err := f.client.rpc(TSETATTR, e)
+	return err
+}
+
+// Rename an entry of the directory to an entry of another one
+func (f *File) RenameAt(oldName string, newDirectory *File, newName string) error {
+	e := &encoder{}
+	e.u32(f.fid)
+	e.str(oldName)
+	e.u32(newDirectory.fid)
+	e.str(newName)
+	_, err := f.client.rpc(TRENAMEAT, e)
+	return err
+}
+
+// Remove an entry of the directory, AT_REMOVEDIR being given for directories
+func (f *File) UnlinkAt(name string, flags uint32) error {
+	e := &encoder{}
+	e.u32(f.fid)
+	e.str(name)
+	e.u32(flags)
+	_, err := f.client.rpc(TUNLINKAT, e)
+	return err
+}
+
+// Remove the file, its fid being released
+func (f *File) Remove() error {
+	e := &encoder{}
+	e.u32(f.fid)
+	_, err := f.client.rpc(TREMOVE, e)
+	return err
+}
+
+func (f *File) Sync() error {
+	e := &encoder{}
+	e.u32(f.fid)
+	e.u32(0)
+	_, err := f.client.rpc(TFSYNC, e)
+	return err
+}
+
+// Release the fid of the file, which stores what was written in it
+func (f *File) Close() error {
+	e := &encoder{}
+	e.u32(f.fid)
+	_, err := f.client.rpc(TCLUNK, e)
+	return err
+}
+
+func (f *File) chunkSize(size int) uint32 {
+	maxSize := f.IOUnit
+	if maxSize == 0 {
+		maxSize = f.client.msize - IO_HEADER_SIZE
+	}
+	if uint32(size) > maxSize {
+		return maxSize
+	}
+	return uint32(size)
+}
@@ -0,0 +1,88 @@
+package p9
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	. "github.com/t-mind/flocons/error"
+)
+
+// Error number sent in Rlerror, with Linux values whatever the system of the server
+type Errno uint32
+
+const (
+	EPERM        Errno = 1
+	ENOENT       Errno = 2
+	EIO          Errno = 5
+	EBADF        Errno = 9
+	EAGAIN       Errno = 11
+	EACCES       Errno = 13
+	EEXIST       Errno = 17
+	ENOTDIR      Errno = 20
+	EISDIR       Errno = 21
+	EINVAL       Errno = 22
+	EFBIG        Errno = 27
+	ENAMETOOLONG Errno = 36
+	ENOSYS       Errno = 38
+	ENOTEMPTY    Errno = 39
+	EPROTO       Errno = 71
+	EOPNOTSUPP   Errno = 95
+)
+
+var errnoNames = map[Errno]string{
+	EPERM:        "operation not permitted",
+	ENOENT:       "no such file or directory",
+	EIO:          "input/output error",
+	EBADF:        "bad file descriptor",
+	EAGAIN:       "resource temporarily unavailable",
+	EACCES:       "permission denied",
+	EEXIST:       "file exists",
+	ENOTDIR:      "not a directory",
+	EISDIR:       "is a directory",
+	EINVAL:       "invalid argument",
+	EFBIG:        "file too large",
+	ENAMETOOLONG: "file name too long",
+	ENOSYS:       "function not implemented",
+	ENOTEMPTY:    "directory not empty",
+	EPROTO:       "protocol error",
+	EOPNOTSUPP:   "operation not supported",
+}
+
+func (e Errno) Error() string {
+	if name, ok := errnoNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("errno %d", uint32(e))
+}
+
+// Convert an error of the storage or of another node to the errno returned to the client
+// Errors which have no better match, like network failures, are I/O errors
+func toErrno(err error) Errno {
+	if errno, ok := err.(Errno); ok {
+		return errno
+	}
+	switch {
+	case os.IsNotExist(err) || IsHttpError(err, http.StatusNotFound):
+		return ENOENT
+	case os.IsPermission(err) || IsHttpError(err, http.StatusForbidden):
+		return EACCES
+	case IsNotEmptyError(err):
+		return ENOTEMPTY
+	case IsIsDirError(err):
+		return EISDIR
+	case IsIsNotDirError(err):
+		return ENOTDIR
+	case os.IsExist(err) || IsHttpError(err, http.StatusConflict) || IsHttpError(err, http.StatusPreconditionFailed):
+		return EEXIST
+	case IsInvalidPathError(err) || IsHttpError(err, http.StatusBadRequest):
+		return EINVAL
+	case IsHttpError(err, http.StatusRequestEntityTooLarge):
+		return EFBIG
+	case IsHttpError(err, http.StatusServiceUnavailable) || IsHttpError(err, http.StatusGatewayTimeout):
+		return EAGAIN
+	default:
+		logger.Warnf("Request failed: %s", err)
+		return EIO
+	}
+}
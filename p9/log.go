@@ -0,0 +1,9 @@
+package p9
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+var logger *log.Entry = log.WithFields(log.Fields{
+	"package": "p9",
+})
@@ -0,0 +1,307 @@
+package p9
+
+import (
+	"encoding/binary"
+	"io"
+
+	. "github.com/t-mind/flocons/error"
+)
+
+const VERSION string = "9P2000.L"
+const UNKNOWN_VERSION string = "unknown"
+
+// Size of the messages negotiated when the client asks for more
+const MAX_MESSAGE_SIZE uint32 = 1 << 20
+
+// Size of the header of read and write messages, which is not available for their data
+const IO_HEADER_SIZE uint32 = 24
+
+// Maximum number of names walked in one message
+const MAX_WALK_ELEMENTS int = 16
+
+const NO_TAG uint16 = 0xFFFF
+const NO_FID uint32 = 0xFFFFFFFF
+const NO_UID uint32 = 0xFFFFFFFF
+
+// Types of messages, each response being the type of its request plus one
+const (
+	RLERROR      uint8 = 7
+	TSTATFS      uint8 = 8
+	TLOPEN       uint8 = 12
+	TLCREATE     uint8 = 14
+	TSYMLINK     uint8 = 16
+	TMKNOD       uint8 = 18
+	TRENAME      uint8 = 20
+	TREADLINK    uint8 = 22
+	TGETATTR     uint8 = 24
+	TSETATTR     uint8 = 26
+	TXATTRWALK   uint8 = 30
+	TXATTRCREATE uint8 = 32
+	TREADDIR     uint8 = 40
+	TFSYNC       uint8 = 50
+	TLOCK        uint8 = 52
+	TGETLOCK     uint8 = 54
+	TLINK        uint8 = 70
+	TMKDIR       uint8 = 72
+	TRENAMEAT    uint8 = 74
+	TUNLINKAT    uint8 = 76
+	TVERSION     uint8 = 100
+	TAUTH        uint8 = 102
+	TATTACH      uint8 = 104
+	TFLUSH       uint8 = 108
+	TWALK        uint8 = 110
+	TREAD        uint8 = 116
+	TWRITE       uint8 = 118
+	TCLUNK       uint8 = 120
+	TREMOVE      uint8 = 122
+)
+
+// Types of qids
+const (
+	QID_DIRECTORY uint8 = 0x80
+	QID_FILE      uint8 = 0x00
+)
+
+// Flags of lopen and lcreate, with their Linux values
+const (
+	O_RDONLY  uint32 = 0x0
+	O_WRONLY  uint32 = 0x1
+	O_RDWR    uint32 = 0x2
+	O_ACCMODE uint32 = 0x3
+	O_CREAT   uint32 = 0x40
+	O_EXCL    uint32 = 0x80
+	O_TRUNC   uint32 = 0x200
+	O_APPEND  uint32 = 0x400
+)
+
+// File types of modes in attributes
+const (
+	S_IFMT  uint32 = 0170000
+	S_IFDIR uint32 = 0040000
+	S_IFREG uint32 = 0100000
+)
+
+// Types of directory entries
+const (
+	DT_DIR uint8 = 4
+	DT_REG uint8 = 8
+)
+
+// Flag of unlinkat to remove directories
+const AT_REMOVEDIR uint32 = 0x200
+
+// Attributes asked by getattr and given back when available
+const (
+	GETATTR_MODE   uint64 = 0x1
+	GETATTR_NLINK  uint64 = 0x2
+	GETATTR_UID    uint64 = 0x4
+	GETATTR_GID    uint64 = 0x8
+	GETATTR_RDEV   uint64 = 0x10
+	GETATTR_ATIME  uint64 = 0x20
+	GETATTR_MTIME  uint64 = 0x40
+	GETATTR_CTIME  uint64 = 0x80
+	GETATTR_INO    uint64 = 0x100
+	GETATTR_SIZE   uint64 = 0x200
+	GETATTR_BLOCKS uint64 = 0x400
+	GETATTR_BASIC  uint64 = 0x7ff
+)
+
+// Attributes changed by setattr
+const (
+	SETATTR_MODE      uint32 = 0x1
+	SETATTR_UID       uint32 = 0x2
+	SETATTR_GID       uint32 = 0x4
+	SETATTR_SIZE      uint32 = 0x8
+	SETATTR_ATIME     uint32 = 0x10
+	SETATTR_MTIME     uint32 = 0x20
+	SETATTR_CTIME     uint32 = 0x40
+	SETATTR_ATIME_SET uint32 = 0x80
+	SETATTR_MTIME_SET uint32 = 0x100
+)
+
+// Magic number of the file system given by statfs, the one of v9fs
+const V9FS_MAGIC uint32 = 0x01021997
+
+// Unique identifier of a file on the server
+type Qid struct {
+	Type    uint8
+	Version uint32
+	Path    uint64
+}
+
+// Attributes of a file, as given by getattr
+type Attr struct {
+	Valid       uint64
+	Qid         Qid
+	Mode        uint32
+	Uid         uint32
+	Gid         uint32
+	Nlink       uint64
+	Rdev        uint64
+	Size        uint64
+	Blksize     uint64
+	Blocks      uint64
+	Atime       Time
+	Mtime       Time
+	Ctime       Time
+	Btime       Time
+	Gen         uint64
+	DataVersion uint64
+}
+
+// Changes of the attributes of a file, only the ones in Valid being applied
+type SetAttr struct {
+	Valid uint32
+	Mode  uint32
+	Uid   uint32
+	Gid   uint32
+	Size  uint64
+	Atime Time
+	Mtime Time
+}
+
+type Time struct {
+	Sec  uint64
+	Nsec uint64
+}
+
+// Entry of a directory, its offset being the one to read the next entries from
+type Dirent struct {
+	Qid    Qid
+	Offset uint64
+	Type   uint8
+	Name   string
+}
+
+// Encodes the fields of a message in little endian, strings being preceded by their size
+type encoder struct {
+	buffer []byte
+}
+
+func (e *encoder) u8(v uint8) {
+	e.buffer = append(e.buffer, v)
+}
+
+func (e *encoder) u16(v uint16) {
+	e.buffer = append(e.buffer, byte(v), byte(v>>8))
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buffer = append(e.buffer, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (e *encoder) u64(v uint64) {
+	e.u32(uint32(v))
+	e.u32(uint32(v >> 32))
+}
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.buffer = append(e.buffer, s...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.u32(uint32(len(b)))
+	e.buffer = append(e.buffer, b...)
+}
+
+func (e *encoder) qid(q Qid) {
+	e.u8(q.Type)
+	e.u32(q.Version)
+	e.u64(q.Path)
+}
+
+func (e *encoder) time(t Time) {
+	e.u64(t.Sec)
+	e.u64(t.Nsec)
+}
+
+func (e *encoder) dirent(d Dirent) {
+	e.qid(d.Qid)
+	e.u64(d.Offset)
+	e.u8(d.Type)
+	e.str(d.Name)
+}
+
+// Decodes the fields of a message, the first missing field making all the following ones zero
+type decoder struct {
+	buffer []byte
+	err    error
+}
+
+func (d *decoder) next(size int) []byte {
+	if d.err != nil {
+		return make([]byte, size)
+	}
+	if len(d.buffer) < size {
+		d.err = NewInternalError("9P message is too short")
+		d.buffer = nil
+		return make([]byte, size)
+	}
+	b := d.buffer[:size]
+	d.buffer = d.buffer[size:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	return d.next(1)[0]
+}
+
+func (d *decoder) u16() uint16 {
+	return binary.LittleEndian.Uint16(d.next(2))
+}
+
+func (d *decoder) u32() uint32 {
+	return binary.LittleEndian.Uint32(d.next(4))
+}
+
+func (d *decoder) u64() uint64 {
+	return binary.LittleEndian.Uint64(d.next(8))
+}
+
+func (d *decoder) str() string {
+	return string(d.next(int(d.u16())))
+}
+
+func (d *decoder) bytes() []byte {
+	return d.next(int(d.u32()))
+}
+
+func (d *decoder) qid() Qid {
+	return Qid{Type: d.u8(), Version: d.u32(), Path: d.u64()}
+}
+
+func (d *decoder) time() Time {
+	return Time{Sec: d.u64(), Nsec: d.u64()}
+}
+
+func (d *decoder) dirent() Dirent {
+	return Dirent{Qid: d.qid(), Offset: d.u64(), Type: d.u8(), Name: d.str()}
+}
+
+// Read a message, made of its size, type, tag and body
+func readMessage(r io.Reader, maxSize uint32) (uint8, uint16, []byte, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, err
+	}
+	size := binary.LittleEndian.Uint32(header)
+	if size < 7 || size > maxSize {
+		return 0, 0, nil, NewInternalError("9P message has an invalid size")
+	}
+	body := make([]byte, size-7)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header[4], binary.LittleEndian.Uint16(header[5:]), body, nil
+}
+
+func writeMessage(w io.Writer, messageType uint8, tag uint16, body []byte) error {
+	e := encoder{buffer: make([]byte, 0, 7+len(body))}
+	e.u32(uint32(7 + len(body)))
+	e.u8(messageType)
+	e.u16(tag)
+	e.buffer = append(e.buffer, body...)
+	_, err := w.Write(e.buffer)
+	return err
+}
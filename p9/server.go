@@ -0,0 +1,1049 @@
+package p9
+
+import (
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/t-mind/flocons/cluster"
+	"github.com/t-mind/flocons/config"
+	. "github.com/t-mind/flocons/error"
+	"github.com/t-mind/flocons/file"
+	"github.com/t-mind/flocons/http"
+	"github.com/t-mind/flocons/storage"
+)
+
+const BLOCK_SIZE uint64 = 4096
+const MAX_NAME_LENGTH int = 255
+
+// Size of the reads copying the data of a file in the buffer of a fid writing it
+const COPY_CHUNK_SIZE uint32 = 1024 * 1024
+
+// Server of the namespace of a cluster with the 9P2000.L protocol
+// Operations on paths which another node is responsible for are sent to it with its http api
+// Requests of a connection are handled one after the other, in the order they are received
+type Server struct {
+	config         *config.Config
+	storage        storage.Storage
+	topologyClient cluster.TopologyClient
+	router         *http.Router
+	listener       net.Listener
+	connections    map[net.Conn]bool
+	mutex          *sync.Mutex
+}
+
+// Connection of a client, with the fids it has attached or walked to
+type connection struct {
+	server *Server
+	conn   net.Conn
+	msize  uint32
+	fids   map[uint32]*fid
+}
+
+// File designated by a fid
+// Regular files opened for writing are buffered in a temporary file, and stored when they are synced or clunked
+type fid struct {
+	root          string // path attached to, which can't be walked out of
+	path          string
+	uid           uint32
+	opened        bool
+	isDir         bool
+	flags         uint32
+	mode          os.FileMode
+	entries       []os.FileInfo // page of the listing of an opened directory
+	entriesOffset uint64        // offset of the first entry of the page
+	listed        bool          // whether the page is the last one of the listing
+	data          *os.File      // buffer of an opened regular file, nil until it is written or truncated
+	size          uint64        // size of the data in the buffer
+	dirty         bool
+}
+
+// Create a server listening on the 9P port of the node
+func NewServer(config *config.Config, storage storage.Storage, topologyClient cluster.TopologyClient) (*Server, error) {
+	if config.Node.P9Port == 0 {
+		return nil, NewInternalError("No 9P port configured")
+	}
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(config.Node.P9Port))
+	if err != nil {
+		return nil, err
+	}
+	return NewServerWithListener(config, storage, topologyClient, listener)
+}
+
+// Create a server accepting connections from a listener, which is closed with the server
+func NewServerWithListener(config *config.Config, storage storage.Storage, topologyClient cluster.TopologyClient, listener net.Listener) (*Server, error) {
+	if config == nil {
+		logger.Fatalf("Tried to create a new 9P server without config")
+	}
+	if storage == nil {
+		logger.Fatalf("Tried to create a new 9P server without storage")
+	}
+	if topologyClient == nil {
+		logger.Fatalf("Tried to create a new 9P server without topology client")
+	}
+	router, err := http.NewRouter(config.Node.ExternalAddress, topologyClient)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	server := &Server{
+		config:         config,
+		storage:        storage,
+		topologyClient: topologyClient,
+		router:         router,
+		listener:       listener,
+		connections:    make(map[net.Conn]bool),
+		mutex:          &sync.Mutex{},
+	}
+	go server.accept()
+	return server, nil
+}
+
+// Address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *Server) accept() {
+	logger.Infof("Listening for 9P connections on %s", s.listener.Addr())
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			logger.Debugf("Stop accepting 9P connections: %s", err)
+			return
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// Serve the requests of a connection until it is closed
+func (s *Server) ServeConn(conn net.Conn) {
+	s.mutex.Lock()
+	s.connections[conn] = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.connections, conn)
+		s.mutex.Unlock()
+	}()
+
+	c := &connection{
+		server: s,
+		conn:   conn,
+		msize:  MAX_MESSAGE_SIZE,
+		fids:   make(map[uint32]*fid),
+	}
+	c.serve()
+}
+
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn := range s.connections {
+		conn.Close()
+	}
+	s.router.Close()
+}
+
+// Client of the node responsible for a path, nil if it is this node or if there is none
+func (s *Server) remoteClient(p string) *http.Client {
+	node := s.topologyClient.GetNodeForObject(p)
+	if node == nil || node.Name == s.config.Node.Name {
+		return nil
+	}
+	return s.router.NodeClient(node)
+}
+
+func (s *Server) getFile(p string) (os.FileInfo, error) {
+	if client := s.remoteClient(p); client != nil {
+		return client.GetFile(p)
+	}
+	return s.storage.GetFile(p)
+}
+
+func (s *Server) getDirectory(p string) (os.FileInfo, error) {
+	if client := s.remoteClient(p); client != nil {
+		return client.GetDirectory(p)
+	}
+	return s.storage.GetDirectory(p)
+}
+
+func (s *Server) getRegularFile(p string) (os.FileInfo, error) {
+	if client := s.remoteClient(p); client != nil {
+		return client.GetRegularFile(p)
+	}
+	return s.storage.GetRegularFile(p)
+}
+
+func (s *Server) createDirectory(p string, mode os.FileMode) (os.FileInfo, error) {
+	if client := s.remoteClient(p); client != nil {
+		return client.CreateDirectory(p, mode)
+	}
+	return s.storage.CreateDirectory(p, mode)
+}
+
+func (s *Server) createRegularFile(p string, mode os.FileMode, data []byte) (os.FileInfo, error) {
+	if client := s.remoteClient(p); client != nil {
+		return client.CreateRegularFile(p, mode, data)
+	}
+	return s.storage.CreateRegularFile(p, mode, data)
+}
+
+func (s *Server) updateFile(p string, changes storage.FileChanges) (os.FileInfo, error) {
+	if client := s.remoteClient(p); client != nil {
+		return client.UpdateFile(p, changes)
+	}
+	return s.storage.UpdateFile(p, changes)
+}
+
+// Files are renamed by the node responsible for their current path
+func (s *Server) renameFile(p string, target string) (os.FileInfo, error) {
+	if client := s.remoteClient(p); client != nil {
+		return client.RenameFile(p, target)
+	}
+	return s.storage.RenameFile(p, target)
+}
+
+// Other nodes answer removals of directories which are not empty with a conflict
+func (s *Server) removeFile(p string) error {
+	if client := s.remoteClient(p); client != nil {
+		err := client.RemoveFile(p)
+		if IsHttpError(err, 409) {
+			return NewNotEmptyError(p)
+		}
+		return err
+	}
+	return s.storage.RemoveFile(p)
+}
+
+func (s *Server) readDirPage(p string, options storage.ReadDirOptions) ([]os.FileInfo, error) {
+	if client := s.remoteClient(p); client != nil {
+		entries, _, err := client.ReadDirPage(p, options)
+		return entries, err
+	}
+	return s.storage.ReadDirPage(p, options)
+}
+
+// Read count bytes of a regular file from offset, less if the file ends before
+func (s *Server) readAt(p string, offset int64, count uint32) ([]byte, error) {
+	if client := s.remoteClient(p); client != nil {
+		return client.ReadRange(p, offset, int64(count))
+	}
+	fi, err := s.storage.GetRegularFile(p)
+	if err != nil {
+		return nil, err
+	}
+	storageFileInfo, _ := fi.(*file.FileInfo)
+	section, release, err := storageFileInfo.OpenData()
+	if err != nil {
+		// We don't have the data, let's read it from the node which wrote it
+		node, found := s.topologyClient.Nodes()[storageFileInfo.Node()]
+		if !found || node.Name == s.config.Node.Name {
+			return nil, err
+		}
+		return s.router.NodeClient(node).ReadRange(p, offset, int64(count))
+	}
+	defer release()
+	data := make([]byte, count)
+	n, err := section.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+// Files written with 9P can't be bigger than the max file size of the configuration
+func (s *Server) maxFileSize() uint64 {
+	return uint64(s.config.Storage.MaxFileSizeInBytes)
+}
+
+func (c *connection) serve() {
+	defer c.close()
+	for {
+		messageType, tag, body, err := readMessage(c.conn, c.msize)
+		if err != nil {
+			if err != io.EOF {
+				logger.Debugf("Close 9P connection of %s: %s", c.conn.RemoteAddr(), err)
+			}
+			return
+		}
+		responseType, response := c.handle(messageType, body)
+		if err := writeMessage(c.conn, responseType, tag, response); err != nil {
+			logger.Debugf("Could not answer 9P request of %s: %s", c.conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// Files written by the client are stored when it disconnects, as if their fids were clunked
+func (c *connection) close() {
+	c.clunkAll()
+	c.conn.Close()
+}
+
+func (c *connection) clunkAll() {
+	for number, f := range c.fids {
+		if err := c.flush(f); err != nil {
+			logger.Errorf("Could not store file %s: %s", f.path, err)
+		}
+		c.release(f)
+		delete(c.fids, number)
+	}
+}
+
+func (c *connection) handle(messageType uint8, body []byte) (uint8, []byte) {
+	d := &decoder{buffer: body}
+	e := &encoder{}
+	var err error
+	switch messageType {
+	case TVERSION:
+		err = c.version(d, e)
+	case TATTACH:
+		err = c.attach(d, e)
+	case TWALK:
+		err = c.walk(d, e)
+	case TLOPEN:
+		err = c.open(d, e)
+	case TLCREATE:
+		err = c.create(d, e)
+	case TREAD:
+		err = c.read(d, e)
+	case TWRITE:
+		err = c.write(d, e)
+	case TREADDIR:
+		err = c.readDir(d, e)
+	case TGETATTR:
+		err = c.getAttr(d, e)
+	case TSETATTR:
+		err = c.setAttr(d, e)
+	case TMKDIR:
+		err = c.mkdir(d, e)
+	case TRENAME:
+		err = c.rename(d, e)
+	case TRENAMEAT:
+		err = c.renameAt(d, e)
+	case TUNLINKAT:
+		err = c.unlinkAt(d, e)
+	case TREMOVE:
+		err = c.remove(d, e)
+	case TFSYNC:
+		err = c.fsync(d, e)
+	case TCLUNK:
+		err = c.clunk(d, e)
+	case TSTATFS:
+		err = c.statfs(d, e)
+	case TFLUSH:
+		// Requests are answered in order, the one to flush has already been answered
+	default:
+		// Authentication, links, special files, extended attributes and locks are not supported
+		err = EOPNOTSUPP
+	}
+	if err != nil {
+		e = &encoder{}
+		e.u32(uint32(toErrno(err)))
+		return RLERROR, e.buffer
+	}
+	return messageType + 1, e.buffer
+}
+
+func (c *connection) version(d *decoder, e *encoder) error {
+	msize, version := d.u32(), d.str()
+	if d.err != nil {
+		return EPROTO
+	}
+	// A new session starts, fids of the previous one are not valid anymore
+	c.clunkAll()
+	if msize > MAX_MESSAGE_SIZE {
+		msize = MAX_MESSAGE_SIZE
+	}
+	if msize <= IO_HEADER_SIZE {
+		return EINVAL
+	}
+	c.msize = msize
+	e.u32(msize)
+	if version != VERSION && !strings.HasPrefix(version, VERSION+".") {
+		e.str(UNKNOWN_VERSION)
+	} else {
+		e.str(VERSION)
+	}
+	return nil
+}
+
+func (c *connection) attach(d *decoder, e *encoder) error {
+	number, _, _, aname, uid := d.u32(), d.u32(), d.str(), d.str(), d.u32()
+	if d.err != nil {
+		return EPROTO
+	}
+	if _, ok := c.fids[number]; ok {
+		return EBADF
+	}
+	root := path.Clean("/" + aname)
+	fi, err := c.server.getDirectory(root)
+	if err != nil {
+		return err
+	}
+	if uid == NO_UID {
+		uid = 0
+	}
+	c.fids[number] = &fid{root: root, path: root, uid: uid}
+	e.qid(fileQid(root, fi))
+	return nil
+}
+
+func (c *connection) walk(d *decoder, e *encoder) error {
+	number, newNumber, count := d.u32(), d.u32(), int(d.u16())
+	if d.err != nil {
+		return EPROTO
+	}
+	if count > MAX_WALK_ELEMENTS {
+		return EINVAL
+	}
+	names := make([]string, count)
+	for i := range names {
+		names[i] = d.str()
+	}
+	if d.err != nil {
+		return EPROTO
+	}
+	f, ok := c.fids[number]
+	if !ok {
+		return EBADF
+	}
+	if _, ok := c.fids[newNumber]; ok && newNumber != number {
+		return EBADF
+	}
+	p := f.path
+	qids := make([]Qid, 0, len(names))
+	for _, name := range names {
+		next, err := walkPath(f.root, p, name)
+		var fi os.FileInfo
+		if err == nil {
+			fi, err = c.server.getFile(next)
+		}
+		if err != nil {
+			// Only the failure of the first name is an error, otherwise the names walked are answered
+			if len(qids) == 0 {
+				return err
+			}
+			break
+		}
+		qids = append(qids, fileQid(next, fi))
+		p = next
+	}
+	if len(qids) == len(names) {
+		c.fids[newNumber] = &fid{root: f.root, path: p, uid: f.uid}
+	}
+	e.u16(uint16(len(qids)))
+	for _, qid := range qids {
+		e.qid(qid)
+	}
+	return nil
+}
+
+func (c *connection) open(d *decoder, e *encoder) error {
+	number, flags := d.u32(), d.u32()
+	if d.err != nil {
+		return EPROTO
+	}
+	f, ok := c.fids[number]
+	if !ok || f.opened {
+		return EBADF
+	}
+	fi, err := c.server.getFile(f.path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() && flags&O_ACCMODE != O_RDONLY {
+		return EISDIR
+	}
+	if !fi.IsDir() && isWritable(flags) && flags&O_TRUNC != 0 {
+		if err := c.createBuffer(f); err != nil {
+			return err
+		}
+		f.dirty = true
+	}
+	f.opened, f.isDir, f.flags, f.mode = true, fi.IsDir(), flags, fi.Mode()
+	e.qid(fileQid(f.path, fi))
+	e.u32(c.msize - IO_HEADER_SIZE)
+	return nil
+}
+
+func (c *connection) create(d *decoder, e *encoder) error {
+	number, name, flags, mode, _ := d.u32(), d.str(), d.u32(), d.u32(), d.u32()
+	if d.err != nil {
+		return EPROTO
+	}
+	f, ok := c.fids[number]
+	if !ok || f.opened {
+		return EBADF
+	}
+	p, err := childPath(f.path, name)
+	if err != nil {
+		return err
+	}
+	fi, err := c.server.getFile(p)
+	created := false
+	switch {
+	case err == nil && flags&O_EXCL != 0:
+		return EEXIST
+	case err == nil && fi.IsDir():
+		return EISDIR
+	case err != nil && !os.IsNotExist(err):
+		return err
+	case err != nil:
+		// The file is stored empty right away, so that it can be seen before being written
+		if fi, err = c.server.createRegularFile(p, os.FileMode(mode).Perm(), []byte{}); err != nil {
+			return err
+		}
+		created = true
+	}
+	f.path = p
+	if isWritable(flags) && (created || flags&O_TRUNC != 0) {
+		if err := c.createBuffer(f); err != nil {
+			return err
+		}
+		f.dirty = !created
+	}
+	f.opened, f.isDir, f.flags, f.mode = true, false, flags, fi.Mode()
+	e.qid(fileQid(p, fi))
+	e.u32(c.msize - IO_HEADER_SIZE)
+	return nil
+}
+
+func (c *connection) read(d *decoder, e *encoder) error {
+	number, offset, count := d.u32(), d.u64(), d.u32()
+	if d.err != nil {
+		return EPROTO
+	}
+	f, ok := c.fids[number]
+	if !ok || !f.opened || f.flags&O_ACCMODE == O_WRONLY {
+		return EBADF
+	}
+	if f.isDir {
+		return EISDIR
+	}
+	if count > c.msize-IO_HEADER_SIZE {
+		count = c.msize - IO_HEADER_SIZE
+	}
+	if f.data != nil {
+		if offset >= f.size {
+			e.bytes(nil)
+			return nil
+		}
+		if uint64(count) > f.size-offset {
+			count = uint32(f.size - offset)
+		}
+		data := make([]byte, count)
+		if _, err := f.data.ReadAt(data, int64(offset)); err != nil {
+			return err
+		}
+		e.bytes(data)
+		return nil
+	}
+	if offset > math.MaxInt64 {
+		e.bytes(nil)
+		return nil
+	}
+	data, err := c.server.readAt(f.path, int64(offset), count)
+	if err != nil {
+		return err
+	}
+	e.bytes(data)
+	return nil
+}
+
+func (c *connection) write(d *decoder, e *encoder) error {
+	number, offset, data := d.u32(), d.u64(), d.bytes()
+	if d.err != nil {
+		return EPROTO
+	}
+	f, ok := c.fids[number]
+	if !ok || !f.opened || !isWritable(f.flags) {
+		return EBADF
+	}
+	if f.data == nil {
+		if err := c.bufferData(f); err != nil {
+			return err
+		}
+	}
+	if f.flags&O_APPEND != 0 {
+		offset = f.size
+	}
+	// Offsets are checked before being added to the length of the data, so that the end can't wrap around
+	maxSize := c.server.maxFileSize()
+	if offset > maxSize || uint64(len(data)) > maxSize-offset {
+		return EFBIG
+	}
+	if _, err := f.data.WriteAt(data, int64(offset)); err != nil {
+		return err
+	}
+	if end := offset + uint64(len(data)); end > f.size {
+		f.size = end
+	}
+	f.dirty = true
+	e.u32(uint32(len(data)))
+	return nil
+}
+
+func (c *connection) readDir(d *decoder, e *encoder) error {
+	number, offset, count := d.u32(), d.u64(), d.u32()
+	if d.err != nil {
+		return EPROTO
+	}
+	f, ok := c.fids[number]
+	if !ok || !f.opened {
+		return EBADF
+	}
+	if !f.isDir {
+		return ENOTDIR
+	}
+	if count > c.msize-IO_HEADER_SIZE {
+		count = c.msize - IO_HEADER_SIZE
+	}
+	// Offsets of entries are their positions in the listing, which is read from the first one again when reading it from the start
+	entries := &encoder{}
+	for i := offset; ; i++ {
+		fi, err := c.dirEntry(f, i)
+		if err != nil {
+			return err
+		}
+		if fi == nil {
+			break
+		}
+		entry := &encoder{}
+		entry.dirent(Dirent{Qid: fileQid(path.Join(f.path, fi.Name()), fi), Offset: i + 1, Type: direntType(fi), Name: fi.Name()})
+		if len(entries.buffer)+len(entry.buffer) > int(count) {
+			break
+		}
+		entries.buffer = append(entries.buffer, entry.buffer...)
+	}
+	e.bytes(entries.buffer)
+	return nil
+}
+
+// Entry of an opened directory at an offset, nil after the last one
+// Only one page of the listing is kept, pages being read again from the first one to go back
+func (c *connection) dirEntry(f *fid, offset uint64) (os.FileInfo, error) {
+	if offset == 0 || offset < f.entriesOffset || (f.entries == nil && !f.listed) {
+		if err := c.readDirPage(f, 0, ""); err != nil {
+			return nil, err
+		}
+	}
+	for offset >= f.entriesOffset+uint64(len(f.entries)) {
+		if f.listed {
+			return nil, nil
+		}
+		last := f.entries[len(f.entries)-1]
+		if err := c.readDirPage(f, f.entriesOffset+uint64(len(f.entries)), storage.ListingCursor(last.Name(), last)); err != nil {
+			return nil, err
+		}
+	}
+	return f.entries[offset-f.entriesOffset], nil
+}
+
+// Read the page of the listing of a directory starting at an offset, after the cursor of the previous entry
+func (c *connection) readDirPage(f *fid, offset uint64, after string) error {
+	entries, err := c.server.readDirPage(f.path, storage.ReadDirOptions{Limit: storage.READ_DIR_BATCH_SIZE, After: after})
+	if err != nil {
+		return err
+	}
+	f.entries, f.entriesOffset, f.listed = entries, offset, len(entries) < storage.READ_DIR_BATCH_SIZE
+	return nil
+}
+
+func (c *connection) getAttr(d *decoder, e *encoder) error {
+	number, _ := d.u32(), d.u64()
+	if d.err != nil {
+		return EPROTO
+	}
+	f, ok := c.fids[number]
+	if !ok {
+		return EBADF
+	}
+	fi, err := c.server.getFile(f.path)
+	if err != nil {
+		return err
+	}
+	size := uint64(fi.Size())
+	if f.data != nil {
+		size = f.size
+	}
+	mode, nlink := S_IFREG, uint64(1)
+	if fi.IsDir() {
+		mode, nlink, size = S_IFDIR, 2, BLOCK_SIZE
+	}
+	modTime := Time{Sec: uint64(fi.ModTime().Unix()), Nsec: uint64(fi.ModTime().Nanosecond())}
+	e.u64(GETATTR_BASIC)
+	e.qid(fileQid(f.path, fi))
+	e.u32(mode | uint32(fi.Mode().Perm()))
+	e.u32(f.uid)
+	e.u32(f.uid)
+	e.u64(nlink)
+	e.u64(0)
+	e.u64(size)
+	e.u64(BLOCK_SIZE)
+	e.u64((size + 511) / 512)
+	e.time(modTime)
+	e.time(modTime)
+	e.time(modTime)
+	e.time(Time{})
+	e.u64(0)
+	e.u64(0)
+	return nil
+}
+
+// Mode, size and modification time can be changed, owners and other times are ignored
+func (c *connection) setAttr(d *decoder, e *encoder) error {
+	number, valid, mode, _, _, size, _, mtime := d.u32(), d.u32(), d.u32(), d.u32(), d.u32(), d.u64(), d.time(), d.time()
+	if d.err != nil {
+		return EPROTO
+	}
+	f, ok := c.fids[number]
+	if !ok {
+		return EBADF
+	}
+	fi, err := c.server.getFile(f.path)
+	if err != nil {
+		return err
+	}
+	if valid&SETATTR_SIZE != 0 {
+		if fi.IsDir() {
+			return EISDIR
+		}
+		if err := c.truncate(f, size); err != nil {
+			return err
+		}
+	}
+	changes := storage.FileChanges{}
+	if valid&SETATTR_MODE != 0 {
+		newMode := fi.Mode()&os.ModeType | os.FileMode(mode).Perm()
+		changes.Mode = &newMode
+	}
+	if valid&SETATTR_MTIME_SET != 0 {
+		modTime := time.Unix(int64(mtime.Sec), int64(mtime.Nsec))
+		changes.ModTime = &modTime
+	} else if valid&SETATTR_MTIME != 0 {
+		modTime := time.Now()
+		changes.ModTime = &modTime
+	}
+	if changes.Mode != nil || changes.ModTime != nil {
+		if _, err := c.server.updateFile(f.path, changes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *connection) mkdir(d *decoder, e *encoder) error {
+	number, name, mode, _ := d.u32(), d.str(), d.u32(), d.u32()
+	if d.err != nil {
+		return EPROTO
+	}
+	f, ok := c.fids[number]
+	if !ok {
+		return EBADF
+	}
+	p, err := childPath(f.path, name)
+	if err != nil {
+		return err
+	}
+	fi, err := c.server.createDirectory(p, os.ModeDir|os.FileMode(mode).Perm())
+	if err != nil {
+		return err
+	}
+	e.qid(fileQid(p, fi))
+	return nil
+}
+
+func (c *connection) rename(d *decoder, e *encoder) error {
+	number, directoryNumber, name := d.u32(), d.u32(), d.str()
+	if d.err != nil {
+		return EPROTO
+	}
+	f, ok := c.fids[number]
+	directory, directoryOk := c.fids[directoryNumber]
+	if !ok || !directoryOk {
+		return EBADF
+	}
+	target, err := childPath(directory.path, name)
+	if err != nil {
+		return err
+	}
+	return c.renameFile(f.path, target)
+}
+
+func (c *connection) renameAt(d *decoder, e *encoder) error {
+	oldNumber, oldName, newNumber, newName := d.u32(), d.str(), d.u32(), d.str()
+	if d.err != nil {
+		return EPROTO
+	}
+	oldDirectory, oldOk := c.fids[oldNumber]
+	newDirectory, newOk := c.fids[newNumber]
+	if !oldOk || !newOk {
+		return EBADF
+	}
+	p, err := childPath(oldDirectory.path, oldName)
+	if err != nil {
+		return err
+	}
+	target, err := childPath(newDirectory.path, newName)
+	if err != nil {
+		return err
+	}
+	return c.renameFile(p, target)
+}
+
+// Rename a file, fids of it and of its descendants following it
+func (c *connection) renameFile(p string, target string) error {
+	if p == "/" || strings.HasPrefix(target, p+"/") {
+		return EINVAL
+	}
+	if _, err := c.server.renameFile(p, target); err != nil {
+		return err
+	}
+	for _, f := range c.fids {
+		if f.path == p || strings.HasPrefix(f.path, p+"/") {
+			f.path = target + f.path[len(p):]
+		}
+	}
+	return nil
+}
+
+func (c *connection) unlinkAt(d *decoder, e *encoder) error {
+	number, name, flags := d.u32(), d.str(), d.u32()
+	if d.err != nil {
+		return EPROTO
+	}
+	directory, ok := c.fids[number]
+	if !ok {
+		return EBADF
+	}
+	p, err := childPath(directory.path, name)
+	if err != nil {
+		return err
+	}
+	fi, err := c.server.getFile(p)
+	if err != nil {
+		return err
+	}
+	if flags&AT_REMOVEDIR != 0 && !fi.IsDir() {
+		return ENOTDIR
+	}
+	if flags&AT_REMOVEDIR == 0 && fi.IsDir() {
+		return EISDIR
+	}
+	return c.server.removeFile(p)
+}
+
+// Remove the file of a fid, which is clunked even if the removal fails
+func (c *connection) remove(d *decoder, e *encoder) error {
+	number := d.u32()
+	if d.err != nil {
+		return EPROTO
+	}
+	f, ok := c.fids[number]
+	if !ok {
+		return EBADF
+	}
+	delete(c.fids, number)
+	c.release(f)
+	return c.server.removeFile(f.path)
+}
+
+func (c *connection) fsync(d *decoder, e *encoder) error {
+	f, ok := c.fids[d.u32()]
+	if d.err != nil {
+		return EPROTO
+	}
+	if !ok {
+		return EBADF
+	}
+	return c.flush(f)
+}
+
+func (c *connection) clunk(d *decoder, e *encoder) error {
+	number := d.u32()
+	if d.err != nil {
+		return EPROTO
+	}
+	f, ok := c.fids[number]
+	if !ok {
+		return EBADF
+	}
+	delete(c.fids, number)
+	defer c.release(f)
+	return c.flush(f)
+}
+
+// Sizes of the storage are not known, only the file system type and limits are given
+func (c *connection) statfs(d *decoder, e *encoder) error {
+	if _, ok := c.fids[d.u32()]; !ok || d.err != nil {
+		return EBADF
+	}
+	e.u32(V9FS_MAGIC)
+	e.u32(uint32(BLOCK_SIZE))
+	for i := 0; i < 6; i++ {
+		e.u64(0)
+	}
+	e.u32(uint32(MAX_NAME_LENGTH))
+	return nil
+}
+
+// Store the data written in a fid, with the current mode of the file if it still exists
+func (c *connection) flush(f *fid) error {
+	if !f.dirty {
+		return nil
+	}
+	mode := f.mode
+	if fi, err := c.server.getRegularFile(f.path); err == nil {
+		mode = fi.Mode()
+	}
+	data := make([]byte, f.size)
+	if _, err := f.data.ReadAt(data, 0); err != nil {
+		return err
+	}
+	if _, err := c.server.createRegularFile(f.path, mode.Perm(), data); err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+// Change the size of a file, in the buffer of the fid if it is being written or by storing it again otherwise
+func (c *connection) truncate(f *fid, size uint64) error {
+	if size > c.server.maxFileSize() {
+		return EFBIG
+	}
+	if f.data == nil {
+		fi, err := c.server.getRegularFile(f.path)
+		if err != nil {
+			return err
+		}
+		if uint64(fi.Size()) == size {
+			return nil
+		}
+		if err := c.bufferData(f); err != nil {
+			return err
+		}
+		if !f.opened || !isWritable(f.flags) {
+			defer c.release(f)
+		}
+	}
+	if err := f.data.Truncate(int64(size)); err != nil {
+		return err
+	}
+	f.size, f.dirty = size, true
+	if !f.opened || !isWritable(f.flags) {
+		return c.flush(f)
+	}
+	return nil
+}
+
+// Create an empty buffer for the data written in a fid
+func (c *connection) createBuffer(f *fid) error {
+	data, err := ioutil.TempFile("", "flocons-9p")
+	if err != nil {
+		return err
+	}
+	// The buffer is only known by its descriptor, so that it is removed even if the server stops
+	if err := os.Remove(data.Name()); err != nil {
+		data.Close()
+		return err
+	}
+	f.data, f.size = data, 0
+	return nil
+}
+
+// Copy the data of a regular file in the buffer of a fid, without reading it entirely in memory
+func (c *connection) bufferData(f *fid) error {
+	fi, err := c.server.getRegularFile(f.path)
+	if err != nil {
+		return err
+	}
+	if uint64(fi.Size()) > c.server.maxFileSize() {
+		return EFBIG
+	}
+	if err := c.createBuffer(f); err != nil {
+		return err
+	}
+	for offset := int64(0); offset < fi.Size(); {
+		data, err := c.server.readAt(f.path, offset, COPY_CHUNK_SIZE)
+		if err == nil && len(data) == 0 {
+			// The file has been truncated meanwhile
+			break
+		}
+		if err == nil {
+			_, err = f.data.WriteAt(data, offset)
+		}
+		if err != nil {
+			c.release(f)
+			return err
+		}
+		offset += int64(len(data))
+		f.size = uint64(offset)
+	}
+	return nil
+}
+
+// Drop the buffer of a fid, the data it has not stored being lost
+func (c *connection) release(f *fid) {
+	if f.data != nil {
+		f.data.Close()
+		f.data, f.size, f.dirty = nil, 0, false
+	}
+}
+
+func isWritable(flags uint32) bool {
+	return flags&O_ACCMODE == O_WRONLY || flags&O_ACCMODE == O_RDWR
+}
+
+// Path of a name walked from a directory, parents not going above the root attached to
+func walkPath(root string, p string, name string) (string, error) {
+	switch name {
+	case ".":
+		return p, nil
+	case "..":
+		if p == root {
+			return p, nil
+		}
+		return path.Dir(p), nil
+	}
+	return childPath(p, name)
+}
+
+// Path of a new entry of a directory
+func childPath(directory string, name string) (string, error) {
+	if len(name) > MAX_NAME_LENGTH {
+		return "", ENAMETOOLONG
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return "", EINVAL
+	}
+	return path.Join(directory, name), nil
+}
+
+// Qids of files are computed from their paths, and their versions from their modification times
+func fileQid(p string, fi os.FileInfo) Qid {
+	hash := fnv.New64a()
+	hash.Write([]byte(p))
+	if fi.IsDir() {
+		return Qid{Type: QID_DIRECTORY, Path: hash.Sum64()}
+	}
+	return Qid{Type: QID_FILE, Version: uint32(fi.ModTime().UnixNano()), Path: hash.Sum64()}
+}
+
+func direntType(fi os.FileInfo) uint8 {
+	if fi.IsDir() {
+		return DT_DIR
+	}
+	return DT_REG
+}
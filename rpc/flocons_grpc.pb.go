@@ -0,0 +1,420 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: flocons.proto
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Flocons_Stat_FullMethodName  = "/flocons.Flocons/Stat"
+	Flocons_Read_FullMethodName  = "/flocons.Flocons/Read"
+	Flocons_Write_FullMethodName = "/flocons.Flocons/Write"
+	Flocons_Mkdir_FullMethodName = "/flocons.Flocons/Mkdir"
+	Flocons_List_FullMethodName  = "/flocons.Flocons/List"
+	Flocons_Watch_FullMethodName = "/flocons.Flocons/Watch"
+)
+
+// FloconsClient is the client API for Flocons service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type FloconsClient interface {
+	// Get the information of a regular file or a directory
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileInfo, error)
+	// Read a regular file in chunks, the first one having the information of the file
+	Read(ctx context.Context, in *ReadRequest, opts ...grpc.CallOption) (Flocons_ReadClient, error)
+	// Create or replace a regular file, the first message giving its path and mode
+	Write(ctx context.Context, opts ...grpc.CallOption) (Flocons_WriteClient, error)
+	Mkdir(ctx context.Context, in *MkdirRequest, opts ...grpc.CallOption) (*FileInfo, error)
+	// List the entries of a directory, or all its descendants
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (Flocons_ListClient, error)
+	// Stream the changes in a directory of the node, until the call is cancelled
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Flocons_WatchClient, error)
+}
+
+type floconsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFloconsClient(cc grpc.ClientConnInterface) FloconsClient {
+	return &floconsClient{cc}
+}
+
+func (c *floconsClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileInfo, error) {
+	out := new(FileInfo)
+	err := c.cc.Invoke(ctx, Flocons_Stat_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *floconsClient) Read(ctx context.Context, in *ReadRequest, opts ...grpc.CallOption) (Flocons_ReadClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Flocons_ServiceDesc.Streams[0], Flocons_Read_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &floconsReadClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Flocons_ReadClient interface {
+	Recv() (*ReadResponse, error)
+	grpc.ClientStream
+}
+
+type floconsReadClient struct {
+	grpc.ClientStream
+}
+
+func (x *floconsReadClient) Recv() (*ReadResponse, error) {
+	m := new(ReadResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *floconsClient) Write(ctx context.Context, opts ...grpc.CallOption) (Flocons_WriteClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Flocons_ServiceDesc.Streams[1], Flocons_Write_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &floconsWriteClient{stream}
+	return x, nil
+}
+
+type Flocons_WriteClient interface {
+	Send(*WriteRequest) error
+	CloseAndRecv() (*FileInfo, error)
+	grpc.ClientStream
+}
+
+type floconsWriteClient struct {
+	grpc.ClientStream
+}
+
+func (x *floconsWriteClient) Send(m *WriteRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *floconsWriteClient) CloseAndRecv() (*FileInfo, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(FileInfo)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *floconsClient) Mkdir(ctx context.Context, in *MkdirRequest, opts ...grpc.CallOption) (*FileInfo, error) {
+	out := new(FileInfo)
+	err := c.cc.Invoke(ctx, Flocons_Mkdir_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *floconsClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (Flocons_ListClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Flocons_ServiceDesc.Streams[2], Flocons_List_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &floconsListClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Flocons_ListClient interface {
+	Recv() (*FileInfo, error)
+	grpc.ClientStream
+}
+
+type floconsListClient struct {
+	grpc.ClientStream
+}
+
+func (x *floconsListClient) Recv() (*FileInfo, error) {
+	m := new(FileInfo)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *floconsClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Flocons_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Flocons_ServiceDesc.Streams[3], Flocons_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &floconsWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Flocons_WatchClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type floconsWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *floconsWatchClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// FloconsServer is the server API for Flocons service.
+// All implementations must embed UnimplementedFloconsServer
+// for forward compatibility
+type FloconsServer interface {
+	// Get the information of a regular file or a directory
+	Stat(context.Context, *StatRequest) (*FileInfo, error)
+	// Read a regular file in chunks, the first one having the information of the file
+	Read(*ReadRequest, Flocons_ReadServer) error
+	// Create or replace a regular file, the first message giving its path and mode
+	Write(Flocons_WriteServer) error
+	Mkdir(context.Context, *MkdirRequest) (*FileInfo, error)
+	// List the entries of a directory, or all its descendants
+	List(*ListRequest, Flocons_ListServer) error
+	// Stream the changes in a directory of the node, until the call is cancelled
+	Watch(*WatchRequest, Flocons_WatchServer) error
+	mustEmbedUnimplementedFloconsServer()
+}
+
+// UnimplementedFloconsServer must be embedded to have forward compatible implementations.
+type UnimplementedFloconsServer struct {
+}
+
+func (UnimplementedFloconsServer) Stat(context.Context, *StatRequest) (*FileInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
+}
+func (UnimplementedFloconsServer) Read(*ReadRequest, Flocons_ReadServer) error {
+	return status.Errorf(codes.Unimplemented, "method Read not implemented")
+}
+func (UnimplementedFloconsServer) Write(Flocons_WriteServer) error {
+	return status.Errorf(codes.Unimplemented, "method Write not implemented")
+}
+func (UnimplementedFloconsServer) Mkdir(context.Context, *MkdirRequest) (*FileInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Mkdir not implemented")
+}
+func (UnimplementedFloconsServer) List(*ListRequest, Flocons_ListServer) error {
+	return status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedFloconsServer) Watch(*WatchRequest, Flocons_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedFloconsServer) mustEmbedUnimplementedFloconsServer() {}
+
+// UnsafeFloconsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FloconsServer will
+// result in compilation errors.
+type UnsafeFloconsServer interface {
+	mustEmbedUnimplementedFloconsServer()
+}
+
+func RegisterFloconsServer(s grpc.ServiceRegistrar, srv FloconsServer) {
+	s.RegisterService(&Flocons_ServiceDesc, srv)
+}
+
+func _Flocons_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FloconsServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Flocons_Stat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FloconsServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Flocons_Read_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReadRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FloconsServer).Read(m, &floconsReadServer{stream})
+}
+
+type Flocons_ReadServer interface {
+	Send(*ReadResponse) error
+	grpc.ServerStream
+}
+
+type floconsReadServer struct {
+	grpc.ServerStream
+}
+
+func (x *floconsReadServer) Send(m *ReadResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Flocons_Write_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FloconsServer).Write(&floconsWriteServer{stream})
+}
+
+type Flocons_WriteServer interface {
+	SendAndClose(*FileInfo) error
+	Recv() (*WriteRequest, error)
+	grpc.ServerStream
+}
+
+type floconsWriteServer struct {
+	grpc.ServerStream
+}
+
+func (x *floconsWriteServer) SendAndClose(m *FileInfo) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *floconsWriteServer) Recv() (*WriteRequest, error) {
+	m := new(WriteRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Flocons_Mkdir_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MkdirRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FloconsServer).Mkdir(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Flocons_Mkdir_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FloconsServer).Mkdir(ctx, req.(*MkdirRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Flocons_List_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FloconsServer).List(m, &floconsListServer{stream})
+}
+
+type Flocons_ListServer interface {
+	Send(*FileInfo) error
+	grpc.ServerStream
+}
+
+type floconsListServer struct {
+	grpc.ServerStream
+}
+
+func (x *floconsListServer) Send(m *FileInfo) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Flocons_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FloconsServer).Watch(m, &floconsWatchServer{stream})
+}
+
+type Flocons_WatchServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type floconsWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *floconsWatchServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Flocons_ServiceDesc is the grpc.ServiceDesc for Flocons service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Flocons_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "flocons.Flocons",
+	HandlerType: (*FloconsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Stat",
+			Handler:    _Flocons_Stat_Handler,
+		},
+		{
+			MethodName: "Mkdir",
+			Handler:    _Flocons_Mkdir_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Read",
+			Handler:       _Flocons_Read_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Write",
+			Handler:       _Flocons_Write_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "List",
+			Handler:       _Flocons_List_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _Flocons_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "flocons.proto",
+}
@@ -0,0 +1,9 @@
+package rpc
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+var logger *log.Entry = log.WithFields(log.Fields{
+	"package": "rpc",
+})
@@ -0,0 +1,433 @@
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative flocons.proto
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/t-mind/flocons/cluster"
+	"github.com/t-mind/flocons/config"
+	. "github.com/t-mind/flocons/error"
+	"github.com/t-mind/flocons/file"
+	"github.com/t-mind/flocons/http"
+	"github.com/t-mind/flocons/storage"
+)
+
+const DEFAULT_CHUNK_SIZE uint32 = 64 * 1024
+
+// Chunks stay well below the default maximum size of messages of 4MB
+const MAX_CHUNK_SIZE uint32 = 1024 * 1024
+
+const DEFAULT_FILE_MODE os.FileMode = 0644
+const DEFAULT_DIRECTORY_MODE os.FileMode = 0755
+
+// Maximum time a watch waits for events before waiting again
+const WATCH_TIMEOUT time.Duration = time.Minute
+
+// Server of the gRPC api, with the storage of the node
+// Operations on paths which another node is responsible for are sent to it with its http api
+type Server struct {
+	UnimplementedFloconsServer
+	config         *config.Config
+	storage        storage.Storage
+	topologyClient cluster.TopologyClient
+	router         *http.Router
+	grpcServer     *grpc.Server
+}
+
+var _ FloconsServer = (*Server)(nil)
+
+// Create a server listening on the gRPC port of the node
+func NewServer(config *config.Config, storage storage.Storage, topologyClient cluster.TopologyClient) (*Server, error) {
+	if config.Node.GrpcPort == 0 {
+		return nil, NewInternalError("No gRPC port configured")
+	}
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(config.Node.GrpcPort))
+	if err != nil {
+		return nil, err
+	}
+	return NewServerWithListener(config, storage, topologyClient, listener)
+}
+
+// Create a server accepting connections from a listener, which is closed with the server
+func NewServerWithListener(config *config.Config, storage storage.Storage, topologyClient cluster.TopologyClient, listener net.Listener) (*Server, error) {
+	if config == nil {
+		logger.Fatalf("Tried to create a new gRPC server without config")
+	}
+	if storage == nil {
+		logger.Fatalf("Tried to create a new gRPC server without storage")
+	}
+	if topologyClient == nil {
+		logger.Fatalf("Tried to create a new gRPC server without topology client")
+	}
+	router, err := http.NewRouter(config.Node.ExternalAddress, topologyClient)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	server := &Server{
+		config:         config,
+		storage:        storage,
+		topologyClient: topologyClient,
+		router:         router,
+		grpcServer:     grpc.NewServer(),
+	}
+	RegisterFloconsServer(server.grpcServer, server)
+	go func() {
+		logger.Infof("Listening for gRPC connections on %s", listener.Addr())
+		if err := server.grpcServer.Serve(listener); err != nil {
+			logger.Errorf("gRPC server stopped: %s", err)
+		}
+	}()
+	return server, nil
+}
+
+func (s *Server) Close() {
+	s.grpcServer.Stop()
+	s.router.Close()
+}
+
+func (s *Server) Stat(ctx context.Context, req *StatRequest) (*FileInfo, error) {
+	p := cleanPath(req.Path)
+	fi, err := s.stat(p)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toFileInfo(p, fi), nil
+}
+
+func (s *Server) Read(req *ReadRequest, stream Flocons_ReadServer) error {
+	if req.Offset < 0 || req.Length < 0 {
+		return invalidArgument("offset and length can't be negative")
+	}
+	p := cleanPath(req.Path)
+	if client := s.remoteClient(p); client != nil {
+		return toStatus(readFromNode(client, p, req, stream))
+	}
+	fi, err := s.storage.GetFile(p)
+	if err != nil {
+		return toStatus(err)
+	}
+	if fi.IsDir() {
+		return toStatus(NewIsDirError(p))
+	}
+	storageFileInfo, _ := fi.(*file.FileInfo)
+	section, release, err := storageFileInfo.OpenData()
+	if err != nil {
+		// We don't have the data, let's read it from the node which wrote it
+		node, found := s.topologyClient.Nodes()[storageFileInfo.Node()]
+		if !found || node.Name == s.config.Node.Name {
+			return toStatus(err)
+		}
+		return toStatus(readFromNode(s.router.NodeClient(node), p, req, stream))
+	}
+	defer release()
+	return toStatus(sendChunks(stream, toFileInfo(p, fi), req, section.ReadAt))
+}
+
+func (s *Server) Write(stream Flocons_WriteServer) error {
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return invalidArgument("no file to write")
+	}
+	if err != nil {
+		return err
+	}
+	if req.Path == "" {
+		return invalidArgument("path of the file to write is missing")
+	}
+	p := cleanPath(req.Path)
+	mode := os.FileMode(req.Mode).Perm()
+	if req.Mode == 0 {
+		mode = DEFAULT_FILE_MODE
+	}
+	createParents := req.CreateParents
+	// Files are stored in one piece, chunks are gathered before up to the max file size
+	maxSize := s.config.Storage.MaxFileSizeInBytes
+	if int64(len(req.Data)) > maxSize {
+		return fileTooLarge(p, maxSize)
+	}
+	data := append([]byte{}, req.Data...)
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if int64(len(req.Data)) > maxSize-int64(len(data)) {
+			return fileTooLarge(p, maxSize)
+		}
+		data = append(data, req.Data...)
+	}
+
+	if createParents {
+		if _, err := s.mkdirAll(path.Dir(p), os.ModeDir|DEFAULT_DIRECTORY_MODE); err != nil {
+			return toStatus(err)
+		}
+	}
+	var fi os.FileInfo
+	if client := s.remoteClient(p); client != nil {
+		fi, err = client.CreateRegularFile(p, mode, data)
+	} else {
+		fi, err = s.storage.CreateRegularFile(p, mode, data)
+	}
+	if err != nil {
+		return toStatus(err)
+	}
+	return stream.SendAndClose(toFileInfo(p, fi))
+}
+
+func (s *Server) Mkdir(ctx context.Context, req *MkdirRequest) (*FileInfo, error) {
+	p := cleanPath(req.Path)
+	mode := os.ModeDir | os.FileMode(req.Mode).Perm()
+	if req.Mode == 0 {
+		mode = os.ModeDir | DEFAULT_DIRECTORY_MODE
+	}
+	var fi os.FileInfo
+	var err error
+	if req.Parents {
+		fi, err = s.mkdirAll(p, mode)
+	} else {
+		fi, err = s.mkdir(p, mode)
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toFileInfo(p, fi), nil
+}
+
+func (s *Server) List(req *ListRequest, stream Flocons_ListServer) error {
+	p := cleanPath(req.Path)
+	client := s.remoteClient(p)
+	var err error
+	if req.Recursive {
+		options := storage.WalkOptions{MaxDepth: int(req.MaxDepth), After: req.After}
+		fn := func(rel string, fi os.FileInfo) error {
+			return stream.Send(toFileInfo(path.Join(p, rel), fi))
+		}
+		if client != nil {
+			err = client.WalkWithOptions(p, options, fn)
+		} else {
+			err = s.storage.WalkWithOptions(p, options, fn)
+		}
+		return toStatus(err)
+	}
+
+	// Types of files have the same values in the api and in the storage
+	options := storage.ReadDirOptions{
+		Limit:  int(req.Limit),
+		After:  req.After,
+		Prefix: req.Prefix,
+		Glob:   req.Glob,
+		Type:   storage.FileType(req.Type),
+	}
+	if err := options.Validate(); err != nil {
+		return invalidArgument(err.Error())
+	}
+	fn := func(fi os.FileInfo) error {
+		return stream.Send(toFileInfo(path.Join(p, fi.Name()), fi))
+	}
+	if client != nil {
+		err = listFromNode(client, p, options, fn)
+	} else {
+		err = s.storage.StreamDir(p, options, fn)
+	}
+	return toStatus(err)
+}
+
+// Events are the ones of this node, as with the http api
+func (s *Server) Watch(req *WatchRequest, stream Flocons_WatchServer) error {
+	p := cleanPath(req.Path)
+	ctx := stream.Context()
+	options := storage.WatchOptions{
+		After:     s.storage.LastEventSequence(),
+		Recursive: req.Recursive,
+		Timeout:   WATCH_TIMEOUT,
+		Cancel:    ctx.Done(),
+	}
+	if req.After != nil {
+		options.After = *req.After
+	}
+	for {
+		events, sequence, err := s.storage.Watch(p, options)
+		if err != nil {
+			return toStatus(err)
+		}
+		for _, event := range events {
+			if err := stream.Send(toEvent(event)); err != nil {
+				return err
+			}
+		}
+		options.After = sequence
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+func (s *Server) stat(p string) (os.FileInfo, error) {
+	if client := s.remoteClient(p); client != nil {
+		return client.GetFile(p)
+	}
+	return s.storage.GetFile(p)
+}
+
+func (s *Server) mkdir(p string, mode os.FileMode) (os.FileInfo, error) {
+	if client := s.remoteClient(p); client != nil {
+		return client.CreateDirectory(p, mode)
+	}
+	return s.storage.CreateDirectory(p, mode)
+}
+
+// Create a directory and its missing parents, each one on the node responsible for it
+func (s *Server) mkdirAll(p string, mode os.FileMode) (os.FileInfo, error) {
+	fi, err := s.stat(p)
+	if err == nil {
+		if !fi.IsDir() {
+			return nil, NewIsNotDirError(p)
+		}
+		return fi, nil
+	}
+	if !os.IsNotExist(err) && !IsHttpError(err, 404) {
+		return nil, err
+	}
+	if p != "/" {
+		if _, err := s.mkdirAll(path.Dir(p), mode); err != nil {
+			return nil, err
+		}
+	}
+	fi, err = s.mkdir(p, mode)
+	if err != nil && (os.IsExist(err) || IsHttpError(err, 409)) {
+		// Someone else created it in the meantime
+		return s.stat(p)
+	}
+	return fi, err
+}
+
+// Client of the node responsible for a path, nil if it is this node or if there is none
+func (s *Server) remoteClient(p string) *http.Client {
+	node := s.topologyClient.GetNodeForObject(p)
+	if node == nil || node.Name == s.config.Node.Name {
+		return nil
+	}
+	return s.router.NodeClient(node)
+}
+
+func readFromNode(client *http.Client, p string, req *ReadRequest, stream Flocons_ReadServer) error {
+	fi, err := client.GetFile(p)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return NewIsDirError(p)
+	}
+	// Chunks are read from the version of the first request, a file replaced meanwhile failing the read
+	conditions := http.Conditions{IfMatch: http.ETag(fi)}
+	return sendChunks(stream, toFileInfo(p, fi), req, func(data []byte, offset int64) (int, error) {
+		read, err := client.ReadRangeWithConditions(p, offset, int64(len(data)), conditions)
+		return copy(data, read), err
+	})
+}
+
+// Send the asked part of a file in chunks, the first one having the information of the file even if it has no data
+func sendChunks(stream Flocons_ReadServer, info *FileInfo, req *ReadRequest, readAt func([]byte, int64) (int, error)) error {
+	chunkSize := req.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DEFAULT_CHUNK_SIZE
+	} else if chunkSize > MAX_CHUNK_SIZE {
+		chunkSize = MAX_CHUNK_SIZE
+	}
+	offset, end := req.Offset, info.Size
+	if req.Length > 0 && offset+req.Length < end {
+		end = offset + req.Length
+	}
+	response := &ReadResponse{Info: info, Offset: offset}
+	for {
+		size := end - offset
+		if size > int64(chunkSize) {
+			size = int64(chunkSize)
+		}
+		if size > 0 {
+			data := make([]byte, size)
+			read, err := readAt(data, offset)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			response.Data = data[:read]
+			offset += int64(read)
+		}
+		if err := stream.Send(response); err != nil {
+			return err
+		}
+		if len(response.Data) == 0 || offset >= end {
+			return nil
+		}
+		response = &ReadResponse{Offset: offset}
+	}
+}
+
+// Read all the pages of a directory from another node, or only the first one if a limit is given
+func listFromNode(client *http.Client, p string, options storage.ReadDirOptions, fn func(os.FileInfo) error) error {
+	for {
+		files, next, err := client.ReadDirPage(p, options)
+		if err != nil {
+			return err
+		}
+		for _, fi := range files {
+			if err := fn(fi); err != nil {
+				return err
+			}
+		}
+		if next == "" || options.Limit > 0 {
+			return nil
+		}
+		options.After = next
+	}
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func toFileInfo(p string, fi os.FileInfo) *FileInfo {
+	info := &FileInfo{
+		Path:    p,
+		Name:    path.Base(p),
+		Type:    FileType_REGULAR,
+		Mode:    uint32(fi.Mode().Perm()),
+		Size:    fi.Size(),
+		ModTime: timestamppb.New(fi.ModTime()),
+		Etag:    http.ETag(fi),
+	}
+	if fi.IsDir() {
+		info.Type = FileType_DIRECTORY
+		info.Size = 0
+	}
+	if storageFileInfo, ok := fi.(*file.FileInfo); ok {
+		info.Node, info.Shard = storageFileInfo.Node(), storageFileInfo.Shard()
+	}
+	return info
+}
+
+func toEvent(event storage.Event) *Event {
+	return &Event{
+		Sequence: event.Sequence,
+		Type:     event.Type,
+		Path:     event.Path,
+		Target:   event.Target,
+		Node:     event.Node,
+		Time:     timestamppb.New(event.Time),
+	}
+}
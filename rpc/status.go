@@ -0,0 +1,116 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	. "github.com/t-mind/flocons/error"
+)
+
+// Domain of the ErrorInfo details of statuses
+const ERROR_DOMAIN string = "flocons"
+
+// Reasons of the ErrorInfo details of statuses
+const (
+	REASON_NOT_FOUND           string = "NOT_FOUND"
+	REASON_ALREADY_EXISTS      string = "ALREADY_EXISTS"
+	REASON_PERMISSION_DENIED   string = "PERMISSION_DENIED"
+	REASON_NOT_EMPTY           string = "NOT_EMPTY"
+	REASON_IS_DIRECTORY        string = "IS_DIRECTORY"
+	REASON_NOT_DIRECTORY       string = "NOT_DIRECTORY"
+	REASON_INVALID_PATH        string = "INVALID_PATH"
+	REASON_INVALID_ARGUMENT    string = "INVALID_ARGUMENT"
+	REASON_PRECONDITION_FAILED string = "PRECONDITION_FAILED"
+	REASON_OUT_OF_RANGE        string = "OUT_OF_RANGE"
+	REASON_FILE_TOO_LARGE      string = "FILE_TOO_LARGE"
+	REASON_EVENTS_LOST         string = "EVENTS_LOST"
+	REASON_NODE_UNAVAILABLE    string = "NODE_UNAVAILABLE"
+	REASON_INTERNAL            string = "INTERNAL"
+	REASON_UNKNOWN             string = "UNKNOWN"
+)
+
+// Convert an error of the storage or of another node to a status, with an ErrorInfo detail giving its reason
+// The path of the error and the lost sequence number of events are given in the metadata of the detail
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return status.FromContextError(err).Err()
+	}
+	code, reason := statusCode(err)
+	metadata := make(map[string]string)
+	if pathError, ok := err.(*os.PathError); ok {
+		metadata["path"] = pathError.Path
+	}
+	if eventsLostError, ok := err.(*EventsLostError); ok {
+		metadata["sequence"] = strconv.FormatUint(eventsLostError.Sequence, 10)
+	}
+	return newStatus(code, reason, err.Error(), metadata)
+}
+
+func newStatus(code codes.Code, reason string, message string, metadata map[string]string) error {
+	s := status.New(code, message)
+	if detailed, err := s.WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: ERROR_DOMAIN, Metadata: metadata}); err == nil {
+		s = detailed
+	}
+	return s.Err()
+}
+
+func invalidArgument(message string) error {
+	return newStatus(codes.InvalidArgument, REASON_INVALID_ARGUMENT, message, nil)
+}
+
+func fileTooLarge(p string, maxSize int64) error {
+	return newStatus(codes.ResourceExhausted, REASON_FILE_TOO_LARGE, fmt.Sprintf("file is bigger than the max file size of %d bytes", maxSize), map[string]string{"path": p})
+}
+
+func statusCode(err error) (codes.Code, string) {
+	switch {
+	case os.IsNotExist(err) || IsHttpError(err, http.StatusNotFound):
+		return codes.NotFound, REASON_NOT_FOUND
+	case os.IsPermission(err) || IsHttpError(err, http.StatusForbidden):
+		return codes.PermissionDenied, REASON_PERMISSION_DENIED
+	case IsNotEmptyError(err):
+		return codes.FailedPrecondition, REASON_NOT_EMPTY
+	case IsIsDirError(err):
+		return codes.FailedPrecondition, REASON_IS_DIRECTORY
+	case IsIsNotDirError(err):
+		return codes.FailedPrecondition, REASON_NOT_DIRECTORY
+	case os.IsExist(err) || IsHttpError(err, http.StatusConflict):
+		return codes.AlreadyExists, REASON_ALREADY_EXISTS
+	case IsHttpError(err, http.StatusPreconditionFailed):
+		return codes.FailedPrecondition, REASON_PRECONDITION_FAILED
+	case IsInvalidPathError(err):
+		return codes.InvalidArgument, REASON_INVALID_PATH
+	case IsHttpError(err, http.StatusBadRequest):
+		return codes.InvalidArgument, REASON_INVALID_ARGUMENT
+	case IsHttpError(err, http.StatusRequestedRangeNotSatisfiable):
+		return codes.OutOfRange, REASON_OUT_OF_RANGE
+	case IsHttpError(err, http.StatusRequestEntityTooLarge):
+		return codes.ResourceExhausted, REASON_FILE_TOO_LARGE
+	case IsEventsLostError(err):
+		return codes.OutOfRange, REASON_EVENTS_LOST
+	case IsHttpError(err, http.StatusServiceUnavailable) || IsHttpError(err, http.StatusGatewayTimeout):
+		return codes.Unavailable, REASON_NODE_UNAVAILABLE
+	}
+	if _, ok := err.(net.Error); ok {
+		return codes.Unavailable, REASON_NODE_UNAVAILABLE
+	}
+	if _, ok := err.(*InternalError); ok {
+		return codes.Internal, REASON_INTERNAL
+	}
+	logger.Warnf("Request failed: %s", err)
+	return codes.Unknown, REASON_UNKNOWN
+}
@@ -0,0 +1,154 @@
+package s3
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/t-mind/flocons/error"
+)
+
+// Minimal client of an S3 compatible object storage, using path style urls
+type Client struct {
+	endpoint   string
+	region     string
+	bucket     string
+	accessKey  string
+	secretKey  string
+	httpClient *http.Client
+}
+
+// Create a client of a bucket. Requests are anonymous if no access key is given
+func NewClient(endpoint string, region string, bucket string, accessKey string, secretKey string) *Client {
+	return &Client{
+		endpoint:   strings.TrimRight(endpoint, "/"),
+		region:     region,
+		bucket:     bucket,
+		accessKey:  accessKey,
+		secretKey:  secretKey,
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// Size and entity tag of an object, the tag being the hex MD5 digest of objects uploaded in one request
+type ObjectInfo struct {
+	Size int64
+	ETag string
+}
+
+// Upload an object of a known size
+func (c *Client) PutObject(key string, body io.Reader, size int64) error {
+	return c.PutObjectWithMD5(key, body, size, nil)
+}
+
+// Upload an object of a known size, which the server rejects if its MD5 digest is not the given one
+func (c *Client) PutObjectWithMD5(key string, body io.Reader, size int64, md5 []byte) error {
+	request, err := c.newRequest(http.MethodPut, key, body)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = size
+	if md5 != nil {
+		request.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5))
+	}
+	response, err := c.do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// Get length bytes of an object from offset, less if the object is shorter
+func (c *Client) GetObjectRange(key string, offset int64, length int64) ([]byte, error) {
+	request, err := c.newRequest(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	response, err := c.do(request)
+	if err != nil {
+		if httpError, ok := err.(*HttpError); ok && httpError.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusPartialContent {
+		// The server ignored the range, let's skip what was not asked
+		if _, err := io.CopyN(ioutil.Discard, response.Body, offset); err != nil {
+			return nil, io.EOF
+		}
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body, length))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Size of an object
+func (c *Client) HeadObject(key string) (int64, error) {
+	info, err := c.StatObject(key)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (c *Client) StatObject(key string) (*ObjectInfo, error) {
+	request, err := c.newRequest(http.MethodHead, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.do(request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	size, err := strconv.ParseInt(response.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Size: size, ETag: strings.Trim(response.Header.Get("ETag"), `"`)}, nil
+}
+
+func (c *Client) DeleteObject(key string) error {
+	request, err := c.newRequest(http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	response, err := c.do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (c *Client) newRequest(method string, key string, body io.Reader) (*http.Request, error) {
+	return http.NewRequest(method, c.endpoint+"/"+uriEncode(c.bucket+"/"+strings.TrimLeft(key, "/"), false), body)
+}
+
+func (c *Client) do(request *http.Request) (*http.Response, error) {
+	if c.accessKey != "" {
+		sign(request, c.region, c.accessKey, c.secretKey, time.Now())
+	}
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 != 2 {
+		response.Body.Close()
+		if response.StatusCode == http.StatusNotFound {
+			return nil, NewFileNotFoundError(request.URL.Path)
+		}
+		return nil, NewHttpError(response.Status, response.StatusCode)
+	}
+	return response, nil
+}
@@ -0,0 +1,51 @@
+package s3
+
+import (
+	"io"
+	"sync"
+)
+
+// Positional reader of an object, each read being a ranged GET
+// Reads fetch at least readAhead bytes, so that consecutive small reads are served by one request
+type ObjectReader struct {
+	client    *Client
+	key       string
+	readAhead int64
+	mutex     *sync.Mutex
+	buffer    []byte
+	offset    int64
+}
+
+func (c *Client) NewObjectReader(key string, readAhead int64) *ObjectReader {
+	return &ObjectReader{
+		client:    c,
+		key:       key,
+		readAhead: readAhead,
+		mutex:     &sync.Mutex{},
+	}
+}
+
+func (r *ObjectReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if off < r.offset || off+int64(len(p)) > r.offset+int64(len(r.buffer)) {
+		length := int64(len(p))
+		if length < r.readAhead {
+			length = r.readAhead
+		}
+		data, err := r.client.GetObjectRange(r.key, off, length)
+		if err != nil {
+			return 0, err
+		}
+		r.buffer = data
+		r.offset = off
+	}
+	n := 0
+	if start := off - r.offset; start < int64(len(r.buffer)) {
+		n = copy(p, r.buffer[start:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// Batches the syncs to disk requested by concurrent writers
+// The first writer waiting schedules a sync after the interval, and all writers waiting
+// until then are released together with its result
+type groupCommitter struct {
+	mutex     *sync.Mutex
+	interval  time.Duration
+	sync      func() error
+	waiters   []chan error
+	scheduled bool
+}
+
+func newGroupCommitter(interval time.Duration, syncFunc func() error) *groupCommitter {
+	return &groupCommitter{
+		mutex:    &sync.Mutex{},
+		interval: interval,
+		sync:     syncFunc,
+		waiters:  make([]chan error, 0),
+	}
+}
+
+// Wait until everything written before the call is synced on disk
+func (g *groupCommitter) Wait() error {
+	waiter := make(chan error, 1)
+	g.mutex.Lock()
+	g.waiters = append(g.waiters, waiter)
+	if !g.scheduled {
+		g.scheduled = true
+		time.AfterFunc(g.interval, g.commit)
+	}
+	g.mutex.Unlock()
+	return <-waiter
+}
+
+func (g *groupCommitter) commit() {
+	g.mutex.Lock()
+	waiters := g.waiters
+	g.waiters = make([]chan error, 0)
+	g.scheduled = false
+	g.mutex.Unlock()
+
+	err := g.sync()
+	if err != nil {
+		logger.Errorf("Could not commit %d writes: %s", len(waiters), err)
+	}
+	for _, waiter := range waiters {
+		waiter <- err
+	}
+}
@@ -2,11 +2,17 @@ package storage
 
 import (
 	"archive/tar"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -14,6 +20,7 @@ import (
 	"github.com/t-mind/flocons/config"
 	. "github.com/t-mind/flocons/error"
 	"github.com/t-mind/flocons/file"
+	"github.com/t-mind/flocons/s3"
 )
 
 var containerRegexp, _ = regexp.Compile(`^files_(([^_]+)_([^_]+)_v([0-9]+)_([0-9]+)).tar$`)
@@ -33,38 +40,72 @@ type RegularFileContainer struct {
 	Version    int
 	Number     int
 	Size       int64
+	syncedSize int64 // size of the container file at the last sync
 	path       string
+	pathMutex  *sync.RWMutex // path changes when the container is moved to the cold tier
+	cold       bool
 	config     *config.Config
-	writeFd    *os.File
+	fs         VFS
+	writeFd    File
 	tarWriter  *tar.Writer
 	writeMutex *sync.Mutex
 	index      *RegularFileContainerIndex
+	readFiles  *fileHandleCache
+	dataCache  *dataCache
+	committer  *groupCommitter
+	remote     *s3.Client // where the container is offloaded, if any
+	journal    *journal
+	storageDir string           // directory of the container relative to the storage, for the journal
+	changes    []JournalRecord  // changes written since the last commit, journaled when they become visible
+	generation uint64           // number of the next commit, which the changes written meanwhile belong to
+	waiting    map[uint64]int   // writers of each generation who have not checked the result of its commit yet
+	failures   map[uint64]error // errors of the commits which failed, until their writers have checked them
 }
 
 // This function creates a new 'RegularFileContainer' object.
 // Either the unerlying files already exists, and just the container object is created
 // or the files don't exist, and it creates new empty ones. The later possibility is only valid for files belonging to the current node
 func NewRegularFileContainer(directory string, name string, config *config.Config, index *RegularFileContainerIndex) (*RegularFileContainer, error) {
+	return openRegularFileContainer(OS, directory, name, config, index)
+}
+
+// Open a container doing all its file system operations through a VFS
+func NewRegularFileContainerWithVFS(fs VFS, directory string, name string, config *config.Config, index *RegularFileContainerIndex) (*RegularFileContainer, error) {
+	return openRegularFileContainer(fs, directory, name, config, index)
+}
+
+func openRegularFileContainer(fs VFS, directory string, name string, config *config.Config, index *RegularFileContainerIndex) (*RegularFileContainer, error) {
 	fullpath := filepath.Join(directory, name)
 	logger.Debugf("Find container %s\n", fullpath)
 	parts := containerRegexp.FindStringSubmatch(name)
 	if parts == nil {
 		return nil, NewInternalError("Tried to create a container with name " + name + " which is invalid")
 	}
+	// The container may have been moved to the cold tier
+	if index == nil {
+		if _, err := fs.Stat(fullpath); os.IsNotExist(err) {
+			if coldDirectory := coldDirectory(directory, config); coldDirectory != "" {
+				if _, err := fs.Stat(filepath.Join(coldDirectory, name)); err == nil {
+					directory = coldDirectory
+					fullpath = filepath.Join(directory, name)
+				}
+			}
+		}
+	}
 	shard := parts[2]
 	node := parts[3]
 	version, _ := strconv.Atoi(parts[4])
 	number, _ := strconv.Atoi(parts[5])
 	var size int64
 
-	containerFileInfo, err := os.Stat(fullpath)
+	containerFileInfo, err := fs.Stat(fullpath)
 	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
 
 	var index_err error
 	if index == nil {
-		index, index_err = FindRegularFileContainerIndex(directory, shard, node, number, config)
+		index, index_err = findRegularFileContainerIndex(fs, directory, shard, node, number, config)
 		if index_err != nil && !os.IsNotExist(index_err) {
 			return nil, index_err
 		}
@@ -74,14 +115,18 @@ func NewRegularFileContainer(directory string, name string, config *config.Confi
 		// We didn't find the container file neither the index file
 		if config.Node.Name == node {
 			// This can be normal only if the file is from this node
-			f, err := os.Create(fullpath)
+			f, err := fs.Create(fullpath)
 			if err != nil {
 				return nil, err
 			}
 			f.Close()
-			index, index_err = NewRegularFileContainerIndex(directory, NewRegularFileContainerIndexName(shard, node, number), config)
+			index, index_err = openRegularFileContainerIndex(fs, directory, NewRegularFileContainerIndexName(shard, node, number), config)
 			if index_err != nil {
-				return nil, err
+				// A container without index would be found again but could never be written
+				if err := fs.Remove(fullpath); err != nil {
+					logger.Errorf("Could not remove container %s whose index could not be created: %s", fullpath, err)
+				}
+				return nil, index_err
 			}
 			logger.Debugf("Created new regular file container %s\n", fullpath)
 		} else {
@@ -94,7 +139,7 @@ func NewRegularFileContainer(directory string, name string, config *config.Confi
 	}
 
 	logger.Debugf("Succesfully found container %s\n", fullpath)
-	return &RegularFileContainer{
+	container := RegularFileContainer{
 		Name:       name,
 		Node:       node,
 		Shard:      shard,
@@ -102,10 +147,18 @@ func NewRegularFileContainer(directory string, name string, config *config.Confi
 		Number:     number,
 		Size:       size,
 		path:       fullpath,
+		fs:         fs,
+		pathMutex:  &sync.RWMutex{},
+		cold:       isColdDirectory(directory, config),
 		config:     config,
 		writeMutex: &sync.Mutex{},
 		index:      index,
-	}, nil
+		generation: 1,
+		waiting:    make(map[uint64]int),
+		failures:   make(map[uint64]error),
+	}
+	container.committer = newGroupCommitter(config.Storage.GroupCommitIntervalDuration, container.Sync)
+	return &container, nil
 }
 
 func (c *RegularFileContainer) GetRegularFile(name string) (os.FileInfo, error) {
@@ -117,13 +170,14 @@ func (c *RegularFileContainer) GetRegularFile(name string) (os.FileInfo, error)
 			return nil, err
 		}
 	} else {
-		f, err := os.OpenFile(c.path, os.O_RDONLY, 0644)
+		f, release, err := c.openForRead(REMOTE_SCAN_READ_AHEAD)
 		if err != nil {
 			return nil, err
 		}
-		defer f.Close()
+		defer release()
 
-		reader := tar.NewReader(f)
+		section := io.NewSectionReader(f, 0, math.MaxInt64)
+		reader := tar.NewReader(section)
 		var address int64
 
 		for {
@@ -139,7 +193,7 @@ func (c *RegularFileContainer) GetRegularFile(name string) (os.FileInfo, error)
 				break
 			}
 			// Let's compute address for next header
-			address, _ = f.Seek(0, os.SEEK_CUR)
+			address, _ = section.Seek(0, io.SeekCurrent)
 			address += h.Size
 			// in tar, blocks are rounded to 512
 			mod512 := address % 512
@@ -148,7 +202,7 @@ func (c *RegularFileContainer) GetRegularFile(name string) (os.FileInfo, error)
 			}
 		}
 		if fi != nil {
-			storageFileInfo := file.FileInfoFromFileInfo(fi, file.FileDataSource{Address: address, Node: c.Node, Shard: c.Shard})
+			storageFileInfo := file.FileInfoFromFileInfo(fi, file.FileDataSource{Address: address, Node: c.Node, Shard: c.Shard, Container: c.Name})
 			fi = storageFileInfo
 		}
 	}
@@ -156,7 +210,9 @@ func (c *RegularFileContainer) GetRegularFile(name string) (os.FileInfo, error)
 		return nil, NewFileNotFoundError(name)
 	}
 
+	// Index entries are shared by concurrent readers, so each one gets its own copy to update
 	storageFileInfo, _ := fi.(*file.FileInfo)
+	storageFileInfo = file.FileInfoFromFileInfo(storageFileInfo, storageFileInfo.Sys().(file.FileDataSource))
 	storageFileInfo.UpdateDataSource(file.FileDataSource{
 		Container: c.Name,
 		Node:      c.Node,
@@ -164,29 +220,46 @@ func (c *RegularFileContainer) GetRegularFile(name string) (os.FileInfo, error)
 		Data: func() ([]byte, error) {
 			return c.GetRegularFileData(storageFileInfo)
 		},
+		Open: func() (*io.SectionReader, func(), error) {
+			return c.OpenRegularFileData(storageFileInfo)
+		},
 	})
 	return storageFileInfo, nil
 }
 
 func (c *RegularFileContainer) GetRegularFileData(fi os.FileInfo) ([]byte, error) {
-	f, err := os.OpenFile(c.path, os.O_RDONLY, 0644)
+	storageFileInfo, isStorageFileInfo := fi.(*file.FileInfo)
+	cacheable := c.dataCache != nil && isStorageFileInfo && storageFileInfo.Container() == c.Name
+	if cacheable {
+		if data, found := c.dataCache.Get(c.currentPath(), storageFileInfo.Address()); found {
+			return data, nil
+		}
+	}
+
+	// Header and data of a file known by its address are fetched at once from offloaded containers
+	readAhead := REMOTE_SCAN_READ_AHEAD
+	if isStorageFileInfo {
+		readAhead = tarFootprint(fi.Size())
+	}
+	f, release, err := c.openForRead(readAhead)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	reader := tar.NewReader(f)
+	defer release()
 
-	if storageFileInfo, ok := fi.(*file.FileInfo); ok {
+	var reader *tar.Reader
+	if isStorageFileInfo {
 		if storageFileInfo.Container() != c.Name {
 			return nil, NewInternalError(fmt.Sprintf("Asked for file data in wrong container (%s != %s)", storageFileInfo.Container(), c.Name))
 		}
-		f.Seek(storageFileInfo.Address(), os.SEEK_SET)
+		reader = tar.NewReader(io.NewSectionReader(f, storageFileInfo.Address(), math.MaxInt64-storageFileInfo.Address()))
 		_, err := reader.Next()
 		if err != nil {
 			return nil, err
 		}
 
 	} else {
+		reader = tar.NewReader(io.NewSectionReader(f, 0, math.MaxInt64))
 		for {
 			h, err := reader.Next()
 			if h == nil {
@@ -201,81 +274,424 @@ func (c *RegularFileContainer) GetRegularFileData(fi os.FileInfo) ([]byte, error
 		}
 	}
 	buffer := make([]byte, fi.Size())
-	_, err = reader.Read(buffer)
+	_, err = io.ReadFull(reader, buffer)
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
+	if cacheable {
+		c.dataCache.Add(c.currentPath(), storageFileInfo.Address(), buffer)
+	}
 	return buffer, nil
 }
 
+// Open a section of the container over the data of a file known by its address, to read only parts of it
+// The returned function must be called once reads are done
+func (c *RegularFileContainer) OpenRegularFileData(fi *file.FileInfo) (*io.SectionReader, func(), error) {
+	if fi.Container() != c.Name {
+		return nil, nil, NewInternalError(fmt.Sprintf("Asked for file data in wrong container (%s != %s)", fi.Container(), c.Name))
+	}
+	// Files small enough are read at once to go through the data cache
+	if c.dataCache != nil && c.dataCache.accepts(fi.Size()) {
+		data, err := c.GetRegularFileData(fi)
+		if err != nil {
+			return nil, nil, err
+		}
+		return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), func() {}, nil
+	}
+
+	readAhead := tarFootprint(fi.Size())
+	if readAhead > REMOTE_SCAN_READ_AHEAD {
+		readAhead = REMOTE_SCAN_READ_AHEAD
+	}
+	f, release, err := c.openForRead(readAhead)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Data starts after the header, which can span several blocks for long names
+	section := io.NewSectionReader(f, fi.Address(), math.MaxInt64-fi.Address())
+	if _, err := tar.NewReader(section).Next(); err != nil {
+		release()
+		return nil, nil, err
+	}
+	headerSize, _ := section.Seek(0, io.SeekCurrent)
+	return io.NewSectionReader(f, fi.Address()+headerSize, fi.Size()), release, nil
+}
+
+// Open the container file for positional reads, through the cache of file handles if any
+// The returned function must be called once reads are done
+// If the container file has been evicted after being offloaded, reads are ranged requests of at least readAhead bytes
+// Other missing containers are not looked up in the bucket, which may hold an older version under the same key
+func (c *RegularFileContainer) openForRead(readAhead int64) (io.ReaderAt, func(), error) {
+	f, release, err := c.openLocalForRead()
+	if err != nil && os.IsNotExist(err) && c.remote != nil && c.isOffloaded() {
+		return c.remote.NewObjectReader(remoteKey(c.currentPath(), c.config), readAhead), func() {}, nil
+	}
+	return f, release, err
+}
+
+func (c *RegularFileContainer) openLocalForRead() (io.ReaderAt, func(), error) {
+	// An opened file stays readable even if the container is moved meanwhile
+	c.pathMutex.RLock()
+	defer c.pathMutex.RUnlock()
+	if c.readFiles == nil {
+		f, err := c.fs.Open(c.path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, func() { f.Close() }, nil
+	}
+	handle, err := c.readFiles.Acquire(c.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return handle, func() { c.readFiles.Release(handle) }, nil
+}
+
+// Append a file to the container
+// It returns once the file is durable according to the durability mode of the configuration
 func (c *RegularFileContainer) CreateRegularFile(name string, mode os.FileMode, data []byte) (os.FileInfo, error) {
+	return c.createRegularFile(name, mode, time.Now(), bytes.NewReader(data), int64(len(data)))
+}
+
+// Append a file of size bytes read from a reader, with the modification time of the file it is copied from
+// The container is locked for writing while reading, so that the data of the file is written in one block
+func (c *RegularFileContainer) CopyRegularFile(name string, mode os.FileMode, modTime time.Time, reader io.Reader, size int64) (os.FileInfo, error) {
+	return c.createRegularFile(name, mode, modTime, reader, size)
+}
+
+func (c *RegularFileContainer) createRegularFile(name string, mode os.FileMode, modTime time.Time, reader io.Reader, size int64) (os.FileInfo, error) {
 	if c.config.Node.Name != c.Node {
 		return nil, NewInternalError("Tried to write file in container of another node " + c.Name)
 	}
 
+	fi, generation, err := c.writeRegularFile(name, mode, modTime, reader, size)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.waitDurability(generation); err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+// Wait for durability without holding the write lock, so that concurrent writes can be synced together
+// The write may have been committed by another writer, so the result of the commit of its generation is returned
+func (c *RegularFileContainer) waitDurability(generation uint64) error {
+	var err error
+	switch c.config.Storage.Durability {
+	case config.DURABILITY_GROUP:
+		err = c.committer.Wait()
+	case config.DURABILITY_NONE:
+		return nil
+	default:
+		err = c.Sync()
+	}
+	if generation == 0 {
+		return err
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	failure, failed := c.failures[generation]
+	if c.waiting[generation]--; c.waiting[generation] <= 0 {
+		delete(c.waiting, generation)
+		delete(c.failures, generation)
+	}
+	if failed {
+		return failure
+	}
+	return err
+}
+
+// Remove a file from the container
+// Data stays in the container, only a tombstone is written in the index
+func (c *RegularFileContainer) RemoveRegularFile(name string) error {
+	if err := c.checkIndexEditable(); err != nil {
+		return err
+	}
+	generation, err := c.removeRegularFile(name)
+	if err != nil {
+		return err
+	}
+	return c.waitDurability(generation)
+}
+
+func (c *RegularFileContainer) removeRegularFile(name string) (uint64, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	previous, found := c.index.latestEntry(name)
+	if !found {
+		return 0, NewFileNotFoundError(name)
+	}
+	if err := c.index.RemoveRegularFile(name); err != nil {
+		return 0, err
+	}
+	c.invalidateData(previous)
+	return c.addChange(JournalRecord{Type: EVENT_DELETE, Name: name, Container: c.Name})
+}
+
+// Change the mode and the modification time of a file of the container
+// Data stays at the same address, only a new entry is written in the index
+func (c *RegularFileContainer) UpdateRegularFile(name string, mode os.FileMode, modTime time.Time) (os.FileInfo, error) {
+	if err := c.checkIndexEditable(); err != nil {
+		return nil, err
+	}
+	generation, err := c.updateRegularFile(name, mode, modTime)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.waitDurability(generation); err != nil {
+		return nil, err
+	}
+	return c.GetRegularFile(name)
+}
+
+func (c *RegularFileContainer) updateRegularFile(name string, mode os.FileMode, modTime time.Time) (uint64, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	previous, found := c.index.latestEntry(name)
+	if !found {
+		return 0, NewFileNotFoundError(name)
+	}
+	previousFileInfo, _ := previous.(*file.FileInfo)
+	fi := file.NewFileInfo(name, mode&os.ModePerm, previousFileInfo.Size(), modTime,
+		file.FileDataSource{Address: previousFileInfo.Address(), Node: c.Node, Shard: c.Shard, Container: c.Name, Digest: previousFileInfo.Digest()})
+	if err := c.index.AddRegularFile(fi); err != nil {
+		return 0, err
+	}
+	return c.addChange(JournalRecord{
+		Type:      EVENT_UPDATE,
+		Name:      name,
+		Container: c.Name,
+		Address:   fi.Address(),
+		Size:      fi.Size(),
+	})
+}
+
+// Give another name to a file of the container, replacing the file with this name if any
+// Data stays at the same address, only the new entry and a tombstone are written in the index
+func (c *RegularFileContainer) RenameRegularFile(name string, newName string) (os.FileInfo, error) {
+	if err := c.checkIndexEditable(); err != nil {
+		return nil, err
+	}
+	generation, err := c.renameRegularFile(name, newName)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.waitDurability(generation); err != nil {
+		return nil, err
+	}
+	return c.GetRegularFile(newName)
+}
+
+func (c *RegularFileContainer) renameRegularFile(name string, newName string) (uint64, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	previous, found := c.index.latestEntry(name)
+	if !found {
+		return 0, NewFileNotFoundError(name)
+	}
+	if name == newName {
+		return 0, nil
+	}
+	previousFileInfo, _ := previous.(*file.FileInfo)
+	fi := file.NewFileInfo(newName, previousFileInfo.Mode(), previousFileInfo.Size(), previousFileInfo.ModTime(),
+		file.FileDataSource{Address: previousFileInfo.Address(), Node: c.Node, Shard: c.Shard, Container: c.Name, Digest: previousFileInfo.Digest()})
+	replaced, replacing := c.index.latestEntry(newName)
+	if err := c.index.AddRegularFile(fi); err != nil {
+		return 0, err
+	}
+	if err := c.index.RemoveRegularFile(name); err != nil {
+		return 0, err
+	}
+	if replacing {
+		c.invalidateData(replaced)
+	}
+	return c.addChange(JournalRecord{
+		Type:      EVENT_RENAME,
+		Name:      name,
+		Target:    path.Join(c.storageDir, newName),
+		Container: c.Name,
+		Address:   fi.Address(),
+		Size:      fi.Size(),
+	})
+}
+
+// Only the node of a container can change its index
+func (c *RegularFileContainer) checkIndexEditable() error {
+	if c.config.Node.Name != c.Node || c.index == nil {
+		return NewInternalError("Tried to change file in container of another node " + c.Name)
+	}
+	return nil
+}
+
+// Drop from the data cache a version of a file which can't be read anymore
+func (c *RegularFileContainer) invalidateData(fi os.FileInfo) {
+	if c.dataCache != nil {
+		storageFileInfo, _ := fi.(*file.FileInfo)
+		c.dataCache.Invalidate(c.currentPath(), storageFileInfo.Address())
+	}
+}
+
+// Keep a change written in the container until it is committed, must be called with write lock
+// Changes are committed right away when writes are not synced, and by the next sync otherwise
+// It returns the generation of the commit the writer has to wait for, 0 if it is already committed
+func (c *RegularFileContainer) addChange(record JournalRecord) (uint64, error) {
+	if c.journal != nil {
+		record.Directory = c.storageDir
+		c.changes = append(c.changes, record)
+	}
+	if c.config.Storage.Durability == config.DURABILITY_NONE {
+		return 0, c.commit(false)
+	}
+	c.waiting[c.generation]++
+	return c.generation, nil
+}
+
+func (c *RegularFileContainer) writeRegularFile(name string, mode os.FileMode, modTime time.Time, reader io.Reader, size int64) (os.FileInfo, uint64, error) {
 	c.writeMutex.Lock()
 	defer c.writeMutex.Unlock()
 
 	if c.writeFd == nil {
-		f, err := os.OpenFile(c.path, os.O_RDWR|os.O_CREATE, 0644)
+		f, err := c.fs.OpenFile(c.path, os.O_RDWR|os.O_CREATE, 0644)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		if _, err = f.Seek(0, os.SEEK_END); err != nil {
-			return nil, err
+		end, err := f.Seek(0, os.SEEK_END)
+		if err != nil {
+			return nil, 0, err
 		}
 
 		c.writeFd = f
 		c.tarWriter = tar.NewWriter(c.writeFd)
+		c.syncedSize = end
 	}
 
 	address, err := c.writeFd.Seek(0, os.SEEK_CUR)
 	if err != nil {
-		c.Close()
-		return nil, err
+		c.closeWriteFd()
+		return nil, 0, err
 	}
 
 	header := tar.Header{
 		Typeflag: tar.TypeReg,
 		Name:     name,
-		Size:     (int64)(len(data)),
+		Size:     size,
 		Mode:     (int64)(mode),
-		ModTime:  time.Now(),
+		ModTime:  modTime,
 	}
 	if err := c.tarWriter.WriteHeader(&header); err != nil {
-		return nil, err
+		c.rollback(address)
+		return nil, 0, err
 	}
-	if _, err := c.tarWriter.Write(data); err != nil {
-		return nil, err
+	digest := md5.New()
+	if _, err := io.Copy(c.tarWriter, io.TeeReader(reader, digest)); err != nil {
+		c.rollback(address)
+		return nil, 0, err
 	}
 	if err := c.tarWriter.Flush(); err != nil {
-		return nil, err
+		c.rollback(address)
+		return nil, 0, err
 	}
 
-	fi := file.FileInfoFromFileInfo(header.FileInfo(), file.FileDataSource{Address: address, Node: c.Node, Shard: c.Shard})
+	fi := file.FileInfoFromFileInfo(header.FileInfo(), file.FileDataSource{Address: address, Node: c.Node, Shard: c.Shard, Container: c.Name, Digest: hex.EncodeToString(digest.Sum(nil))})
 
 	if c.index != nil {
+		previous, found := c.index.latestEntry(name)
 		if err = c.index.AddRegularFile(fi); err != nil {
-			return nil, err
+			// Data without index entry would never be read, let's not keep it
+			c.rollback(address)
+			return nil, 0, err
+		}
+		if found {
+			// The previous version of the file is overwritten
+			c.invalidateData(previous)
 		}
 	}
 
 	c.Size, _ = c.writeFd.Seek(0, os.SEEK_CUR)
-	return fi, nil
+
+	generation, err := c.addChange(JournalRecord{
+		Time:      header.ModTime,
+		Type:      EVENT_CREATE,
+		Name:      name,
+		Container: c.Name,
+		Address:   address,
+		Size:      header.Size,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return fi, generation, nil
+}
+
+// Drop a partially written file so that the container ends with complete tar blocks
+// If that fails, the write file is closed and will be reopened at its end by the next write
+func (c *RegularFileContainer) rollback(address int64) {
+	if err := c.writeFd.Truncate(address); err != nil {
+		logger.Errorf("Could not roll back container %s to %d: %s", c.Name, address, err)
+		c.closeWriteFd()
+		return
+	}
+	if _, err := c.writeFd.Seek(address, os.SEEK_SET); err != nil {
+		c.closeWriteFd()
+		return
+	}
+	c.tarWriter = tar.NewWriter(c.writeFd)
+	c.Size = address
 }
 
 func (c *RegularFileContainer) ListFiles() ([]os.FileInfo, error) {
+	files := make([]os.FileInfo, 0, 100)
+	err := c.WalkFiles(func(fi os.FileInfo) error {
+		files = append(files, fi)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Call fn on the files of the container with a name after the given one, sorted by name
+// Walk stops at the first error returned by fn
+func (c *RegularFileContainer) WalkSortedFiles(after string, fn func(os.FileInfo) error) error {
 	if c.index != nil {
-		return c.index.ListFiles()
+		return c.index.WalkSortedFiles(after, fn)
 	}
 
-	f, err := os.OpenFile(c.path, os.O_RDONLY, 0644)
+	// Containers without index are read from their tar, which is not sorted
+	files, err := c.ListFiles()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer f.Close()
-	reader := tar.NewReader(f)
-	files := make([]os.FileInfo, 0, 100)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	for _, fi := range files {
+		if fi.Name() <= after {
+			continue
+		}
+		if err := fn(fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Call fn on all files of the container, without keeping them in memory
+// Walk stops at the first error returned by fn
+func (c *RegularFileContainer) WalkFiles(fn func(os.FileInfo) error) error {
+	if c.index != nil {
+		return c.index.WalkFiles(fn)
+	}
+
+	f, release, err := c.openForRead(REMOTE_SCAN_READ_AHEAD)
+	if err != nil {
+		return err
+	}
+	defer release()
+	section := io.NewSectionReader(f, 0, math.MaxInt64)
+	reader := tar.NewReader(section)
 	var address int64
 	for {
 		h, err := reader.Next()
@@ -283,12 +699,14 @@ func (c *RegularFileContainer) ListFiles() ([]os.FileInfo, error) {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := fn(file.FileInfoFromFileInfo(h.FileInfo(), file.FileDataSource{Address: address, Node: c.Node, Shard: c.Shard, Container: c.Name})); err != nil {
+			return err
 		}
-		files = append(files, file.FileInfoFromFileInfo(h.FileInfo(), file.FileDataSource{Address: address, Node: c.Node, Shard: c.Shard}))
 
 		// Let's compute address for next header
-		address, _ = f.Seek(0, os.SEEK_CUR)
+		address, _ = section.Seek(0, io.SeekCurrent)
 		address += h.Size
 		// in tar, blocks are rounded to 512
 		mod512 := address % 512
@@ -296,17 +714,19 @@ func (c *RegularFileContainer) ListFiles() ([]os.FileInfo, error) {
 			address += 512 - mod512
 		}
 	}
-	return files, nil
+	return nil
 }
 
 func (c *RegularFileContainer) IsWriteable(config *config.Config) bool {
-	if c.Node != config.Node.Name || c.index == nil {
+	if c.Node != config.Node.Name || c.index == nil || c.IsCold() {
 		return false
 	}
 
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
 	var size int64
 	if c.writeFd == nil {
-		containerFileInfo, err := os.Stat(c.path)
+		containerFileInfo, err := c.fs.Stat(c.currentPath())
 		if err != nil {
 			return false
 		}
@@ -317,14 +737,106 @@ func (c *RegularFileContainer) IsWriteable(config *config.Config) bool {
 	return size < config.Storage.MaxContainerSizeInByes
 }
 
+// Size of the container file on disk, or estimated from the index if we don't have the container file
+func (c *RegularFileContainer) CurrentSize() (int64, error) {
+	c.writeMutex.Lock()
+	writing, size := c.writeFd != nil, c.Size
+	c.writeMutex.Unlock()
+	if writing {
+		return size, nil
+	}
+	containerFileInfo, err := c.fs.Stat(c.currentPath())
+	if err != nil {
+		if os.IsNotExist(err) && c.index != nil {
+			return c.index.EstimatedContainerSize()
+		}
+		return 0, err
+	}
+	return containerFileInfo.Size(), nil
+}
+
+// Sync on disk the data and then the index of the files written in the container, and journal their changes
+func (c *RegularFileContainer) Sync() error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.commit(true)
+}
+
+// Files written since the last commit only become visible once their data and their index entries are synced
+// and their changes are journaled. If one of these steps fails, they are dropped from the container and from the index,
+// and the error is kept for all the writers of the generation
+// Must be called with write lock
+func (c *RegularFileContainer) commit(sync bool) error {
+	err := c.commitChanges(sync)
+	if err != nil {
+		c.discard()
+		if c.waiting[c.generation] > 0 {
+			c.failures[c.generation] = err
+		}
+	}
+	c.generation++
+	return err
+}
+
+// Must be called with write lock
+func (c *RegularFileContainer) commitChanges(sync bool) error {
+	if sync && c.writeFd != nil {
+		if err := c.writeFd.Sync(); err != nil {
+			return err
+		}
+	}
+	if sync && c.index != nil {
+		if err := c.index.Sync(); err != nil {
+			return err
+		}
+	}
+	if len(c.changes) > 0 {
+		if err := c.journal.Append(c.changes, sync); err != nil {
+			return err
+		}
+		c.changes = nil
+	}
+	if c.index != nil {
+		c.index.Publish()
+	}
+	if c.writeFd != nil {
+		c.syncedSize = c.Size
+	}
+	return nil
+}
+
+// Drop the files written since the last commit, must be called with write lock
+func (c *RegularFileContainer) discard() {
+	if c.index != nil {
+		c.index.Discard()
+	}
+	if c.writeFd != nil {
+		c.rollback(c.syncedSize)
+	}
+	c.changes = nil
+}
+
 func (c *RegularFileContainer) Close() {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.config.Storage.Durability != config.DURABILITY_NONE {
+		// Writers may still wait for a group commit, let's not close files before they are synced
+		if err := c.commit(true); err != nil {
+			logger.Errorf("Could not sync container %s before closing: %s", c.Name, err)
+		}
+	}
+	c.closeWriteFd()
+	if c.index != nil {
+		c.index.Close()
+	}
+}
+
+// Must be called with write lock
+func (c *RegularFileContainer) closeWriteFd() {
 	if c.writeFd != nil {
 		// Never ever close the writer because it will add closing data at the end of tar, terminating the archive
 		// c.tarWriter.Close()
 		c.writeFd.Close()
 		c.writeFd = nil
 	}
-	if c.index != nil {
-		c.index.Close()
-	}
 }
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// Size bounded cache of regular file data, keyed by container file and address of the file in the container
+// Containers are append only so an address always holds the same data. Entries are invalidated
+// when the file they hold is deleted or overwritten only to free memory sooner
+type dataCache struct {
+	mutex       *sync.Mutex
+	entries     *lru.Cache
+	containers  map[string]map[int64]bool // cached addresses by container, to invalidate whole containers
+	maxBytes    int64
+	maxFileSize int64
+	bytes       int64
+	hits        int64
+	misses      int64
+}
+
+type dataCacheKey struct {
+	container string
+	address   int64
+}
+
+// Counters of the data cache
+type DataCacheStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+func newDataCache(maxBytes int64, maxFileSize int64) *dataCache {
+	c := dataCache{
+		mutex:       &sync.Mutex{},
+		entries:     lru.New(0),
+		containers:  make(map[string]map[int64]bool),
+		maxBytes:    maxBytes,
+		maxFileSize: maxFileSize,
+	}
+	c.entries.OnEvicted = func(key lru.Key, value interface{}) {
+		cacheKey, _ := key.(dataCacheKey)
+		data, _ := value.([]byte)
+		c.bytes -= int64(len(data))
+		if addresses, found := c.containers[cacheKey.container]; found {
+			delete(addresses, cacheKey.address)
+			if len(addresses) == 0 {
+				delete(c.containers, cacheKey.container)
+			}
+		}
+	}
+	return &c
+}
+
+// Get cached data, which must not be modified
+func (c *dataCache) Get(container string, address int64) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if value, found := c.entries.Get(dataCacheKey{container: container, address: address}); found {
+		c.hits++
+		data, _ := value.([]byte)
+		return data, true
+	}
+	c.misses++
+	return nil, false
+}
+
+// Check if data of a given size can be kept in the cache
+func (c *dataCache) accepts(size int64) bool {
+	return size <= c.maxFileSize && size <= c.maxBytes
+}
+
+func (c *dataCache) Add(container string, address int64, data []byte) {
+	size := int64(len(data))
+	if !c.accepts(size) {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := dataCacheKey{container: container, address: address}
+	if _, found := c.entries.Get(key); found {
+		return
+	}
+	for c.bytes+size > c.maxBytes && c.entries.Len() > 0 {
+		c.entries.RemoveOldest()
+	}
+	c.entries.Add(key, data)
+	c.bytes += size
+	addresses, found := c.containers[container]
+	if !found {
+		addresses = make(map[int64]bool)
+		c.containers[container] = addresses
+	}
+	addresses[address] = true
+}
+
+func (c *dataCache) Invalidate(container string, address int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries.Remove(dataCacheKey{container: container, address: address})
+}
+
+// Invalidate all entries of a container, when it is moved or removed
+func (c *dataCache) InvalidateContainer(container string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for address := range c.containers[container] {
+		c.entries.Remove(dataCacheKey{container: container, address: address})
+	}
+}
+
+func (c *dataCache) Stats() DataCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return DataCacheStats{
+		Entries: c.entries.Len(),
+		Bytes:   c.bytes,
+		Hits:    c.hits,
+		Misses:  c.misses,
+	}
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/t-mind/flocons/config"
+	. "github.com/t-mind/flocons/error"
+)
+
+// Paths of a directory on each disk of the storage, the main path first
+// Directories are mirrored on all disks while containers are spread across them
+func (s *DiskStorage) diskPaths(p string) []string {
+	relative := s.makeRelative(p)
+	paths := make([]string, len(s.paths))
+	for i, root := range s.paths {
+		paths[i] = filepath.Join(root, relative)
+	}
+	return paths
+}
+
+// Paths where containers of a directory can be found: on each disk, then on the cold tier
+func (s *DiskStorage) containerPaths(p string) []string {
+	paths := s.diskPaths(p)
+	if s.config.Storage.ColdPath != "" {
+		paths = append(paths, filepath.Join(s.config.Storage.ColdPath, s.makeRelative(p)))
+	}
+	return paths
+}
+
+func (s *DiskStorage) makeRelative(p string) string {
+	for _, root := range s.paths {
+		if p == root || strings.HasPrefix(p, root+string(filepath.Separator)) {
+			return strings.TrimPrefix(p, root)
+		}
+	}
+	return p
+}
+
+// Find a directory on the first disk where it is readable, so that losing a disk doesn't hide directories
+func (s *DiskStorage) findDirectory(p string) (string, os.FileInfo, error) {
+	var firstErr error
+	for _, fullPath := range s.diskPaths(p) {
+		fi, err := s.fs.Stat(fullPath)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if !fi.IsDir() {
+			return "", nil, NewIsNotDirError(p)
+		}
+		return fullPath, fi, nil
+	}
+	return "", nil, firstErr
+}
+
+// Roots of the disks where a new container can be created, in order of preference
+func (s *DiskStorage) placementPaths() []string {
+	s.placementMutex.Lock()
+	defer s.placementMutex.Unlock()
+
+	paths := make([]string, 0, len(s.paths))
+	if s.config.Storage.Placement == config.PLACEMENT_FREE_SPACE {
+		freeSpaces := make(map[string]int64)
+		for _, root := range s.paths {
+			if freeSpace, err := diskFreeSpace(root); err == nil {
+				freeSpaces[root] = freeSpace
+				paths = append(paths, root)
+			} else {
+				logger.Warnf("Could not get free space of %s: %s", root, err)
+			}
+		}
+		if len(paths) > 0 {
+			sort.SliceStable(paths, func(i, j int) bool { return freeSpaces[paths[i]] > freeSpaces[paths[j]] })
+			return paths
+		}
+		// Free space is unknown, let's spread containers evenly
+	}
+
+	for i := range s.paths {
+		paths = append(paths, s.paths[(s.nextPath+i)%len(s.paths)])
+	}
+	s.nextPath = (s.nextPath + 1) % len(s.paths)
+	return paths
+}
+
+// Check that a disk is a writeable directory
+func checkDiskPath(fs VFS, p string) error {
+	fi, err := fs.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return NewIsNotDirError(p)
+	}
+	testPath := filepath.Join(p, "flocons-test")
+	if file, err := fs.Create(testPath); err == nil {
+		file.Close()
+	} else {
+		return os.ErrPermission
+	}
+	if fs.Remove(testPath) != nil {
+		return os.ErrPermission
+	}
+	return nil
+}
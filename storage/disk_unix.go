@@ -0,0 +1,16 @@
+// +build !windows
+
+package storage
+
+import (
+	"syscall"
+)
+
+// Number of bytes available to write on the disk of a path
+func diskFreeSpace(p string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(p, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
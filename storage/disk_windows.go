@@ -0,0 +1,12 @@
+// +build windows
+
+package storage
+
+import (
+	. "github.com/t-mind/flocons/error"
+)
+
+// Number of bytes available to write on the disk of a path
+func diskFreeSpace(p string) (int64, error) {
+	return 0, NewInternalError("free space of " + p + " is not available on windows")
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Operations of a VFS in which faults can be injected
+const (
+	FAULT_OPEN     string = "open" // Open, OpenFile and Create
+	FAULT_STAT     string = "stat"
+	FAULT_READDIR  string = "readdir" // ReadDir, Glob and Readdir
+	FAULT_MKDIR    string = "mkdir"
+	FAULT_RENAME   string = "rename"
+	FAULT_REMOVE   string = "remove"
+	FAULT_READ     string = "read"
+	FAULT_WRITE    string = "write"
+	FAULT_SYNC     string = "sync"
+	FAULT_TRUNCATE string = "truncate"
+	FAULT_CHMOD    string = "chmod" // Chmod and Chtimes
+)
+
+// Fault to inject in a FaultyFS
+type Fault struct {
+	Op      string // operation to fail
+	Pattern string // glob matched against the base name of files, any file if empty
+	Nth     int    // only fail the nth matching operation, counted from 1. Every matching operation fails if 0
+	Err     error  // error of the failing operation, EIO if nil
+	// For writes, number of bytes accepted by matching files before writes are cut short, like on a full disk
+	// Nth is ignored if set
+	AfterBytes int64
+}
+
+// VFS failing on scripted operations, for tests
+type FaultyFS struct {
+	fs     VFS
+	mutex  *sync.Mutex
+	faults []*injectedFault
+	counts map[string]int
+}
+
+type injectedFault struct {
+	Fault
+	matched int
+	written int64
+}
+
+type faultyFile struct {
+	File
+	fs *FaultyFS
+}
+
+func NewFaultyFS(fs VFS) *FaultyFS {
+	return &FaultyFS{
+		fs:     fs,
+		mutex:  &sync.Mutex{},
+		faults: make([]*injectedFault, 0),
+		counts: make(map[string]int),
+	}
+}
+
+func (f *FaultyFS) Inject(fault Fault) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if fault.Err == nil {
+		fault.Err = syscall.EIO
+	}
+	f.faults = append(f.faults, &injectedFault{Fault: fault})
+}
+
+// Remove all injected faults
+func (f *FaultyFS) Clear() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.faults = make([]*injectedFault, 0)
+}
+
+// Number of operations of a kind done so far, failed or not
+func (f *FaultyFS) Count(op string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.counts[op]
+}
+
+// Check if an operation on a file must fail, and for writes the number of bytes to write before failing
+func (f *FaultyFS) check(op string, name string, size int) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.counts[op]++
+	for _, fault := range f.faults {
+		if fault.Op != op {
+			continue
+		}
+		if fault.Pattern != "" {
+			if matched, _ := filepath.Match(fault.Pattern, filepath.Base(name)); !matched {
+				continue
+			}
+		}
+		if op == FAULT_WRITE && fault.AfterBytes > 0 {
+			allowed := fault.AfterBytes - fault.written
+			if allowed >= int64(size) {
+				fault.written += int64(size)
+				continue
+			}
+			if allowed < 0 {
+				allowed = 0
+			}
+			fault.written += allowed
+			return int(allowed), &os.PathError{Op: op, Path: name, Err: fault.Err}
+		}
+		fault.matched++
+		if fault.Nth == 0 || fault.matched == fault.Nth {
+			return 0, &os.PathError{Op: op, Path: name, Err: fault.Err}
+		}
+	}
+	return size, nil
+}
+
+func (f *FaultyFS) wrap(file File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{File: file, fs: f}, nil
+}
+
+func (f *FaultyFS) Open(name string) (File, error) {
+	if _, err := f.check(FAULT_OPEN, name, 0); err != nil {
+		return nil, err
+	}
+	return f.wrap(f.fs.Open(name))
+}
+
+func (f *FaultyFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if _, err := f.check(FAULT_OPEN, name, 0); err != nil {
+		return nil, err
+	}
+	return f.wrap(f.fs.OpenFile(name, flag, perm))
+}
+
+func (f *FaultyFS) Create(name string) (File, error) {
+	if _, err := f.check(FAULT_OPEN, name, 0); err != nil {
+		return nil, err
+	}
+	return f.wrap(f.fs.Create(name))
+}
+
+func (f *FaultyFS) Stat(name string) (os.FileInfo, error) {
+	if _, err := f.check(FAULT_STAT, name, 0); err != nil {
+		return nil, err
+	}
+	return f.fs.Stat(name)
+}
+
+func (f *FaultyFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	if _, err := f.check(FAULT_READDIR, dirname, 0); err != nil {
+		return nil, err
+	}
+	return f.fs.ReadDir(dirname)
+}
+
+func (f *FaultyFS) Glob(pattern string) ([]string, error) {
+	if _, err := f.check(FAULT_READDIR, filepath.Dir(pattern), 0); err != nil {
+		return nil, err
+	}
+	return f.fs.Glob(pattern)
+}
+
+func (f *FaultyFS) Mkdir(name string, perm os.FileMode) error {
+	if _, err := f.check(FAULT_MKDIR, name, 0); err != nil {
+		return err
+	}
+	return f.fs.Mkdir(name, perm)
+}
+
+func (f *FaultyFS) MkdirAll(path string, perm os.FileMode) error {
+	if _, err := f.check(FAULT_MKDIR, path, 0); err != nil {
+		return err
+	}
+	return f.fs.MkdirAll(path, perm)
+}
+
+func (f *FaultyFS) Rename(oldpath string, newpath string) error {
+	if _, err := f.check(FAULT_RENAME, newpath, 0); err != nil {
+		return err
+	}
+	return f.fs.Rename(oldpath, newpath)
+}
+
+func (f *FaultyFS) Remove(name string) error {
+	if _, err := f.check(FAULT_REMOVE, name, 0); err != nil {
+		return err
+	}
+	return f.fs.Remove(name)
+}
+
+func (f *FaultyFS) RemoveAll(path string) error {
+	if _, err := f.check(FAULT_REMOVE, path, 0); err != nil {
+		return err
+	}
+	return f.fs.RemoveAll(path)
+}
+
+func (f *FaultyFS) Chmod(name string, mode os.FileMode) error {
+	if _, err := f.check(FAULT_CHMOD, name, 0); err != nil {
+		return err
+	}
+	return f.fs.Chmod(name, mode)
+}
+
+func (f *FaultyFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if _, err := f.check(FAULT_CHMOD, name, 0); err != nil {
+		return err
+	}
+	return f.fs.Chtimes(name, atime, mtime)
+}
+
+func (f *faultyFile) Read(p []byte) (int, error) {
+	if _, err := f.fs.check(FAULT_READ, f.Name(), len(p)); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultyFile) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := f.fs.check(FAULT_READ, f.Name(), len(p)); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+// A failing write may still write the first bytes, like a short write on a full disk
+func (f *faultyFile) Write(p []byte) (int, error) {
+	n, err := f.fs.check(FAULT_WRITE, f.Name(), len(p))
+	if err != nil {
+		if n > 0 {
+			n, _ = f.File.Write(p[:n])
+		}
+		return n, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultyFile) Readdir(n int) ([]os.FileInfo, error) {
+	if _, err := f.fs.check(FAULT_READDIR, f.Name(), 0); err != nil {
+		return nil, err
+	}
+	return f.File.Readdir(n)
+}
+
+func (f *faultyFile) Sync() error {
+	if _, err := f.fs.check(FAULT_SYNC, f.Name(), 0); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *faultyFile) Truncate(size int64) error {
+	if _, err := f.fs.check(FAULT_TRUNCATE, f.Name(), 0); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
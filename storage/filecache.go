@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// Cache of read only file handles, shared between goroutines which must only use positional reads
+// A handle evicted from the cache is closed once all its users have released it
+type fileHandleCache struct {
+	fs      VFS
+	mutex   *sync.Mutex
+	handles *lru.Cache
+}
+
+type fileHandle struct {
+	File
+	users   int
+	evicted bool
+}
+
+func newFileHandleCache(fs VFS, size int) *fileHandleCache {
+	c := fileHandleCache{
+		fs:      fs,
+		mutex:   &sync.Mutex{},
+		handles: lru.New(size),
+	}
+	c.handles.OnEvicted = func(key lru.Key, value interface{}) {
+		handle, _ := value.(*fileHandle)
+		handle.evicted = true
+		if handle.users == 0 {
+			handle.Close()
+		}
+	}
+	return &c
+}
+
+// Get a read only handle on a file, opening it if not yet in cache
+// The handle must be released after use
+func (c *fileHandleCache) Acquire(p string) (*fileHandle, error) {
+	if handle := c.get(p); handle != nil {
+		return handle, nil
+	}
+
+	// Don't hold the lock while opening the file
+	f, err := c.fs.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if rawHandle, found := c.handles.Get(p); found {
+		// Somebody opened it in the meantime
+		f.Close()
+		handle, _ := rawHandle.(*fileHandle)
+		handle.users++
+		return handle, nil
+	}
+	handle := &fileHandle{File: f, users: 1}
+	c.handles.Add(p, handle)
+	return handle, nil
+}
+
+func (c *fileHandleCache) get(p string) *fileHandle {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if rawHandle, found := c.handles.Get(p); found {
+		handle, _ := rawHandle.(*fileHandle)
+		handle.users++
+		return handle
+	}
+	return nil
+}
+
+func (c *fileHandleCache) Release(handle *fileHandle) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	handle.users--
+	if handle.users == 0 && handle.evicted {
+		handle.Close()
+	}
+}
+
+// Forget the handle of a file, which will be closed once released by all its users
+func (c *fileHandleCache) Remove(p string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.handles.Remove(p)
+}
+
+func (c *fileHandleCache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.handles.Clear()
+}
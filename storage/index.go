@@ -3,6 +3,7 @@ package storage
 import (
 	"encoding/csv"
 	"math"
+	"sort"
 
 	"github.com/t-mind/flocons/config"
 	"github.com/t-mind/flocons/file"
@@ -21,6 +22,13 @@ import (
 
 var indexRegexp, _ = regexp.Compile(`^index_(([^_]+)_([^_]+)_v([0-9]+)_([0-9]+)).csv$`)
 
+// Address of the entries removing a file from the index
+// Containers are append only, so removals and metadata changes are only written in the index
+const TOMBSTONE_ADDRESS int64 = -1
+
+// Fields of an index record: name, address, mode, size and modification time, optionally followed by the digest of the data
+const INDEX_RECORD_FIELDS int = 5
+
 func IsRegularFileContainerIndex(name string) bool {
 	return indexRegexp.MatchString(name)
 }
@@ -30,20 +38,39 @@ func NewRegularFileContainerIndexName(shard string, node string, number int) str
 }
 
 type RegularFileContainerIndex struct {
-	Name       string
-	Node       string
-	Shard      string
-	Version    int
-	Number     int
-	path       string
-	config     *config.Config
-	entries    map[string]os.FileInfo
-	lastSize   int64
-	writeFd    *os.File
-	writeMutex *sync.Mutex
+	Name         string
+	Node         string
+	Shard        string
+	Version      int
+	Number       int
+	path         string
+	pathMutex    *sync.RWMutex // path changes when the index is moved to the cold tier
+	config       *config.Config
+	entries      map[string]os.FileInfo
+	entriesMutex *sync.RWMutex // entries are changed by writes and by reads of the index file while listings read them
+	sortedNames  []string      // names of the entries sorted for paginated listings, possibly with removed ones
+	addedNames   []string      // names added since sortedNames was built
+	lastSize     int64
+	syncedSize   int64         // size of the index file at the last publication
+	unsynced     []indexChange // changes written after the last publication, only visible once synced and journaled
+	updateMutex  *sync.Mutex
+	onUpdate     func(string, os.FileInfo) // called with the event of each entry read from the index file after it has been opened
+	fs           VFS
+	writeFd      File
+	writeMutex   *sync.Mutex
+}
+
+// Change of an entry written in the index file, a nil file info being a removal
+type indexChange struct {
+	name string
+	fi   os.FileInfo
 }
 
 func NewRegularFileContainerIndex(directory string, name string, config *config.Config) (*RegularFileContainerIndex, error) {
+	return openRegularFileContainerIndex(OS, directory, name, config)
+}
+
+func openRegularFileContainerIndex(fs VFS, directory string, name string, config *config.Config) (*RegularFileContainerIndex, error) {
 	fullpath := filepath.Join(directory, name)
 	parts := indexRegexp.FindStringSubmatch(name)
 	if parts == nil {
@@ -54,24 +81,28 @@ func NewRegularFileContainerIndex(directory string, name string, config *config.
 	version, _ := strconv.Atoi(parts[4])
 	number, _ := strconv.Atoi(parts[5])
 	index := RegularFileContainerIndex{
-		Name:       name,
-		Node:       node,
-		Shard:      shard,
-		Version:    version,
-		Number:     number,
-		path:       fullpath,
-		config:     config,
-		entries:    make(map[string]os.FileInfo),
-		writeMutex: &sync.Mutex{},
-	}
-	_, err := os.Stat(fullpath)
+		Name:         name,
+		Node:         node,
+		Shard:        shard,
+		Version:      version,
+		Number:       number,
+		path:         fullpath,
+		pathMutex:    &sync.RWMutex{},
+		updateMutex:  &sync.Mutex{},
+		fs:           fs,
+		config:       config,
+		entries:      make(map[string]os.FileInfo),
+		entriesMutex: &sync.RWMutex{},
+		writeMutex:   &sync.Mutex{},
+	}
+	_, err := fs.Stat(fullpath)
 	if err != nil {
 		// We didn't find the index file or we have a permission problem
 		if !os.IsNotExist(err) || node != config.Node.Name {
 			return nil, err
 		}
 		// It can be normal if we dind't find the file and we are on the same node, let's create it
-		f, err := os.Create(fullpath)
+		f, err := fs.Create(fullpath)
 		if err != nil {
 			return nil, err
 		}
@@ -82,29 +113,34 @@ func NewRegularFileContainerIndex(directory string, name string, config *config.
 	if err != nil {
 		return nil, err
 	}
+	index.syncedSize = index.lastSize
 	return &index, nil
 }
 
 func FindRegularFileContainerIndex(directory string, shard string, node string, number int, config *config.Config) (*RegularFileContainerIndex, error) {
+	return findRegularFileContainerIndex(OS, directory, shard, node, number, config)
+}
+
+func findRegularFileContainerIndex(fs VFS, directory string, shard string, node string, number int, config *config.Config) (*RegularFileContainerIndex, error) {
 	pattern := fmt.Sprintf("%s_%s_%s_v*_%d.csv", filepath.Join(directory, "index"), shard, node, number)
-	matches, err := filepath.Glob(pattern)
+	matches, err := fs.Glob(pattern)
 	if err != nil {
 		return nil, err
 	}
 	if len(matches) == 0 {
 		return nil, NewFileNotFoundError(pattern)
 	}
-	return NewRegularFileContainerIndex(directory, filepath.Base(matches[0]), config)
+	return openRegularFileContainerIndex(fs, directory, filepath.Base(matches[0]), config)
 }
 
 func (i *RegularFileContainerIndex) GetRegularFile(name string) (os.FileInfo, error) {
-	entry, found := i.entries[name]
+	entry, found := i.entry(name)
 	if !found {
 		err := i.updateEntries()
 		if err != nil {
 			return nil, err
 		}
-		entry, found = i.entries[name]
+		entry, found = i.entry(name)
 	}
 	if found {
 		return entry, nil
@@ -112,6 +148,123 @@ func (i *RegularFileContainerIndex) GetRegularFile(name string) (os.FileInfo, er
 	return nil, NewFileNotFoundError(name)
 }
 
+// Entry of a file as already read from the index file
+func (i *RegularFileContainerIndex) entry(name string) (os.FileInfo, bool) {
+	i.entriesMutex.RLock()
+	defer i.entriesMutex.RUnlock()
+	entry, found := i.entries[name]
+	return entry, found
+}
+
+func (i *RegularFileContainerIndex) setEntry(name string, fi os.FileInfo) {
+	i.entriesMutex.Lock()
+	defer i.entriesMutex.Unlock()
+	if _, found := i.entries[name]; !found && i.sortedNames != nil {
+		i.addedNames = append(i.addedNames, name)
+	}
+	i.entries[name] = fi
+}
+
+func (i *RegularFileContainerIndex) removeEntry(name string) {
+	i.entriesMutex.Lock()
+	defer i.entriesMutex.Unlock()
+	delete(i.entries, name)
+}
+
+// Entry of a file including the changes written but not synced yet, so that new changes are based on them
+func (i *RegularFileContainerIndex) latestEntry(name string) (os.FileInfo, bool) {
+	i.writeMutex.Lock()
+	defer i.writeMutex.Unlock()
+	for j := len(i.unsynced) - 1; j >= 0; j-- {
+		if i.unsynced[j].name == name {
+			return i.unsynced[j].fi, i.unsynced[j].fi != nil
+		}
+	}
+	return i.entry(name)
+}
+
+// Keep a written change until it is published, must be called with write lock
+func (i *RegularFileContainerIndex) publish(change indexChange) {
+	i.unsynced = append(i.unsynced, change)
+}
+
+func (i *RegularFileContainerIndex) apply(change indexChange) {
+	if change.fi == nil {
+		i.removeEntry(change.name)
+	} else {
+		i.setEntry(change.name, change.fi)
+	}
+}
+
+// Sorted names of the entries, only sorting the names added since the last call
+// The returned slice is never changed afterwards, so that it can be read without lock
+func (i *RegularFileContainerIndex) sortNames() []string {
+	i.entriesMutex.Lock()
+	defer i.entriesMutex.Unlock()
+	if i.sortedNames == nil {
+		names := make([]string, 0, len(i.entries))
+		for name := range i.entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		i.sortedNames = names
+		i.addedNames = nil
+	} else if len(i.addedNames) > 0 || len(i.sortedNames) > 2*len(i.entries) {
+		// Merge the added names, dropping the removed ones and the names added again after a removal
+		sort.Strings(i.addedNames)
+		names := make([]string, 0, len(i.entries))
+		sorted, added := i.sortedNames, i.addedNames
+		for len(sorted) > 0 || len(added) > 0 {
+			var name string
+			if len(added) == 0 || (len(sorted) > 0 && sorted[0] < added[0]) {
+				name, sorted = sorted[0], sorted[1:]
+			} else {
+				name, added = added[0], added[1:]
+			}
+			if _, found := i.entries[name]; found && (len(names) == 0 || names[len(names)-1] != name) {
+				names = append(names, name)
+			}
+		}
+		i.sortedNames = names
+		i.addedNames = nil
+	}
+	return i.sortedNames
+}
+
+// Call fn on the files of the index with a name after the given one, sorted by name
+// A page of a listing only costs the lookup of its first name, and the names added since the previous page are sorted
+func (i *RegularFileContainerIndex) WalkSortedFiles(after string, fn func(os.FileInfo) error) error {
+	if err := i.updateEntries(); err != nil {
+		return err
+	}
+	names := i.sortNames()
+	start := sort.SearchStrings(names, after)
+	for _, name := range names[start:] {
+		if name == after {
+			continue
+		}
+		// The name may have been removed since names were sorted
+		if fi, found := i.entry(name); found {
+			if err := fn(fi); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Copy of the entries, which can be walked while the index changes
+func (i *RegularFileContainerIndex) entriesSnapshot() []os.FileInfo {
+	i.entriesMutex.RLock()
+	defer i.entriesMutex.RUnlock()
+	files := make([]os.FileInfo, 0, len(i.entries))
+	for _, fi := range i.entries {
+		files = append(files, fi)
+	}
+	return files
+}
+
+// Add a file to the index, replacing the entry with the same name if any
 func (i *RegularFileContainerIndex) AddRegularFile(f os.FileInfo) error {
 	storageFileInfo, ok := f.(*file.FileInfo)
 	if !ok {
@@ -120,9 +273,51 @@ func (i *RegularFileContainerIndex) AddRegularFile(f os.FileInfo) error {
 
 	i.writeMutex.Lock()
 	defer i.writeMutex.Unlock()
+	i.updateMutex.Lock()
+	defer i.updateMutex.Unlock()
+	record := []string{
+		storageFileInfo.Name(),
+		strconv.FormatInt(storageFileInfo.Address(), 10),
+		strconv.FormatUint((uint64)(storageFileInfo.Mode()), 8),
+		strconv.FormatInt(storageFileInfo.Size(), 10),
+		strconv.FormatInt(storageFileInfo.ModTime().Unix(), 10),
+	}
+	if digest := storageFileInfo.Digest(); digest != "" {
+		record = append(record, digest)
+	}
+	err := i.writeRecord(record)
+	if err != nil {
+		return err
+	}
+	i.publish(indexChange{name: storageFileInfo.Name(), fi: storageFileInfo})
+	return nil
+}
+
+// Remove a file from the index with a tombstone entry, its data staying in the container
+func (i *RegularFileContainerIndex) RemoveRegularFile(name string) error {
+	i.writeMutex.Lock()
+	defer i.writeMutex.Unlock()
+	i.updateMutex.Lock()
+	defer i.updateMutex.Unlock()
+	err := i.writeRecord([]string{
+		name,
+		strconv.FormatInt(TOMBSTONE_ADDRESS, 10),
+		"0",
+		"0",
+		strconv.FormatInt(time.Now().Unix(), 10),
+	})
+	if err != nil {
+		return err
+	}
+	i.publish(indexChange{name: name})
+	return nil
+}
 
+// Append a line to the index file, must be called with write and update locks
+// so that the new line is not read again as a change from another process
+func (i *RegularFileContainerIndex) writeRecord(record []string) error {
 	if i.writeFd == nil {
-		f, err := os.OpenFile(i.path, os.O_RDWR|os.O_CREATE, 0644)
+		f, err := i.fs.OpenFile(i.path, os.O_RDWR|os.O_CREATE, 0644)
 		if err != nil {
 			return err
 		}
@@ -132,32 +327,100 @@ func (i *RegularFileContainerIndex) AddRegularFile(f os.FileInfo) error {
 		i.writeFd = f
 	}
 
-	writer := csv.NewWriter(i.writeFd)
-	err := writer.Write([]string{
-		storageFileInfo.Name(),
-		strconv.FormatInt(storageFileInfo.Address(), 10),
-		strconv.FormatUint((uint64)(storageFileInfo.Mode()), 8),
-		strconv.FormatInt(storageFileInfo.Size(), 10),
-		strconv.FormatInt(storageFileInfo.ModTime().Unix(), 10),
-	})
+	offset, err := i.writeFd.Seek(0, os.SEEK_CUR)
 	if err != nil {
+		i.writeFd.Close()
+		i.writeFd = nil
+		return err
+	}
+	writer := csv.NewWriter(i.writeFd)
+	if err := writer.Write(record); err != nil {
+		i.rollback(offset)
 		return err
 	}
 	writer.Flush()
+	if err := writer.Error(); err != nil {
+		i.rollback(offset)
+		return err
+	}
 	i.lastSize, _ = i.writeFd.Seek(0, os.SEEK_CUR)
-	i.entries[storageFileInfo.Name()] = storageFileInfo
-	return i.writeFd.Sync()
+	return nil
+}
+
+// Sync on disk the entries added to the index, they become visible with Publish
+// If the sync fails, the entries written since the last publication are dropped so that they never become visible
+func (i *RegularFileContainerIndex) Sync() error {
+	i.writeMutex.Lock()
+	defer i.writeMutex.Unlock()
+	if i.writeFd == nil {
+		return nil
+	}
+	i.updateMutex.Lock()
+	defer i.updateMutex.Unlock()
+	if err := i.writeFd.Sync(); err != nil {
+		i.discardUnsynced()
+		return err
+	}
+	return nil
+}
+
+// Make visible the entries written since the last publication
+func (i *RegularFileContainerIndex) Publish() {
+	i.writeMutex.Lock()
+	defer i.writeMutex.Unlock()
+	i.updateMutex.Lock()
+	defer i.updateMutex.Unlock()
+	for _, change := range i.unsynced {
+		i.apply(change)
+	}
+	i.unsynced = nil
+	i.syncedSize = i.lastSize
+}
+
+// Drop the entries written since the last publication, when the data of their files could not be synced or journaled
+func (i *RegularFileContainerIndex) Discard() {
+	i.writeMutex.Lock()
+	defer i.writeMutex.Unlock()
+	if i.writeFd == nil {
+		i.unsynced = nil
+		return
+	}
+	i.updateMutex.Lock()
+	defer i.updateMutex.Unlock()
+	i.discardUnsynced()
+}
+
+// Drop the entries written since the last publication, must be called with write and update locks
+func (i *RegularFileContainerIndex) discardUnsynced() {
+	logger.Warnf("Drop %d changes of index %s which could not be synced", len(i.unsynced), i.Name)
+	i.rollback(i.syncedSize)
+	i.lastSize = i.syncedSize
+	i.unsynced = nil
 }
 
 func (i *RegularFileContainerIndex) ListFiles() ([]os.FileInfo, error) {
+	files := make([]os.FileInfo, 0)
+	err := i.WalkFiles(func(fi os.FileInfo) error {
+		files = append(files, fi)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Call fn on the files of the index, which may change meanwhile as fn is called on a copy of the entries
+func (i *RegularFileContainerIndex) WalkFiles(fn func(os.FileInfo) error) error {
 	if err := i.updateEntries(); err != nil {
-		fmt.Println(err)
+		return err
 	}
-	files := make([]os.FileInfo, 0, len(i.entries))
-	for _, file := range i.entries {
-		files = append(files, file)
+	for _, file := range i.entriesSnapshot() {
+		if err := fn(file); err != nil {
+			return err
+		}
 	}
-	return files, nil
+	return nil
 }
 
 func (i *RegularFileContainerIndex) EstimatedContainerSize() (int64, error) {
@@ -165,7 +428,7 @@ func (i *RegularFileContainerIndex) EstimatedContainerSize() (int64, error) {
 		fmt.Println(err)
 	}
 	var size float64
-	for _, f := range i.entries {
+	for _, f := range i.entriesSnapshot() {
 		storageFileInfo, _ := f.(*file.FileInfo)
 		size = math.Max(size, float64(storageFileInfo.Address()+storageFileInfo.Size()))
 	}
@@ -173,12 +436,16 @@ func (i *RegularFileContainerIndex) EstimatedContainerSize() (int64, error) {
 }
 
 func (i *RegularFileContainerIndex) updateEntries() error {
-	fi, err := os.Stat(i.path)
+	i.updateMutex.Lock()
+	defer i.updateMutex.Unlock()
+	i.pathMutex.RLock()
+	defer i.pathMutex.RUnlock()
+	fi, err := i.fs.Stat(i.path)
 	if err != nil {
 		return err
 	}
 	if fi.Size() > i.lastSize {
-		f, err := os.Open(i.path)
+		f, err := i.fs.Open(i.path)
 		if err != nil {
 			return err
 		}
@@ -189,26 +456,44 @@ func (i *RegularFileContainerIndex) updateEntries() error {
 		}
 
 		reader := csv.NewReader(f)
-		reader.FieldsPerRecord = 5
+		// The digest of the data is only written since it is computed
+		reader.FieldsPerRecord = -1
 		reader.ReuseRecord = true
 		for {
 			record, err := reader.Read()
 			if err == io.EOF {
 				break
 			}
-			if err == nil {
+			if err == nil && (len(record) == INDEX_RECORD_FIELDS || len(record) == INDEX_RECORD_FIELDS+1) {
 				name := record[0]
 				address, _ := strconv.ParseInt(record[1], 10, 64)
 				mode, _ := strconv.ParseUint(record[2], 8, 32)
 				size, _ := strconv.ParseInt(record[3], 10, 64)
 				modTime, _ := strconv.ParseInt(record[4], 10, 64)
+				digest := ""
+				if len(record) > INDEX_RECORD_FIELDS {
+					digest = record[INDEX_RECORD_FIELDS]
+				}
 
-				i.entries[name] = file.NewFileInfo(name,
+				fi := file.NewFileInfo(name,
 					(os.FileMode)(mode), size, time.Unix(modTime, 0),
 					file.FileDataSource{
-						Node:    i.Node,
-						Address: address,
+						Node:      i.Node,
+						Shard:     i.Shard,
+						Container: NewRegularFileContainerName(i.Shard, i.Node, i.Number),
+						Address:   address,
+						Digest:    digest,
 					})
+				event := EVENT_CREATE
+				if address == TOMBSTONE_ADDRESS {
+					event = EVENT_DELETE
+					i.removeEntry(name)
+				} else {
+					i.setEntry(name, fi)
+				}
+				if i.onUpdate != nil {
+					i.onUpdate(event, fi)
+				}
 			}
 		}
 
@@ -217,7 +502,20 @@ func (i *RegularFileContainerIndex) updateEntries() error {
 	return nil
 }
 
+// Drop a partially written line, must be called with write lock
+func (i *RegularFileContainerIndex) rollback(offset int64) {
+	if err := i.writeFd.Truncate(offset); err != nil {
+		logger.Errorf("Could not roll back index %s to %d: %s", i.path, offset, err)
+	}
+	if _, err := i.writeFd.Seek(offset, os.SEEK_SET); err != nil {
+		i.writeFd.Close()
+		i.writeFd = nil
+	}
+}
+
 func (i *RegularFileContainerIndex) Close() {
+	i.writeMutex.Lock()
+	defer i.writeMutex.Unlock()
 	if i.writeFd != nil {
 		i.writeFd.Close()
 		i.writeFd = nil
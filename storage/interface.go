@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"os"
+)
+
+// Storage of directories and regular files, used by the servers
+// Regular files are returned as *file.FileInfo giving access to their data
+type Storage interface {
+	CreateDirectory(p string, mode os.FileMode) (os.FileInfo, error)
+	CreateDirectoryAndParents(p string, mode os.FileMode) (os.FileInfo, error)
+	GetDirectory(p string) (os.FileInfo, error)
+	CreateRegularFile(p string, mode os.FileMode, data []byte) (os.FileInfo, error)
+	GetRegularFile(p string) (os.FileInfo, error)
+	GetFile(p string) (os.FileInfo, error)
+	RemoveFile(p string) error
+	UpdateFile(p string, changes FileChanges) (os.FileInfo, error)
+	RenameFile(p string, target string) (os.FileInfo, error)
+	CopyFile(p string, target string) (os.FileInfo, error)
+	ReadDir(directory string) ([]os.FileInfo, error)
+	ReadDirPage(directory string, options ReadDirOptions) ([]os.FileInfo, error)
+	StreamDir(directory string, options ReadDirOptions, fn func(os.FileInfo) error) error
+	Walk(root string, fn WalkFunc) error
+	WalkWithOptions(root string, options WalkOptions, fn WalkFunc) error
+	DirectoryStats(directory string, recursive bool) (*DirectoryStats, error)
+	Watch(p string, options WatchOptions) ([]Event, uint64, error) // events and the sequence number to resume from
+	LastEventSequence() uint64
+	Close()
+	Destroy() error
+}
+
+// Storage caching the data of regular files
+type CachingStorage interface {
+	DataCacheStats() DataCacheStats
+}
+
+// Storage keeping a journal of its mutations
+type JournalingStorage interface {
+	ReadJournal(options JournalReadOptions) ([]JournalRecord, error)
+}
+
+// Storage keeping the versions of a regular file written by several nodes, each node only able to remove its own
+type VersioningStorage interface {
+	GetRegularFileVersions(p string) ([]os.FileInfo, error) // versions in all containers, the first one being the one read
+}
+
+var _ Storage = (*DiskStorage)(nil)
+var _ CachingStorage = (*DiskStorage)(nil)
+var _ JournalingStorage = (*DiskStorage)(nil)
+var _ VersioningStorage = (*DiskStorage)(nil)
+var _ Storage = (*MemoryStorage)(nil)
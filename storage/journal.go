@@ -0,0 +1,453 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/t-mind/flocons/config"
+	. "github.com/t-mind/flocons/error"
+)
+
+const JOURNAL_SEGMENT_PREFIX string = "journal_"
+const JOURNAL_SEGMENT_SUFFIX string = ".csv"
+
+// Number of records returned by a journal read without limit
+const JOURNAL_PAGE_SIZE int = 1000
+
+// Number of records between two offsets kept in the index of a journal segment
+const JOURNAL_INDEX_INTERVAL uint64 = 1000
+
+var errJournalPageFull = errors.New("journal page is full")
+
+// Mutation of the storage, as written in the journal
+type JournalRecord struct {
+	Sequence  uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Directory string    `json:"directory"`
+	Name      string    `json:"name"`
+	Target    string    `json:"target,omitempty"` // new path of a renamed entry
+	Container string    `json:"container,omitempty"`
+	Address   int64     `json:"address"`
+	Size      int64     `json:"size"`
+}
+
+type JournalReadOptions struct {
+	After   uint64          // sequence number of the last record already read
+	Limit   int             // maximum number of records, JOURNAL_PAGE_SIZE if 0
+	Timeout time.Duration   // maximum time to wait for new records, no wait if 0
+	Cancel  <-chan struct{} // stops waiting when closed
+}
+
+// Append-only journal of the mutations of a node
+// It is split in segments named after the sequence number of their first record. A new segment is started
+// when the current one is full and at each start, segments older than the retention are then removed
+type journal struct {
+	fs        VFS
+	directory string
+	config    *config.Config
+	mutex     *sync.Mutex
+	sequence  uint64   // sequence number of the last record
+	segments  []uint64 // first sequence number of each segment, in order
+	writeFd   File
+	writeSize int64
+	changed   chan struct{}            // closed and replaced on each new record
+	offsets   map[uint64][]journalMark // offset of every JOURNAL_INDEX_INTERVAL-th record of each segment, built when first read
+}
+
+// Offset of a record in a journal segment
+type journalMark struct {
+	sequence uint64
+	offset   int64
+}
+
+func openJournal(fs VFS, config *config.Config) (*journal, error) {
+	directory := config.Storage.JournalPath
+	if err := fs.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	j := journal{
+		fs:        fs,
+		directory: directory,
+		config:    config,
+		mutex:     &sync.Mutex{},
+		segments:  make([]uint64, 0),
+		changed:   make(chan struct{}),
+		offsets:   make(map[uint64][]journalMark),
+	}
+
+	prefix := JOURNAL_SEGMENT_PREFIX + config.Node.Name + "_"
+	matches, err := fs.Glob(filepath.Join(directory, prefix+"*"+JOURNAL_SEGMENT_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range matches {
+		first, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(match), prefix), JOURNAL_SEGMENT_SUFFIX), 10, 64)
+		if err != nil {
+			logger.Warnf("Ignore unexpected journal file %s", match)
+			continue
+		}
+		j.segments = append(j.segments, first)
+	}
+	sort.Slice(j.segments, func(a, b int) bool { return j.segments[a] < j.segments[b] })
+
+	// Sequence numbers go on after the last complete record of the last segment
+	if len(j.segments) > 0 {
+		last := j.segments[len(j.segments)-1]
+		j.sequence = last - 1
+		marks, err := j.indexSegment(last, func(record *JournalRecord) {
+			j.sequence = record.Sequence
+		})
+		if err != nil {
+			return nil, err
+		}
+		j.offsets[last] = marks
+	}
+	j.removeExpiredSegments()
+	return &j, nil
+}
+
+func (j *journal) segmentPath(first uint64) string {
+	return filepath.Join(j.directory, fmt.Sprintf("%s%s_%020d%s", JOURNAL_SEGMENT_PREFIX, j.config.Node.Name, first, JOURNAL_SEGMENT_SUFFIX))
+}
+
+// Write records at the end of the journal, syncing them on disk if asked
+// Records are only readable once they are all written and synced, if one of them fails none is kept
+func (j *journal) Append(records []JournalRecord, sync bool) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.writeFd != nil && j.writeSize >= j.config.Storage.JournalSegmentSizeInBytes {
+		if err := j.closeSegment(); err != nil {
+			return err
+		}
+		j.removeExpiredSegments()
+	}
+	if j.writeFd == nil {
+		first := j.sequence + 1
+		f, err := j.fs.Create(j.segmentPath(first))
+		if err != nil {
+			return err
+		}
+		j.writeFd = f
+		j.writeSize = 0
+		// The last segment may have no record if the node stopped just after starting it
+		if len(j.segments) == 0 || j.segments[len(j.segments)-1] != first {
+			j.segments = append(j.segments, first)
+		}
+		j.offsets[first] = nil
+	}
+
+	segment := j.segments[len(j.segments)-1]
+	marks := j.offsets[segment]
+	sequence := j.sequence
+	buffer := bytes.Buffer{}
+	writer := csv.NewWriter(&buffer)
+	for _, record := range records {
+		sequence++
+		if (sequence-segment)%JOURNAL_INDEX_INTERVAL == 0 {
+			marks = append(marks, journalMark{sequence: sequence, offset: j.writeSize + int64(buffer.Len())})
+		}
+		if record.Time.IsZero() {
+			record.Time = time.Now()
+		}
+		writer.Write([]string{
+			strconv.FormatUint(sequence, 10),
+			strconv.FormatInt(record.Time.UnixNano(), 10),
+			record.Type,
+			record.Directory,
+			record.Name,
+			record.Target,
+			record.Container,
+			strconv.FormatInt(record.Address, 10),
+			strconv.FormatInt(record.Size, 10),
+		})
+		writer.Flush()
+	}
+	if _, err := j.writeFd.Write(buffer.Bytes()); err != nil {
+		j.rollback()
+		return err
+	}
+	if sync {
+		if err := j.writeFd.Sync(); err != nil {
+			j.rollback()
+			return err
+		}
+	}
+	j.writeSize += int64(buffer.Len())
+	j.sequence = sequence
+	j.offsets[segment] = marks
+	close(j.changed)
+	j.changed = make(chan struct{})
+	return nil
+}
+
+// Drop records partially written after the last readable one, or start a new segment if that's not possible
+// Must be called with the journal lock
+func (j *journal) rollback() {
+	if err := j.writeFd.Truncate(j.writeSize); err != nil {
+		logger.Errorf("Could not roll back journal to %d: %s", j.writeSize, err)
+		j.writeFd.Close()
+		j.writeFd = nil
+	} else if _, err := j.writeFd.Seek(j.writeSize, os.SEEK_SET); err != nil {
+		j.writeFd.Close()
+		j.writeFd = nil
+	}
+}
+
+// Read the records after a sequence number, waiting for new ones if there are none
+func (j *journal) Read(options JournalReadOptions) ([]JournalRecord, error) {
+	var timeout <-chan time.Time
+	if options.Timeout > 0 {
+		timer := time.NewTimer(options.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		records, changed, err := j.read(options)
+		if err != nil || len(records) > 0 || options.Timeout <= 0 {
+			return records, err
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return records, nil
+		case <-options.Cancel:
+			return records, nil
+		}
+	}
+}
+
+// Read the records after a sequence number, with the channel closed on the next record
+// It fails if some of these records have been removed by retention
+func (j *journal) read(options JournalReadOptions) ([]JournalRecord, <-chan struct{}, error) {
+	j.mutex.Lock()
+	sequence := j.sequence
+	segments := make([]uint64, len(j.segments))
+	copy(segments, j.segments)
+	changed := j.changed
+	j.mutex.Unlock()
+
+	records := make([]JournalRecord, 0)
+	if options.After == sequence {
+		return records, changed, nil
+	}
+	if options.After > sequence || len(segments) == 0 || options.After+1 < segments[0] {
+		return nil, nil, NewEventsLostError(options.After)
+	}
+	limit := options.Limit
+	if limit <= 0 {
+		limit = JOURNAL_PAGE_SIZE
+	}
+
+	start := sort.Search(len(segments), func(i int) bool { return segments[i] > options.After+1 }) - 1
+	for _, first := range segments[start:] {
+		offset, err := j.offset(first, options.After+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = j.readSegment(first, offset, func(record *JournalRecord, end int64) error {
+			if record.Sequence <= options.After {
+				return nil
+			}
+			// Later records may be in the middle of being written
+			if record.Sequence > sequence || len(records) == limit {
+				return errJournalPageFull
+			}
+			records = append(records, *record)
+			return nil
+		})
+		if err == errJournalPageFull {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return records, changed, nil
+}
+
+// Offset in a segment from which to read a record, indexing the segment if it's not done yet
+func (j *journal) offset(first uint64, sequence uint64) (int64, error) {
+	j.mutex.Lock()
+	marks, found := j.offsets[first]
+	j.mutex.Unlock()
+	if !found {
+		// Only the last segment is written and it is always indexed, others can be indexed without lock
+		var err error
+		if marks, err = j.indexSegment(first, nil); err != nil {
+			return 0, err
+		}
+		j.mutex.Lock()
+		j.offsets[first] = marks
+		j.mutex.Unlock()
+	}
+	i := sort.Search(len(marks), func(i int) bool { return marks[i].sequence > sequence }) - 1
+	if i < 0 {
+		return 0, nil
+	}
+	return marks[i].offset, nil
+}
+
+// Read a whole segment to find the offset of every JOURNAL_INDEX_INTERVAL-th record, calling fn on each record if not nil
+func (j *journal) indexSegment(first uint64, fn func(*JournalRecord)) ([]journalMark, error) {
+	marks := make([]journalMark, 0)
+	offset := int64(0)
+	err := j.readSegment(first, 0, func(record *JournalRecord, end int64) error {
+		if (record.Sequence-first)%JOURNAL_INDEX_INTERVAL == 0 {
+			marks = append(marks, journalMark{sequence: record.Sequence, offset: offset})
+		}
+		offset = end
+		if fn != nil {
+			fn(record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return marks, nil
+}
+
+// Call fn on each record of a segment from an offset with the offset of its end, stopping at the first error returned by fn
+// A record not ending with a new line at the end of the segment, left by a crash, is ignored
+func (j *journal) readSegment(first uint64, offset int64, fn func(*JournalRecord, int64) error) error {
+	f, err := j.fs.Open(j.segmentPath(first))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NewEventsLostError(first - 1)
+		}
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, os.SEEK_SET); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := readJournalLine(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			logger.Warnf("Ignore truncated record at the end of journal segment %s", j.segmentPath(first))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(len(line))
+		record, err := parseJournalRecord(line)
+		if err != nil {
+			logger.Warnf("Stop reading journal segment %s at invalid record: %s", j.segmentPath(first), err)
+			return nil
+		}
+		if err := fn(record, offset); err != nil {
+			return err
+		}
+	}
+}
+
+// Read the csv line of a record, a new line inside a quoted field not ending it
+// It returns io.ErrUnexpectedEOF if the file ends before the end of the line
+func readJournalLine(reader *bufio.Reader) ([]byte, error) {
+	line := make([]byte, 0, 128)
+	for {
+		part, err := reader.ReadBytes('\n')
+		line = append(line, part...)
+		if err == io.EOF && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Quotes inside quoted fields are doubled, so the line ends once they are balanced
+		if bytes.Count(line, []byte{'"'})%2 == 0 {
+			return line, nil
+		}
+	}
+}
+
+func parseJournalRecord(line []byte) (*JournalRecord, error) {
+	reader := csv.NewReader(bytes.NewReader(line))
+	reader.FieldsPerRecord = 9
+	fields, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	record := JournalRecord{
+		Type:      fields[2],
+		Directory: fields[3],
+		Name:      fields[4],
+		Target:    fields[5],
+		Container: fields[6],
+	}
+	var nanoseconds int64
+	if record.Sequence, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+		return nil, err
+	}
+	if nanoseconds, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return nil, err
+	}
+	record.Time = time.Unix(0, nanoseconds)
+	if record.Address, err = strconv.ParseInt(fields[7], 10, 64); err != nil {
+		return nil, err
+	}
+	if record.Size, err = strconv.ParseInt(fields[8], 10, 64); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Remove the segments not written since the retention, except the last one which holds the last sequence number
+// Must be called with the journal lock
+func (j *journal) removeExpiredSegments() {
+	expiration := time.Now().Add(-j.config.Storage.JournalRetentionDuration)
+	for len(j.segments) > 1 {
+		segmentPath := j.segmentPath(j.segments[0])
+		fi, err := j.fs.Stat(segmentPath)
+		if err == nil && fi.ModTime().After(expiration) {
+			return
+		}
+		if err == nil {
+			if err := j.fs.Remove(segmentPath); err != nil {
+				logger.Errorf("Could not remove expired journal segment %s: %s", segmentPath, err)
+				return
+			}
+			logger.Infof("Removed expired journal segment %s", segmentPath)
+		}
+		delete(j.offsets, j.segments[0])
+		j.segments = j.segments[1:]
+	}
+}
+
+// Must be called with the journal lock
+func (j *journal) closeSegment() error {
+	if j.writeFd == nil {
+		return nil
+	}
+	err := j.writeFd.Sync()
+	j.writeFd.Close()
+	j.writeFd = nil
+	return err
+}
+
+func (j *journal) Close() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if err := j.closeSegment(); err != nil {
+		logger.Errorf("Could not sync journal before closing: %s", err)
+	}
+}
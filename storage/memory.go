@@ -0,0 +1,401 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/t-mind/flocons/config"
+	. "github.com/t-mind/flocons/error"
+	"github.com/t-mind/flocons/file"
+)
+
+// Storage keeping all directories and files in memory, for tests, embedding and nodes without disk
+type MemoryStorage struct {
+	config  *config.Config
+	mutex   *sync.RWMutex
+	entries map[string]*memoryEntry // by clean slash separated path
+	events  *eventLog
+}
+
+type memoryEntry struct {
+	info     *file.FileInfo
+	data     []byte
+	children map[string]*memoryEntry // only for directories
+}
+
+func NewMemoryStorage(config *config.Config) *MemoryStorage {
+	s := MemoryStorage{
+		config: config,
+		mutex:  &sync.RWMutex{},
+		events: newEventLog(EVENT_LOG_SIZE),
+	}
+	s.reset()
+	return &s
+}
+
+func (s *MemoryStorage) reset() {
+	s.entries = map[string]*memoryEntry{
+		"/": s.newDirectoryEntry("/", 0755),
+	}
+}
+
+func memoryPath(p string) string {
+	return path.Clean("/" + filepath.ToSlash(p))
+}
+
+func (s *MemoryStorage) newDirectoryEntry(name string, mode os.FileMode) *memoryEntry {
+	return &memoryEntry{
+		info:     file.NewFileInfo(name, (mode&os.ModePerm)|0700|os.ModeDir, 0, time.Now(), file.FileDataSource{Node: s.config.Node.Name, Shard: s.config.Node.Shard}),
+		children: make(map[string]*memoryEntry),
+	}
+}
+
+func (s *MemoryStorage) CreateDirectory(p string, mode os.FileMode) (os.FileInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.createDirectory(memoryPath(p), mode)
+}
+
+func (s *MemoryStorage) createDirectory(p string, mode os.FileMode) (os.FileInfo, error) {
+	if _, found := s.entries[p]; found {
+		return nil, &os.PathError{Op: "mkdir", Path: p, Err: os.ErrExist}
+	}
+	parent, err := s.getDirectory(path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	entry := s.newDirectoryEntry(path.Base(p), mode)
+	parent.children[entry.info.Name()] = entry
+	s.entries[p] = entry
+	s.events.publish(EVENT_MKDIR, p, "", s.config.Node.Name)
+	return entry.info, nil
+}
+
+func (s *MemoryStorage) CreateDirectoryAndParents(p string, mode os.FileMode) (os.FileInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.createDirectoryAndParents(memoryPath(p), mode)
+}
+
+func (s *MemoryStorage) createDirectoryAndParents(p string, mode os.FileMode) (os.FileInfo, error) {
+	if entry, found := s.entries[p]; found {
+		if !entry.info.IsDir() {
+			return nil, NewIsNotDirError(p)
+		}
+		return entry.info, nil
+	}
+	if _, err := s.createDirectoryAndParents(path.Dir(p), mode); err != nil {
+		return nil, err
+	}
+	return s.createDirectory(p, mode)
+}
+
+func (s *MemoryStorage) GetDirectory(p string) (os.FileInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	entry, err := s.getDirectory(memoryPath(p))
+	if err != nil {
+		return nil, err
+	}
+	return entry.info, nil
+}
+
+func (s *MemoryStorage) getDirectory(p string) (*memoryEntry, error) {
+	entry, found := s.entries[p]
+	if !found {
+		return nil, NewFileNotFoundError(p)
+	}
+	if !entry.info.IsDir() {
+		return nil, NewIsNotDirError(p)
+	}
+	return entry, nil
+}
+
+// Create or overwrite a regular file
+func (s *MemoryStorage) CreateRegularFile(p string, mode os.FileMode, data []byte) (os.FileInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p = memoryPath(p)
+	parent, err := s.getDirectory(path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	if previous, found := s.entries[p]; found && previous.info.IsDir() {
+		return nil, NewIsDirError(p)
+	}
+	entry := &memoryEntry{data: make([]byte, len(data))}
+	copy(entry.data, data)
+	digest := md5.Sum(data)
+	entry.info = file.NewFileInfo(path.Base(p), mode&os.ModePerm, int64(len(data)), time.Now(), file.FileDataSource{
+		Node:   s.config.Node.Name,
+		Shard:  s.config.Node.Shard,
+		Digest: hex.EncodeToString(digest[:]),
+		Data: func() ([]byte, error) {
+			return entry.data, nil
+		},
+	})
+	parent.children[entry.info.Name()] = entry
+	s.entries[p] = entry
+	s.events.publish(EVENT_CREATE, p, "", s.config.Node.Name)
+	return entry.info, nil
+}
+
+func (s *MemoryStorage) GetRegularFile(p string) (os.FileInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	p = memoryPath(p)
+	if _, err := s.getDirectory(path.Dir(p)); err != nil {
+		return nil, err
+	}
+	entry, found := s.entries[p]
+	if !found || entry.info.IsDir() {
+		return nil, NewFileNotFoundError(p)
+	}
+	return entry.info, nil
+}
+
+func (s *MemoryStorage) GetFile(p string) (os.FileInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	entry, found := s.entries[memoryPath(p)]
+	if !found {
+		return nil, NewFileNotFoundError(p)
+	}
+	return entry.info, nil
+}
+
+// Remove a regular file, or a directory if it is empty
+func (s *MemoryStorage) RemoveFile(p string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p = memoryPath(p)
+	entry, found := s.entries[p]
+	if !found {
+		return NewFileNotFoundError(p)
+	}
+	if p == "/" {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrPermission}
+	}
+	if len(entry.children) > 0 {
+		return NewNotEmptyError(p)
+	}
+	delete(s.entries[path.Dir(p)].children, path.Base(p))
+	delete(s.entries, p)
+	s.events.publish(EVENT_DELETE, p, "", s.config.Node.Name)
+	return nil
+}
+
+func (s *MemoryStorage) UpdateFile(p string, changes FileChanges) (os.FileInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p = memoryPath(p)
+	entry, found := s.entries[p]
+	if !found {
+		return nil, NewFileNotFoundError(p)
+	}
+	mode := entry.info.Mode()
+	if changes.Mode != nil {
+		mode = (mode & os.ModeType) | (*changes.Mode & os.ModePerm)
+		if mode.IsDir() {
+			mode |= 0700
+		}
+	}
+	modTime := entry.info.ModTime()
+	if changes.ModTime != nil {
+		modTime = *changes.ModTime
+	}
+	entry.setInfo(entry.info.Name(), mode, modTime)
+	s.events.publish(EVENT_UPDATE, p, "", s.config.Node.Name)
+	return entry.info, nil
+}
+
+// Move a regular file or a directory to another path, replacing the regular file at this path if any
+func (s *MemoryStorage) RenameFile(p string, target string) (os.FileInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p = memoryPath(p)
+	target = memoryPath(target)
+	entry, found := s.entries[p]
+	if !found {
+		return nil, NewFileNotFoundError(p)
+	}
+	if p == "/" {
+		return nil, &os.PathError{Op: "rename", Path: p, Err: os.ErrPermission}
+	}
+	if p == target {
+		return entry.info, nil
+	}
+	parent, err := s.getDirectory(path.Dir(target))
+	if err != nil {
+		return nil, err
+	}
+	if previous, found := s.entries[target]; found && (entry.info.IsDir() || previous.info.IsDir()) {
+		return nil, &os.PathError{Op: "rename", Path: target, Err: os.ErrExist}
+	}
+	if strings.HasPrefix(target, p+"/") {
+		return nil, NewInvalidPathError("rename", target)
+	}
+
+	delete(s.entries[path.Dir(p)].children, path.Base(p))
+	entry.setInfo(path.Base(target), entry.info.Mode(), entry.info.ModTime())
+	parent.children[path.Base(target)] = entry
+	// Descendants of a directory are known by their path too
+	for entryPath, descendant := range s.entries {
+		if entryPath == p || strings.HasPrefix(entryPath, p+"/") {
+			delete(s.entries, entryPath)
+			s.entries[target+strings.TrimPrefix(entryPath, p)] = descendant
+		}
+	}
+	s.events.publish(EVENT_RENAME, p, target, s.config.Node.Name)
+	return entry.info, nil
+}
+
+func (s *MemoryStorage) CopyFile(p string, target string) (os.FileInfo, error) {
+	fi, err := s.GetFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, NewIsDirError(p)
+	}
+	storageFileInfo, _ := fi.(*file.FileInfo)
+	data, err := storageFileInfo.Data()
+	if err != nil {
+		return nil, err
+	}
+	return s.CreateRegularFile(target, fi.Mode(), data)
+}
+
+// Replace the file info of an entry, keeping its data
+func (e *memoryEntry) setInfo(name string, mode os.FileMode, modTime time.Time) {
+	dataSource, _ := e.info.Sys().(file.FileDataSource)
+	e.info = file.NewFileInfo(name, mode, e.info.Size(), modTime, dataSource)
+}
+
+func (s *MemoryStorage) ReadDir(directory string) ([]os.FileInfo, error) {
+	return s.ReadDirPage(directory, ReadDirOptions{})
+}
+
+// Read one page of a directory, with the same order and cursor semantics as DiskStorage
+func (s *MemoryStorage) ReadDirPage(directory string, options ReadDirOptions) ([]os.FileInfo, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	entry, err := s.getDirectory(memoryPath(directory))
+	if err != nil {
+		return nil, err
+	}
+
+	after, afterDirectory := parseListingCursor(options.After)
+	if after == "" || options.Type == DIRECTORY_FILE_TYPE {
+		afterDirectory = true
+	} else if child, found := entry.children[after]; found && child.info.IsDir() && options.Type != REGULAR_FILE_TYPE {
+		afterDirectory = true
+	}
+
+	dirs := make([]os.FileInfo, 0)
+	if options.Type != REGULAR_FILE_TYPE && afterDirectory {
+		collector := newReadDirCollector(&options, after, options.Limit)
+		for _, child := range entry.children {
+			if child.info.IsDir() {
+				collector.Add(child.info)
+			}
+		}
+		dirs = collector.Sorted()
+	}
+
+	files := make([]os.FileInfo, 0)
+	remaining := options.Limit - len(dirs)
+	if options.Type != DIRECTORY_FILE_TYPE && (options.Limit <= 0 || remaining > 0) {
+		if afterDirectory {
+			after = ""
+		}
+		collector := newReadDirCollector(&options, after, remaining)
+		for _, child := range entry.children {
+			if !child.info.IsDir() {
+				collector.Add(child.info)
+			}
+		}
+		files = collector.Sorted()
+	}
+	return append(dirs, files...), nil
+}
+
+// Entries are always streamed sorted, as a page without limit
+func (s *MemoryStorage) StreamDir(directory string, options ReadDirOptions, fn func(os.FileInfo) error) error {
+	files, err := s.ReadDirPage(directory, options)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Walk(root string, fn WalkFunc) error {
+	return s.WalkWithOptions(root, WalkOptions{}, fn)
+}
+
+func (s *MemoryStorage) WalkWithOptions(root string, options WalkOptions, fn WalkFunc) error {
+	return walkWithOptions(s, root, options, fn)
+}
+
+// Statistics of a directory, files being stored without any overhead
+func (s *MemoryStorage) DirectoryStats(directory string, recursive bool) (*DirectoryStats, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	entry, err := s.getDirectory(memoryPath(directory))
+	if err != nil {
+		return nil, err
+	}
+	return entry.stats(recursive), nil
+}
+
+func (e *memoryEntry) stats(recursive bool) *DirectoryStats {
+	stats := newDirectoryStats()
+	for _, child := range e.children {
+		if !child.info.IsDir() {
+			stats.Files++
+			stats.LogicalBytes += child.info.Size()
+			stats.PhysicalBytes += child.info.Size()
+		} else if recursive {
+			stats.Directories++
+			stats.add(child.stats(true))
+		}
+	}
+	return stats
+}
+
+// Wait for events of a directory after a sequence number
+func (s *MemoryStorage) Watch(p string, options WatchOptions) ([]Event, uint64, error) {
+	if _, err := s.GetDirectory(p); err != nil {
+		return nil, 0, err
+	}
+	return s.events.watch(memoryPath(p), options)
+}
+
+func (s *MemoryStorage) LastEventSequence() uint64 {
+	return s.events.lastSequence()
+}
+
+// Memory storage keeps no journal
+func (s *MemoryStorage) Close() {}
+
+// Remove all directories and files
+func (s *MemoryStorage) Destroy() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reset()
+	return nil
+}
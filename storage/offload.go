@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/t-mind/flocons/config"
+	. "github.com/t-mind/flocons/error"
+	"github.com/t-mind/flocons/s3"
+)
+
+// Size of the ranged requests used to scan an offloaded container without index
+const REMOTE_SCAN_READ_AHEAD int64 = 1024 * 1024
+
+// Suffix of the file written next to a container once it is offloaded, holding the MD5 digest of the container
+const OFFLOAD_MARKER_SUFFIX string = ".offloaded"
+
+// Key of an offloaded file, made of its path relative to the storage, whatever the disk or tier it is on
+func remoteKey(p string, config *config.Config) string {
+	roots := append([]string{config.Storage.Path}, config.Storage.Paths...)
+	if config.Storage.ColdPath != "" {
+		roots = append(roots, config.Storage.ColdPath)
+	}
+	for _, root := range roots {
+		if root != "" && strings.HasPrefix(p, root+string(filepath.Separator)) {
+			p = strings.TrimPrefix(p, root)
+			break
+		}
+	}
+	return path.Join(config.Storage.Offload.Prefix, filepath.ToSlash(p))
+}
+
+// Upload sealed containers and their index to the offload bucket, evicting local container files if configured
+// Indexes are kept locally to list and locate files. It returns the number of offloaded containers
+func (s *DiskStorage) OffloadContainers() (int, error) {
+	if s.remote == nil {
+		return 0, nil
+	}
+	s.moveMutex.Lock()
+	defer s.moveMutex.Unlock()
+	offloaded := 0
+	err := s.walkAllContainers("/", func(cacheEntry *DirectoryCacheEntry, container *RegularFileContainer) {
+		if !s.isSealed(cacheEntry, container) {
+			return
+		}
+		uploaded, err := container.offload(s.remote)
+		if err != nil {
+			logger.Errorf("Could not offload container %s: %s", container.Name, err)
+			return
+		}
+		if uploaded {
+			offloaded++
+		}
+		if s.config.Storage.Offload.Evict {
+			if err := container.evict(); err != nil {
+				logger.Errorf("Could not evict offloaded container %s: %s", container.Name, err)
+			} else if !uploaded {
+				offloaded++
+			}
+		}
+	})
+	return offloaded, err
+}
+
+// Upload the container file then its index, unless already uploaded, and mark the container as offloaded
+func (c *RegularFileContainer) offload(remote *s3.Client) (bool, error) {
+	containerPath := c.currentPath()
+	checksum, uploaded, err := uploadFile(c.fs, remote, containerPath, remoteKey(containerPath, c.config))
+	if err != nil {
+		return false, err
+	}
+	indexPath := c.index.currentPath()
+	if _, _, err := uploadFile(c.fs, remote, indexPath, remoteKey(indexPath, c.config)); err != nil {
+		return false, err
+	}
+	if previous, err := c.offloadedChecksum(); err != nil || previous != checksum {
+		if err := writeFile(c.fs, containerPath+OFFLOAD_MARKER_SUFFIX, []byte(checksum)); err != nil {
+			return false, err
+		}
+	}
+	return uploaded, nil
+}
+
+// MD5 digest of the container when it was offloaded, or an error if it has not been offloaded
+func (c *RegularFileContainer) offloadedChecksum() (string, error) {
+	f, err := c.fs.Open(c.currentPath() + OFFLOAD_MARKER_SUFFIX)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	checksum, err := ioutil.ReadAll(f)
+	return string(checksum), err
+}
+
+// Whether the container has been offloaded, so that its data can be read from the bucket
+func (c *RegularFileContainer) isOffloaded() bool {
+	_, err := c.fs.Stat(c.currentPath() + OFFLOAD_MARKER_SUFFIX)
+	return err == nil
+}
+
+// Remove the local container file once the bucket is known to hold the same content, reads being then served from the bucket
+func (c *RegularFileContainer) evict() error {
+	containerPath := c.currentPath()
+	fi, err := c.fs.Stat(containerPath)
+	if err != nil {
+		return err
+	}
+	checksum, err := c.offloadedChecksum()
+	if err != nil {
+		return err
+	}
+	info, err := c.remote.StatObject(remoteKey(containerPath, c.config))
+	if err != nil {
+		return err
+	}
+	if info.Size != fi.Size() || info.ETag != checksum {
+		return NewInternalError(fmt.Sprintf("offloaded container has size %d and digest %s instead of %d and %s", info.Size, info.ETag, fi.Size(), checksum))
+	}
+	// Readers which already opened the file keep reading it until they release it
+	if c.readFiles != nil {
+		c.readFiles.Remove(containerPath)
+	}
+	if err := c.fs.Remove(containerPath); err != nil {
+		return err
+	}
+	logger.Infof("Evicted offloaded container %s", containerPath)
+	return nil
+}
+
+// Upload a file if the bucket doesn't already hold an object with the same digest, and return the hex MD5 digest of the file
+// The bucket checks the digest of the uploaded data, so that a corrupted upload is rejected
+func uploadFile(fs VFS, remote *s3.Client, p string, key string) (string, bool, error) {
+	f, err := fs.Open(p)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", false, err
+	}
+	digest := md5.New()
+	if _, err := io.Copy(digest, f); err != nil {
+		return "", false, err
+	}
+	sum := digest.Sum(nil)
+	checksum := hex.EncodeToString(sum)
+	if info, err := remote.StatObject(key); err == nil && info.Size == fi.Size() && info.ETag == checksum {
+		return checksum, false, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", false, err
+	}
+	if err := remote.PutObjectWithMD5(key, f, fi.Size(), sum); err != nil {
+		return "", false, err
+	}
+	logger.Debugf("Uploaded %s to %s", p, key)
+	return checksum, true, nil
+}
+
+// Write a small file, which appears only once complete and synced
+func writeFile(fs VFS, p string, data []byte) error {
+	tmpPath := p + ".tmp"
+	out, err := fs.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(data); err != nil {
+		out.Close()
+		fs.Remove(tmpPath)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		fs.Remove(tmpPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		fs.Remove(tmpPath)
+		return err
+	}
+	return fs.Rename(tmpPath, p)
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"container/heap"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type FileType int
+
+const (
+	ANY_FILE_TYPE FileType = iota
+	REGULAR_FILE_TYPE
+	DIRECTORY_FILE_TYPE
+)
+
+const READ_DIR_BATCH_SIZE int = 1000
+
+// Options to read only one page of a directory
+// Directories are listed before regular files, each sorted by name
+// After is the cursor of the last entry of the previous page, given by ListingCursor. If it designates a sub directory,
+// the page starts with the next sub directories, otherwise it starts with the next regular files
+type ReadDirOptions struct {
+	Limit  int      // max number of entries returned, 0 means no limit
+	After  string   // only return entries after this cursor, which is a name of the listed type if Type is given
+	Prefix string   // only return entries with names starting with this prefix
+	Glob   string   // only return entries with names matching this pattern (see filepath.Match)
+	Type   FileType // only return entries of this type
+}
+
+// Cursor designating an entry in listings: its name, followed by a slash for a directory
+// so that a regular file and a sub directory with the same name are not mistaken for one another
+func ListingCursor(name string, fi os.FileInfo) string {
+	if fi.IsDir() {
+		return name + "/"
+	}
+	return name
+}
+
+// Name designated by a cursor and whether it is explicitly a directory
+// A name without slash designates a sub directory only if one exists with this name
+func parseListingCursor(after string) (string, bool) {
+	if strings.HasSuffix(after, "/") {
+		return strings.TrimSuffix(after, "/"), true
+	}
+	return after, false
+}
+
+// Check that the filters of the options are valid
+func (o *ReadDirOptions) Validate() error {
+	if o.Glob != "" {
+		if _, err := filepath.Match(o.Glob, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *ReadDirOptions) match(fi os.FileInfo) bool {
+	switch {
+	case o.Type == REGULAR_FILE_TYPE && fi.IsDir():
+		return false
+	case o.Type == DIRECTORY_FILE_TYPE && !fi.IsDir():
+		return false
+	case o.Prefix != "" && !strings.HasPrefix(fi.Name(), o.Prefix):
+		return false
+	case o.Glob != "":
+		matched, _ := filepath.Match(o.Glob, fi.Name())
+		return matched
+	}
+	return true
+}
+
+// Collects matching entries keeping only the first ones by name, so that memory is bounded by the limit
+type readDirCollector struct {
+	options *ReadDirOptions
+	after   string
+	limit   int
+	entries fileInfoMaxHeap
+}
+
+func newReadDirCollector(options *ReadDirOptions, after string, limit int) *readDirCollector {
+	return &readDirCollector{
+		options: options,
+		after:   after,
+		limit:   limit,
+		entries: make(fileInfoMaxHeap, 0),
+	}
+}
+
+func (c *readDirCollector) Add(fi os.FileInfo) error {
+	if fi.Name() <= c.after || !c.options.match(fi) {
+		return nil
+	}
+	if c.limit <= 0 || len(c.entries) < c.limit {
+		heap.Push(&c.entries, fi)
+	} else if fi.Name() < c.entries[0].Name() {
+		c.entries[0] = fi
+		heap.Fix(&c.entries, 0)
+	}
+	return nil
+}
+
+// Returned by AddSorted when next entries cannot be kept anymore
+var errCollectorFull = errors.New("read dir collector is full")
+
+// Add an entry coming from a walk sorted by name, stopping it with errCollectorFull once next entries would be dropped
+func (c *readDirCollector) AddSorted(fi os.FileInfo) error {
+	if c.limit > 0 && len(c.entries) >= c.limit && fi.Name() >= c.entries[0].Name() {
+		return errCollectorFull
+	}
+	return c.Add(fi)
+}
+
+func (c *readDirCollector) Sorted() []os.FileInfo {
+	files := []os.FileInfo(c.entries)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	return files
+}
+
+type fileInfoMaxHeap []os.FileInfo
+
+func (h fileInfoMaxHeap) Len() int            { return len(h) }
+func (h fileInfoMaxHeap) Less(i, j int) bool  { return h[i].Name() > h[j].Name() }
+func (h fileInfoMaxHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *fileInfoMaxHeap) Push(x interface{}) { *h = append(*h, x.(os.FileInfo)) }
+func (h *fileInfoMaxHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/t-mind/flocons/file"
+)
+
+// Size of a tar block, headers and data are aligned on it
+const TAR_BLOCK_SIZE int64 = 512
+
+// Statistics about the files of a directory, computed from the container indexes without reading data
+type DirectoryStats struct {
+	Directories   int64                     `json:"directories"`
+	Files         int64                     `json:"files"`
+	LogicalBytes  int64                     `json:"logical_bytes"`
+	PhysicalBytes int64                     `json:"physical_bytes"`
+	DeadBytes     int64                     `json:"dead_bytes"`
+	Containers    map[string]map[string]int `json:"containers"` // number of containers by shard and node
+}
+
+// Ratio of container bytes which don't belong to any live file, like overwritten files
+func (d *DirectoryStats) DeadBytesRatio() float64 {
+	if d.PhysicalBytes == 0 {
+		return 0
+	}
+	return float64(d.DeadBytes) / float64(d.PhysicalBytes)
+}
+
+func (d *DirectoryStats) add(other *DirectoryStats) {
+	d.Directories += other.Directories
+	d.Files += other.Files
+	d.LogicalBytes += other.LogicalBytes
+	d.PhysicalBytes += other.PhysicalBytes
+	d.DeadBytes += other.DeadBytes
+	for shard, nodes := range other.Containers {
+		for node, count := range nodes {
+			d.addContainers(shard, node, count)
+		}
+	}
+}
+
+func (d *DirectoryStats) addContainers(shard string, node string, count int) {
+	nodes, found := d.Containers[shard]
+	if !found {
+		nodes = make(map[string]int)
+		d.Containers[shard] = nodes
+	}
+	nodes[node] += count
+}
+
+func newDirectoryStats() *DirectoryStats {
+	return &DirectoryStats{Containers: make(map[string]map[string]int)}
+}
+
+// Compute statistics of the regular files of a directory, and of all its sub directories if recursive
+func (s *DiskStorage) DirectoryStats(directory string, recursive bool) (*DirectoryStats, error) {
+	if _, err := s.GetDirectory(directory); err != nil {
+		return nil, err
+	}
+	stats := newDirectoryStats()
+	// Only the last version of a file is alive when it has been written several times
+	liveFiles := make(map[string]*file.FileInfo)
+	liveBytes := int64(0)
+	walker := newRegularFileContainerWalker(s, directory)
+	for {
+		container, err := walker.Next()
+		if err != nil {
+			return nil, err
+		}
+		if container == nil {
+			break
+		}
+		size, err := container.CurrentSize()
+		if err != nil {
+			logger.Warnf("Could not get size of container %s: %s", container.Name, err)
+			continue
+		}
+		stats.PhysicalBytes += size
+		stats.addContainers(container.Shard, container.Node, 1)
+		err = container.WalkFiles(func(fi os.FileInfo) error {
+			storageFileInfo, _ := fi.(*file.FileInfo)
+			if previous, found := liveFiles[fi.Name()]; found {
+				if !previous.ModTime().Before(fi.ModTime()) {
+					return nil
+				}
+				liveBytes -= tarFootprint(previous.Size())
+				stats.LogicalBytes -= previous.Size()
+				stats.Files--
+			}
+			liveFiles[fi.Name()] = storageFileInfo
+			liveBytes += tarFootprint(fi.Size())
+			stats.LogicalBytes += fi.Size()
+			stats.Files++
+			return nil
+		})
+		if err != nil {
+			logger.Warnf("Could not list files of container %s: %s", container.Name, err)
+		}
+	}
+	if stats.PhysicalBytes > liveBytes {
+		stats.DeadBytes = stats.PhysicalBytes - liveBytes
+	}
+
+	if recursive {
+		fullpath, _, err := s.findDirectory(directory)
+		if err != nil {
+			return nil, err
+		}
+		subDirectories := make([]string, 0)
+		err = s.walkSubDirectories(fullpath, func(fi os.FileInfo) error {
+			subDirectories = append(subDirectories, filepath.Join(directory, fi.Name()))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, subDirectory := range subDirectories {
+			subStats, err := s.DirectoryStats(subDirectory, true)
+			if err != nil {
+				return nil, err
+			}
+			stats.Directories++
+			stats.add(subStats)
+		}
+	}
+	return stats, nil
+}
+
+// Estimated number of bytes used by a file in a container: one header block and the data aligned on blocks
+func tarFootprint(size int64) int64 {
+	blocks := (size + TAR_BLOCK_SIZE - 1) / TAR_BLOCK_SIZE
+	return TAR_BLOCK_SIZE * (1 + blocks)
+}
@@ -1,57 +1,106 @@
 package storage
 
 import (
-	"io/ioutil"
+	"hash/fnv"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
 
 	"github.com/t-mind/flocons/config"
 	. "github.com/t-mind/flocons/error"
+	"github.com/t-mind/flocons/s3"
 
 	"github.com/golang/groupcache/lru"
 )
 
 const DIRECTORY_CACHE_SIZE int = 1000
+const VERSION_MUTEX_STRIPES int = 64
 
-type Storage struct {
+type DiskStorage struct {
+	fs               VFS
 	path             string
+	paths            []string // main path then additional disks
+	placementMutex   *sync.Mutex
+	nextPath         int
 	config           *config.Config
 	directoryCache   *lru.Cache
+	watchCache       *lru.Cache // sub directories of recursive watches which are not in the directory cache
 	updateCacheMutex *sync.Mutex
+	readFiles        *fileHandleCache
+	dataCache        *dataCache
+	tieringMutex     *sync.Mutex
+	moveMutex        *sync.Mutex // held while containers change path, by tiering, offloading and directory renames
+	stopTiering      chan bool
+	remote           *s3.Client
+	events           *eventLog
+	poller           *watchPoller
+	journal          *journal
+	versionMutexes   []*sync.Mutex // striped by path, held while a file is written and its other versions removed
 }
 
 type DirectoryCacheEntry struct {
-	writeContainer            *RegularFileContainer
+	writeContainers           []*RegularFileContainer // containers open for writing, writers are spread across them
+	nextWriteContainer        int
 	containers                map[string]*RegularFileContainer
+	scanned                   bool // containers appearing after the first scan are new ones from other nodes
 	containersUpdateMutex     sync.Mutex
 	writeContainerUpdateMutex sync.Mutex
 }
 
 type regularFileContainerWalker struct {
-	storage    *Storage
+	storage    *DiskStorage
 	directory  string
 	cacheEntry *DirectoryCacheEntry
 
-	cacheKeys    []string
+	known        []*RegularFileContainer // containers already in the cache entry when the walk started
 	currentIndex int
-	files        []os.FileInfo
+	scanned      bool
+	discovered   []*RegularFileContainer // containers found on disk which were not yet in the cache entry
 }
 
-func NewStorage(config *config.Config) (*Storage, error) {
+func NewStorage(config *config.Config) (*DiskStorage, error) {
+	return NewStorageWithVFS(config, OS)
+}
+
+// Create a storage doing all its file system operations through a VFS
+func NewStorageWithVFS(config *config.Config, fs VFS) (*DiskStorage, error) {
 	if config.Storage.Path == "" {
 		return nil, NewInternalError("Tried to initialize storage with no configured path")
 	}
 	if config.Node.Name == "" {
 		return nil, NewInternalError("Tried to initialize storage with no configured node name")
 	}
-	s := Storage{
+	paths := config.Storage.Paths
+	if len(paths) == 0 {
+		paths = []string{config.Storage.Path}
+	}
+	s := DiskStorage{
+		fs:               fs,
 		path:             config.Storage.Path,
+		paths:            paths,
+		placementMutex:   &sync.Mutex{},
+		tieringMutex:     &sync.Mutex{},
+		moveMutex:        &sync.Mutex{},
 		config:           config,
 		directoryCache:   lru.New(DIRECTORY_CACHE_SIZE),
+		watchCache:       lru.New(WATCH_CACHE_SIZE),
 		updateCacheMutex: &sync.Mutex{},
+		readFiles:        newFileHandleCache(fs, config.Storage.MaxOpenFiles),
+		events:           newEventLog(EVENT_LOG_SIZE),
+		versionMutexes:   make([]*sync.Mutex, VERSION_MUTEX_STRIPES),
+	}
+	for i := range s.versionMutexes {
+		s.versionMutexes[i] = &sync.Mutex{}
+	}
+	s.poller = newWatchPoller(s.refreshDirectory)
+	if offload := config.Storage.Offload; offload.Endpoint != "" {
+		s.remote = s3.NewClient(offload.Endpoint, offload.Region, offload.Bucket, offload.AccessKey, offload.SecretKey)
+	}
+	if config.Storage.DataCacheSizeInBytes > 0 {
+		s.dataCache = newDataCache(config.Storage.DataCacheSizeInBytes, config.Storage.DataCacheMaxFileSizeInBytes)
 	}
 	s.directoryCache.OnEvicted = func(key lru.Key, value interface{}) {
 		cacheEntry, _ := value.(*DirectoryCacheEntry)
@@ -59,93 +108,160 @@ func NewStorage(config *config.Config) (*Storage, error) {
 		defer cacheEntry.containersUpdateMutex.Unlock()
 		cacheEntry.writeContainerUpdateMutex.Lock()
 		defer cacheEntry.writeContainerUpdateMutex.Unlock()
-		if cacheEntry.writeContainer != nil {
-			cacheEntry.writeContainer.Close()
+		for _, writeContainer := range cacheEntry.writeContainers {
+			if writeContainer != nil {
+				writeContainer.Close()
+			}
+		}
+		// Containers of the directory are not known anymore, let's not keep their files open
+		for _, container := range cacheEntry.containers {
+			s.readFiles.Remove(container.currentPath())
 		}
 	}
 
-	fi, err := os.Stat(s.path)
-	if err != nil {
-		return nil, err
-	}
-	if !fi.IsDir() {
-		return nil, NewIsNotDirError(s.path)
+	// A failing disk only makes its containers unavailable, storage is usable as long as one disk works
+	var firstErr error
+	usable := 0
+	for _, p := range s.paths {
+		if err := checkDiskPath(s.fs, p); err != nil {
+			logger.Errorf("Storage path %s is not usable: %s", p, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			usable++
+		}
 	}
-	testPath := s.MakeAbsolute("flocons-test")
-	if file, err := os.Create(testPath); err == nil {
-		file.Close()
-	} else {
-		return nil, os.ErrPermission
+	if usable == 0 {
+		return nil, firstErr
 	}
-	if os.Remove(testPath) != nil {
-		return nil, os.ErrPermission
+	if config.Storage.JournalPath != "" {
+		journal, err := openJournal(fs, config)
+		if err != nil {
+			return nil, err
+		}
+		s.journal = journal
 	}
 	return &s, nil
 }
 
-func (s *Storage) MakeAbsolute(p string) string {
+// Path of a storage entry on the main disk
+func (s *DiskStorage) MakeAbsolute(p string) string {
 	if !strings.HasPrefix(p, s.path) {
 		return filepath.Join(s.path, p)
 	}
 	return p
 }
 
-func (s *Storage) CreateDirectory(p string, mode os.FileMode) (os.FileInfo, error) {
+// Create a directory on all disks
+// It fails if the directory already exists, still creating it on the disks where it was missing
+func (s *DiskStorage) CreateDirectory(p string, mode os.FileMode) (os.FileInfo, error) {
 	mode |= 0700 // be sure that we will whatever be able to interact with this directory
-	fullPath := s.MakeAbsolute(p)
-	logger.Debugf("create directory %s with mode %o\n", fullPath, mode)
-	if err := os.Mkdir(fullPath, mode); err != nil {
+	fi, err := s.mirrorDirectory(p, func(fullPath string) error {
+		logger.Debugf("create directory %s with mode %o\n", fullPath, mode)
+		return s.fs.Mkdir(fullPath, mode)
+	})
+	if err != nil {
 		return nil, err
 	}
-	return os.Stat(fullPath)
+	return fi, s.recordDirectoryChange(EVENT_MKDIR, p, "")
 }
 
-func (s *Storage) CreateDirectoryAndParents(p string, mode os.FileMode) (os.FileInfo, error) {
+func (s *DiskStorage) CreateDirectoryAndParents(p string, mode os.FileMode) (os.FileInfo, error) {
 	mode |= 0700 // be sure that we will whatever be able to interact with this directory
-	fullPath := s.MakeAbsolute(p)
-	logger.Debugf("create directory %s and parents with mode %o\n", fullPath, mode)
-	if err := os.MkdirAll(fullPath, mode); err != nil {
+	fi, err := s.mirrorDirectory(p, func(fullPath string) error {
+		logger.Debugf("create directory %s and parents with mode %o\n", fullPath, mode)
+		return s.fs.MkdirAll(fullPath, mode)
+	})
+	if err != nil {
 		return nil, err
 	}
-	return os.Stat(fullPath)
+	return fi, s.recordDirectoryChange(EVENT_MKDIR, p, "")
 }
 
-func (s *Storage) GetDirectory(p string) (os.FileInfo, error) {
-	fullPath := s.MakeAbsolute(p)
+// Publish a change of a directory to watchers and write it in the journal, target being the new path of a renamed directory
+func (s *DiskStorage) recordDirectoryChange(eventType string, p string, target string) error {
+	s.events.publish(eventType, p, target, s.config.Node.Name)
+	if s.journal == nil {
+		return nil
+	}
+	p = path.Clean("/" + filepath.ToSlash(p))
+	if target != "" {
+		target = path.Clean("/" + filepath.ToSlash(target))
+	}
+	record := JournalRecord{Type: eventType, Directory: path.Dir(p), Name: path.Base(p), Target: target}
+	return s.journal.Append([]JournalRecord{record}, s.config.Storage.Durability != config.DURABILITY_NONE)
+}
 
-	fi, err := os.Stat(fullPath)
-	if err != nil {
-		return nil, err
+// Apply a directory creation on all disks, ignoring failing disks as long as one succeeds
+func (s *DiskStorage) mirrorDirectory(p string, create func(fullPath string) error) (os.FileInfo, error) {
+	var createdPath string
+	var firstErr, existErr error
+	for _, fullPath := range s.diskPaths(p) {
+		if err := create(fullPath); err != nil {
+			if os.IsExist(err) {
+				existErr = err
+			} else {
+				logger.Warnf("Could not create directory %s: %s", fullPath, err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if createdPath == "" {
+			createdPath = fullPath
+		}
 	}
-	if !fi.IsDir() {
-		return nil, NewIsNotDirError(p)
+	if existErr != nil {
+		return nil, existErr
 	}
-	return fi, nil
+	if createdPath == "" {
+		return nil, firstErr
+	}
+	return s.fs.Stat(createdPath)
+}
+
+func (s *DiskStorage) GetDirectory(p string) (os.FileInfo, error) {
+	_, fi, err := s.findDirectory(p)
+	return fi, err
 }
 
-func (s *Storage) CreateRegularFile(p string, mode os.FileMode, data []byte) (os.FileInfo, error) {
+func (s *DiskStorage) CreateRegularFile(p string, mode os.FileMode, data []byte) (os.FileInfo, error) {
 	directory := filepath.Dir(p)
 	if _, err := s.GetDirectory(directory); err != nil {
 		return nil, err
 	}
 	cacheEntry := s.getDirectoryCacheEntry(directory)
-	if err := s.ensureCacheEntryWriteContainer(directory, cacheEntry); err != nil {
+	writeContainer, err := s.ensureCacheEntryWriteContainer(directory, cacheEntry)
+	if err != nil {
 		return nil, err
 	}
-	return (*cacheEntry.writeContainer).CreateRegularFile(filepath.Base(p), mode, data)
+	if s.config.Storage.WriteContainers > 1 {
+		// The previous version may be in the container of another slot, and could be read again
+		mutex := s.versionMutex(p)
+		mutex.Lock()
+		defer mutex.Unlock()
+	}
+	fi, err := writeContainer.CreateRegularFile(filepath.Base(p), mode, data)
+	if err != nil {
+		return nil, err
+	}
+	if s.config.Storage.WriteContainers > 1 {
+		if err := s.removeOtherLocalVersions(p, writeContainer); err != nil {
+			return nil, err
+		}
+	}
+	s.events.publish(EVENT_CREATE, p, "", s.config.Node.Name)
+	return fi, nil
 }
 
-func (s *Storage) GetRegularFile(p string) (os.FileInfo, error) {
+func (s *DiskStorage) GetRegularFile(p string) (os.FileInfo, error) {
 	directory := filepath.Dir(p)
-	fullDirectory := s.MakeAbsolute(directory)
 	fileName := filepath.Base(p)
-	fi, err := os.Stat(fullDirectory)
-	if err != nil {
+	if _, err := s.GetDirectory(directory); err != nil {
 		return nil, err
 	}
-	if !fi.IsDir() {
-		return nil, NewIsNotDirError(directory)
-	}
 
 	walker := newRegularFileContainerWalker(s, directory)
 	for {
@@ -162,7 +278,7 @@ func (s *Storage) GetRegularFile(p string) (os.FileInfo, error) {
 	}
 }
 
-func (s *Storage) GetFile(p string) (os.FileInfo, error) {
+func (s *DiskStorage) GetFile(p string) (os.FileInfo, error) {
 	d, derr := s.GetDirectory(p)
 	if derr == nil {
 		return d, nil
@@ -179,7 +295,7 @@ func (s *Storage) GetFile(p string) (os.FileInfo, error) {
 	return nil, ferr
 }
 
-func (s *Storage) getDirectoryCacheEntry(directory string) *DirectoryCacheEntry {
+func (s *DiskStorage) getDirectoryCacheEntry(directory string) *DirectoryCacheEntry {
 	s.updateCacheMutex.Lock()
 	defer s.updateCacheMutex.Unlock()
 
@@ -187,43 +303,87 @@ func (s *Storage) getDirectoryCacheEntry(directory string) *DirectoryCacheEntry
 	if rawEntry, found := s.directoryCache.Get(directory); found {
 		cacheEntry, _ = rawEntry.(*DirectoryCacheEntry)
 	} else {
-		var nullContainer *RegularFileContainer
-		cacheEntry = &DirectoryCacheEntry{
-			containers:                make(map[string]*RegularFileContainer),
-			writeContainer:            nullContainer,
-			containersUpdateMutex:     sync.Mutex{},
-			writeContainerUpdateMutex: sync.Mutex{},
-		}
+		cacheEntry = s.newDirectoryCacheEntry()
 		s.directoryCache.Add(directory, cacheEntry)
 	}
 	return cacheEntry
 }
 
-// Ensure that we have a container open for writing
-// If there is already one and it is not full, it returns this container
-// If there is one but full, it closes and creates a new one
-// If there is none yet, it tries to find the container with the highest number and opens it if not full (or corrupted)
-// If none it found, it creates a new one
-func (s *Storage) ensureCacheEntryWriteContainer(directory string, cacheEntry *DirectoryCacheEntry) error {
+// Cache entry of a directory if it is cached, otherwise a new entry which is not added to the cache
+// so that background walks of all directories don't evict the directories being used
+func (s *DiskStorage) peekDirectoryCacheEntry(directory string) (*DirectoryCacheEntry, bool) {
+	s.updateCacheMutex.Lock()
+	defer s.updateCacheMutex.Unlock()
+
+	if rawEntry, found := s.directoryCache.Get(directory); found {
+		cacheEntry, _ := rawEntry.(*DirectoryCacheEntry)
+		return cacheEntry, true
+	}
+	return s.newDirectoryCacheEntry(), false
+}
+
+// Whether a directory is cached with another entry than the given one
+func (s *DiskStorage) isCachedWithOtherEntry(directory string, cacheEntry *DirectoryCacheEntry) bool {
+	s.updateCacheMutex.Lock()
+	defer s.updateCacheMutex.Unlock()
+
+	rawEntry, found := s.directoryCache.Get(directory)
+	return found && rawEntry.(*DirectoryCacheEntry) != cacheEntry
+}
+
+// Mutex serializing the writes of a file with the removal of its other versions, so that concurrent writes don't remove each other
+func (s *DiskStorage) versionMutex(p string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(filepath.Clean(p)))
+	return s.versionMutexes[hash.Sum32()%uint32(len(s.versionMutexes))]
+}
+
+func (s *DiskStorage) newDirectoryCacheEntry() *DirectoryCacheEntry {
+	return &DirectoryCacheEntry{
+		containers:                make(map[string]*RegularFileContainer),
+		writeContainers:           make([]*RegularFileContainer, s.config.Storage.WriteContainers),
+		containersUpdateMutex:     sync.Mutex{},
+		writeContainerUpdateMutex: sync.Mutex{},
+	}
+}
+
+// Ensure that we have a container open for writing and return it
+// Up to the configured number of containers are open for writing in each directory, and they are
+// handed out in turn so that concurrent writers don't wait for each other.
+// If the container of the next slot is open and not full, it returns this container
+// If it is full, it closes it and opens another one in the slot
+// If the slot is empty, it tries to find the writeable container with the highest number not used by another slot
+// and opens it if not full (or corrupted)
+// If none is found, it creates a new one numbered after all containers of the node, including those being written
+func (s *DiskStorage) ensureCacheEntryWriteContainer(directory string, cacheEntry *DirectoryCacheEntry) (*RegularFileContainer, error) {
 	cacheEntry.writeContainerUpdateMutex.Lock()
 	defer cacheEntry.writeContainerUpdateMutex.Unlock()
 
+	slot := cacheEntry.nextWriteContainer
+	cacheEntry.nextWriteContainer = (slot + 1) % len(cacheEntry.writeContainers)
+
 	// First let's check if the actual container is not full
-	if cacheEntry.writeContainer != nil && !cacheEntry.writeContainer.IsWriteable(s.config) {
-		logger.Infof("Container %s is full -> close it\n", cacheEntry.writeContainer.Name)
-		cacheEntry.writeContainer.Close()
-		cacheEntry.writeContainer = nil
+	if writeContainer := cacheEntry.writeContainers[slot]; writeContainer != nil && !writeContainer.IsWriteable(s.config) {
+		logger.Infof("Container %s is full -> close it\n", writeContainer.Name)
+		writeContainer.Close()
+		cacheEntry.writeContainers[slot] = nil
 	}
 
-	if cacheEntry.writeContainer == nil {
+	if cacheEntry.writeContainers[slot] == nil {
 		logger.Debugf("No container opened to write in directory %s on node %s -> let's search for one\n", s.config.Storage.Path, s.config.Node.Name)
+		used := make(map[string]bool)
+		for _, writeContainer := range cacheEntry.writeContainers {
+			if writeContainer != nil {
+				used[writeContainer.Name] = true
+			}
+		}
 		var writeContainer *RegularFileContainer
 		var maxNumber int = 0
 		walker := newRegularFileContainerWalkerFromCacheEntry(s, directory, cacheEntry)
 		for {
 			container, err := walker.Next()
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if container == nil {
 				break
@@ -232,7 +392,7 @@ func (s *Storage) ensureCacheEntryWriteContainer(directory string, cacheEntry *D
 			if container.Node == s.config.Node.Name && container.Number > maxNumber {
 				maxNumber = container.Number
 			}
-			if container.IsWriteable(s.config) && (writeContainer == nil || writeContainer.Number < container.Number) {
+			if !used[container.Name] && container.IsWriteable(s.config) && (writeContainer == nil || writeContainer.Number < container.Number) {
 				logger.Debugf("Found one valid container %s\n", container.Name)
 				writeContainer = container
 			}
@@ -241,105 +401,306 @@ func (s *Storage) ensureCacheEntryWriteContainer(directory string, cacheEntry *D
 			cacheEntry.containersUpdateMutex.Lock()
 			defer cacheEntry.containersUpdateMutex.Unlock()
 			name := NewRegularFileContainerName(s.config.Node.Shard, s.config.Node.Name, maxNumber+1)
-			logger.Infof("No container available to write in directory %s on node %s -> let's create %s\n", s.config.Storage.Path, s.config.Node.Name, name)
-			newWriteContainer, err := NewRegularFileContainer(s.MakeAbsolute(directory), name, s.config, nil)
+			newWriteContainer, err := s.createRegularFileContainer(directory, name)
 			if err != nil {
-				logger.Fatalf("Could not create new regular file container %s", err)
+				return nil, err
 			}
 			cacheEntry.containers[name] = newWriteContainer
 			writeContainer = newWriteContainer
 		}
-		cacheEntry.writeContainer = writeContainer
+		cacheEntry.writeContainers[slot] = writeContainer
 	}
-	return nil
+	return cacheEntry.writeContainers[slot], nil
 }
 
-func (s *Storage) ReadDir(directory string) ([]os.FileInfo, error) {
-	fullpath := s.MakeAbsolute(directory)
-	fi, err := os.Stat(fullpath)
+// Create a new container on the first disk accepting it according to the placement policy
+func (s *DiskStorage) createRegularFileContainer(directory string, name string) (*RegularFileContainer, error) {
+	_, fi, err := s.findDirectory(directory)
 	if err != nil {
 		return nil, err
 	}
-	if !fi.IsDir() {
-		return nil, NewIsNotDirError(fullpath)
+	var firstErr error
+	for _, root := range s.placementPaths() {
+		fullDirectory := filepath.Join(root, s.makeRelative(directory))
+		logger.Infof("No container available to write in directory %s on node %s -> let's create %s\n", fullDirectory, s.config.Node.Name, name)
+		// The directory may be missing on a disk added after its creation
+		err := s.fs.MkdirAll(fullDirectory, fi.Mode().Perm()|0700)
+		if err == nil {
+			var container *RegularFileContainer
+			if container, err = s.newRegularFileContainer(fullDirectory, name, nil); err == nil {
+				return container, nil
+			}
+		}
+		logger.Errorf("Could not create new regular file container %s in %s: %s", name, fullDirectory, err)
+		if firstErr == nil {
+			firstErr = err
+		}
 	}
+	return nil, firstErr
+}
+
+func (s *DiskStorage) ReadDir(directory string) ([]os.FileInfo, error) {
+	return s.ReadDirPage(directory, ReadDirOptions{})
+}
 
-	rawFiles, err := ioutil.ReadDir(fullpath)
+// Read one page of a directory, with only the entries matching the options
+// Sub directories come first, then regular files, each sorted by name
+func (s *DiskStorage) ReadDirPage(directory string, options ReadDirOptions) ([]os.FileInfo, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	fullpath, _, err := s.findDirectory(directory)
 	if err != nil {
 		return nil, err
 	}
+
+	// The cursor is either a sub directory or a regular file
+	after, afterDirectory := parseListingCursor(options.After)
+	if after == "" || options.Type == DIRECTORY_FILE_TYPE {
+		afterDirectory = true
+	} else if !afterDirectory && options.Type != REGULAR_FILE_TYPE {
+		if fi, err := s.fs.Stat(filepath.Join(fullpath, after)); err == nil && fi.IsDir() {
+			// A regular file with the same name takes precedence, the sub directory being designated with a slash
+			_, err := s.GetRegularFile(filepath.Join(directory, after))
+			afterDirectory = err != nil
+		}
+	}
+
 	dirs := make([]os.FileInfo, 0)
-	for _, f := range rawFiles {
-		if f.IsDir() {
-			dirs = append(dirs, f)
+	if options.Type != REGULAR_FILE_TYPE && afterDirectory {
+		collector := newReadDirCollector(&options, after, options.Limit)
+		if err := s.walkSubDirectories(fullpath, collector.Add); err != nil {
+			return nil, err
 		}
+		dirs = collector.Sorted()
 	}
 
 	files := make([]os.FileInfo, 0)
-	walker := newRegularFileContainerWalker(s, directory)
-	for {
-		container, err := walker.Next()
+	remaining := options.Limit - len(dirs)
+	if options.Type != DIRECTORY_FILE_TYPE && (options.Limit <= 0 || remaining > 0) {
+		if afterDirectory {
+			after = ""
+		}
+		// Containers are walked sorted, so that each one stops as soon as its next files cannot be in the page
+		collector := newReadDirCollector(&options, after, remaining)
+		walker := newRegularFileContainerWalker(s, directory)
+		for {
+			container, err := walker.Next()
+			if err != nil {
+				return nil, err
+			}
+			if container == nil {
+				break
+			}
+			if err := container.WalkSortedFiles(after, collector.AddSorted); err != nil && err != errCollectorFull {
+				return nil, err
+			}
+		}
+		files = collector.Sorted()
+	}
+	return append(dirs, files...), nil
+}
+
+// Call fn on each entry of a directory matching the options, stopping at the first error returned by fn
+// Without limit and cursor, entries are streamed in storage order, sub directories first, so that
+// huge directories can be listed without loading them in memory. Otherwise they come sorted as in ReadDirPage
+func (s *DiskStorage) StreamDir(directory string, options ReadDirOptions, fn func(os.FileInfo) error) error {
+	if options.Limit > 0 || options.After != "" {
+		files, err := s.ReadDirPage(directory, options)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if container == nil {
-			break
+		for _, f := range files {
+			if err := fn(f); err != nil {
+				return err
+			}
 		}
-		if fs, err := container.ListFiles(); err == nil {
-			files = append(files, fs...)
+		return nil
+	}
+
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	fullpath, _, err := s.findDirectory(directory)
+	if err != nil {
+		return err
+	}
+	// Errors of fn and errors reading one container stop the listing
+	var fnErr error
+	filter := func(fi os.FileInfo) error {
+		if !options.match(fi) {
+			return nil
 		}
+		fnErr = fn(fi)
+		return fnErr
 	}
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].Name() < files[j].Name()
-	})
-	return append(dirs, files...), nil
+	if options.Type != REGULAR_FILE_TYPE {
+		if err := s.walkSubDirectories(fullpath, filter); err != nil {
+			return err
+		}
+	}
+	if options.Type != DIRECTORY_FILE_TYPE {
+		walker := newRegularFileContainerWalker(s, directory)
+		for {
+			container, err := walker.Next()
+			if err != nil {
+				return err
+			}
+			if container == nil {
+				break
+			}
+			if err := container.WalkFiles(filter); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Call fn on all sub directories, reading the directory by batches to avoid loading all entries in memory
+// Walk stops at the first error returned by fn
+func (s *DiskStorage) walkSubDirectories(fullpath string, fn func(os.FileInfo) error) error {
+	f, err := s.fs.Open(fullpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		entries, err := f.Readdir(READ_DIR_BATCH_SIZE)
+		for _, entry := range entries {
+			if entry.IsDir() {
+				if err := fn(entry); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF || len(entries) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Create a container object sharing the file handles of the storage
+func (s *DiskStorage) newRegularFileContainer(directory string, name string, index *RegularFileContainerIndex) (*RegularFileContainer, error) {
+	container, err := openRegularFileContainer(s.fs, directory, name, s.config, index)
+	if err != nil {
+		return nil, err
+	}
+	container.readFiles = s.readFiles
+	container.dataCache = s.dataCache
+	container.remote = s.remote
+	container.journal = s.journal
+	container.storageDir = path.Clean("/" + filepath.ToSlash(s.makeRelative(directory)))
+	return container, nil
+}
+
+// Counters of the data cache, all zero if the cache is disabled
+func (s *DiskStorage) DataCacheStats() DataCacheStats {
+	if s.dataCache == nil {
+		return DataCacheStats{}
+	}
+	return s.dataCache.Stats()
 }
 
-func (s *Storage) ResetCache() {
+func (s *DiskStorage) ResetCache() {
+	s.updateCacheMutex.Lock()
+	defer s.updateCacheMutex.Unlock()
 	s.directoryCache.Clear()
+	s.watchCache.Clear()
 }
 
-func (s *Storage) Close() {
+func (s *DiskStorage) Close() {
+	s.poller.close()
 	s.ResetCache()
+	s.readFiles.Clear()
+	if s.journal != nil {
+		s.journal.Close()
+	}
 }
 
-func (s *Storage) Destroy() error {
+// Read the journal of the node after a sequence number, waiting for new records according to the options
+func (s *DiskStorage) ReadJournal(options JournalReadOptions) ([]JournalRecord, error) {
+	if s.journal == nil {
+		return nil, NewFileNotFoundError("journal")
+	}
+	return s.journal.Read(options)
+}
+
+func (s *DiskStorage) Destroy() error {
 	s.Close()
-	return os.RemoveAll(s.path)
+	var firstErr error
+	paths := s.paths
+	if s.config.Storage.JournalPath != "" {
+		paths = append([]string{s.config.Storage.JournalPath}, paths...)
+	}
+	for _, p := range paths {
+		if err := s.fs.RemoveAll(p); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
-func newRegularFileContainerWalker(s *Storage, directory string) *regularFileContainerWalker {
+func newRegularFileContainerWalker(s *DiskStorage, directory string) *regularFileContainerWalker {
 	return newRegularFileContainerWalkerFromCacheEntry(s, directory, s.getDirectoryCacheEntry(directory))
 }
 
-func newRegularFileContainerWalkerFromCacheEntry(s *Storage, directory string, entry *DirectoryCacheEntry) *regularFileContainerWalker {
-	cacheKeys := make([]string, 0, len(entry.containers))
-	for index, _ := range entry.containers {
-		cacheKeys = append(cacheKeys, index)
+func newRegularFileContainerWalkerFromCacheEntry(s *DiskStorage, directory string, entry *DirectoryCacheEntry) *regularFileContainerWalker {
+	// Containers are added by writers and by other walks meanwhile
+	entry.containersUpdateMutex.Lock()
+	defer entry.containersUpdateMutex.Unlock()
+	known := make([]*RegularFileContainer, 0, len(entry.containers))
+	for _, container := range entry.containers {
+		known = append(known, container)
 	}
 	return &regularFileContainerWalker{
 		storage:      s,
 		directory:    directory,
 		cacheEntry:   entry,
-		cacheKeys:    cacheKeys,
+		known:        known,
 		currentIndex: -1,
 	}
 }
 
 func (w *regularFileContainerWalker) Next() (*RegularFileContainer, error) {
 	w.currentIndex++
-	if w.currentIndex < len(w.cacheKeys) {
-		return w.cacheEntry.containers[w.cacheKeys[w.currentIndex]], nil
+	if w.currentIndex < len(w.known) {
+		return w.known[w.currentIndex], nil
+	}
+
+	if w.scanned {
+		// The directory has already been looked up, let's return the other containers found there
+		discoveredIndex := w.currentIndex - len(w.known)
+		if discoveredIndex < len(w.discovered) {
+			return w.discovered[discoveredIndex], nil
+		}
+		return nil, nil
 	}
 
-	fullpath := w.storage.MakeAbsolute(w.directory)
-	if w.files == nil {
-		files, err := ioutil.ReadDir(fullpath)
+	// Containers can be on any disk or on the cold tier, a failing disk only hides its own containers
+	filesByDirectory := make(map[string][]os.FileInfo)
+	var firstErr error
+	for _, fullpath := range w.storage.containerPaths(w.directory) {
+		files, err := w.storage.fs.ReadDir(fullpath)
 		if err != nil {
-			return nil, err
+			if !os.IsNotExist(err) {
+				logger.Errorf("Could not look for containers in %s: %s", fullpath, err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
 		}
-		w.files = files
+		filesByDirectory[fullpath] = files
+	}
+	if len(filesByDirectory) == 0 {
+		return nil, firstErr
 	}
+	w.scanned = true
+	w.discovered = make([]*RegularFileContainer, 0)
 
 	// Be sure not to update the mutex with twice the same container
 	w.cacheEntry.containersUpdateMutex.Lock()
@@ -347,47 +708,50 @@ func (w *regularFileContainerWalker) Next() (*RegularFileContainer, error) {
 
 	// Let's lookup the directory for not yet managed containers or lonely indexes
 	containers := w.cacheEntry.containers
-	var nextContainer *RegularFileContainer
-	for ; w.currentIndex < len(w.cacheKeys)+len(w.files); w.currentIndex++ {
-		file := w.files[w.currentIndex-len(w.cacheKeys)]
-		if file.IsDir() {
-			continue
-		}
-		name := file.Name()
-		found := false
-		// Lonely index ref if any
-		var index *RegularFileContainerIndex
-		if IsRegularFileContainer(name) {
-			_, found = containers[name]
-		} else if IsRegularFileContainerIndex(name) {
-			for _, container := range containers {
-				if container.index != nil && container.index.Name == name {
-					found = true
-					break
+	for _, fullpath := range w.storage.containerPaths(w.directory) {
+		for _, file := range filesByDirectory[fullpath] {
+			if file.IsDir() {
+				continue
+			}
+			name := file.Name()
+			found := false
+			// Lonely index ref if any
+			var index *RegularFileContainerIndex
+			if IsRegularFileContainer(name) {
+				_, found = containers[name]
+			} else if IsRegularFileContainerIndex(name) {
+				for _, container := range containers {
+					if container.index != nil && container.index.Name == name {
+						found = true
+						break
+					}
+				}
+				if !found {
+					// We found a lonely index
+					index, err := openRegularFileContainerIndex(w.storage.fs, fullpath, name, w.storage.config)
+					if err != nil {
+						logger.Errorln(err)
+						continue
+					}
+					// Let's defined the name of the empty refular file container that will be created
+					name = NewRegularFileContainerName(index.Shard, index.Node, index.Number)
 				}
 			}
 			if !found {
-				// We found a lonely index
-				index, err := NewRegularFileContainerIndex(fullpath, name, w.storage.config)
+				container, err := w.storage.newRegularFileContainer(fullpath, name, index)
 				if err != nil {
 					logger.Errorln(err)
-					continue
-				}
-				// Let's defined the name of the empty refular file container that will be created
-				name = NewRegularFileContainerName(index.Shard, index.Node, index.Number)
-			}
-		}
-		if !found {
-			container, err := NewRegularFileContainer(fullpath, name, w.storage.config, index)
-			if err != nil {
-				logger.Errorln(err)
-			} else {
-				containers[name] = container
-				if nextContainer == nil {
-					nextContainer = container // still, let's continue to update the cache entry
+				} else {
+					containers[name] = container
+					w.discovered = append(w.discovered, container)
+					w.storage.watchContainer(w.directory, container, w.cacheEntry.scanned)
 				}
 			}
 		}
 	}
-	return nextContainer, nil
+	w.cacheEntry.scanned = true
+	if len(w.discovered) > 0 {
+		return w.discovered[0], nil
+	}
+	return nil, nil
 }
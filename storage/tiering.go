@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/t-mind/flocons/config"
+)
+
+// Directory of the cold tier matching a directory of the storage, empty if there is no cold tier
+func coldDirectory(directory string, config *config.Config) string {
+	if config.Storage.ColdPath == "" || isColdDirectory(directory, config) {
+		return ""
+	}
+	roots := config.Storage.Paths
+	if len(roots) == 0 {
+		roots = []string{config.Storage.Path}
+	}
+	for _, root := range roots {
+		if directory == root || strings.HasPrefix(directory, root+string(filepath.Separator)) {
+			return filepath.Join(config.Storage.ColdPath, strings.TrimPrefix(directory, root))
+		}
+	}
+	return ""
+}
+
+func isColdDirectory(directory string, config *config.Config) bool {
+	coldPath := config.Storage.ColdPath
+	return coldPath != "" && (directory == coldPath || strings.HasPrefix(directory, coldPath+string(filepath.Separator)))
+}
+
+// Move to the cold tier all containers which are full and older than the tiering age
+// It returns the number of moved containers
+func (s *DiskStorage) TierContainers() (int, error) {
+	if s.config.Storage.ColdPath == "" {
+		return 0, nil
+	}
+	s.moveMutex.Lock()
+	defer s.moveMutex.Unlock()
+	return s.tierDirectory("/")
+}
+
+func (s *DiskStorage) tierDirectory(directory string) (int, error) {
+	moved := 0
+	err := s.walkAllContainers(directory, func(cacheEntry *DirectoryCacheEntry, container *RegularFileContainer) {
+		if !s.isSealed(cacheEntry, container) || container.IsCold() {
+			return
+		}
+		fi, err := s.fs.Stat(container.currentPath())
+		if err != nil || time.Since(fi.ModTime()) < s.config.Storage.TieringAgeDuration {
+			return
+		}
+		hotDirectory := filepath.Dir(container.currentPath())
+		if err := container.moveTo(coldDirectory(hotDirectory, s.config)); err != nil {
+			logger.Errorf("Could not move container %s to cold tier: %s", container.Name, err)
+			return
+		}
+		moved++
+	})
+	return moved, err
+}
+
+// Call fn on all containers of a directory and of its sub directories
+// Directories which are not cached are not added to the cache, their containers being opened only for the walk
+func (s *DiskStorage) walkAllContainers(directory string, fn func(*DirectoryCacheEntry, *RegularFileContainer)) error {
+	return s.walkDirectoryTree(directory, func(directory string) error {
+		cacheEntry, cached := s.peekDirectoryCacheEntry(directory)
+		walker := newRegularFileContainerWalkerFromCacheEntry(s, directory, cacheEntry)
+		for {
+			container, err := walker.Next()
+			if err != nil {
+				return err
+			}
+			if container == nil {
+				break
+			}
+			fn(cacheEntry, container)
+		}
+		if !cached && s.isCachedWithOtherEntry(directory, cacheEntry) {
+			// The directory has been cached meanwhile with other objects for the containers changed by fn
+			s.forgetDirectory(directory)
+		}
+		return nil
+	})
+}
+
+// Call fn on a directory and then on each of its sub directories, recursively
+func (s *DiskStorage) walkDirectoryTree(directory string, fn func(string) error) error {
+	if err := fn(directory); err != nil {
+		return err
+	}
+	fullpath, _, err := s.findDirectory(directory)
+	if err != nil {
+		return err
+	}
+	subDirectories := make([]string, 0)
+	err = s.walkSubDirectories(fullpath, func(fi os.FileInfo) error {
+		subDirectories = append(subDirectories, filepath.Join(directory, fi.Name()))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, subDirectory := range subDirectories {
+		if err := s.walkDirectoryTree(subDirectory, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A container is sealed once full and not open for writing anymore, only containers of this node are considered
+func (s *DiskStorage) isSealed(cacheEntry *DirectoryCacheEntry, container *RegularFileContainer) bool {
+	if container.Node != s.config.Node.Name || container.index == nil {
+		return false
+	}
+	cacheEntry.writeContainerUpdateMutex.Lock()
+	defer cacheEntry.writeContainerUpdateMutex.Unlock()
+	for _, writeContainer := range cacheEntry.writeContainers {
+		if writeContainer == container {
+			return false
+		}
+	}
+	if _, err := s.fs.Stat(container.currentPath()); err != nil {
+		return false
+	}
+	return !container.IsWriteable(s.config)
+}
+
+// Move containers to the cold tier and offload them every tiering interval, until StopTiering is called
+func (s *DiskStorage) StartTiering() {
+	s.tieringMutex.Lock()
+	defer s.tieringMutex.Unlock()
+	if s.stopTiering != nil || (s.config.Storage.ColdPath == "" && s.remote == nil) {
+		return
+	}
+	stop := make(chan bool)
+	s.stopTiering = stop
+	go func() {
+		ticker := time.NewTicker(s.config.Storage.TieringIntervalDuration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if moved, err := s.TierContainers(); err != nil {
+					logger.Errorf("Could not move containers to cold tier: %s", err)
+				} else if moved > 0 {
+					logger.Infof("Moved %d containers to cold tier", moved)
+				}
+				if offloaded, err := s.OffloadContainers(); err != nil {
+					logger.Errorf("Could not offload containers: %s", err)
+				} else if offloaded > 0 {
+					logger.Infof("Offloaded %d containers", offloaded)
+				}
+			}
+		}
+	}()
+}
+
+func (s *DiskStorage) StopTiering() {
+	s.tieringMutex.Lock()
+	defer s.tieringMutex.Unlock()
+	if s.stopTiering != nil {
+		close(s.stopTiering)
+		s.stopTiering = nil
+	}
+}
+
+// Path of the container file, which changes when the container is moved to the cold tier
+func (c *RegularFileContainer) currentPath() string {
+	c.pathMutex.RLock()
+	defer c.pathMutex.RUnlock()
+	return c.path
+}
+
+func (c *RegularFileContainer) IsCold() bool {
+	c.pathMutex.RLock()
+	defer c.pathMutex.RUnlock()
+	return c.cold
+}
+
+// Move the container file and its index to a directory of the cold tier
+// Files are first copied, then readers are switched to the copies and finally the original files are removed,
+// so that readers always find a complete container
+func (c *RegularFileContainer) moveTo(directory string) error {
+	if err := c.fs.MkdirAll(directory, 0700); err != nil {
+		return err
+	}
+	oldPath := c.currentPath()
+	newPath := filepath.Join(directory, c.Name)
+	if err := copyFile(c.fs, oldPath, newPath); err != nil {
+		return err
+	}
+	// Removals and metadata changes are still written in the index, let's not lose them during the copy
+	c.writeMutex.Lock()
+	var oldIndexPath, newIndexPath string
+	if c.index != nil {
+		c.index.Close()
+		oldIndexPath = c.index.currentPath()
+		newIndexPath = filepath.Join(directory, c.index.Name)
+		if err := copyFile(c.fs, oldIndexPath, newIndexPath); err != nil {
+			c.writeMutex.Unlock()
+			c.fs.Remove(newPath)
+			return err
+		}
+	}
+
+	c.pathMutex.Lock()
+	c.path = newPath
+	c.cold = true
+	if c.index != nil {
+		c.index.pathMutex.Lock()
+		c.index.path = newIndexPath
+		c.index.pathMutex.Unlock()
+	}
+	c.pathMutex.Unlock()
+	c.writeMutex.Unlock()
+
+	// Readers which already opened the old file keep reading it until they release it
+	if c.readFiles != nil {
+		c.readFiles.Remove(oldPath)
+	}
+	if c.dataCache != nil {
+		c.dataCache.InvalidateContainer(oldPath)
+	}
+	// Containers are offloaded once sealed, and can be moved before being evicted
+	if _, err := c.fs.Stat(oldPath + OFFLOAD_MARKER_SUFFIX); err == nil {
+		if err := copyFile(c.fs, oldPath+OFFLOAD_MARKER_SUFFIX, newPath+OFFLOAD_MARKER_SUFFIX); err != nil {
+			logger.Warnf("Could not move offload marker of container %s: %s", oldPath, err)
+		} else {
+			c.fs.Remove(oldPath + OFFLOAD_MARKER_SUFFIX)
+		}
+	}
+	if oldIndexPath != "" {
+		if err := c.fs.Remove(oldIndexPath); err != nil {
+			logger.Warnf("Could not remove index %s moved to cold tier: %s", oldIndexPath, err)
+		}
+	}
+	if err := c.fs.Remove(oldPath); err != nil {
+		logger.Warnf("Could not remove container %s moved to cold tier: %s", oldPath, err)
+	}
+	logger.Infof("Moved container %s to %s", oldPath, newPath)
+	return nil
+}
+
+func (i *RegularFileContainerIndex) currentPath() string {
+	i.pathMutex.RLock()
+	defer i.pathMutex.RUnlock()
+	return i.path
+}
+
+// Copy a file, the destination appearing only once complete and synced
+func copyFile(fs VFS, source string, destination string) error {
+	in, err := fs.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmpPath := destination + ".tmp"
+	out, err := fs.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		fs.Remove(tmpPath)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		fs.Remove(tmpPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		fs.Remove(tmpPath)
+		return err
+	}
+	return fs.Rename(tmpPath, destination)
+}
@@ -0,0 +1,412 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/t-mind/flocons/error"
+	"github.com/t-mind/flocons/file"
+)
+
+// Changes of the metadata of a file or a directory, nil fields are left unchanged
+type FileChanges struct {
+	Mode    *os.FileMode
+	ModTime *time.Time
+}
+
+// Remove a regular file, or a directory if it is empty
+// Data of removed files stays in their containers, they are only removed from the indexes
+func (s *DiskStorage) RemoveFile(p string) error {
+	p = filepath.Clean(p)
+	if _, err := s.GetDirectory(p); err == nil {
+		return s.removeDirectory(p)
+	}
+	containers, err := s.findLocalVersions(p)
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		if err := container.RemoveRegularFile(filepath.Base(p)); err != nil {
+			return err
+		}
+	}
+	s.events.publish(EVENT_DELETE, p, "", s.config.Node.Name)
+	return nil
+}
+
+// Remove an empty directory on all disks, with the containers of the files which have been removed from it
+func (s *DiskStorage) removeDirectory(p string) error {
+	if path.Clean("/"+filepath.ToSlash(p)) == "/" {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrPermission}
+	}
+	entries, err := s.ReadDirPage(p, ReadDirOptions{Limit: 1})
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return NewNotEmptyError(p)
+	}
+	s.forgetDirectory(p)
+
+	removed := false
+	var firstErr error
+	for _, fullpath := range s.containerPaths(p) {
+		if err := s.fs.RemoveAll(fullpath); err != nil {
+			logger.Warnf("Could not remove directory %s: %s", fullpath, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		removed = true
+	}
+	if !removed {
+		return firstErr
+	}
+	return s.recordDirectoryChange(EVENT_DELETE, p, "")
+}
+
+// Change the mode or the modification time of a regular file or a directory
+// Directories are changed on all disks, regular files with a new entry in the index of their container
+func (s *DiskStorage) UpdateFile(p string, changes FileChanges) (os.FileInfo, error) {
+	p = filepath.Clean(p)
+	fi, err := s.GetFile(p)
+	if err != nil {
+		return nil, err
+	}
+	mode := fi.Mode()
+	if changes.Mode != nil {
+		mode = *changes.Mode
+	}
+	modTime := fi.ModTime()
+	if changes.ModTime != nil {
+		modTime = *changes.ModTime
+	}
+
+	if fi.IsDir() {
+		updated := false
+		var firstErr error
+		for _, fullpath := range s.diskPaths(p) {
+			err := s.fs.Chmod(fullpath, (mode&os.ModePerm)|0700)
+			if err == nil {
+				err = s.fs.Chtimes(fullpath, modTime, modTime)
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			updated = true
+		}
+		if !updated {
+			return nil, firstErr
+		}
+		if err := s.recordDirectoryChange(EVENT_UPDATE, p, ""); err != nil {
+			return nil, err
+		}
+		return s.GetDirectory(p)
+	}
+
+	container, err := s.containerOf(filepath.Dir(p), fi)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := container.UpdateRegularFile(fi.Name(), mode, modTime)
+	if err != nil {
+		return nil, err
+	}
+	s.events.publish(EVENT_UPDATE, p, "", s.config.Node.Name)
+	return updated, nil
+}
+
+// Move a regular file or a directory to another path, replacing the regular file at this path if any
+// Files renamed in their directory only get a new entry in the index of their container, other files are copied
+func (s *DiskStorage) RenameFile(p string, target string) (os.FileInfo, error) {
+	p = filepath.Clean(p)
+	target = filepath.Clean(target)
+	fi, err := s.GetFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if p == target {
+		return fi, nil
+	}
+	if _, err := s.GetDirectory(filepath.Dir(target)); err != nil {
+		return nil, err
+	}
+	if targetFileInfo, err := s.GetFile(target); err == nil && (fi.IsDir() || targetFileInfo.IsDir()) {
+		return nil, &os.PathError{Op: "rename", Path: target, Err: os.ErrExist}
+	}
+	if fi.IsDir() {
+		return s.renameDirectory(p, target)
+	}
+
+	container, err := s.containerOf(filepath.Dir(p), fi)
+	if err == nil && filepath.Dir(p) == filepath.Dir(target) {
+		// Other versions of the target would come back once it is replaced in this container
+		if err := s.removeOtherLocalVersions(target, container); err != nil {
+			return nil, err
+		}
+		renamed, err := container.RenameRegularFile(fi.Name(), filepath.Base(target))
+		if err != nil {
+			return nil, err
+		}
+		s.events.publish(EVENT_RENAME, p, target, s.config.Node.Name)
+		return renamed, nil
+	}
+
+	// Files are copied to a container of the target directory before being removed, so that a failure leaves
+	// the file at its path or at both paths, but never at none
+	copied, err := s.copyRegularFile(p, target, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.RemoveFile(p); err != nil {
+		if err := s.RemoveFile(target); err != nil {
+			logger.Errorf("Could not remove copy %s of file %s which could not be removed: %s", target, p, err)
+		}
+		return nil, err
+	}
+	return copied, nil
+}
+
+// Rename a directory on all disks and on the cold tier
+// Offloaded containers are known in the bucket by their path, so directories holding some can't be renamed
+func (s *DiskStorage) renameDirectory(p string, target string) (os.FileInfo, error) {
+	if strings.HasPrefix(target, p+string(filepath.Separator)) {
+		return nil, NewInvalidPathError("rename", target)
+	}
+	// Containers must not be moved to the cold tier or offloaded meanwhile
+	s.moveMutex.Lock()
+	defer s.moveMutex.Unlock()
+
+	// Containers are known by their path, which changes for the whole tree
+	offloaded := ""
+	err := s.walkAllContainers(p, func(_ *DirectoryCacheEntry, container *RegularFileContainer) {
+		if container.isOffloaded() {
+			offloaded = container.currentPath()
+		}
+		if s.dataCache != nil {
+			s.dataCache.InvalidateContainer(container.currentPath())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if offloaded != "" {
+		logger.Warnf("Refuse to rename directory %s holding offloaded container %s", p, offloaded)
+		return nil, &os.PathError{Op: "rename", Path: p, Err: os.ErrPermission}
+	}
+	directories := make([]string, 0)
+	err = s.walkDirectoryTree(p, func(directory string) error {
+		directories = append(directories, directory)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sources := s.containerPaths(p)
+	targets := s.containerPaths(target)
+	renamed := false
+	var firstErr error
+	for i, source := range sources {
+		if _, err := s.fs.Stat(source); os.IsNotExist(err) {
+			continue
+		}
+		if err := s.fs.MkdirAll(filepath.Dir(targets[i]), 0700); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if err := s.fs.Rename(source, targets[i]); err != nil {
+			logger.Errorf("Could not rename directory %s to %s: %s", source, targets[i], err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		renamed = true
+	}
+	// Only the directories of the tree are forgotten, their containers being found again at their new path
+	for _, directory := range directories {
+		if _, cached := s.peekDirectoryCacheEntry(directory); cached {
+			s.forgetDirectory(directory)
+		}
+	}
+	if !renamed {
+		return nil, firstErr
+	}
+	if err := s.recordDirectoryChange(EVENT_RENAME, p, target); err != nil {
+		return nil, err
+	}
+	return s.GetDirectory(target)
+}
+
+// Copy a regular file to another path, replacing the regular file at this path if any
+func (s *DiskStorage) CopyFile(p string, target string) (os.FileInfo, error) {
+	return s.copyRegularFile(p, target, false)
+}
+
+// Copy the data of a regular file to a container of the target directory, without loading it in memory
+// The copy keeps the modification time of the file if asked
+func (s *DiskStorage) copyRegularFile(p string, target string, keepModTime bool) (os.FileInfo, error) {
+	fi, err := s.GetFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, NewIsDirError(p)
+	}
+	directory := filepath.Dir(target)
+	if _, err := s.GetDirectory(directory); err != nil {
+		return nil, err
+	}
+	storageFileInfo, _ := fi.(*file.FileInfo)
+	section, release, err := storageFileInfo.OpenData()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	modTime := time.Now()
+	if keepModTime {
+		modTime = fi.ModTime()
+	}
+	writeContainer, err := s.ensureCacheEntryWriteContainer(directory, s.getDirectoryCacheEntry(directory))
+	if err != nil {
+		return nil, err
+	}
+	mutex := s.versionMutex(target)
+	mutex.Lock()
+	defer mutex.Unlock()
+	copied, err := writeContainer.CopyRegularFile(filepath.Base(target), fi.Mode(), modTime, section, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.removeOtherLocalVersions(target, writeContainer); err != nil {
+		return nil, err
+	}
+	s.events.publish(EVENT_CREATE, target, "", s.config.Node.Name)
+	return copied, nil
+}
+
+// Remove the versions of a file in the containers of this node other than the one holding the current version
+func (s *DiskStorage) removeOtherLocalVersions(p string, current *RegularFileContainer) error {
+	versions, err := s.findLocalVersions(p)
+	if err != nil {
+		return nil
+	}
+	for _, version := range versions {
+		if version != current {
+			if err := version.RemoveRegularFile(filepath.Base(p)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Versions of a regular file in the containers of all nodes, the first one being the one read
+// Each node can only remove the versions of its own containers
+func (s *DiskStorage) GetRegularFileVersions(p string) ([]os.FileInfo, error) {
+	directory := filepath.Dir(p)
+	name := filepath.Base(p)
+	if _, err := s.GetDirectory(directory); err != nil {
+		return nil, err
+	}
+	versions := make([]os.FileInfo, 0, 1)
+	walker := newRegularFileContainerWalker(s, directory)
+	for {
+		container, err := walker.Next()
+		if err != nil {
+			return nil, err
+		}
+		if container == nil {
+			break
+		}
+		if fi, err := container.GetRegularFile(name); err == nil {
+			versions = append(versions, fi)
+		}
+	}
+	if len(versions) == 0 {
+		return nil, NewFileNotFoundError(p)
+	}
+	return versions, nil
+}
+
+// Containers of this node holding a version of a file
+// It fails if the file is only in containers of other nodes, which are the only ones able to change them
+func (s *DiskStorage) findLocalVersions(p string) ([]*RegularFileContainer, error) {
+	directory := filepath.Dir(p)
+	name := filepath.Base(p)
+	if _, err := s.GetDirectory(directory); err != nil {
+		return nil, err
+	}
+	containers := make([]*RegularFileContainer, 0, 1)
+	var foreign *RegularFileContainer
+	walker := newRegularFileContainerWalker(s, directory)
+	for {
+		container, err := walker.Next()
+		if err != nil {
+			return nil, err
+		}
+		if container == nil {
+			break
+		}
+		if _, err := container.GetRegularFile(name); err != nil {
+			continue
+		}
+		if container.Node == s.config.Node.Name && container.index != nil {
+			containers = append(containers, container)
+		} else {
+			foreign = container
+		}
+	}
+	if len(containers) == 0 {
+		if foreign != nil {
+			return nil, NewInternalError(fmt.Sprintf("File %s is only in container %s of node %s", p, foreign.Name, foreign.Node))
+		}
+		return nil, NewFileNotFoundError(p)
+	}
+	return containers, nil
+}
+
+// Container of this node holding a version of a file
+func (s *DiskStorage) containerOf(directory string, fi os.FileInfo) (*RegularFileContainer, error) {
+	storageFileInfo, _ := fi.(*file.FileInfo)
+	cacheEntry := s.getDirectoryCacheEntry(directory)
+	cacheEntry.containersUpdateMutex.Lock()
+	container, found := cacheEntry.containers[storageFileInfo.Container()]
+	cacheEntry.containersUpdateMutex.Unlock()
+	if !found || container.Node != s.config.Node.Name || container.index == nil {
+		return nil, NewInternalError(fmt.Sprintf("File %s is in container %s of node %s", fi.Name(), storageFileInfo.Container(), storageFileInfo.Node()))
+	}
+	return container, nil
+}
+
+// Forget the containers of a directory, closing them
+func (s *DiskStorage) forgetDirectory(directory string) {
+	cacheEntry := s.getDirectoryCacheEntry(directory)
+	walker := newRegularFileContainerWalkerFromCacheEntry(s, directory, cacheEntry)
+	for {
+		container, err := walker.Next()
+		if err != nil || container == nil {
+			break
+		}
+		// New containers of a directory created again at this path would have the same names
+		if s.dataCache != nil {
+			s.dataCache.InvalidateContainer(container.currentPath())
+		}
+	}
+	s.updateCacheMutex.Lock()
+	defer s.updateCacheMutex.Unlock()
+	s.directoryCache.Remove(directory)
+	s.watchCache.Remove(directory)
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Function called for each entry met while walking a directory, with the path of the entry relative to the walked root
+// If it returns filepath.SkipDir on a directory, the content of this directory is skipped.
+// If it returns filepath.SkipDir on a regular file, the remaining files of its directory are skipped.
+// Any other error stops the walk
+type WalkFunc func(p string, fi os.FileInfo) error
+
+// Options to walk only a part of a directory tree
+// Entries of each directory are walked in the same order as ReadDirPage, each sub directory being immediately followed by its content
+type WalkOptions struct {
+	MaxDepth int    // max depth of walked entries, 1 being the direct children of the root. 0 means no limit
+	After    string // only walk entries after this relative path, which is the last one of the previous walk, given by ListingCursor
+}
+
+// Walk all descendants of a directory
+func (s *DiskStorage) Walk(root string, fn WalkFunc) error {
+	return s.WalkWithOptions(root, WalkOptions{}, fn)
+}
+
+// Walk descendants of a directory matching the options
+// Directories are read by batches, so that memory use is bounded whatever the size of the directories
+func (s *DiskStorage) WalkWithOptions(root string, options WalkOptions, fn WalkFunc) error {
+	return walkWithOptions(s, root, options, fn)
+}
+
+// Walk any storage through its paginated listings
+func walkWithOptions(s Storage, root string, options WalkOptions, fn WalkFunc) error {
+	if _, err := s.GetDirectory(root); err != nil {
+		return err
+	}
+	// Only the last element of the cursor can be a regular file, it keeps its trailing slash if it is a directory
+	var after []string
+	if cursor := strings.TrimPrefix(filepath.ToSlash(options.After), "/"); cursor != "" && cursor != "/" {
+		name, directory := parseListingCursor(cursor)
+		after = strings.Split(name, "/")
+		if directory {
+			after[len(after)-1] += "/"
+		}
+	}
+	err := walkDirectory(s, root, "", 1, after, &options, fn)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkDirectory(s Storage, root string, rel string, depth int, after []string, options *WalkOptions, fn WalkFunc) error {
+	descend := options.MaxDepth <= 0 || depth < options.MaxDepth
+	directory := filepath.Join(root, filepath.FromSlash(rel))
+	readDirOptions := ReadDirOptions{Limit: READ_DIR_BATCH_SIZE}
+	if len(after) > 0 {
+		readDirOptions.After = after[0]
+		name, isDir := parseListingCursor(after[0])
+		if len(after) > 1 {
+			readDirOptions.After, isDir = name+"/", true
+		} else if !isDir {
+			isDir = isCursorDirectory(s, directory, name)
+		}
+		// The walk stopped on this sub directory or inside it, let's finish it first
+		if descend && isDir {
+			if err := walkDirectory(s, root, path.Join(rel, name), depth+1, after[1:], options, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		files, err := s.ReadDirPage(directory, readDirOptions)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			p := path.Join(rel, f.Name())
+			err := fn(p, f)
+			if f.IsDir() {
+				if err == filepath.SkipDir {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if descend {
+					if err := walkDirectory(s, root, p, depth+1, nil, options, fn); err != nil {
+						return err
+					}
+				}
+			} else if err == filepath.SkipDir {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		if len(files) < readDirOptions.Limit {
+			return nil
+		}
+		last := files[len(files)-1]
+		readDirOptions.After = ListingCursor(last.Name(), last)
+	}
+}
+
+// Whether a name given without slash designates a sub directory, as in ReadDirPage
+func isCursorDirectory(s Storage, directory string, name string) bool {
+	if _, err := s.GetDirectory(filepath.Join(directory, name)); err != nil {
+		return false
+	}
+	_, err := s.GetRegularFile(filepath.Join(directory, name))
+	return err != nil
+}
@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/t-mind/flocons/error"
+)
+
+// Types of change events
+const (
+	EVENT_CREATE string = "create"
+	EVENT_DELETE string = "delete"
+	EVENT_MKDIR  string = "mkdir"
+	EVENT_RENAME string = "rename"
+	EVENT_UPDATE string = "update" // mode or modification time changed
+)
+
+// Number of events kept in memory, watchers resuming from an older sequence number have lost events
+const EVENT_LOG_SIZE int = 10000
+
+// Interval at which watched directories are looked up for files written by other nodes
+const WATCH_POLL_INTERVAL time.Duration = time.Second
+
+// Recursively watched directories are walked entirely, so only once every this number of poll intervals
+const WATCH_RECURSIVE_POLL_TICKS int = 10
+
+// Number of sub directories of recursive watches whose containers are kept between polls while they are not in the directory cache
+const WATCH_CACHE_SIZE int = 1000
+
+// Change of a file or a directory of the storage
+// Sequence numbers are given by the node in increasing order, starting from 1 when it starts
+type Event struct {
+	Sequence uint64    `json:"seq"`
+	Type     string    `json:"type"`
+	Path     string    `json:"path"`
+	Target   string    `json:"target,omitempty"` // new path of a renamed file or directory
+	Node     string    `json:"node"`             // node which made the change
+	Time     time.Time `json:"time"`
+}
+
+type WatchOptions struct {
+	After     uint64          // sequence number of the last event already received
+	Recursive bool            // also watch all sub directories
+	Timeout   time.Duration   // maximum time to wait for an event, no wait if 0
+	Cancel    <-chan struct{} // stops waiting when closed
+}
+
+// In memory log of the last events, in a ring buffer
+type eventLog struct {
+	mutex    *sync.Mutex
+	events   []Event
+	first    int
+	count    int
+	sequence uint64        // sequence number of the last event
+	changed  chan struct{} // closed and replaced on each new event
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{
+		mutex:   &sync.Mutex{},
+		events:  make([]Event, size),
+		changed: make(chan struct{}),
+	}
+}
+
+func (l *eventLog) publish(eventType string, p string, target string, node string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sequence++
+	event := Event{Sequence: l.sequence, Type: eventType, Path: path.Clean("/" + p), Node: node, Time: time.Now()}
+	if target != "" {
+		event.Target = path.Clean("/" + target)
+	}
+	if l.count < len(l.events) {
+		l.events[(l.first+l.count)%len(l.events)] = event
+		l.count++
+	} else {
+		l.events[l.first] = event
+		l.first = (l.first + 1) % len(l.events)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *eventLog) lastSequence() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.sequence
+}
+
+// Events of a directory after a sequence number, with the sequence number of the last event looked at
+// and the channel closed on the next event
+// It fails if some of these events are not in the log anymore, or if the sequence number comes from before a restart
+func (l *eventLog) since(p string, options WatchOptions) ([]Event, uint64, <-chan struct{}, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if options.After > l.sequence || options.After+uint64(l.count) < l.sequence {
+		return nil, 0, nil, NewEventsLostError(options.After)
+	}
+	events := make([]Event, 0)
+	for i := l.count - int(l.sequence-options.After); i < l.count; i++ {
+		event := l.events[(l.first+i)%len(l.events)]
+		if eventMatches(event, p, options.Recursive) {
+			events = append(events, event)
+		}
+	}
+	return events, l.sequence, l.changed, nil
+}
+
+// Wait for events of a directory, returning them with the sequence number to resume from
+// Without matching events, it is the last sequence number looked at, so that watchers don't fall behind the log
+func (l *eventLog) watch(p string, options WatchOptions) ([]Event, uint64, error) {
+	var timeout <-chan time.Time
+	if options.Timeout > 0 {
+		timer := time.NewTimer(options.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		events, sequence, changed, err := l.since(p, options)
+		if err != nil || len(events) > 0 || options.Timeout <= 0 {
+			return events, sequence, err
+		}
+		select {
+		case <-changed:
+			// Events may be from other directories, let's look again
+		case <-timeout:
+			return events, sequence, nil
+		case <-options.Cancel:
+			return events, sequence, nil
+		}
+	}
+}
+
+// Directories looked up for files written by other nodes, shared by all their watchers
+type watchPoller struct {
+	mutex       *sync.Mutex
+	directories map[watchedDirectory]int // number of watchers of each directory
+	stop        chan bool
+	refresh     func(p string, recursive bool)
+}
+
+type watchedDirectory struct {
+	path      string
+	recursive bool
+}
+
+func newWatchPoller(refresh func(p string, recursive bool)) *watchPoller {
+	return &watchPoller{
+		mutex:       &sync.Mutex{},
+		directories: make(map[watchedDirectory]int),
+		refresh:     refresh,
+	}
+}
+
+// Look up a directory until remove is called as many times as add
+// Polling starts with the first watcher and goes on until close, so that successive watches keep its pace
+func (w *watchPoller) add(p string, recursive bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.directories[watchedDirectory{path: path.Clean("/" + p), recursive: recursive}]++
+	if w.stop == nil {
+		w.stop = make(chan bool)
+		go w.poll(w.stop)
+	}
+}
+
+func (w *watchPoller) remove(p string, recursive bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	directory := watchedDirectory{path: path.Clean("/" + p), recursive: recursive}
+	if w.directories[directory]--; w.directories[directory] <= 0 {
+		delete(w.directories, directory)
+	}
+}
+
+func (w *watchPoller) close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.stop != nil {
+		close(w.stop)
+		w.stop = nil
+	}
+}
+
+func (w *watchPoller) poll(stop chan bool) {
+	ticker := time.NewTicker(WATCH_POLL_INTERVAL)
+	defer ticker.Stop()
+	for ticks := 1; ; ticks++ {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		w.mutex.Lock()
+		directories := make([]watchedDirectory, 0, len(w.directories))
+		for directory := range w.directories {
+			if !directory.recursive || ticks%WATCH_RECURSIVE_POLL_TICKS == 0 {
+				directories = append(directories, directory)
+			}
+		}
+		w.mutex.Unlock()
+		for _, directory := range directories {
+			w.refresh(directory.path, directory.recursive)
+		}
+	}
+}
+
+// Wait for events of a directory after a sequence number
+// Meanwhile the directory is looked up regularly for files written by other nodes
+func (s *DiskStorage) Watch(p string, options WatchOptions) ([]Event, uint64, error) {
+	if _, err := s.GetDirectory(p); err != nil {
+		return nil, 0, err
+	}
+	if options.Timeout > 0 {
+		s.poller.add(p, options.Recursive)
+		defer s.poller.remove(p, options.Recursive)
+	}
+	return s.events.watch(p, options)
+}
+
+func (s *DiskStorage) LastEventSequence() uint64 {
+	return s.events.lastSequence()
+}
+
+// Publish the files written by another node in a container, as they are found in its index
+// Files already in a container discovered after the first scan of its directory are new too
+func (s *DiskStorage) watchContainer(directory string, container *RegularFileContainer, isNew bool) {
+	if container.Node == s.config.Node.Name || container.index == nil {
+		return
+	}
+	notify := func(eventType string, fi os.FileInfo) {
+		s.events.publish(eventType, path.Join(directory, fi.Name()), "", container.Node)
+	}
+	if isNew {
+		container.index.WalkFiles(func(fi os.FileInfo) error {
+			notify(EVENT_CREATE, fi)
+			return nil
+		})
+	}
+	container.index.updateMutex.Lock()
+	container.index.onUpdate = notify
+	container.index.updateMutex.Unlock()
+}
+
+// Look for new containers and new entries in the indexes of a directory
+func (s *DiskStorage) refreshDirectory(p string, recursive bool) {
+	s.refreshDirectoryWithCacheEntry(p, s.getDirectoryCacheEntry(p), recursive)
+}
+
+// The sub directories of a recursive watch are not added to the directory cache, so that walking the tree
+// doesn't evict the directories being used
+func (s *DiskStorage) refreshDirectoryWithCacheEntry(p string, cacheEntry *DirectoryCacheEntry, recursive bool) {
+	walker := newRegularFileContainerWalkerFromCacheEntry(s, p, cacheEntry)
+	for {
+		container, err := walker.Next()
+		if err != nil || container == nil {
+			break
+		}
+		if container.index != nil && container.Node != s.config.Node.Name {
+			if err := container.index.updateEntries(); err != nil {
+				logger.Warnf("Could not update index of container %s: %s", container.Name, err)
+			}
+		}
+	}
+	if !recursive {
+		return
+	}
+	fullpath, _, err := s.findDirectory(p)
+	if err != nil {
+		return
+	}
+	s.walkSubDirectories(fullpath, func(fi os.FileInfo) error {
+		directory := path.Join(p, fi.Name())
+		s.refreshDirectoryWithCacheEntry(directory, s.watchedDirectoryCacheEntry(directory), true)
+		return nil
+	})
+}
+
+// Cache entry of a sub directory of a recursive watch if it is cached, otherwise an entry kept apart from the cache
+// Containers are kept between polls so that the entries added to their indexes meanwhile are found
+func (s *DiskStorage) watchedDirectoryCacheEntry(directory string) *DirectoryCacheEntry {
+	s.updateCacheMutex.Lock()
+	defer s.updateCacheMutex.Unlock()
+
+	if rawEntry, found := s.directoryCache.Get(directory); found {
+		s.watchCache.Remove(directory)
+		cacheEntry, _ := rawEntry.(*DirectoryCacheEntry)
+		return cacheEntry
+	}
+	if rawEntry, found := s.watchCache.Get(directory); found {
+		cacheEntry, _ := rawEntry.(*DirectoryCacheEntry)
+		return cacheEntry
+	}
+	cacheEntry := s.newDirectoryCacheEntry()
+	s.watchCache.Add(directory, cacheEntry)
+	return cacheEntry
+}
+
+func eventMatches(event Event, p string, recursive bool) bool {
+	p = path.Clean("/" + p)
+	if event.Path == p || path.Dir(event.Path) == p {
+		return true
+	}
+	return recursive && (p == "/" || strings.HasPrefix(event.Path, p+"/"))
+}
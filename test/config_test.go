@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/t-mind/flocons/config"
 )
@@ -75,3 +76,126 @@ func TestBadConfig(t *testing.T) {
 		t.Errorf("Config %v should have failed", config)
 	}
 }
+
+func TestDurabilityConfig(t *testing.T) {
+	c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555}, "storage": {"path": "/tmp"}}`))
+	if err != nil {
+		t.Fatalf("Could not parse config %s", err)
+	}
+	if c.Storage.Durability != config.DURABILITY_SYNC {
+		t.Errorf("Durability %s is different than expected %s", c.Storage.Durability, config.DURABILITY_SYNC)
+	}
+	c, err = config.NewConfigFromJson([]byte(`{"node": {"port": 5555}, "storage": {"path": "/tmp", "durability": "group", "group_commit_interval": "2ms"}}`))
+	if err != nil {
+		t.Fatalf("Could not parse config %s", err)
+	}
+	if c.Storage.GroupCommitIntervalDuration != 2*time.Millisecond {
+		t.Errorf("Group commit interval %s is different than expected 2ms", c.Storage.GroupCommitIntervalDuration)
+	}
+	if c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555}, "storage": {"path": "/tmp", "durability": "never"}}`)); err == nil {
+		t.Errorf("Config %v should have failed", c)
+	}
+	if c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555}, "storage": {"path": "/tmp", "group_commit_interval": "-1s"}}`)); err == nil {
+		t.Errorf("Config %v should have failed", c)
+	}
+}
+
+func TestStoragePathsConfig(t *testing.T) {
+	c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555}, "storage": {"paths": ["/tmp/a", "/tmp/b"]}}`))
+	if err != nil {
+		t.Fatalf("Could not parse config %s", err)
+	}
+	if c.Storage.Path != "/tmp/a" || len(c.Storage.Paths) != 2 {
+		t.Errorf("Storage path %s and paths %v are different than expected", c.Storage.Path, c.Storage.Paths)
+	}
+	if c.Storage.Placement != config.PLACEMENT_ROUND_ROBIN {
+		t.Errorf("Placement %s is different than expected %s", c.Storage.Placement, config.PLACEMENT_ROUND_ROBIN)
+	}
+	c, err = config.NewConfigFromJson([]byte(`{"node": {"port": 5555}, "storage": {"path": "/tmp/a", "paths": ["/tmp/b"], "placement": "free_space"}}`))
+	if err != nil {
+		t.Fatalf("Could not parse config %s", err)
+	}
+	if len(c.Storage.Paths) != 2 || c.Storage.Paths[0] != "/tmp/a" {
+		t.Errorf("Storage paths %v are different than expected", c.Storage.Paths)
+	}
+	if c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555}, "storage": {"path": "/tmp", "placement": "random"}}`)); err == nil {
+		t.Errorf("Config %v should have failed", c)
+	}
+}
+
+func TestOffloadConfig(t *testing.T) {
+	c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555}, "storage": {"path": "/tmp", "offload": {"endpoint": "http://localhost:9000", "bucket": "flocons"}}}`))
+	if err != nil {
+		t.Fatalf("Could not parse config %s", err)
+	}
+	if c.Storage.Offload.Region != "us-east-1" {
+		t.Errorf("Offload region %s is different than expected us-east-1", c.Storage.Offload.Region)
+	}
+	if c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555}, "storage": {"path": "/tmp", "offload": {"endpoint": "http://localhost:9000"}}}`)); err == nil {
+		t.Errorf("Config %v should have failed", c)
+	}
+	if c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555}, "storage": {"path": "/tmp", "offload": {"endpoint": "localhost", "bucket": "flocons"}}}`)); err == nil {
+		t.Errorf("Config %v should have failed", c)
+	}
+}
+
+func TestJournalConfig(t *testing.T) {
+	c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555}, "storage": {"path": "/tmp", "journal_path": "/tmp/journal"}}`))
+	if err != nil {
+		t.Fatalf("Could not parse config %s", err)
+	}
+	if c.Storage.JournalSegmentSizeInBytes != 64*1000*1000 || c.Storage.JournalRetentionDuration != 168*time.Hour {
+		t.Errorf("Journal defaults %d and %s are different than expected", c.Storage.JournalSegmentSizeInBytes, c.Storage.JournalRetentionDuration)
+	}
+	if c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555}, "storage": {"path": "/tmp", "journal_segment_size": "a lot"}}`)); err == nil {
+		t.Errorf("Config %v should have failed", c)
+	}
+	if c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555}, "storage": {"path": "/tmp", "journal_retention": "-1h"}}`)); err == nil {
+		t.Errorf("Config %v should have failed", c)
+	}
+}
+
+func TestMaxFileSizeConfig(t *testing.T) {
+	c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555}, "storage": {"path": "/tmp"}}`))
+	if err != nil {
+		t.Fatalf("Could not parse config %s", err)
+	}
+	if c.Storage.MaxFileSizeInBytes != 1000*1000*1000 {
+		t.Errorf("Default max file size %d is different than expected", c.Storage.MaxFileSizeInBytes)
+	}
+	if c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555}, "storage": {"path": "/tmp", "max_file_size": "0"}}`)); err == nil {
+		t.Errorf("Config %v should have failed", c)
+	}
+}
+
+func TestP9PortConfig(t *testing.T) {
+	c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555, "9p_port": 5564}, "storage": {"path": "/tmp"}}`))
+	if err != nil {
+		t.Fatalf("Could not parse config %s", err)
+	}
+	if c.Node.P9Port != 5564 {
+		t.Errorf("9P port %d is different than expected %d", c.Node.P9Port, 5564)
+	}
+	if c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555, "9p_port": 5555}, "storage": {"path": "/tmp"}}`)); err == nil {
+		t.Errorf("Config %v should have failed", c)
+	}
+	if c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555, "9p_port": 70000}, "storage": {"path": "/tmp"}}`)); err == nil {
+		t.Errorf("Config %v should have failed", c)
+	}
+}
+
+func TestGrpcPortConfig(t *testing.T) {
+	c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555, "9p_port": 5564, "grpc_port": 5565}, "storage": {"path": "/tmp"}}`))
+	if err != nil {
+		t.Fatalf("Could not parse config %s", err)
+	}
+	if c.Node.GrpcPort != 5565 {
+		t.Errorf("gRPC port %d is different than expected %d", c.Node.GrpcPort, 5565)
+	}
+	if c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555, "9p_port": 5564, "grpc_port": 5564}, "storage": {"path": "/tmp"}}`)); err == nil {
+		t.Errorf("Config %v should have failed", c)
+	}
+	if c, err := config.NewConfigFromJson([]byte(`{"node": {"port": 5555, "grpc_port": -1}, "storage": {"path": "/tmp"}}`)); err == nil {
+		t.Errorf("Config %v should have failed", c)
+	}
+}
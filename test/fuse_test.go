@@ -0,0 +1,106 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package test
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	fuselib "bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"github.com/t-mind/flocons/fuse"
+	"github.com/t-mind/flocons/http"
+)
+
+// The nodes of the file system are called like the kernel would, so that no mount is needed
+func TestFuseFileSystem(t *testing.T) {
+	server := initServer(t)
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	router, err := http.NewRouter("http://127.0.0.1:5555", nil)
+	if err != nil {
+		t.Fatalf("Could not create router: %s", err)
+	}
+	defer router.Close()
+	ctx := context.Background()
+	root, _ := fuse.NewFileSystem(router, time.Minute).Root()
+	rootDir := root.(*fuse.Dir)
+
+	node, err := rootDir.Mkdir(ctx, &fuselib.MkdirRequest{Name: "fuseDir", Mode: os.ModeDir | 0755})
+	if err != nil {
+		t.Fatalf("Could not make directory: %s", err)
+	}
+	dir := node.(*fuse.Dir)
+	if _, err := rootDir.Mkdir(ctx, &fuselib.MkdirRequest{Name: "fuseDir", Mode: os.ModeDir | 0755}); err != fuselib.Errno(syscall.EEXIST) {
+		t.Errorf("Making an existing directory returned %v instead of EEXIST", err)
+	}
+
+	node, handle, err := dir.Create(ctx, &fuselib.CreateRequest{Name: "file", Flags: fuselib.OpenReadWrite, Mode: 0640}, &fuselib.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Could not create file: %s", err)
+	}
+	fileHandle := handle.(*fuse.FileHandle)
+	for _, write := range []struct {
+		offset int64
+		data   string
+	}{{0, "hello"}, {5, " world"}, {0, "H"}} {
+		if err := fileHandle.Write(ctx, &fuselib.WriteRequest{Offset: write.offset, Data: []byte(write.data)}, &fuselib.WriteResponse{}); err != nil {
+			t.Errorf("Could not write: %s", err)
+		}
+	}
+	var attr fuselib.Attr
+	if err := node.Attr(ctx, &attr); err != nil || attr.Size != 11 {
+		t.Errorf("Attributes of a file being written are %v, %v", attr, err)
+	}
+	if err := fileHandle.Release(ctx, &fuselib.ReleaseRequest{}); err != nil {
+		t.Errorf("Could not release file: %s", err)
+	}
+	fi := testReadFile(t, client, "/fuseDir", "file", "Hello world")
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("Written file has mode %s instead of 0640", fi.Mode())
+	}
+
+	handle, err = node.(fs.NodeOpener).Open(ctx, &fuselib.OpenRequest{Flags: fuselib.OpenReadOnly}, &fuselib.OpenResponse{})
+	if err != nil {
+		t.Fatalf("Could not open file: %s", err)
+	}
+	readResponse := &fuselib.ReadResponse{}
+	if err := handle.(fs.HandleReader).Read(ctx, &fuselib.ReadRequest{Offset: 6, Size: 100}, readResponse); err != nil || string(readResponse.Data) != "world" {
+		t.Errorf("Read returned %s, %v", readResponse.Data, err)
+	}
+
+	dirents, err := dir.ReadDirAll(ctx)
+	if err != nil || len(dirents) != 1 || dirents[0].Name != "file" || dirents[0].Type != fuselib.DT_File {
+		t.Errorf("Directory listing returned %v, %v", dirents, err)
+	}
+	if err := dir.Rename(ctx, &fuselib.RenameRequest{OldName: "file", NewName: "renamed"}, dir); err != nil {
+		t.Errorf("Could not rename file: %s", err)
+	}
+	if _, err := dir.Lookup(ctx, &fuselib.LookupRequest{Name: "file"}, &fuselib.LookupResponse{}); err != fuselib.Errno(syscall.ENOENT) {
+		t.Errorf("Lookup of a renamed file returned %v instead of ENOENT", err)
+	}
+	if _, err := dir.Lookup(ctx, &fuselib.LookupRequest{Name: "renamed"}, &fuselib.LookupResponse{}); err != nil {
+		t.Errorf("Could not look up renamed file: %s", err)
+	}
+
+	if err := rootDir.Remove(ctx, &fuselib.RemoveRequest{Name: "fuseDir", Dir: true}); err != fuselib.Errno(syscall.ENOTEMPTY) {
+		t.Errorf("Removing a directory with files returned %v instead of ENOTEMPTY", err)
+	}
+	if err := dir.Remove(ctx, &fuselib.RemoveRequest{Name: "renamed", Dir: true}); err != fuselib.Errno(syscall.ENOTDIR) {
+		t.Errorf("Removing a file as a directory returned %v instead of ENOTDIR", err)
+	}
+	if err := dir.Remove(ctx, &fuselib.RemoveRequest{Name: "renamed"}); err != nil {
+		t.Errorf("Could not remove file: %s", err)
+	}
+	if err := rootDir.Remove(ctx, &fuselib.RemoveRequest{Name: "fuseDir", Dir: true}); err != nil {
+		t.Errorf("Could not remove directory: %s", err)
+	}
+}
@@ -1,26 +1,52 @@
 package test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	gohttp "net/http"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
 	"github.com/t-mind/flocons/storage"
 	"github.com/t-mind/flocons/test/mock"
 
 	"github.com/t-mind/flocons/config"
+	. "github.com/t-mind/flocons/error"
+	"github.com/t-mind/flocons/file"
 	"github.com/t-mind/flocons/http"
+	"github.com/t-mind/flocons/s3"
 )
 
 func initServer(t *testing.T) *http.Server {
+	return initServerWithOptions(t, "")
+}
+
+// Initialize a server with additional storage options in json, each preceded by a comma
+func initServerWithOptions(t *testing.T, options string) *http.Server {
 	directory, err := ioutil.TempDir(os.TempDir(), "flocons-test")
 	if err != nil {
 		panic(err)
 	}
 
-	json_config := fmt.Sprintf(`{"node": {"name": "node-%d", "port": 5555}, "storage": {"path": %q}}`, 0, directory)
+	json_config := fmt.Sprintf(`{"node": {"name": "node-%d", "port": 5555}, "storage": {"path": %q%s}}`, 0, directory, options)
 	config, err := config.NewConfigFromJson([]byte(json_config))
 	if err != nil {
 		t.Errorf("Could not parse config %s: %s", json_config, err)
@@ -96,3 +122,966 @@ func TestConcurrentClients(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestBatchRead(t *testing.T) {
+	server := initServer(t)
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	testCreateDirectory(t, client, "/testDir")
+	paths := make([]string, 0)
+	for i := 0; i < 10; i++ {
+		testCreateFile(t, client, "/testDir", fmt.Sprintf("testFile-%d", i), fmt.Sprintf("testData-%d", i))
+		paths = append(paths, fmt.Sprintf("/testDir/testFile-%d", i))
+	}
+	paths = append(paths, "/testDir/missingFile")
+
+	results, err := client.GetRegularFiles(paths)
+	if err != nil {
+		t.Errorf("Could not read files in batch: %s", err)
+		t.FailNow()
+	}
+	if len(results) != len(paths) {
+		t.Errorf("Number of results is different than expected %d != %d", len(results), len(paths))
+		t.FailNow()
+	}
+	for i := 0; i < 10; i++ {
+		result := results[i]
+		if result.Path != paths[i] {
+			t.Errorf("Result path %s is different than expected %s", result.Path, paths[i])
+		}
+		if result.Err != nil {
+			t.Errorf("Could not read file %s in batch: %s", result.Path, result.Err)
+			continue
+		}
+		data, _ := result.FileInfo.(*file.FileInfo).Data()
+		if string(data) != fmt.Sprintf("testData-%d", i) {
+			t.Errorf("Data value does not match: %s != %s", data, fmt.Sprintf("testData-%d", i))
+		}
+	}
+	if last := results[len(results)-1]; !os.IsNotExist(last.Err) {
+		t.Errorf("Expected not found error for %s, got %v", last.Path, last.Err)
+	}
+
+	// The list of paths has a maximum size
+	body := `["` + strings.Repeat("a", int(http.MAX_BATCH_REQUEST_SIZE)) + `"]`
+	resp, err := gohttp.Post("http://127.0.0.1:5555"+http.BATCH_PREFIX, http.JSON_MIME_TYPE, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Could not send batch request: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != gohttp.StatusRequestEntityTooLarge {
+		t.Errorf("Status %d of a too large batch request is different than expected", resp.StatusCode)
+	}
+}
+
+func TestLsPages(t *testing.T) {
+	server := initServer(t)
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	testCreateDirectory(t, client, "/testDir")
+	testCreateDirectory(t, client, "/testDir/subDir")
+	for i := 0; i < 10; i++ {
+		testCreateFile(t, client, "/testDir", fmt.Sprintf("testFile-%d", i), "testData")
+	}
+
+	names := make([]string, 0)
+	options := storage.ReadDirOptions{Limit: 3}
+	for {
+		files, next, err := client.ReadDirPage("/testDir", options)
+		if err != nil {
+			t.Errorf("Could not read directory page: %s", err)
+			t.FailNow()
+		}
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		if next == "" {
+			break
+		}
+		options.After = next
+	}
+	if len(names) != 11 || names[0] != "subDir" || names[10] != "testFile-9" {
+		t.Errorf("Entries read by pages are different than expected: %v", names)
+	}
+
+	files, _, err := client.ReadDirPage("/testDir", storage.ReadDirOptions{Glob: "*-[12]", Type: storage.REGULAR_FILE_TYPE})
+	if err != nil || len(files) != 2 {
+		t.Errorf("Entries matching glob are different than expected: %v (%v)", files, err)
+	}
+	if _, _, err := client.ReadDirPage("/testDir", storage.ReadDirOptions{Glob: "["}); err == nil {
+		t.Errorf("Invalid glob should have failed")
+	}
+}
+
+func TestLsFormats(t *testing.T) {
+	server := initServer(t)
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	testCreateDirectory(t, client, "/testDir")
+	testCreateDirectory(t, client, "/testDir/subDir")
+	testCreateFile(t, client, "/testDir", "image.jpg", "testData")
+
+	type entry struct {
+		Name        string `json:"name"`
+		Type        string `json:"type"`
+		Mode        uint32 `json:"mode"`
+		Size        int64  `json:"size"`
+		ContentType string `json:"content_type"`
+		Node        string `json:"node"`
+		Container   string `json:"container"`
+	}
+	checkEntries := func(format string, entries []entry) {
+		if len(entries) != 2 {
+			t.Errorf("Number of %s entries is different than expected %d != %d", format, len(entries), 2)
+			return
+		}
+		if entries[0].Name != "subDir" || entries[0].Type != "directory" || entries[0].Mode != 0755 {
+			t.Errorf("Directory %s entry is different than expected: %v", format, entries[0])
+		}
+		if entries[1].Name != "image.jpg" || entries[1].Type != "file" || entries[1].Size != 8 ||
+			entries[1].ContentType != "image/jpeg" || entries[1].Node != "node-0" || entries[1].Container == "" {
+			t.Errorf("File %s entry is different than expected: %v", format, entries[1])
+		}
+	}
+
+	req, _ := gohttp.NewRequest("GET", "http://127.0.0.1:5555/files/testDir", nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err := gohttp.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("Could not list directory: %s", err)
+		t.FailNow()
+	}
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Content type %s is different than expected application/json", resp.Header.Get("Content-Type"))
+	}
+	var entries []entry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Errorf("Could not decode json listing: %s", err)
+	}
+	resp.Body.Close()
+	checkEntries("json", entries)
+
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err = gohttp.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("Could not list directory: %s", err)
+		t.FailNow()
+	}
+	entries = make([]entry, 0)
+	decoder := json.NewDecoder(resp.Body)
+	for decoder.More() {
+		var e entry
+		if err := decoder.Decode(&e); err != nil {
+			t.Errorf("Could not decode ndjson listing: %s", err)
+			break
+		}
+		entries = append(entries, e)
+	}
+	resp.Body.Close()
+	checkEntries("ndjson", entries)
+
+	files, err := client.ReadDir("/testDir")
+	if err != nil || len(files) != 2 {
+		t.Errorf("Could not read directory: %v (%v)", files, err)
+		t.FailNow()
+	}
+	if sf, ok := files[1].(*file.FileInfo); !ok || sf.Node() != "node-0" || sf.Container() == "" {
+		t.Errorf("Client listing did not get data source of %s", files[1].Name())
+	}
+}
+
+func TestWalk(t *testing.T) {
+	server := initServer(t)
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	testWalk(t, client)
+
+	// Recursive listing by pages
+	paths := make([]string, 0)
+	after := ""
+	for {
+		resp, err := gohttp.Get("http://127.0.0.1:5555/files/testDir?recursive=true&limit=3&after=" + after)
+		if err != nil {
+			t.Errorf("Could not walk directory: %s", err)
+			t.FailNow()
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			paths = append(paths, strings.Split(line, ",")[1])
+		}
+		after = resp.Header.Get("X-Next-After")
+		if after == "" {
+			break
+		}
+	}
+	expected := []string{"a", "a/aa", "a/aa/file-1", "a/file-2", "b", "b/file-3", "file-4"}
+	if fmt.Sprint(paths) != fmt.Sprint(expected) {
+		t.Errorf("Walked paths %v are different than expected %v", paths, expected)
+	}
+}
+
+func TestDirectoryStats(t *testing.T) {
+	server := initServer(t)
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	testCreateDirectory(t, client, "/testDir")
+	testCreateDirectory(t, client, "/testDir/subDir")
+	testCreateFile(t, client, "/testDir", "testFile", "testData")
+	testCreateFile(t, client, "/testDir/subDir", "testFile", "testData")
+
+	stats, err := client.DirectoryStats("/testDir", true)
+	if err != nil {
+		t.Errorf("Could not get directory stats: %s", err)
+		t.FailNow()
+	}
+	if stats.Files != 2 || stats.LogicalBytes != 16 || stats.Directories != 1 || stats.Containers["shard-1"]["node-0"] != 2 {
+		t.Errorf("Stats %+v are different than expected 2 files of 16 bytes", stats)
+	}
+	if _, err := client.DirectoryStats("/missingDir", false); !os.IsNotExist(err) {
+		t.Errorf("Expected not found error, got %v", err)
+	}
+}
+
+func TestServerWithMemoryStorage(t *testing.T) {
+	config, err := config.NewConfigFromJson([]byte(`{"node": {"name": "node-0", "port": 5555}, "storage": {"path": "/nowhere"}}`))
+	if err != nil {
+		t.Fatalf("Could not parse config: %s", err)
+	}
+	server, err := http.NewServer(config, storage.NewMemoryStorage(config), &mock.NullTopologyClient{})
+	if err != nil {
+		t.Fatalf("Could instantiate server: %s", err)
+	}
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	testCreateDirectory(t, client, "/testDir")
+	testGetDirectory(t, client, "/testDir")
+	testCreateFile(t, client, "/testDir", "testFile", "testData")
+	testReadFile(t, client, "/testDir", "testFile", "testData")
+	client.CreateRegularFile("/testDir/testFile2", 0644, []byte("testData2"))
+	if files, _, err := client.ReadDirPage("/testDir", storage.ReadDirOptions{Limit: 1}); err != nil || len(files) != 1 || files[0].Name() != "testFile" {
+		t.Errorf("First page %v of directory is different than expected: %s", files, err)
+	}
+
+	// Memory storage has neither data cache nor journal
+	if stats, err := client.DataCacheStats(); err != nil || stats.Hits != 0 {
+		t.Errorf("Data cache stats %v of memory storage are different than expected: %s", stats, err)
+	}
+	if _, _, err := client.ReadJournal(storage.JournalReadOptions{}); !IsHttpError(err, gohttp.StatusNotImplemented) {
+		t.Errorf("Reading the journal of memory storage should not be implemented: %s", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	server := initServer(t)
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	testCreateDirectory(t, client, "/testDir")
+	created := make(chan bool)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		testCreateFile(t, client, "/testDir", "testFile", "testData")
+		close(created)
+	}()
+	events, sequence, err := client.Watch("/testDir", storage.WatchOptions{Timeout: 5 * time.Second})
+	<-created
+	if err != nil || len(events) != 1 || events[0].Path != "/testDir/testFile" || events[0].Type != storage.EVENT_CREATE {
+		t.Errorf("Long poll events are different than expected: %+v, %v", events, err)
+		t.FailNow()
+	}
+	if sequence != events[0].Sequence {
+		t.Errorf("Sequence to resume from %d is not the one of the last event %d", sequence, events[0].Sequence)
+	}
+	events, next, err := client.Watch("/testDir", storage.WatchOptions{After: sequence, Timeout: 10 * time.Millisecond})
+	if err != nil || len(events) != 0 || next != sequence {
+		t.Errorf("Long poll without events returned %+v, %d, %v", events, next, err)
+	}
+	if _, _, err := client.Watch("/missingDir", storage.WatchOptions{Timeout: 10 * time.Millisecond}); !os.IsNotExist(err) {
+		t.Errorf("Watch of a missing directory returned %v", err)
+	}
+
+	// Event stream resumed from the beginning
+	req, _ := gohttp.NewRequest("GET", "http://127.0.0.1:5555/watch/testDir", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := gohttp.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("Could not open event stream: %s", err)
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Content type of event stream is %s", resp.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(resp.Body)
+	lines := make([]string, 0)
+	for len(lines) < 6 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Errorf("Could not read event stream: %s", err)
+			break
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	if len(lines) == 6 && (lines[0] != "id: 1" || lines[1] != "event: mkdir" || lines[4] != "id: 2" || lines[5] != "event: create") {
+		t.Errorf("Event stream is different than expected: %v", lines)
+	}
+}
+
+func TestReadJournal(t *testing.T) {
+	journalDirectory, err := ioutil.TempDir(os.TempDir(), "flocons-journal")
+	if err != nil {
+		panic(err)
+	}
+	server := initServerWithOptions(t, fmt.Sprintf(`, "journal_path": %q`, journalDirectory))
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	testCreateDirectory(t, client, "/testDir")
+	records, sequence, err := client.ReadJournal(storage.JournalReadOptions{})
+	if err != nil || len(records) != 1 || records[0].Type != storage.EVENT_MKDIR || records[0].Name != "testDir" || sequence != 1 {
+		t.Errorf("Journal records are different than expected: %+v, %v", records, err)
+		t.FailNow()
+	}
+
+	// A follower waits for the next record
+	created := make(chan bool)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		testCreateFile(t, client, "/testDir", "testFile", "testData")
+		close(created)
+	}()
+	records, sequence, err = client.ReadJournal(storage.JournalReadOptions{After: sequence, Timeout: 5 * time.Second})
+	<-created
+	if err != nil || len(records) != 1 || records[0].Type != storage.EVENT_CREATE || records[0].Directory != "/testDir" ||
+		records[0].Name != "testFile" || records[0].Container == "" || records[0].Size != 8 || sequence != 2 {
+		t.Errorf("Tailed journal records are different than expected: %+v, %v", records, err)
+	}
+	if _, _, err := client.ReadJournal(storage.JournalReadOptions{After: 10}); err == nil {
+		t.Error("Journal read after the last sequence number did not fail")
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	server := initServer(t)
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	before := time.Now().Truncate(time.Second)
+	testCreateDirectory(t, client, "/testDir")
+	testCreateFile(t, client, "/testDir", "testFile", "testData")
+	fi, err := client.GetFile("/testDir/testFile")
+	if err != nil {
+		t.Fatalf("Could not get file: %s", err)
+	}
+	etag := http.ETag(fi)
+	if etag == "" {
+		t.Error("File has no entity tag")
+	}
+	if fi.ModTime().Before(before) || fi.ModTime().After(time.Now()) {
+		t.Errorf("Modification time %s of file is different than expected", fi.ModTime())
+	}
+
+	// Reads
+	if _, _, err := client.GetFileDataWithConditions("/testDir/testFile", http.Conditions{IfNoneMatch: etag}); !IsHttpError(err, 304) {
+		t.Errorf("Read with matching If-None-Match returned %v instead of 304", err)
+	}
+	if _, err := client.GetFileWithConditions("/testDir/testFile", http.Conditions{IfModifiedSince: fi.ModTime()}); !IsHttpError(err, 304) {
+		t.Errorf("Read with If-Modified-Since returned %v instead of 304", err)
+	}
+	if _, data, err := client.GetFileDataWithConditions("/testDir/testFile", http.Conditions{IfNoneMatch: `"other"`}); err != nil || string(data) != "testData" {
+		t.Errorf("Read with other If-None-Match returned %s, %v", data, err)
+	}
+	if _, data, err := client.GetFileDataWithConditions("/testDir/testFile", http.Conditions{IfModifiedSince: before.Add(-time.Hour)}); err != nil || string(data) != "testData" {
+		t.Errorf("Read with older If-Modified-Since returned %s, %v", data, err)
+	}
+
+	// Create only if absent
+	if _, err := client.CreateRegularFileWithConditions("/testDir/testFile", 0644, []byte("otherData"), http.Conditions{IfNoneMatch: "*"}); !IsHttpError(err, 412) {
+		t.Errorf("Create of existing file with If-None-Match * returned %v instead of 412", err)
+	}
+	if _, err := client.CreateRegularFileWithConditions("/testDir/newFile", 0644, []byte("newData"), http.Conditions{IfNoneMatch: "*"}); err != nil {
+		t.Errorf("Could not create absent file with If-None-Match *: %s", err)
+	}
+	if _, err := client.CreateRegularFileWithConditions("/testDir/missingFile", 0644, []byte("newData"), http.Conditions{IfMatch: "*"}); !IsHttpError(err, 412) {
+		t.Errorf("Overwrite of absent file with If-Match returned %v instead of 412", err)
+	}
+
+	// Optimistic concurrency
+	updated, err := client.CreateRegularFileWithConditions("/testDir/testFile", 0644, []byte("updatedData"), http.Conditions{IfMatch: etag})
+	if err != nil {
+		t.Fatalf("Could not overwrite file with matching If-Match: %s", err)
+	}
+	if http.ETag(updated) == etag {
+		t.Error("Entity tag did not change after overwrite")
+	}
+	if _, err := client.CreateRegularFileWithConditions("/testDir/testFile", 0644, []byte("lostData"), http.Conditions{IfMatch: etag}); !IsHttpError(err, 412) {
+		t.Errorf("Overwrite with stale If-Match returned %v instead of 412", err)
+	}
+	testReadFile(t, client, "/testDir", "testFile", "updatedData")
+}
+
+func TestRangeRequests(t *testing.T) {
+	server := initServer(t)
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	// A long name needs extended tar headers before the data
+	name := strings.Repeat("n", 150)
+	testCreateDirectory(t, client, "/testDir")
+	testCreateFile(t, client, "/testDir", "testFile", "0123456789")
+	testCreateFile(t, client, "/testDir", name, "abcdefghij")
+
+	get := func(p string, header gohttp.Header) *gohttp.Response {
+		req, _ := gohttp.NewRequest("GET", "http://127.0.0.1:5555/files"+p, nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		resp, err := gohttp.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Could not get %s: %s", p, err)
+		}
+		return resp
+	}
+
+	resp := get("/testDir/testFile", gohttp.Header{"Range": {"bytes=2-5"}})
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 206 || string(body) != "2345" || resp.Header.Get("Content-Range") != "bytes 2-5/10" {
+		t.Errorf("Single range returned %d %s with Content-Range %s", resp.StatusCode, body, resp.Header.Get("Content-Range"))
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Error("Accept-Ranges is not advertised")
+	}
+
+	resp = get("/testDir/"+name, gohttp.Header{"Range": {"bytes=0-1, -3"}})
+	_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+	parts := make([]string, 0)
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		data, _ := ioutil.ReadAll(part)
+		parts = append(parts, part.Header.Get("Content-Range")+" "+string(data))
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 206 || strings.Join(parts, ",") != "bytes 0-1/10 ab,bytes 7-9/10 hij" {
+		t.Errorf("Multiple ranges returned %d %v", resp.StatusCode, parts)
+	}
+
+	// Overlapping ranges adding up to more than the file are ignored instead of amplifying the response
+	resp = get("/testDir/testFile", gohttp.Header{"Range": {"bytes=" + strings.Repeat("0-9,", 99) + "0-9"}})
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "0123456789" {
+		t.Errorf("Overlapping ranges returned %d with %d bytes instead of the whole file", resp.StatusCode, len(body))
+	}
+
+	resp = get("/testDir/testFile", gohttp.Header{"Range": {"bytes=20-30"}})
+	resp.Body.Close()
+	if resp.StatusCode != 416 || resp.Header.Get("Content-Range") != "bytes */10" {
+		t.Errorf("Unsatisfiable range returned %d with Content-Range %s", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+
+	resp = get("/testDir/testFile", gohttp.Header{"Range": {"bytes=2-5"}, "If-Range": {`"other"`}})
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "0123456789" {
+		t.Errorf("Range with other If-Range returned %d %s instead of the whole file", resp.StatusCode, body)
+	}
+
+	for _, c := range []struct {
+		offset   int64
+		length   int64
+		expected string
+	}{{0, 3, "012"}, {8, 5, "89"}, {12, 2, ""}} {
+		data, err := client.ReadRange("/testDir/testFile", c.offset, c.length)
+		if err != nil || string(data) != c.expected {
+			t.Errorf("Read of %d bytes at %d returned %s, %v instead of %s", c.length, c.offset, data, err, c.expected)
+		}
+	}
+	if _, err := client.ReadRange("/testDir/missingFile", 0, 1); !os.IsNotExist(err) {
+		t.Errorf("Read range of missing file returned %v", err)
+	}
+}
+
+func TestHeadAndRangeRequests(t *testing.T) {
+	server := initServer(t)
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	// Other files around the requested one check that ranges never go past its data in the container
+	testCreateDirectory(t, client, "/testDir")
+	testCreateFile(t, client, "/testDir", "beforeFile", "BBBBBBBBBB")
+	testCreateFile(t, client, "/testDir", "testFile", "0123456789")
+	testCreateFile(t, client, "/testDir", "afterFile", "AAAAAAAAAA")
+
+	do := func(method string, header gohttp.Header) (*gohttp.Response, string) {
+		req, _ := gohttp.NewRequest(method, "http://127.0.0.1:5555/files/testDir/testFile", nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		resp, err := gohttp.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Could not %s file: %s", method, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	resp, body := do("HEAD", nil)
+	if resp.StatusCode != 200 || body != "" || resp.ContentLength != 10 || resp.Header.Get("Accept-Ranges") != "bytes" || resp.Header.Get("ETag") == "" {
+		t.Errorf("HEAD returned %d %q with headers %v", resp.StatusCode, body, resp.Header)
+	}
+	etag := resp.Header.Get("ETag")
+
+	// Ranges are only defined for GET
+	resp, body = do("HEAD", gohttp.Header{"Range": {"bytes=2-5"}})
+	if resp.StatusCode != 200 || body != "" || resp.ContentLength != 10 {
+		t.Errorf("HEAD with range returned %d %q with headers %v", resp.StatusCode, body, resp.Header)
+	}
+
+	for _, c := range []struct {
+		header   string
+		expected string
+	}{{"bytes=5-", "56789"}, {"bytes=-3", "789"}, {"bytes=8-20", "89"}, {"bytes=0-0", "0"}} {
+		resp, body = do("GET", gohttp.Header{"Range": {c.header}})
+		if resp.StatusCode != 206 || body != c.expected {
+			t.Errorf("Range %s returned %d %q instead of %q", c.header, resp.StatusCode, body, c.expected)
+		}
+	}
+
+	resp, body = do("GET", gohttp.Header{"Range": {"bytes=2-5"}, "If-Range": {etag}})
+	if resp.StatusCode != 206 || body != "2345" {
+		t.Errorf("Range with current If-Range returned %d %q", resp.StatusCode, body)
+	}
+	resp, body = do("GET", gohttp.Header{"Range": {"bytes=2-5"}, "If-None-Match": {etag}})
+	if resp.StatusCode != 304 || body != "" {
+		t.Errorf("Range of unmodified file returned %d %q instead of 304", resp.StatusCode, body)
+	}
+}
+
+func TestFileVerbs(t *testing.T) {
+	server := initServer(t)
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	testCreateDirectory(t, client, "/testDir")
+	if _, err := client.PutRegularFile("/testDir/testFile", 0644, []byte("testData")); err != nil {
+		t.Errorf("Could not put file: %s", err)
+	}
+	if _, err := client.PutRegularFile("/testDir/testFile", 0644, []byte("newData")); err != nil {
+		t.Errorf("Could not replace file: %s", err)
+	}
+	testReadFile(t, client, "/testDir", "testFile", "newData")
+
+	mode := os.FileMode(0600)
+	modTime := time.Unix(1500000000, 0)
+	fi, err := client.UpdateFile("/testDir/testFile", storage.FileChanges{Mode: &mode, ModTime: &modTime})
+	if err != nil || fi.Mode() != mode || !fi.ModTime().Equal(modTime) {
+		t.Errorf("Update of file returned %v, %v", fi, err)
+	}
+
+	if fi, err := client.CopyFile("/testDir/testFile", "/testDir/copiedFile"); err != nil || fi.Size() != 7 {
+		t.Errorf("Copy of file returned %v, %v", fi, err)
+	}
+	if fi, err := client.RenameFile("/testDir/copiedFile", "/testDir/renamedFile"); err != nil || fi.Name() != "renamedFile" {
+		t.Errorf("Rename of file returned %v, %v", fi, err)
+	}
+	testReadFile(t, client, "/testDir", "renamedFile", "newData")
+
+	req, _ := gohttp.NewRequest("MOVE", "http://127.0.0.1:5555/files/testDir/testFile", nil)
+	req.Header.Set("Destination", "/files/testDir/renamedFile")
+	req.Header.Set("Overwrite", "F")
+	if resp, err := gohttp.DefaultClient.Do(req); err != nil || resp.StatusCode != 412 {
+		t.Errorf("Move without overwrite onto an existing file returned %v, %v", resp, err)
+	}
+
+	if err := client.RemoveFile("/testDir/renamedFile"); err != nil {
+		t.Errorf("Could not remove file: %s", err)
+	}
+	if _, err := client.GetFile("/testDir/renamedFile"); !os.IsNotExist(err) {
+		t.Errorf("Removed file is still found: %v", err)
+	}
+	if err := client.RemoveFile("/testDir"); !IsHttpError(err, 409) {
+		t.Errorf("Removing a directory with files returned %v instead of 409", err)
+	}
+
+	req, _ = gohttp.NewRequest("OPTIONS", "http://127.0.0.1:5555/files/testDir/testFile", nil)
+	resp, err := gohttp.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != 405 || !strings.Contains(resp.Header.Get("Allow"), "MOVE") {
+		t.Errorf("Unsupported method returned %v, %v instead of 405 with Allow", resp, err)
+	}
+}
+
+func TestUploadSizeLimit(t *testing.T) {
+	server := initServerWithOptions(t, `, "max_file_size": "1KB"`)
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	testCreateDirectory(t, client, "/testDir")
+	put := func(prefix string, name string, size int, chunked bool) int {
+		var body io.Reader = bytes.NewReader(make([]byte, size))
+		if chunked {
+			// A reader of unknown size is sent chunked
+			body = ioutil.NopCloser(body)
+		}
+		req, _ := gohttp.NewRequest("PUT", "http://127.0.0.1:5555"+prefix+"/testDir/"+name, body)
+		resp, err := gohttp.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("PUT of %s failed: %s", name, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := put("/files", "big", 2048, false); status != 413 {
+		t.Errorf("Upload bigger than the max file size returned %d instead of 413", status)
+	}
+	if status := put("/files", "bigChunked", 2048, true); status != 413 {
+		t.Errorf("Chunked upload bigger than the max file size returned %d instead of 413", status)
+	}
+	if status := put("/dav", "bigDav", 2048, true); status != 413 {
+		t.Errorf("WebDAV chunked upload bigger than the max file size returned %d instead of 413", status)
+	}
+	if status := put("/files", "small", 1000, true); status != 200 {
+		t.Errorf("Chunked upload of the max file size returned %d instead of 200", status)
+	}
+	if _, err := client.GetFile("/testDir/bigChunked"); !os.IsNotExist(err) {
+		t.Errorf("Refused upload is found: %v", err)
+	}
+}
+
+func TestWebDAV(t *testing.T) {
+	server := initServer(t)
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	dav := func(method string, p string, body string, headers map[string]string) *gohttp.Response {
+		req, _ := gohttp.NewRequest(method, "http://127.0.0.1:5555/dav"+p, strings.NewReader(body))
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := gohttp.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s of %s failed: %s", method, p, err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+		return resp
+	}
+
+	if resp := dav("OPTIONS", "/", "", nil); resp.StatusCode != 200 || resp.Header.Get("DAV") == "" || !strings.Contains(resp.Header.Get("Allow"), "PROPFIND") {
+		t.Errorf("OPTIONS returned %v", resp)
+	}
+	if resp := dav("MKCOL", "/davDir", "", nil); resp.StatusCode != 201 {
+		t.Errorf("MKCOL returned %d instead of 201", resp.StatusCode)
+	}
+	if resp := dav("MKCOL", "/davDir", "", nil); resp.StatusCode != 405 {
+		t.Errorf("MKCOL of an existing collection returned %d instead of 405", resp.StatusCode)
+	}
+	if resp := dav("MKCOL", "/missing/davDir", "", nil); resp.StatusCode != 409 {
+		t.Errorf("MKCOL without parent returned %d instead of 409", resp.StatusCode)
+	}
+	if resp := dav("PUT", "/davDir/a%20file.txt", "testData", map[string]string{"Content-Type": "text/plain"}); resp.StatusCode != 201 {
+		t.Errorf("PUT of a new file returned %d instead of 201", resp.StatusCode)
+	}
+	if resp := dav("PUT", "/davDir/a%20file.txt", "newData", nil); resp.StatusCode != 204 {
+		t.Errorf("PUT of an existing file returned %d instead of 204", resp.StatusCode)
+	}
+	testReadFile(t, client, "/davDir", "a file.txt", "newData")
+
+	resp := dav("PROPFIND", "/davDir", "", map[string]string{"Depth": "1"})
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 207 {
+		t.Errorf("PROPFIND returned %d instead of 207", resp.StatusCode)
+	}
+	for _, expected := range []string{"<D:href>/dav/davDir/</D:href>", "<D:collection></D:collection>", "<D:href>/dav/davDir/a%20file.txt</D:href>", "<D:getcontentlength>7</D:getcontentlength>"} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("PROPFIND response %s doesn't contain %s", body, expected)
+		}
+	}
+	if resp := dav("PROPFIND", "/davDir", "", nil); resp.StatusCode != 403 {
+		t.Errorf("PROPFIND with infinite depth returned %d instead of 403", resp.StatusCode)
+	}
+
+	// Entries of large collections are streamed in a valid document
+	testCreateDirectory(t, client, "/davLargeDir")
+	for i := 0; i < 100; i++ {
+		testCreateFile(t, client, "/davLargeDir", fmt.Sprintf("file%d", i), "testData")
+	}
+	resp = dav("PROPFIND", "/davLargeDir", "", map[string]string{"Depth": "1"})
+	var multistatus struct {
+		Responses []struct {
+			Href string `xml:"href"`
+		} `xml:"response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil || len(multistatus.Responses) != 101 {
+		t.Errorf("PROPFIND of a large collection returned %d responses instead of 101: %v", len(multistatus.Responses), err)
+	} else if multistatus.Responses[0].Href != "/dav/davLargeDir/" {
+		t.Errorf("First response of PROPFIND is %s instead of the collection", multistatus.Responses[0].Href)
+	}
+
+	if resp := dav("COPY", "/davDir", "", map[string]string{"Destination": "http://127.0.0.1:5555/dav/copiedDir"}); resp.StatusCode != 201 {
+		t.Errorf("COPY of a collection returned %d instead of 201", resp.StatusCode)
+	}
+	testReadFile(t, client, "/copiedDir", "a file.txt", "newData")
+	if resp := dav("MOVE", "/copiedDir/a%20file.txt", "", map[string]string{"Destination": "/dav/davDir/a%20file.txt", "Overwrite": "F"}); resp.StatusCode != 412 {
+		t.Errorf("MOVE without overwrite onto an existing file returned %d instead of 412", resp.StatusCode)
+	}
+	if resp := dav("MOVE", "/copiedDir/a%20file.txt", "", map[string]string{"Destination": "/dav/davDir/a%20file.txt"}); resp.StatusCode != 204 {
+		t.Errorf("MOVE onto an existing file returned %d instead of 204", resp.StatusCode)
+	}
+
+	if resp := dav("LOCK", "/davDir/a%20file.txt", "", nil); resp.StatusCode != 200 || resp.Header.Get("Lock-Token") == "" {
+		t.Errorf("LOCK returned %v", resp)
+	}
+	if resp := dav("UNLOCK", "/davDir/a%20file.txt", "", nil); resp.StatusCode != 204 {
+		t.Errorf("UNLOCK returned %d instead of 204", resp.StatusCode)
+	}
+
+	if resp := dav("DELETE", "/davDir", "", nil); resp.StatusCode != 204 {
+		t.Errorf("DELETE of a collection returned %d instead of 204", resp.StatusCode)
+	}
+	if _, err := client.GetFile("/davDir"); !os.IsNotExist(err) {
+		t.Errorf("Deleted collection is still found: %v", err)
+	}
+}
+
+func TestS3Gateway(t *testing.T) {
+	server := initServer(t)
+	defer server.CloseAndDestroyStorage()
+
+	client := initClient(t)
+	defer client.Close()
+
+	s3Request := func(method string, p string, headers map[string]string) (*gohttp.Response, string) {
+		req, _ := gohttp.NewRequest(method, "http://127.0.0.1:5555/s3"+p, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := gohttp.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s of %s failed: %s", method, p, err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	if resp, _ := s3Request("PUT", "/bucket", nil); resp.StatusCode != 200 {
+		t.Errorf("Bucket creation returned %d instead of 200", resp.StatusCode)
+	}
+	if resp, body := s3Request("GET", "/", nil); resp.StatusCode != 200 || !strings.Contains(body, "<Name>bucket</Name>") {
+		t.Errorf("Bucket listing returned %d %s", resp.StatusCode, body)
+	}
+
+	// Requests of the client are signed like with any S3 service
+	bucket := s3.NewClient("http://127.0.0.1:5555/s3", "us-east-1", "bucket", "accessKey", "secretKey")
+	for _, key := range []string{"a.txt", "photos/2020/jan.jpg", "photos/2020/feb.jpg", "photos/2021/mar.jpg", "photos/index.html"} {
+		if err := bucket.PutObject(key, strings.NewReader("data of "+key), int64(len("data of "+key))); err != nil {
+			t.Errorf("Could not put object %s: %s", key, err)
+		}
+	}
+	testReadFile(t, client, "/bucket/photos/2020", "jan.jpg", "data of photos/2020/jan.jpg")
+	if size, err := bucket.HeadObject("photos/2021/mar.jpg"); err != nil || size != 27 {
+		t.Errorf("Head of object returned %d, %v", size, err)
+	}
+	if data, err := bucket.GetObjectRange("photos/2021/mar.jpg", 8, 6); err != nil || string(data) != "photos" {
+		t.Errorf("Range of object returned %s, %v", data, err)
+	}
+	if _, err := bucket.HeadObject("photos"); !os.IsNotExist(err) {
+		t.Errorf("Head of a prefix returned %v instead of not found", err)
+	}
+
+	resp, body := s3Request("GET", "/bucket?list-type=2&prefix=photos/&delimiter=/", nil)
+	if resp.StatusCode != 200 || !strings.Contains(body, "<Key>photos/index.html</Key>") ||
+		!strings.Contains(body, "<CommonPrefixes><Prefix>photos/2020/</Prefix></CommonPrefixes><CommonPrefixes><Prefix>photos/2021/</Prefix></CommonPrefixes>") ||
+		strings.Contains(body, "jan.jpg") {
+		t.Errorf("Listing with delimiter returned %d %s", resp.StatusCode, body)
+	}
+	var keys []string
+	token := ""
+	for {
+		resp, body := s3Request("GET", "/bucket?list-type=2&max-keys=2&prefix=photos&continuation-token="+url.QueryEscape(token), nil)
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal([]byte(body), &result); err != nil || resp.StatusCode != 200 || len(result.Contents) > 2 {
+			t.Fatalf("Listing page returned %d %s", resp.StatusCode, body)
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	if strings.Join(keys, ",") != "photos/2020/feb.jpg,photos/2020/jan.jpg,photos/2021/mar.jpg,photos/index.html" {
+		t.Errorf("Paginated listing returned %v", keys)
+	}
+
+	if resp, body := s3Request("PUT", "/bucket/copies/a.txt", map[string]string{"X-Amz-Copy-Source": "/bucket/a.txt"}); resp.StatusCode != 200 || !strings.Contains(body, "<CopyObjectResult") {
+		t.Errorf("Copy of object returned %d %s", resp.StatusCode, body)
+	}
+	testReadFile(t, client, "/bucket/copies", "a.txt", "data of a.txt")
+
+	if err := bucket.DeleteObject("a.txt"); err != nil {
+		t.Errorf("Could not delete object: %s", err)
+	}
+	if err := bucket.DeleteObject("a.txt"); err != nil {
+		t.Errorf("Delete of a missing object returned %s", err)
+	}
+	if resp, body := s3Request("GET", "/bucket/a.txt", nil); resp.StatusCode != 404 || !strings.Contains(body, "<Code>NoSuchKey</Code>") {
+		t.Errorf("Get of a deleted object returned %d %s", resp.StatusCode, body)
+	}
+	if resp, body := s3Request("DELETE", "/bucket", nil); resp.StatusCode != 409 || !strings.Contains(body, "<Code>BucketNotEmpty</Code>") {
+		t.Errorf("Delete of a bucket with objects returned %d %s", resp.StatusCode, body)
+	}
+	if resp, _ := s3Request("GET", "/missing?list-type=2", nil); resp.StatusCode != 404 {
+		t.Errorf("Listing of a missing bucket returned %d instead of 404", resp.StatusCode)
+	}
+}
+
+func TestS3GatewayWithAwsSdk(t *testing.T) {
+	server := initServerWithOptions(t, `, "max_file_size": "1KB"`)
+	defer server.CloseAndDestroyStorage()
+
+	ctx := context.Background()
+	sdk := awss3.New(awss3.Options{
+		Region: "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "accessKey", SecretAccessKey: "secretKey"}, nil
+		}),
+		EndpointResolver: awss3.EndpointResolverFromURL("http://127.0.0.1:5555/s3"),
+		UsePathStyle:     true,
+	})
+	errorCode := func(err error) string {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			return apiErr.ErrorCode()
+		}
+		return fmt.Sprint(err)
+	}
+
+	if _, err := sdk.CreateBucket(ctx, &awss3.CreateBucketInput{Bucket: aws.String("sdk")}); err != nil {
+		t.Fatalf("Could not create bucket: %s", err)
+	}
+	for _, key := range []string{"b", "a/x", "a.txt", "a-b/x", "a/b/c"} {
+		data := "data of " + key
+		out, err := sdk.PutObject(ctx, &awss3.PutObjectInput{Bucket: aws.String("sdk"), Key: aws.String(key), Body: strings.NewReader(data)})
+		if err != nil {
+			t.Fatalf("Could not put object %s: %s", key, err)
+		}
+		if digest := md5.Sum([]byte(data)); aws.ToString(out.ETag) != "\""+hex.EncodeToString(digest[:])+"\"" {
+			t.Errorf("ETag of %s is %s instead of the md5 of the data", key, aws.ToString(out.ETag))
+		}
+	}
+
+	// Without delimiter, keys are listed in byte order through all directories
+	var keys []string
+	paginator := awss3.NewListObjectsV2Paginator(sdk, &awss3.ListObjectsV2Input{Bucket: aws.String("sdk"), MaxKeys: 2})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			t.Fatalf("Could not list objects: %s", err)
+		}
+		if len(page.Contents) > 2 {
+			t.Errorf("Listing page has %d objects", len(page.Contents))
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+	if strings.Join(keys, ",") != "a-b/x,a.txt,a/b/c,a/x,b" {
+		t.Errorf("Paginated listing returned %v", keys)
+	}
+	listing, err := sdk.ListObjectsV2(ctx, &awss3.ListObjectsV2Input{Bucket: aws.String("sdk"), Delimiter: aws.String("/")})
+	if err != nil {
+		t.Fatalf("Could not list objects with delimiter: %s", err)
+	}
+	keys = nil
+	for _, object := range listing.Contents {
+		keys = append(keys, aws.ToString(object.Key))
+	}
+	for _, prefix := range listing.CommonPrefixes {
+		keys = append(keys, aws.ToString(prefix.Prefix))
+	}
+	if strings.Join(keys, ",") != "a.txt,b,a-b/,a/" {
+		t.Errorf("Listing with delimiter returned %v", keys)
+	}
+
+	if head, err := sdk.HeadObject(ctx, &awss3.HeadObjectInput{Bucket: aws.String("sdk"), Key: aws.String("a/b/c")}); err != nil || head.ContentLength != 13 {
+		t.Errorf("Head of object returned %v, %v", head, err)
+	}
+	if object, err := sdk.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("sdk"), Key: aws.String("a.txt"), Range: aws.String("bytes=8-")}); err != nil {
+		t.Errorf("Could not get range of object: %s", err)
+	} else {
+		data, _ := ioutil.ReadAll(object.Body)
+		object.Body.Close()
+		if string(data) != "a.txt" {
+			t.Errorf("Range of object returned %s", data)
+		}
+	}
+	if _, err := sdk.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("sdk"), Key: aws.String("a.txt"), Range: aws.String("bytes=100-")}); errorCode(err) != "InvalidRange" {
+		t.Errorf("Get of an unsatisfiable range returned %s instead of InvalidRange", errorCode(err))
+	}
+	if _, err := sdk.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("sdk"), Key: aws.String("missing")}); errorCode(err) != "NoSuchKey" {
+		t.Errorf("Get of a missing object returned %s instead of NoSuchKey", errorCode(err))
+	}
+	if _, err := sdk.PutObject(ctx, &awss3.PutObjectInput{Bucket: aws.String("sdk"), Key: aws.String("b"), Body: strings.NewReader("other"), ContentMD5: aws.String("1B2M2Y8AsgTpgAmY7PhCfg==")}); errorCode(err) != "BadDigest" {
+		t.Errorf("Put with a wrong Content-MD5 returned %s instead of BadDigest", errorCode(err))
+	}
+	if _, err := sdk.PutObject(ctx, &awss3.PutObjectInput{Bucket: aws.String("sdk"), Key: aws.String("big"), Body: bytes.NewReader(make([]byte, 2048))}); errorCode(err) != "EntityTooLarge" {
+		t.Errorf("Put of an object bigger than the max file size returned %s instead of EntityTooLarge", errorCode(err))
+	}
+
+	if _, err := sdk.DeleteObject(ctx, &awss3.DeleteObjectInput{Bucket: aws.String("sdk"), Key: aws.String("b")}); err != nil {
+		t.Errorf("Could not delete object: %s", err)
+	}
+	if _, err := sdk.DeleteBucket(ctx, &awss3.DeleteBucketInput{Bucket: aws.String("sdk")}); errorCode(err) != "BucketNotEmpty" {
+		t.Errorf("Delete of a bucket with objects returned %s instead of BucketNotEmpty", errorCode(err))
+	}
+}
@@ -6,17 +6,23 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	gohttp "net/http"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/t-mind/flocons/cluster"
 	"github.com/t-mind/flocons/config"
+	"github.com/t-mind/flocons/file"
 	"github.com/t-mind/flocons/http"
 	"github.com/t-mind/flocons/storage"
 	"github.com/t-mind/flocons/test/mock"
 )
 
-func createServerAndClient(t *testing.T, number int, zookeeper *mock.Zookeeper, trueDispatcher bool) (*http.Server, *http.Client, *storage.Storage) {
+func createServerAndClient(t *testing.T, number int, zookeeper *mock.Zookeeper, trueDispatcher bool) (*http.Server, *http.Client, *storage.DiskStorage) {
 	directory, err := ioutil.TempDir(os.TempDir(), "flocons-test")
 	if err != nil {
 		panic(err)
@@ -180,3 +186,334 @@ func TestSimpleDispatching(t *testing.T) {
 		testReadFile(t, client, dir, fmt.Sprintf("testFile%d", i), fmt.Sprintf("testData%d", i))
 	}
 }
+
+func TestDistributedBatchRead(t *testing.T) {
+	log.SetLevel(log.DebugLevel)
+	mock := mock.NewZookeeper()
+	server1, client1, storage1 := createServerAndClient(t, 1, mock, false)
+	defer server1.CloseAndDestroyStorage()
+	defer client1.Close()
+	server2, client2, storage2 := createServerAndClient(t, 2, mock, false)
+	defer server2.CloseAndDestroyStorage()
+	defer client2.Close()
+
+	// Data is fetched from a node whose name comes after the one of the reading node, and then before
+	testDistributedBatchRead(t, "/dir", client2, storage2, client1, storage1)
+	testDistributedBatchRead(t, "/otherDir", client1, storage1, client2, storage2)
+}
+
+func testDistributedBatchRead(t *testing.T, dir string, writer *http.Client, writerStorage *storage.DiskStorage, reader *http.Client, readerStorage *storage.DiskStorage) {
+	testCreateDirectory(t, writer, dir)
+	testCreateFile(t, writer, dir, "testFile1", "testData1")
+	testCreateFile(t, writer, dir, "testFile2", "testData2")
+
+	// Let's copy indexes only from the writer storage to the reader storage so that data must be fetched on the writer node
+	readerDir := readerStorage.MakeAbsolute(dir)
+	writerDir := writerStorage.MakeAbsolute(dir)
+	os.Mkdir(readerDir, 0755)
+	files, _ := filepath.Glob(filepath.Join(writerDir, "index*"))
+	for _, file := range files {
+		origin, _ := os.Open(file)
+		copy, _ := os.Create(filepath.Join(readerDir, file[len(writerDir):]))
+		io.Copy(copy, origin)
+		origin.Close()
+		copy.Close()
+	}
+
+	results, err := reader.GetRegularFiles([]string{dir + "/testFile1", dir + "/testFile2"})
+	if err != nil {
+		t.Errorf("Could not read files in batch: %s", err)
+		t.FailNow()
+	}
+	for i, result := range results {
+		if result.Err != nil {
+			t.Errorf("Could not read file %s in batch: %s", result.Path, result.Err)
+			continue
+		}
+		data, _ := result.FileInfo.(*file.FileInfo).Data()
+		if string(data) != fmt.Sprintf("testData%d", i+1) {
+			t.Errorf("Data value does not match: %s != %s", data, fmt.Sprintf("testData%d", i+1))
+		}
+	}
+}
+
+func TestDistributedRemove(t *testing.T) {
+	mock := mock.NewZookeeper()
+	server1, client1, storage1 := createServerAndClient(t, 1, mock, false)
+	defer server1.CloseAndDestroyStorage()
+	defer client1.Close()
+	server2, client2, storage2 := createServerAndClient(t, 2, mock, false)
+	defer server2.CloseAndDestroyStorage()
+	defer client2.Close()
+
+	// Both nodes wrote a version of the file, node 1 seeing the index of node 2
+	testCreateDirectory(t, client1, "/dir")
+	testCreateDirectory(t, client2, "/dir")
+	testCreateFile(t, client2, "/dir", "testFile", "oldData")
+	testCreateFile(t, client1, "/dir", "testFile", "newData")
+	copyIndexes := func() {
+		copyIndexesOfDirectory(storage2, storage1, "/dir")
+	}
+	copyIndexes()
+	if versions, err := storage1.GetRegularFileVersions("/dir/testFile"); err != nil || len(versions) != 2 {
+		t.Fatalf("Node 1 sees %d versions of the file instead of 2: %v", len(versions), err)
+	}
+
+	// Removing the file on node 1 removes the version of node 2 through it
+	if err := client1.RemoveFile("/dir/testFile"); err != nil {
+		t.Errorf("Could not remove file: %s", err)
+	}
+	if _, err := storage2.GetRegularFile("/dir/testFile"); !os.IsNotExist(err) {
+		t.Errorf("Version of node 2 is still found: %v", err)
+	}
+	// Indexes of other nodes are read again once their containers are forgotten
+	copyIndexes()
+	storage1.ResetCache()
+	if _, err := client1.GetRegularFile("/dir/testFile"); !os.IsNotExist(err) {
+		t.Errorf("Removed file is still found on node 1: %v", err)
+	}
+}
+
+// Make the indexes of a directory written by a node visible to another one, as a shared storage would
+func copyIndexesOfDirectory(from *storage.DiskStorage, to *storage.DiskStorage, directory string) {
+	fromDirectory := from.MakeAbsolute(directory)
+	toDirectory := to.MakeAbsolute(directory)
+	files, _ := filepath.Glob(filepath.Join(fromDirectory, "index*"))
+	for _, file := range files {
+		origin, _ := os.Open(file)
+		copy, _ := os.Create(filepath.Join(toDirectory, file[len(fromDirectory):]))
+		io.Copy(copy, origin)
+		origin.Close()
+		copy.Close()
+	}
+}
+
+func TestDistributedDavRemove(t *testing.T) {
+	mock := mock.NewZookeeper()
+	server1, client1, storage1 := createServerAndClient(t, 1, mock, false)
+	defer server1.CloseAndDestroyStorage()
+	defer client1.Close()
+	server2, client2, storage2 := createServerAndClient(t, 2, mock, false)
+	defer server2.CloseAndDestroyStorage()
+	defer client2.Close()
+
+	testCreateDirectory(t, client1, "/davDir")
+	testCreateDirectory(t, client2, "/davDir")
+	testCreateFile(t, client2, "/davDir", "remoteFile", "remoteData")
+	copyIndexesOfDirectory(storage2, storage1, "/davDir")
+
+	// The removal by node 2 becomes visible to node 1 some time after it has been written to the index of node 2
+	indexesSize := func() int64 {
+		var size int64
+		files, _ := filepath.Glob(filepath.Join(storage2.MakeAbsolute("/davDir"), "index*"))
+		for _, file := range files {
+			if fi, err := os.Stat(file); err == nil {
+				size += fi.Size()
+			}
+		}
+		return size
+	}
+	initialSize := indexesSize()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if indexesSize() > initialSize {
+				time.Sleep(200 * time.Millisecond)
+				copyIndexesOfDirectory(storage2, storage1, "/davDir")
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	req, _ := gohttp.NewRequest("DELETE", "http://127.0.0.1:5556/dav/davDir", nil)
+	resp, err := gohttp.DefaultClient.Do(req)
+	<-done
+	if err != nil || resp.StatusCode != 204 {
+		t.Fatalf("DELETE of a collection with a file of another node returned %v, %v instead of 204", resp, err)
+	}
+	if _, err := client1.GetFile("/davDir"); !os.IsNotExist(err) {
+		t.Errorf("Deleted collection is still found: %v", err)
+	}
+	if _, err := storage2.GetRegularFile("/davDir/remoteFile"); !os.IsNotExist(err) {
+		t.Errorf("File of node 2 is still found: %v", err)
+	}
+}
+
+func TestDistributedS3RemoveAndReplace(t *testing.T) {
+	mock := mock.NewZookeeper()
+	server1, client1, storage1 := createServerAndClient(t, 1, mock, false)
+	defer server1.CloseAndDestroyStorage()
+	defer client1.Close()
+	server2, client2, storage2 := createServerAndClient(t, 2, mock, false)
+	defer server2.CloseAndDestroyStorage()
+	defer client2.Close()
+
+	s3Request := func(method string, p string, body string) int {
+		req, _ := gohttp.NewRequest(method, "http://127.0.0.1:5556/s3"+p, strings.NewReader(body))
+		resp, err := gohttp.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s of %s failed: %s", method, p, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	versionsOfNode2 := func(p string) int {
+		versions, _ := storage2.GetRegularFileVersions(p)
+		count := 0
+		for _, version := range versions {
+			if version.(*file.FileInfo).Node() == "node-2" {
+				count++
+			}
+		}
+		return count
+	}
+
+	// Both nodes wrote a version of the objects, node 1 seeing the index of node 2
+	testCreateDirectory(t, client1, "/bucket")
+	testCreateDirectory(t, client2, "/bucket")
+	for _, key := range []string{"removed", "replaced"} {
+		testCreateFile(t, client2, "/bucket", key, "oldData")
+		testCreateFile(t, client1, "/bucket", key, "newData")
+	}
+	copyIndexesOfDirectory(storage2, storage1, "/bucket")
+
+	if status := s3Request("DELETE", "/bucket/removed", ""); status != 204 {
+		t.Errorf("DELETE of object returned %d instead of 204", status)
+	}
+	if count := versionsOfNode2("/bucket/removed"); count != 0 {
+		t.Errorf("Removed object still has %d versions on node 2", count)
+	}
+
+	if status := s3Request("PUT", "/bucket/replaced", "replacingData"); status != 200 {
+		t.Errorf("PUT of object returned %d instead of 200", status)
+	}
+	if count := versionsOfNode2("/bucket/replaced"); count != 0 {
+		t.Errorf("Replaced object still has %d versions on node 2", count)
+	}
+	testReadFile(t, client1, "/bucket", "replaced", "replacingData")
+}
+
+func TestConcurrentDistributedRemoves(t *testing.T) {
+	mock := mock.NewZookeeper()
+	server1, client1, storage1 := createServerAndClient(t, 1, mock, false)
+	defer server1.CloseAndDestroyStorage()
+	defer client1.Close()
+	server2, client2, storage2 := createServerAndClient(t, 2, mock, false)
+	defer server2.CloseAndDestroyStorage()
+	defer client2.Close()
+
+	// Both nodes have a version of each file, and see the one of the other node
+	count := 2 * http.FILE_WORKER_POOL_SIZE
+	testCreateDirectory(t, client1, "/dir")
+	testCreateDirectory(t, client2, "/dir")
+	for i := 0; i < count; i++ {
+		testCreateFile(t, client1, "/dir", fmt.Sprintf("file%d", i), "data1")
+		testCreateFile(t, client2, "/dir", fmt.Sprintf("file%d", i), "data2")
+	}
+	copyIndexesOfDirectory(storage1, storage2, "/dir")
+	copyIndexesOfDirectory(storage2, storage1, "/dir")
+
+	// Each node waits for the other one to remove its versions, while more requests than workers come
+	var wg sync.WaitGroup
+	failures := make(chan error, count)
+	for i := 0; i < count; i++ {
+		client := client1
+		if i%2 == 1 {
+			client = client2
+		}
+		wg.Add(1)
+		go func(client *http.Client, p string) {
+			defer wg.Done()
+			if err := client.RemoveFile(p); err != nil {
+				failures <- err
+			}
+		}(client, fmt.Sprintf("/dir/file%d", i))
+	}
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Concurrent removals through both nodes are blocked")
+	}
+	close(failures)
+	for err := range failures {
+		t.Errorf("Could not remove file: %s", err)
+	}
+
+	// Both nodes remove the same files at once, each one asking the other to remove its version
+	removeThroughBothNodes := func(directory string, remove func(client *http.Client, p string) error) {
+		testCreateDirectory(t, client1, directory)
+		testCreateDirectory(t, client2, directory)
+		for i := 0; i < count; i++ {
+			testCreateFile(t, client1, directory, fmt.Sprintf("file%d", i), "data1")
+			testCreateFile(t, client2, directory, fmt.Sprintf("file%d", i), "data2")
+		}
+		copyIndexesOfDirectory(storage1, storage2, directory)
+		copyIndexesOfDirectory(storage2, storage1, directory)
+		failures := make(chan error, 2*count)
+		for i := 0; i < count; i++ {
+			for _, client := range []*http.Client{client1, client2} {
+				wg.Add(1)
+				go func(client *http.Client, p string) {
+					defer wg.Done()
+					// The file may already be removed by the other node
+					if err := remove(client, p); err != nil && !os.IsNotExist(err) {
+						failures <- err
+					}
+				}(client, fmt.Sprintf("%s/file%d", directory, i))
+			}
+		}
+		done := make(chan bool)
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Removals of the same files in %s through both nodes are blocked", directory)
+		}
+		close(failures)
+		for err := range failures {
+			t.Errorf("Could not remove file: %s", err)
+		}
+		// Each node only sees the removals of the other one once it reads its index again
+		for i := 0; i < count; i++ {
+			for node, s := range map[string]*storage.DiskStorage{"node-1": storage1, "node-2": storage2} {
+				versions, _ := s.GetRegularFileVersions(fmt.Sprintf("%s/file%d", directory, i))
+				for _, version := range versions {
+					if version.(*file.FileInfo).Node() == node {
+						t.Errorf("Version of %s of %s/file%d is still found", node, directory, i)
+					}
+				}
+			}
+		}
+	}
+	removeThroughBothNodes("/sameDir", func(client *http.Client, p string) error {
+		return client.RemoveFile(p)
+	})
+	removeThroughBothNodes("/sameDavDir", func(client *http.Client, p string) error {
+		port := 5556
+		if client == client2 {
+			port = 5557
+		}
+		req, _ := gohttp.NewRequest("DELETE", fmt.Sprintf("http://127.0.0.1:%d/dav%s", port, p), nil)
+		resp, err := gohttp.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == gohttp.StatusNotFound {
+			return os.ErrNotExist
+		} else if resp.StatusCode != gohttp.StatusNoContent {
+			body, _ := ioutil.ReadAll(resp.Body)
+			return fmt.Errorf("DELETE of %s returned %d %s", p, resp.StatusCode, body)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,141 @@
+package mock
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// In-process stand-in of an S3 compatible server, holding objects in memory
+// Only path style PUT, GET with a single range, HEAD and DELETE of objects are supported
+// Like S3, uploads are checked against their Content-MD5 header and the ETag of objects is their hex MD5 digest
+type S3 struct {
+	server        *httptest.Server
+	mutex         *sync.Mutex
+	objects       map[string][]byte
+	rangeRequests int
+	unsigned      int // requests received without signature
+}
+
+func NewS3() *S3 {
+	s := S3{
+		mutex:   &sync.Mutex{},
+		objects: make(map[string][]byte),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return &s
+}
+
+func (s *S3) URL() string {
+	return s.server.URL
+}
+
+func (s *S3) Close() {
+	s.server.Close()
+}
+
+// Keys of stored objects, with the bucket name as first path element
+func (s *S3) Keys() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Store an object directly, with the bucket name as first path element of the key
+func (s *S3) SetObject(key string, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.objects[key] = data
+}
+
+// Number of GET requests with a range
+func (s *S3) RangeRequests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rangeRequests
+}
+
+// Number of requests without AWS signature version 4
+func (s *S3) UnsignedRequests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.unsigned
+}
+
+func (s *S3) handle(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") || r.Header.Get("X-Amz-Date") == "" {
+		s.unsigned++
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	switch r.Method {
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sum := md5.Sum(data)
+		if expected := r.Header.Get("Content-MD5"); expected != "" {
+			if decoded, err := base64.StdEncoding.DecodeString(expected); err != nil || !bytes.Equal(decoded, sum[:]) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		s.objects[key] = data
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead, http.MethodGet:
+		data, found := s.objects[key]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sum := md5.Sum(data)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+		rangeHeader := r.Header.Get("Range")
+		if r.Method == http.MethodHead || rangeHeader == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			if r.Method == http.MethodGet {
+				w.Write(data)
+			}
+			return
+		}
+		s.rangeRequests++
+		var start, end int
+		if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end); err != nil || start > end {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if start >= len(data) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start : end+1])
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
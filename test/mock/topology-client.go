@@ -9,3 +9,14 @@ func (c *NullTopologyClient) Nodes() map[string]*cluster.NodeInfo {
 }
 func (c *NullTopologyClient) GetNodeForObject(p string) *cluster.NodeInfo { return nil }
 func (c *NullTopologyClient) Close()                                      {}
+
+// Topology where one node is responsible for all paths
+type StaticTopologyClient struct {
+	Node *cluster.NodeInfo
+}
+
+func (c *StaticTopologyClient) Nodes() map[string]*cluster.NodeInfo {
+	return map[string]*cluster.NodeInfo{c.Node.Name: c.Node}
+}
+func (c *StaticTopologyClient) GetNodeForObject(p string) *cluster.NodeInfo { return c.Node }
+func (c *StaticTopologyClient) Close()                                      {}
@@ -2,6 +2,7 @@ package mock
 
 import (
 	"path"
+	"sync"
 	"time"
 
 	"github.com/samuel/go-zookeeper/zk"
@@ -11,6 +12,7 @@ import (
 type Zookeeper struct {
 	root   *ZookeeperNode
 	Events chan zk.Event
+	mutex  *sync.Mutex // clients of all nodes share the tree
 }
 
 type ZookeeperClient struct {
@@ -23,6 +25,7 @@ func NewZookeeper() *Zookeeper {
 	return &Zookeeper{
 		root:   newZookeeperNode(nil, nil),
 		Events: make(chan zk.Event, 1000),
+		mutex:  &sync.Mutex{},
 	}
 }
 
@@ -39,6 +42,8 @@ func (z *Zookeeper) GetFactory() cluster.ZookeeperClientFactory {
 }
 
 func (c *ZookeeperClient) Create(p string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	c.zk.mutex.Lock()
+	defer c.zk.mutex.Unlock()
 	if c.closed {
 		return "", zk.ErrConnectionClosed
 	}
@@ -64,6 +69,8 @@ func (c *ZookeeperClient) Create(p string, data []byte, flags int32, acl []zk.AC
 }
 
 func (c *ZookeeperClient) Set(p string, data []byte, version int32) (*zk.Stat, error) {
+	c.zk.mutex.Lock()
+	defer c.zk.mutex.Unlock()
 	if c.closed {
 		return nil, zk.ErrConnectionClosed
 	}
@@ -78,6 +85,8 @@ func (c *ZookeeperClient) Set(p string, data []byte, version int32) (*zk.Stat, e
 }
 
 func (c *ZookeeperClient) Delete(p string, version int32) error {
+	c.zk.mutex.Lock()
+	defer c.zk.mutex.Unlock()
 	if c.closed {
 		return zk.ErrConnectionClosed
 	}
@@ -96,6 +105,8 @@ func (c *ZookeeperClient) Delete(p string, version int32) error {
 }
 
 func (c *ZookeeperClient) Exists(p string) (bool, *zk.Stat, error) {
+	c.zk.mutex.Lock()
+	defer c.zk.mutex.Unlock()
 	if c.closed {
 		return false, nil, zk.ErrConnectionClosed
 	}
@@ -112,6 +123,8 @@ func (c *ZookeeperClient) ExistsW(p string) (bool, *zk.Stat, <-chan zk.Event, er
 }
 
 func (c *ZookeeperClient) Get(p string) ([]byte, *zk.Stat, error) {
+	c.zk.mutex.Lock()
+	defer c.zk.mutex.Unlock()
 	if c.closed {
 		return nil, nil, zk.ErrConnectionClosed
 	}
@@ -123,6 +136,8 @@ func (c *ZookeeperClient) Get(p string) ([]byte, *zk.Stat, error) {
 }
 
 func (c *ZookeeperClient) GetW(p string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	c.zk.mutex.Lock()
+	defer c.zk.mutex.Unlock()
 	if c.closed {
 		return nil, nil, nil, zk.ErrConnectionClosed
 	}
@@ -139,6 +154,8 @@ func (c *ZookeeperClient) GetW(p string) ([]byte, *zk.Stat, <-chan zk.Event, err
 }
 
 func (c *ZookeeperClient) Children(p string) ([]string, *zk.Stat, error) {
+	c.zk.mutex.Lock()
+	defer c.zk.mutex.Unlock()
 	if c.closed {
 		return nil, nil, zk.ErrConnectionClosed
 	}
@@ -150,6 +167,8 @@ func (c *ZookeeperClient) Children(p string) ([]string, *zk.Stat, error) {
 }
 
 func (c *ZookeeperClient) ChildrenW(p string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	c.zk.mutex.Lock()
+	defer c.zk.mutex.Unlock()
 	if c.closed {
 		return nil, nil, nil, zk.ErrConnectionClosed
 	}
@@ -166,6 +185,8 @@ func (c *ZookeeperClient) ChildrenW(p string) ([]string, *zk.Stat, <-chan zk.Eve
 }
 
 func (c *ZookeeperClient) Close() {
+	c.zk.mutex.Lock()
+	defer c.zk.mutex.Unlock()
 	if c.closed {
 		panic("Can't close a client twice")
 	}
@@ -178,6 +199,8 @@ func (c *ZookeeperClient) Close() {
 }
 
 func (z *Zookeeper) Clear() {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
 	z.root.clear(nil)
 }
 
@@ -0,0 +1,309 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/t-mind/flocons/cluster"
+	"github.com/t-mind/flocons/config"
+	"github.com/t-mind/flocons/p9"
+	"github.com/t-mind/flocons/storage"
+	"github.com/t-mind/flocons/test/mock"
+)
+
+// Start a 9P server of a node, with additional storage options in json, each preceded by a comma
+func initP9Server(t *testing.T, nodeName string, topologyClient cluster.TopologyClient, options string) (storage.Storage, *p9.Server, *p9.Client) {
+	directory, err := ioutil.TempDir(os.TempDir(), "flocons-test")
+	if err != nil {
+		panic(err)
+	}
+	config, err := config.NewConfigFromJson([]byte(`{"node": {"name": "` + nodeName + `"}, "storage": {"path": "` + directory + `"` + options + `}}`))
+	if err != nil {
+		t.Fatalf("Could not parse config: %s", err)
+	}
+	storage, err := storage.NewStorage(config)
+	if err != nil {
+		t.Fatalf("Could not instantiate storage: %s", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	server, err := p9.NewServerWithListener(config, storage, topologyClient, listener)
+	if err != nil {
+		t.Fatalf("Could not instantiate 9P server: %s", err)
+	}
+	client, err := p9.Dial(server.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect to 9P server: %s", err)
+	}
+	return storage, server, client
+}
+
+func TestP9Server(t *testing.T) {
+	storage, server, client := initP9Server(t, "node-0", &mock.NullTopologyClient{}, "")
+	defer storage.Destroy()
+	defer server.Close()
+	defer client.Close()
+
+	root, err := client.Attach("")
+	if err != nil {
+		t.Fatalf("Could not attach: %s", err)
+	}
+	if _, err := root.Mkdir("p9Dir", 0755); err != nil {
+		t.Fatalf("Could not make directory: %s", err)
+	}
+	if _, err := root.Mkdir("p9Dir", 0755); err != p9.EEXIST {
+		t.Errorf("Making an existing directory returned %v instead of EEXIST", err)
+	}
+	dir, err := root.Walk("p9Dir")
+	if err != nil {
+		t.Fatalf("Could not walk to directory: %s", err)
+	}
+	if _, err := root.Walk("p9Dir", "missing"); err != p9.ENOENT {
+		t.Errorf("Walking to a missing file returned %v instead of ENOENT", err)
+	}
+
+	f, err := dir.Walk()
+	if err != nil {
+		t.Fatalf("Could not clone directory: %s", err)
+	}
+	if err := f.Create("file", p9.O_RDWR|p9.O_EXCL, 0640); err != nil {
+		t.Fatalf("Could not create file: %s", err)
+	}
+	for _, write := range []struct {
+		offset int64
+		data   string
+	}{{0, "hello"}, {5, " world"}, {0, "H"}} {
+		if _, err := f.WriteAt([]byte(write.data), write.offset); err != nil {
+			t.Errorf("Could not write: %s", err)
+		}
+	}
+	if attr, err := f.GetAttr(); err != nil || attr.Size != 11 || attr.Mode != p9.S_IFREG|0640 {
+		t.Errorf("Attributes of a file being written are %v, %v", attr, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Could not close file: %s", err)
+	}
+	testReadFile(t, storage, "/p9Dir", "file", "Hello world")
+
+	f, err = dir.Walk("file")
+	if err != nil {
+		t.Fatalf("Could not walk to file: %s", err)
+	}
+	if err := f.Open(p9.O_RDONLY); err != nil {
+		t.Fatalf("Could not open file: %s", err)
+	}
+	data := make([]byte, 10)
+	if n, err := f.ReadAt(data, 6); err != io.EOF || string(data[:n]) != "world" {
+		t.Errorf("Read returned %s, %v", data[:n], err)
+	}
+	if _, err := f.WriteAt([]byte("data"), 0); err != p9.EBADF {
+		t.Errorf("Writing a file opened for reading returned %v instead of EBADF", err)
+	}
+	if err := f.SetAttr(p9.SetAttr{Valid: p9.SETATTR_SIZE | p9.SETATTR_MODE, Size: 5, Mode: 0600}); err != nil {
+		t.Errorf("Could not set attributes: %s", err)
+	}
+	if fi := testReadFile(t, storage, "/p9Dir", "file", "Hello"); fi.Mode().Perm() != 0600 {
+		t.Errorf("Mode of file %s is different than expected 0600", fi.Mode())
+	}
+	f.Close()
+
+	if err := dir.Open(p9.O_RDONLY); err != nil {
+		t.Fatalf("Could not open directory: %s", err)
+	}
+	entries, err := dir.ReadDir()
+	if err != nil || len(entries) != 1 || entries[0].Name != "file" || entries[0].Type != p9.DT_REG {
+		t.Errorf("Directory listing returned %v, %v", entries, err)
+	}
+	if err := dir.RenameAt("file", dir, "renamed"); err != nil {
+		t.Errorf("Could not rename file: %s", err)
+	}
+	testReadFile(t, storage, "/p9Dir", "renamed", "Hello")
+
+	if err := root.UnlinkAt("p9Dir", p9.AT_REMOVEDIR); err != p9.ENOTEMPTY {
+		t.Errorf("Removing a directory with files returned %v instead of ENOTEMPTY", err)
+	}
+	if err := dir.UnlinkAt("renamed", p9.AT_REMOVEDIR); err != p9.ENOTDIR {
+		t.Errorf("Removing a file as a directory returned %v instead of ENOTDIR", err)
+	}
+	if err := dir.UnlinkAt("renamed", 0); err != nil {
+		t.Errorf("Could not remove file: %s", err)
+	}
+	if err := dir.Remove(); err != nil {
+		t.Errorf("Could not remove directory: %s", err)
+	}
+	if _, err := storage.GetFile("/p9Dir"); !os.IsNotExist(err) {
+		t.Errorf("Removed directory still exists: %v", err)
+	}
+}
+
+// Offsets and sizes sent by clients can't make files bigger than the max file size
+func TestP9ServerLimits(t *testing.T) {
+	storage, server, client := initP9Server(t, "node-0", &mock.NullTopologyClient{}, `, "max_file_size": "1KB"`)
+	defer storage.Destroy()
+	defer server.Close()
+	defer client.Close()
+
+	root, err := client.Attach("")
+	if err != nil {
+		t.Fatalf("Could not attach: %s", err)
+	}
+	f, err := root.Walk()
+	if err != nil {
+		t.Fatalf("Could not clone root: %s", err)
+	}
+	if err := f.Create("file", p9.O_RDWR, 0644); err != nil {
+		t.Fatalf("Could not create file: %s", err)
+	}
+	if _, err := f.WriteAt([]byte("data"), -1); err != p9.EFBIG {
+		t.Errorf("Write at the last offset returned %v instead of EFBIG", err)
+	}
+	if _, err := f.WriteAt([]byte("data"), 998); err != p9.EFBIG {
+		t.Errorf("Write after the max file size returned %v instead of EFBIG", err)
+	}
+	if err := f.SetAttr(p9.SetAttr{Valid: p9.SETATTR_SIZE, Size: 1 << 62}); err != p9.EFBIG {
+		t.Errorf("Truncate to a huge size returned %v instead of EFBIG", err)
+	}
+	if _, err := f.WriteAt([]byte("data"), 996); err != nil {
+		t.Errorf("Could not write up to the max file size: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Could not close file: %s", err)
+	}
+	if fi, err := storage.GetRegularFile("/file"); err != nil || fi.Size() != 1000 {
+		t.Errorf("Written file is %v, %v", fi, err)
+	}
+}
+
+// Directories are listed in pages, entries keeping their offsets across pages
+func TestP9ServerLargeDirectory(t *testing.T) {
+	storage, server, client := initP9Server(t, "node-0", &mock.NullTopologyClient{}, "")
+	defer storage.Destroy()
+	defer server.Close()
+	defer client.Close()
+
+	if _, err := storage.CreateDirectory("/large", os.ModeDir|0755); err != nil {
+		t.Fatalf("Could not create directory: %s", err)
+	}
+	count := 1100
+	for i := 0; i < count; i++ {
+		if _, err := storage.CreateRegularFile(fmt.Sprintf("/large/file%04d", i), 0644, []byte{}); err != nil {
+			t.Fatalf("Could not create file: %s", err)
+		}
+	}
+	root, err := client.Attach("")
+	if err != nil {
+		t.Fatalf("Could not attach: %s", err)
+	}
+	dir, err := root.Walk("large")
+	if err != nil {
+		t.Fatalf("Could not walk to directory: %s", err)
+	}
+	if err := dir.Open(p9.O_RDONLY); err != nil {
+		t.Fatalf("Could not open directory: %s", err)
+	}
+	entries, err := dir.ReadDir()
+	if err != nil || len(entries) != count {
+		t.Fatalf("Listing returned %d entries, %v", len(entries), err)
+	}
+	for i, entry := range entries {
+		if entry.Name != fmt.Sprintf("file%04d", i) || entry.Offset != uint64(i+1) {
+			t.Errorf("Entry %d is %s at offset %d", i, entry.Name, entry.Offset)
+			break
+		}
+	}
+	// Listings start again from the first entry
+	if entries, err := dir.ReadDir(); err != nil || len(entries) != count {
+		t.Errorf("Second listing returned %d entries, %v", len(entries), err)
+	}
+}
+
+// Operations on paths of another node are sent to its http api
+func TestP9ServerForwarding(t *testing.T) {
+	httpServer := initServer(t)
+	defer httpServer.CloseAndDestroyStorage()
+	httpClient := initClient(t)
+	defer httpClient.Close()
+
+	topologyClient := &mock.StaticTopologyClient{Node: &cluster.NodeInfo{Name: "node-0", Address: "http://127.0.0.1:5555", Shard: "shard-1"}}
+	storage, server, client := initP9Server(t, "node-1", topologyClient, "")
+	defer storage.Destroy()
+	defer server.Close()
+	defer client.Close()
+
+	root, err := client.Attach("")
+	if err != nil {
+		t.Fatalf("Could not attach: %s", err)
+	}
+	if _, err := root.Mkdir("forwarded", 0755); err != nil {
+		t.Fatalf("Could not make directory: %s", err)
+	}
+	dir, err := root.Walk("forwarded")
+	if err != nil {
+		t.Fatalf("Could not walk to directory: %s", err)
+	}
+	f, err := dir.Walk()
+	if err != nil {
+		t.Fatalf("Could not clone directory: %s", err)
+	}
+	if err := f.Create("file", p9.O_RDWR, 0644); err != nil {
+		t.Fatalf("Could not create file: %s", err)
+	}
+	if _, err := f.WriteAt([]byte("forwarded data"), 0); err != nil {
+		t.Errorf("Could not write: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Could not close file: %s", err)
+	}
+	testReadFile(t, httpClient, "/forwarded", "file", "forwarded data")
+	if _, err := storage.GetFile("/forwarded"); !os.IsNotExist(err) {
+		t.Errorf("Forwarded directory was created locally: %v", err)
+	}
+
+	f, err = dir.Walk("file")
+	if err != nil {
+		t.Fatalf("Could not walk to file: %s", err)
+	}
+	if err := f.Open(p9.O_RDWR); err != nil {
+		t.Fatalf("Could not open file: %s", err)
+	}
+	data := make([]byte, 10)
+	if n, err := f.ReadAt(data, 10); err != io.EOF || string(data[:n]) != "data" {
+		t.Errorf("Read returned %s, %v", data[:n], err)
+	}
+	// The data of the file is copied in the buffer of the fid before being changed
+	if _, err := f.WriteAt([]byte("F"), 0); err != nil {
+		t.Errorf("Could not write: %s", err)
+	}
+	if attr, err := f.GetAttr(); err != nil || attr.Size != 14 {
+		t.Errorf("Attributes of a file being written are %v, %v", attr, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Could not close file: %s", err)
+	}
+	testReadFile(t, httpClient, "/forwarded", "file", "Forwarded data")
+
+	if err := dir.Open(p9.O_RDONLY); err != nil {
+		t.Fatalf("Could not open directory: %s", err)
+	}
+	if entries, err := dir.ReadDir(); err != nil || len(entries) != 1 || entries[0].Name != "file" {
+		t.Errorf("Directory listing returned %v, %v", entries, err)
+	}
+	if err := root.UnlinkAt("forwarded", p9.AT_REMOVEDIR); err != p9.ENOTEMPTY {
+		t.Errorf("Removing a directory with files returned %v instead of ENOTEMPTY", err)
+	}
+	if err := dir.UnlinkAt("file", 0); err != nil {
+		t.Errorf("Could not remove file: %s", err)
+	}
+	if _, err := httpClient.GetFile("/forwarded/file"); !os.IsNotExist(err) {
+		t.Errorf("Removed file still exists: %v", err)
+	}
+	if _, err := root.Walk("forwarded", "missing"); err != p9.ENOENT {
+		t.Errorf("Walking to a missing file returned %v instead of ENOENT", err)
+	}
+}
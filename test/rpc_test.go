@@ -0,0 +1,301 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/t-mind/flocons/cluster"
+	"github.com/t-mind/flocons/config"
+	"github.com/t-mind/flocons/rpc"
+	"github.com/t-mind/flocons/storage"
+	"github.com/t-mind/flocons/test/mock"
+)
+
+// Start a gRPC server of a node on an in-process connection, with additional storage options in json, each preceded by a comma
+func initGrpcServer(t *testing.T, nodeName string, topologyClient cluster.TopologyClient, options string) (storage.Storage, *rpc.Server, rpc.FloconsClient, *grpc.ClientConn) {
+	directory, err := ioutil.TempDir(os.TempDir(), "flocons-test")
+	if err != nil {
+		panic(err)
+	}
+	config, err := config.NewConfigFromJson([]byte(`{"node": {"name": "` + nodeName + `"}, "storage": {"path": "` + directory + `"` + options + `}}`))
+	if err != nil {
+		t.Fatalf("Could not parse config: %s", err)
+	}
+	storage, err := storage.NewStorage(config)
+	if err != nil {
+		t.Fatalf("Could not instantiate storage: %s", err)
+	}
+	listener := bufconn.Listen(1024 * 1024)
+	server, err := rpc.NewServerWithListener(config, storage, topologyClient, listener)
+	if err != nil {
+		t.Fatalf("Could not instantiate gRPC server: %s", err)
+	}
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Could not connect to gRPC server: %s", err)
+	}
+	return storage, server, rpc.NewFloconsClient(conn), conn
+}
+
+func testGrpcWrite(t *testing.T, client rpc.FloconsClient, request *rpc.WriteRequest, chunks ...string) *rpc.FileInfo {
+	stream, err := client.Write(context.Background())
+	if err != nil {
+		t.Fatalf("Could not start writing: %s", err)
+	}
+	// The first message is sent even without data, for its path
+	if len(chunks) == 0 {
+		chunks = []string{""}
+	}
+	for _, chunk := range chunks {
+		request.Data = []byte(chunk)
+		if err := stream.Send(request); err != nil {
+			t.Fatalf("Could not send chunk: %s", err)
+		}
+		request = &rpc.WriteRequest{}
+	}
+	fi, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("Could not write file: %s", err)
+	}
+	return fi
+}
+
+func testGrpcRead(t *testing.T, client rpc.FloconsClient, request *rpc.ReadRequest) (*rpc.FileInfo, string, error) {
+	stream, err := client.Read(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Could not start reading: %s", err)
+	}
+	var info *rpc.FileInfo
+	data := []byte{}
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			return info, string(data), nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if info == nil {
+			info = response.Info
+		}
+		if response.Offset != request.Offset+int64(len(data)) {
+			t.Errorf("Chunk offset %d is different than expected %d", response.Offset, request.Offset+int64(len(data)))
+		}
+		data = append(data, response.Data...)
+	}
+}
+
+func testGrpcList(t *testing.T, client rpc.FloconsClient, request *rpc.ListRequest) []string {
+	stream, err := client.List(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Could not start listing: %s", err)
+	}
+	var paths []string
+	for {
+		fi, err := stream.Recv()
+		if err == io.EOF {
+			return paths
+		}
+		if err != nil {
+			t.Fatalf("Could not list %s: %s", request.Path, err)
+		}
+		paths = append(paths, fi.Path)
+	}
+}
+
+func testGrpcStatus(t *testing.T, err error, code codes.Code, reason string) {
+	s, _ := status.FromError(err)
+	if s.Code() != code {
+		t.Errorf("Status %v is different than expected %s", err, code)
+		return
+	}
+	for _, detail := range s.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Domain == rpc.ERROR_DOMAIN {
+			if info.Reason != reason {
+				t.Errorf("Reason %s is different than expected %s", info.Reason, reason)
+			}
+			return
+		}
+	}
+	t.Errorf("Status %v has no error info", err)
+}
+
+func TestGrpcServer(t *testing.T) {
+	storage, server, client, conn := initGrpcServer(t, "node-0", &mock.NullTopologyClient{}, "")
+	defer storage.Destroy()
+	defer server.Close()
+	defer conn.Close()
+	ctx := context.Background()
+
+	if _, err := client.Mkdir(ctx, &rpc.MkdirRequest{Path: "/grpcDir"}); err != nil {
+		t.Fatalf("Could not make directory: %s", err)
+	}
+	_, err := client.Mkdir(ctx, &rpc.MkdirRequest{Path: "/grpcDir"})
+	testGrpcStatus(t, err, codes.AlreadyExists, rpc.REASON_ALREADY_EXISTS)
+	if fi, err := client.Mkdir(ctx, &rpc.MkdirRequest{Path: "/grpcDir/a/b", Mode: 0700, Parents: true}); err != nil || fi.Mode != 0700 || fi.Type != rpc.FileType_DIRECTORY {
+		t.Errorf("Making directory with parents returned %v, %v", fi, err)
+	}
+
+	fi := testGrpcWrite(t, client, &rpc.WriteRequest{Path: "/grpcDir/file"}, "hello", " world")
+	if fi.Size != 11 || fi.Mode != 0644 || fi.Node != "node-0" {
+		t.Errorf("Written file info %v is different than expected", fi)
+	}
+	testReadFile(t, storage, "/grpcDir", "file", "hello world")
+	testGrpcWrite(t, client, &rpc.WriteRequest{Path: "/grpcDir/c/d/empty", Mode: 0600, CreateParents: true})
+	testReadFile(t, storage, "/grpcDir/c/d", "empty", "")
+
+	if fi, err := client.Stat(ctx, &rpc.StatRequest{Path: "/grpcDir/file"}); err != nil || fi.Size != 11 || fi.Type != rpc.FileType_REGULAR || fi.Etag == "" {
+		t.Errorf("Stat returned %v, %v", fi, err)
+	}
+	_, err = client.Stat(ctx, &rpc.StatRequest{Path: "/grpcDir/missing"})
+	testGrpcStatus(t, err, codes.NotFound, rpc.REASON_NOT_FOUND)
+
+	if info, data, err := testGrpcRead(t, client, &rpc.ReadRequest{Path: "/grpcDir/file", ChunkSize: 4}); err != nil || data != "hello world" || info == nil || info.Size != 11 {
+		t.Errorf("Read returned %v, %s, %v", info, data, err)
+	}
+	if _, data, err := testGrpcRead(t, client, &rpc.ReadRequest{Path: "/grpcDir/file", Offset: 6, Length: 3}); err != nil || data != "wor" {
+		t.Errorf("Read of a part returned %s, %v", data, err)
+	}
+	if info, data, err := testGrpcRead(t, client, &rpc.ReadRequest{Path: "/grpcDir/file", Offset: 20}); err != nil || data != "" || info == nil {
+		t.Errorf("Read after the end returned %v, %s, %v", info, data, err)
+	}
+	_, _, err = testGrpcRead(t, client, &rpc.ReadRequest{Path: "/grpcDir/a"})
+	testGrpcStatus(t, err, codes.FailedPrecondition, rpc.REASON_IS_DIRECTORY)
+
+	// Complete listings are in storage order
+	paths := testGrpcList(t, client, &rpc.ListRequest{Path: "/grpcDir"})
+	sort.Strings(paths)
+	if len(paths) != 3 || paths[0] != "/grpcDir/a" || paths[1] != "/grpcDir/c" || paths[2] != "/grpcDir/file" {
+		t.Errorf("Listing %v is different than expected", paths)
+	}
+	if paths := testGrpcList(t, client, &rpc.ListRequest{Path: "/grpcDir", Limit: 1, After: "c"}); len(paths) != 1 || paths[0] != "/grpcDir/file" {
+		t.Errorf("Listing after c %v is different than expected", paths)
+	}
+	if paths := testGrpcList(t, client, &rpc.ListRequest{Path: "/grpcDir", Recursive: true}); len(paths) != 6 || paths[1] != "/grpcDir/a/b" || paths[4] != "/grpcDir/c/d/empty" {
+		t.Errorf("Recursive listing %v is different than expected", paths)
+	}
+
+	watchCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	after := uint64(0)
+	events, err := client.Watch(watchCtx, &rpc.WatchRequest{Path: "/grpcDir", Recursive: true, After: &after})
+	if err != nil {
+		t.Fatalf("Could not watch: %s", err)
+	}
+	for {
+		event, err := events.Recv()
+		if err != nil {
+			t.Fatalf("No event for the written file: %s", err)
+		}
+		if event.Path == "/grpcDir/file" && event.Type == "create" && event.Node == "node-0" {
+			break
+		}
+	}
+	cancel()
+}
+
+// Operations on paths of another node are sent to its http api
+func TestGrpcServerForwarding(t *testing.T) {
+	httpServer := initServer(t)
+	defer httpServer.CloseAndDestroyStorage()
+	httpClient := initClient(t)
+	defer httpClient.Close()
+
+	topologyClient := &mock.StaticTopologyClient{Node: &cluster.NodeInfo{Name: "node-0", Address: "http://127.0.0.1:5555", Shard: "shard-1"}}
+	storage, server, client, conn := initGrpcServer(t, "node-1", topologyClient, "")
+	defer storage.Destroy()
+	defer server.Close()
+	defer conn.Close()
+	ctx := context.Background()
+
+	if _, err := client.Mkdir(ctx, &rpc.MkdirRequest{Path: "/forwarded/dir", Parents: true}); err != nil {
+		t.Fatalf("Could not make directory: %s", err)
+	}
+	testGrpcWrite(t, client, &rpc.WriteRequest{Path: "/forwarded/dir/file"}, "forwarded ", "data")
+	testReadFile(t, httpClient, "/forwarded/dir", "file", "forwarded data")
+	if _, err := storage.GetFile("/forwarded"); !os.IsNotExist(err) {
+		t.Errorf("Forwarded directory was created locally: %v", err)
+	}
+
+	if fi, err := client.Stat(ctx, &rpc.StatRequest{Path: "/forwarded/dir/file"}); err != nil || fi.Size != 14 {
+		t.Errorf("Stat returned %v, %v", fi, err)
+	}
+	if _, data, err := testGrpcRead(t, client, &rpc.ReadRequest{Path: "/forwarded/dir/file", Offset: 10, ChunkSize: 2}); err != nil || data != "data" {
+		t.Errorf("Read returned %s, %v", data, err)
+	}
+	if paths := testGrpcList(t, client, &rpc.ListRequest{Path: "/forwarded", Recursive: true}); len(paths) != 2 || paths[1] != "/forwarded/dir/file" {
+		t.Errorf("Recursive listing %v is different than expected", paths)
+	}
+	_, err := client.Stat(ctx, &rpc.StatRequest{Path: "/forwarded/missing"})
+	testGrpcStatus(t, err, codes.NotFound, rpc.REASON_NOT_FOUND)
+
+	// A file replaced during a forwarded read is not read partly from each version
+	if _, err := httpClient.CreateRegularFile("/forwarded/big", 0644, bytes.Repeat([]byte("a"), 1024*1024)); err != nil {
+		t.Fatalf("Could not create file: %s", err)
+	}
+	stream, err := client.Read(ctx, &rpc.ReadRequest{Path: "/forwarded/big", ChunkSize: 1024})
+	if err != nil {
+		t.Fatalf("Could not start reading: %s", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Could not read first chunk: %s", err)
+	}
+	if _, err := httpClient.PutRegularFile("/forwarded/big", 0644, bytes.Repeat([]byte("b"), 1024*1024)); err != nil {
+		t.Fatalf("Could not replace file: %s", err)
+	}
+	for {
+		chunk, err := stream.Recv()
+		if err != nil {
+			testGrpcStatus(t, err, codes.FailedPrecondition, rpc.REASON_PRECONDITION_FAILED)
+			break
+		}
+		if bytes.Contains(chunk.Data, []byte("b")) {
+			t.Fatalf("Chunk at %d was read from the new version of the file", chunk.Offset)
+		}
+	}
+}
+
+// Writes can't gather more data than the max file size
+func TestGrpcWriteLimit(t *testing.T) {
+	storage, server, client, conn := initGrpcServer(t, "node-0", &mock.NullTopologyClient{}, `, "max_file_size": "1KB"`)
+	defer storage.Destroy()
+	defer server.Close()
+	defer conn.Close()
+
+	stream, err := client.Write(context.Background())
+	if err != nil {
+		t.Fatalf("Could not start writing: %s", err)
+	}
+	request := &rpc.WriteRequest{Path: "/big"}
+	for i := 0; i < 4; i++ {
+		request.Data = make([]byte, 400)
+		// The server may stop the stream before all chunks are sent
+		if err := stream.Send(request); err != nil {
+			break
+		}
+		request = &rpc.WriteRequest{}
+	}
+	_, err = stream.CloseAndRecv()
+	testGrpcStatus(t, err, codes.ResourceExhausted, rpc.REASON_FILE_TOO_LARGE)
+	if _, err := storage.GetFile("/big"); !os.IsNotExist(err) {
+		t.Errorf("File bigger than the max file size was stored: %v", err)
+	}
+
+	testGrpcWrite(t, client, &rpc.WriteRequest{Path: "/small"}, string(make([]byte, 500)), string(make([]byte, 500)))
+}
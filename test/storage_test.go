@@ -1,11 +1,16 @@
 package test
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -13,16 +18,19 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/t-mind/flocons/config"
+	. "github.com/t-mind/flocons/error"
+	"github.com/t-mind/flocons/file"
 	"github.com/t-mind/flocons/storage"
+	"github.com/t-mind/flocons/test/mock"
 )
 
-func initStorages(t *testing.T, count int) []*storage.Storage {
+func initStorages(t *testing.T, count int) []*storage.DiskStorage {
 	directory, err := ioutil.TempDir(os.TempDir(), "flocons-test")
 	if err != nil {
 		panic(err)
 	}
 
-	ss := make([]*storage.Storage, count)
+	ss := make([]*storage.DiskStorage, count)
 	for i := 0; i < count; i++ {
 		json_config := fmt.Sprintf(`{"node": {"name": "node-%d"}, "storage": {"path": %q}}`, i, directory)
 		config, err := config.NewConfigFromJson([]byte(json_config))
@@ -41,6 +49,26 @@ func initStorages(t *testing.T, count int) []*storage.Storage {
 	return ss
 }
 
+// Initialize one storage with additional storage options in json
+func initStorageWithOptions(t *testing.T, options string) *storage.DiskStorage {
+	directory, err := ioutil.TempDir(os.TempDir(), "flocons-test")
+	if err != nil {
+		panic(err)
+	}
+	json_config := fmt.Sprintf(`{"node": {"name": "node-0"}, "storage": {"path": %q, %s}}`, directory, options)
+	config, err := config.NewConfigFromJson([]byte(json_config))
+	if err != nil {
+		t.Errorf("Could not parse config %s: %s", json_config, err)
+		t.FailNow()
+	}
+	s, err := storage.NewStorage(config)
+	if err != nil {
+		t.Errorf("Could not mount storage on %s: %s", directory, err)
+		t.FailNow()
+	}
+	return s
+}
+
 func TestDirectory(t *testing.T) {
 	storage := initStorages(t, 1)[0]
 	defer storage.Destroy()
@@ -246,3 +274,1184 @@ func TestMissingContainer(t *testing.T) {
 		t.Errorf("Container files should not have been created")
 	}
 }
+
+func TestStorageReadDirPage(t *testing.T) {
+	s := initStorages(t, 1)[0]
+	defer s.Destroy()
+
+	testReadDirPage(t, s)
+}
+
+func testReadDirPage(t *testing.T, s storage.Storage) {
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	for i := 0; i < 5; i++ {
+		testCreateDirectory(t, s, filepath.Join(testDir, fmt.Sprintf("dir-%d", i)))
+	}
+	for i := 0; i < 25; i++ {
+		testCreateFile(t, s, testDir, fmt.Sprintf("file-%02d", i), "testData")
+	}
+
+	// Read all entries by pages of 4
+	names := make([]string, 0)
+	options := storage.ReadDirOptions{Limit: 4}
+	for {
+		files, err := s.ReadDirPage(testDir, options)
+		if err != nil {
+			t.Errorf("Could not read directory page: %s", err)
+			t.FailNow()
+		}
+		if len(files) > options.Limit {
+			t.Errorf("Page of %d entries is bigger than limit %d", len(files), options.Limit)
+		}
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		if len(files) < options.Limit {
+			break
+		}
+		options.After = files[len(files)-1].Name()
+	}
+	if len(names) != 30 {
+		t.Errorf("Number of entries read is different than expected %d != %d", len(names), 30)
+		t.FailNow()
+	}
+	for i := 0; i < 5; i++ {
+		if names[i] != fmt.Sprintf("dir-%d", i) {
+			t.Errorf("Entry %s is different than expected dir-%d", names[i], i)
+		}
+	}
+	for i := 0; i < 25; i++ {
+		if names[i+5] != fmt.Sprintf("file-%02d", i) {
+			t.Errorf("Entry %s is different than expected file-%02d", names[i+5], i)
+		}
+	}
+
+	files, _ := s.ReadDirPage(testDir, storage.ReadDirOptions{Prefix: "file-1", Type: storage.REGULAR_FILE_TYPE})
+	if len(files) != 10 {
+		t.Errorf("Number of entries with prefix is different than expected %d != %d", len(files), 10)
+	}
+	files, _ = s.ReadDirPage(testDir, storage.ReadDirOptions{Glob: "*-[34]"})
+	if len(files) != 2 || files[0].Name() != "dir-3" || files[1].Name() != "dir-4" {
+		t.Errorf("Entries matching glob are different than expected: %v", files)
+	}
+	files, _ = s.ReadDirPage(testDir, storage.ReadDirOptions{Type: storage.DIRECTORY_FILE_TYPE})
+	if len(files) != 5 {
+		t.Errorf("Number of directories is different than expected %d != %d", len(files), 5)
+	}
+	if _, err := s.ReadDirPage(testDir, storage.ReadDirOptions{Glob: "["}); err == nil {
+		t.Errorf("Invalid glob should have failed")
+	}
+}
+
+// A regular file and a sub directory with the same name are both listed once while paginating,
+// and files written between pages are found when they come after the cursor
+func TestStorageReadDirPageCursor(t *testing.T) {
+	s := initStorages(t, 1)[0]
+	defer s.Destroy()
+
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	testCreateDirectory(t, s, filepath.Join(testDir, "same"))
+	testCreateFile(t, s, testDir, "same", "testData")
+	testCreateFile(t, s, testDir, "file-1", "testData")
+	testCreateFile(t, s, testDir, "zfile-1", "testData")
+
+	names := make([]string, 0)
+	options := storage.ReadDirOptions{Limit: 1}
+	for {
+		files, err := s.ReadDirPage(testDir, options)
+		if err != nil {
+			t.Fatalf("Could not read directory page: %s", err)
+		}
+		for _, f := range files {
+			names = append(names, storage.ListingCursor(f.Name(), f))
+		}
+		if len(files) < options.Limit {
+			break
+		}
+		if len(names) == 2 {
+			testCreateFile(t, s, testDir, "file-0", "testData")
+			testCreateFile(t, s, testDir, "xfile-1", "testData")
+		}
+		if len(names) > 10 {
+			t.Fatalf("Pagination does not end: %v", names)
+		}
+		options.After = storage.ListingCursor(files[len(files)-1].Name(), files[len(files)-1])
+	}
+	expected := []string{"same/", "file-1", "same", "xfile-1", "zfile-1"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("Entries %v are different than expected %v", names, expected)
+	}
+
+	// Without slash, the name designates the regular file
+	files, _ := s.ReadDirPage(testDir, storage.ReadDirOptions{After: "same"})
+	if len(files) != 2 || files[0].Name() != "xfile-1" {
+		t.Errorf("Entries after file same are different than expected: %v", files)
+	}
+}
+
+// Listings are consistent snapshots of each index while files are written
+func TestStorageStreamDirDuringWrites(t *testing.T) {
+	s := initStorages(t, 1)[0]
+	defer s.Destroy()
+
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			testCreateFile(t, s, testDir, fmt.Sprintf("testFile%d", i), "testData")
+		}
+	}()
+	for listing := true; listing; {
+		select {
+		case <-done:
+			listing = false
+		default:
+		}
+		count := 0
+		if err := s.StreamDir(testDir, storage.ReadDirOptions{}, func(os.FileInfo) error { count++; return nil }); err != nil {
+			t.Fatalf("Could not stream directory during writes: %s", err)
+		}
+		if !listing && count != 50 {
+			t.Errorf("Found %d files instead of 50", count)
+		}
+	}
+}
+
+func TestStorageWalk(t *testing.T) {
+	s := initStorages(t, 1)[0]
+	defer s.Destroy()
+
+	testWalk(t, s)
+}
+
+func TestStorageDirectoryStats(t *testing.T) {
+	s := initStorages(t, 1)[0]
+	defer s.Destroy()
+
+	testDir := "/testDir"
+	content := make([]byte, 1000)
+	testCreateDirectory(t, s, testDir)
+	testCreateDirectory(t, s, filepath.Join(testDir, "subDir"))
+	for i := 0; i < 3; i++ {
+		testCreateFileWithBytes(t, s, testDir, fmt.Sprintf("testFile%d", i), content)
+	}
+	for i := 0; i < 2; i++ {
+		testCreateFileWithBytes(t, s, filepath.Join(testDir, "subDir"), fmt.Sprintf("testFile%d", i), content)
+	}
+
+	stats, err := s.DirectoryStats(testDir, false)
+	if err != nil {
+		t.Errorf("Could not get directory stats: %s", err)
+		t.FailNow()
+	}
+	if stats.Files != 3 || stats.LogicalBytes != 3000 || stats.Directories != 0 {
+		t.Errorf("Stats %+v are different than expected 3 files of 3000 bytes", stats)
+	}
+	if stats.PhysicalBytes != 3*(512+1024) || stats.DeadBytes != 0 || stats.DeadBytesRatio() != 0 {
+		t.Errorf("Stats %+v have wrong physical or dead bytes", stats)
+	}
+	if stats.Containers["shard-1"]["node-0"] != 1 {
+		t.Errorf("Stats %+v have wrong containers", stats)
+	}
+
+	stats, _ = s.DirectoryStats(testDir, true)
+	if stats.Files != 5 || stats.LogicalBytes != 5000 || stats.Directories != 1 || stats.Containers["shard-1"]["node-0"] != 2 {
+		t.Errorf("Recursive stats %+v are different than expected 5 files of 5000 bytes in 2 containers", stats)
+	}
+
+	// Writing again a file makes its previous version dead
+	testCreateFileWithBytes(t, s, testDir, "testFile0", content)
+	stats, _ = s.DirectoryStats(testDir, false)
+	if stats.Files != 3 || stats.DeadBytes != 512+1024 || stats.DeadBytesRatio() != 0.25 {
+		t.Errorf("Stats %+v are different than expected after overwrite", stats)
+	}
+}
+
+func TestStorageConcurrentReadsWithFewOpenFiles(t *testing.T) {
+	s := initStorageWithOptions(t, `"max_open_files": 2`)
+	defer s.Destroy()
+
+	numDirs := 10
+	for i := 0; i < numDirs; i++ {
+		dir := fmt.Sprintf("/testDir%d", i)
+		testCreateDirectory(t, s, dir)
+		for j := 0; j < 5; j++ {
+			testCreateFile(t, s, dir, fmt.Sprintf("testFile%d", j), fmt.Sprintf("testData%d-%d", i, j))
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				dir := fmt.Sprintf("/testDir%d", (id+j)%numDirs)
+				testReadFile(t, s, dir, fmt.Sprintf("testFile%d", j), fmt.Sprintf("testData%d-%d", (id+j)%numDirs, j))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestStorageDataCache(t *testing.T) {
+	s := initStorageWithOptions(t, `"data_cache_size": "100B", "data_cache_max_file_size": "40B"`)
+	defer s.Destroy()
+
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	for i := 0; i < 5; i++ {
+		testCreateFile(t, s, testDir, fmt.Sprintf("testFile%d", i), fmt.Sprintf("%030d", i))
+	}
+	testCreateFile(t, s, testDir, "bigFile", fmt.Sprintf("%050d", 0))
+
+	testReadFile(t, s, testDir, "testFile0", fmt.Sprintf("%030d", 0))
+	testReadFile(t, s, testDir, "testFile0", fmt.Sprintf("%030d", 0))
+	stats := s.DataCacheStats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 || stats.Bytes != 30 {
+		t.Errorf("Cache stats %+v are different than expected after reading twice one file", stats)
+	}
+
+	testReadFile(t, s, testDir, "bigFile", fmt.Sprintf("%050d", 0))
+	if stats := s.DataCacheStats(); stats.Entries != 1 {
+		t.Errorf("File bigger than max cached file size has been cached: %+v", stats)
+	}
+
+	for i := 0; i < 5; i++ {
+		testReadFile(t, s, testDir, fmt.Sprintf("testFile%d", i), fmt.Sprintf("%030d", i))
+	}
+	if stats := s.DataCacheStats(); stats.Bytes > 100 || stats.Entries != 3 {
+		t.Errorf("Cache stats %+v exceed max cache size", stats)
+	}
+
+	// Overwriting a file invalidates its cached data
+	testCreateFile(t, s, testDir, "testFile4", fmt.Sprintf("%030d", 44))
+	testReadFile(t, s, testDir, "testFile4", fmt.Sprintf("%030d", 44))
+}
+
+func TestStorageGroupCommit(t *testing.T) {
+	for _, durability := range []string{"group", "none"} {
+		s := initStorageWithOptions(t, fmt.Sprintf(`"durability": "%s", "group_commit_interval": "5ms"`, durability))
+
+		testDir := "/testDir"
+		testCreateDirectory(t, s, testDir)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				testCreateFile(t, s, testDir, fmt.Sprintf("testFile%d", id), fmt.Sprintf("testData%d", id))
+			}(i)
+		}
+		wg.Wait()
+		for i := 0; i < 20; i++ {
+			testReadFile(t, s, testDir, fmt.Sprintf("testFile%d", i), fmt.Sprintf("testData%d", i))
+		}
+		s.Destroy()
+	}
+}
+
+func TestStorageParallelWriteContainers(t *testing.T) {
+	s := initStorageWithOptions(t, `"write_containers": 3`)
+	defer s.Destroy()
+
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			testCreateFile(t, s, testDir, fmt.Sprintf("testFile%d", id), fmt.Sprintf("testData%d", id))
+		}(i)
+	}
+	wg.Wait()
+
+	stats, err := s.DirectoryStats(testDir, false)
+	if err != nil {
+		t.Fatalf("Could not get stats of %s: %s", testDir, err)
+	}
+	if count := stats.Containers["shard-1"]["node-0"]; count != 3 {
+		t.Errorf("Files have been written in %d containers instead of 3", count)
+	}
+	if stats.Files != 30 {
+		t.Errorf("Found %d files instead of 30", stats.Files)
+	}
+
+	// Containers are found again after a restart
+	s.Close()
+	for i := 0; i < 30; i++ {
+		testReadFile(t, s, testDir, fmt.Sprintf("testFile%d", i), fmt.Sprintf("testData%d", i))
+	}
+	testCreateFile(t, s, testDir, "testFile30", "testData30")
+	stats, _ = s.DirectoryStats(testDir, false)
+	if count := stats.Containers["shard-1"]["node-0"]; count != 3 {
+		t.Errorf("Files have been written in %d containers instead of 3 after restart", count)
+	}
+}
+
+func TestStorageOverwriteAcrossWriteContainers(t *testing.T) {
+	s := initStorageWithOptions(t, `"write_containers": 2`)
+	defer s.Destroy()
+
+	// Each version is written in the container of another slot
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	testCreateFile(t, s, testDir, "testFile", "v1")
+	testCreateFile(t, s, testDir, "testFile", "v2-new")
+	for i := 0; i < 10; i++ {
+		s.ResetCache()
+		testReadFile(t, s, testDir, "testFile", "v2-new")
+	}
+
+	// Concurrent writers of a file don't remove the versions of each other
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			testCreateFile(t, s, testDir, "testFile", fmt.Sprintf("v%d", id))
+		}(i)
+	}
+	wg.Wait()
+	s.Close()
+	if versions, err := s.GetRegularFileVersions(testDir + "/testFile"); err != nil || len(versions) != 1 {
+		t.Errorf("Expected 1 version of the file after concurrent writes, got %d: %v", len(versions), err)
+	}
+}
+
+func TestStorageMultiplePaths(t *testing.T) {
+	disks := make([]string, 2)
+	for i := range disks {
+		disk, err := ioutil.TempDir(os.TempDir(), "flocons-test")
+		if err != nil {
+			panic(err)
+		}
+		disks[i] = disk
+	}
+	paths, _ := json.Marshal(disks)
+	s := initStorageWithOptions(t, fmt.Sprintf(`"paths": %s, "write_containers": 3`, paths))
+	defer s.Destroy()
+
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	directories := []string{s.MakeAbsolute(testDir), filepath.Join(disks[0], testDir), filepath.Join(disks[1], testDir)}
+	for _, directory := range directories {
+		if fi, err := os.Stat(directory); err != nil || !fi.IsDir() {
+			t.Errorf("Directory %s has not been mirrored", directory)
+		}
+	}
+
+	// Each write container is created on the next disk
+	for i := 0; i < 9; i++ {
+		testCreateFile(t, s, testDir, fmt.Sprintf("testFile%d", i), fmt.Sprintf("testData%d", i))
+	}
+	for _, directory := range directories {
+		if containers, _ := filepath.Glob(filepath.Join(directory, "*.tar")); len(containers) != 1 {
+			t.Errorf("Found %d containers in %s instead of 1", len(containers), directory)
+		}
+	}
+	s.Close()
+	for i := 0; i < 9; i++ {
+		testReadFile(t, s, testDir, fmt.Sprintf("testFile%d", i), fmt.Sprintf("testData%d", i))
+	}
+
+	// Losing a disk only loses its containers
+	os.RemoveAll(disks[1])
+	ioutil.WriteFile(disks[1], []byte{}, 0644)
+	s.Close()
+	files, err := s.ReadDir(testDir)
+	if err != nil {
+		t.Fatalf("Could not read directory %s after losing a disk: %s", testDir, err)
+	}
+	if len(files) != 6 {
+		t.Errorf("Found %d files instead of 6 after losing a disk", len(files))
+	}
+	for i := 0; i < 9; i++ {
+		name := fmt.Sprintf("testFile%d", i)
+		if i%3 == 2 {
+			if _, err := s.GetRegularFile(filepath.Join(testDir, name)); err == nil {
+				t.Errorf("File %s of lost disk is still found", name)
+			}
+		} else {
+			testReadFile(t, s, testDir, name, fmt.Sprintf("testData%d", i))
+		}
+	}
+	testCreateFile(t, s, testDir, "testFile9", "testData9")
+	testReadFile(t, s, testDir, "testFile9", "testData9")
+}
+
+func TestStorageTiering(t *testing.T) {
+	coldPath, err := ioutil.TempDir(os.TempDir(), "flocons-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(coldPath)
+	s := initStorageWithOptions(t, fmt.Sprintf(`"cold_path": %q, "tiering_age": "1ms", "max_container_size": "1KB", "data_cache_size": "1MB"`, coldPath))
+	defer s.Destroy()
+
+	// Each file fills a container, only the last one is still open for writing
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	testCreateDirectory(t, s, "/testDir/subDir")
+	for i := 0; i < 3; i++ {
+		testCreateFile(t, s, testDir, fmt.Sprintf("testFile%d", i), fmt.Sprintf("testData%d", i))
+	}
+	testCreateFile(t, s, "/testDir/subDir", "testFile", "testData")
+	for i := 0; i < 3; i++ {
+		testReadFile(t, s, testDir, fmt.Sprintf("testFile%d", i), fmt.Sprintf("testData%d", i))
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Readers never miss a file while containers are moved
+	stop := make(chan bool)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					testReadFile(t, s, testDir, fmt.Sprintf("testFile%d", id), fmt.Sprintf("testData%d", id))
+				}
+			}
+		}(i)
+	}
+	moved, err := s.TierContainers()
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Errorf("Could not move containers to cold tier: %s", err)
+	}
+	if moved != 2 {
+		t.Errorf("Moved %d containers instead of 2", moved)
+	}
+	if containers, _ := filepath.Glob(filepath.Join(coldPath, testDir, "*.tar")); len(containers) != 2 {
+		t.Errorf("Found %d containers in cold tier instead of 2", len(containers))
+	}
+	if indexes, _ := filepath.Glob(filepath.Join(coldPath, testDir, "*.csv")); len(indexes) != 2 {
+		t.Errorf("Found %d indexes in cold tier instead of 2", len(indexes))
+	}
+	if containers, _ := filepath.Glob(filepath.Join(s.MakeAbsolute(testDir), "*.tar")); len(containers) != 1 {
+		t.Errorf("Found %d containers in hot tier instead of 1", len(containers))
+	}
+	if moved, _ := s.TierContainers(); moved != 0 {
+		t.Errorf("Moved again %d containers", moved)
+	}
+
+	// Containers are found on the cold tier after a restart
+	s.Close()
+	for i := 0; i < 3; i++ {
+		testReadFile(t, s, testDir, fmt.Sprintf("testFile%d", i), fmt.Sprintf("testData%d", i))
+	}
+	testReadFile(t, s, "/testDir/subDir", "testFile", "testData")
+	testCreateFile(t, s, testDir, "testFile3", "testData3")
+	testReadFile(t, s, testDir, "testFile3", "testData3")
+
+	c, _ := config.NewConfigFromJson([]byte(fmt.Sprintf(`{"node": {"name": "node-0"}, "storage": {"path": %q, "cold_path": %q}}`, s.MakeAbsolute("/"), coldPath)))
+	container, err := storage.NewRegularFileContainer(s.MakeAbsolute(testDir), storage.NewRegularFileContainerName("shard-1", "node-0", 1), c, nil)
+	if err != nil {
+		t.Fatalf("Could not open container moved to cold tier: %s", err)
+	}
+	defer container.Close()
+	if !container.IsCold() {
+		t.Errorf("Container %s has not been found on cold tier", container.Name)
+	}
+	if _, err := container.GetRegularFile("testFile0"); err != nil {
+		t.Errorf("Could not find file in container moved to cold tier: %s", err)
+	}
+}
+
+func TestStorageOffload(t *testing.T) {
+	remote := mock.NewS3()
+	defer remote.Close()
+	s := initStorageWithOptions(t, fmt.Sprintf(`"max_container_size": "1KB", "offload": {"endpoint": %q, "bucket": "flocons", "prefix": "node-0", "access_key": "key", "secret_key": "secret", "evict": true}`, remote.URL()))
+	defer s.Destroy()
+
+	// Each file fills a container, only the last one is still open for writing
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	for i := 0; i < 3; i++ {
+		testCreateFile(t, s, testDir, fmt.Sprintf("testFile%d", i), fmt.Sprintf("testData%d", i))
+	}
+	// The bucket already holds another object of the same size under the key of the first container, which must be replaced
+	containers, _ := filepath.Glob(filepath.Join(s.MakeAbsolute(testDir), "files_*_1.tar"))
+	if len(containers) != 1 {
+		t.Fatalf("Found %d first containers instead of 1", len(containers))
+	}
+	if fi, err := os.Stat(containers[0]); err == nil {
+		remote.SetObject("flocons/node-0/testDir/"+filepath.Base(containers[0]), make([]byte, fi.Size()))
+	}
+
+	offloaded, err := s.OffloadContainers()
+	if err != nil {
+		t.Errorf("Could not offload containers: %s", err)
+	}
+	if offloaded != 2 {
+		t.Errorf("Offloaded %d containers instead of 2", offloaded)
+	}
+	if keys := remote.Keys(); len(keys) != 4 {
+		t.Errorf("Bucket holds %v instead of 2 containers and 2 indexes", keys)
+	}
+	for _, key := range remote.Keys() {
+		if !strings.HasPrefix(key, "flocons/node-0/testDir/") {
+			t.Errorf("Object %s has not the expected key", key)
+		}
+	}
+	if remote.UnsignedRequests() > 0 {
+		t.Errorf("%d requests have not been signed", remote.UnsignedRequests())
+	}
+	if containers, _ := filepath.Glob(filepath.Join(s.MakeAbsolute(testDir), "*.tar")); len(containers) != 1 {
+		t.Errorf("Found %d local containers instead of 1", len(containers))
+	}
+	if indexes, _ := filepath.Glob(filepath.Join(s.MakeAbsolute(testDir), "*.csv")); len(indexes) != 3 {
+		t.Errorf("Found %d local indexes instead of 3", len(indexes))
+	}
+
+	// Evicted containers are read with one ranged request per file
+	s.Close()
+	for i := 0; i < 3; i++ {
+		testReadFile(t, s, testDir, fmt.Sprintf("testFile%d", i), fmt.Sprintf("testData%d", i))
+	}
+	if count := remote.RangeRequests(); count != 2 {
+		t.Errorf("%d ranged requests have been sent instead of 2", count)
+	}
+	if files, err := s.ReadDir(testDir); err != nil || len(files) != 3 {
+		t.Errorf("Could not list the 3 files of offloaded containers: %v %s", files, err)
+	}
+	// The last container is not open for writing anymore after the restart
+	if offloaded, _ := s.OffloadContainers(); offloaded != 1 {
+		t.Errorf("Offloaded %d containers instead of the last full one", offloaded)
+	}
+	if offloaded, _ := s.OffloadContainers(); offloaded != 0 {
+		t.Errorf("Offloaded again %d containers", offloaded)
+	}
+
+	// A missing container which has not been offloaded is not read from the bucket, even if it holds an object at its key
+	otherDir := "/otherDir"
+	testCreateDirectory(t, s, otherDir)
+	testCreateFile(t, s, otherDir, "testFile", "testData")
+	s.Close()
+	containers, _ = filepath.Glob(filepath.Join(s.MakeAbsolute(otherDir), "files_*.tar"))
+	for _, container := range containers {
+		data, _ := ioutil.ReadFile(container)
+		remote.SetObject("flocons/node-0/otherDir/"+filepath.Base(container), data)
+		os.Remove(container)
+	}
+	if fi, err := s.GetRegularFile(otherDir + "/testFile"); err != nil {
+		t.Errorf("Could not find file of missing container: %s", err)
+	} else if _, err := fi.(*file.FileInfo).Data(); err == nil {
+		t.Error("Missing container which has not been offloaded has been read from the bucket")
+	}
+
+	// Offloaded containers are known in the bucket by their path
+	if _, err := s.RenameFile(testDir, "/renamedDir"); !os.IsPermission(err) {
+		t.Errorf("Rename of directory with offloaded containers returned %v instead of a permission error", err)
+	}
+	testReadFile(t, s, testDir, "testFile0", "testData0")
+}
+
+func initMemoryStorage(t *testing.T) *storage.MemoryStorage {
+	config, err := config.NewConfigFromJson([]byte(`{"node": {"name": "node-0"}, "storage": {"path": "/nowhere"}}`))
+	if err != nil {
+		t.Fatalf("Could not parse config: %s", err)
+	}
+	return storage.NewMemoryStorage(config)
+}
+
+func TestMemoryStorage(t *testing.T) {
+	s := initMemoryStorage(t)
+	defer s.Destroy()
+
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	testGetDirectory(t, s, testDir)
+	testCreateFile(t, s, testDir, "testFile1", "testData1")
+	testReadFile(t, s, testDir, "testFile1", "testData1")
+	testCreateFile(t, s, testDir, "testFile1", "testData2")
+	testReadFile(t, s, testDir, "testFile1", "testData2")
+
+	if _, err := s.CreateDirectory(testDir, 0755); !os.IsExist(err) {
+		t.Errorf("Creating twice a directory should fail with exist error: %s", err)
+	}
+	if _, err := s.CreateRegularFile("/missingDir/testFile", 0644, []byte("testData")); !os.IsNotExist(err) {
+		t.Errorf("Creating a file in a missing directory should fail with not exist error: %s", err)
+	}
+	if _, err := s.GetRegularFile(filepath.Join(testDir, "missingFile")); !os.IsNotExist(err) {
+		t.Errorf("Getting a missing file should fail with not exist error: %s", err)
+	}
+	if _, err := s.CreateDirectoryAndParents("/a/b/c", 0755); err != nil {
+		t.Errorf("Could not create directory and parents: %s", err)
+	}
+	testGetDirectory(t, s, "/a/b")
+	if _, err := s.RenameFile("/", "/a/root"); !os.IsPermission(err) {
+		t.Errorf("Renaming the root should fail with permission error: %s", err)
+	}
+
+	stats, err := s.DirectoryStats("/", true)
+	if err != nil || stats.Files != 1 || stats.Directories != 4 || stats.LogicalBytes != 9 {
+		t.Errorf("Stats %+v are different than expected: %s", stats, err)
+	}
+}
+
+func TestMemoryStorageLs(t *testing.T) {
+	s := initMemoryStorage(t)
+	testReadDir(t, s)
+	s.Destroy()
+	testReadDirPage(t, s)
+	s.Destroy()
+	testWalk(t, s)
+}
+
+// Initialize one storage doing its file operations through a fault injecting VFS
+func initFaultyStorage(t *testing.T, options string) (*storage.DiskStorage, *storage.FaultyFS, *config.Config) {
+	directory, err := ioutil.TempDir(os.TempDir(), "flocons-test")
+	if err != nil {
+		panic(err)
+	}
+	json_config := fmt.Sprintf(`{"node": {"name": "node-0"}, "storage": {"path": %q%s}}`, directory, options)
+	config, err := config.NewConfigFromJson([]byte(json_config))
+	if err != nil {
+		t.Errorf("Could not parse config %s: %s", json_config, err)
+		t.FailNow()
+	}
+	fs := storage.NewFaultyFS(storage.OS)
+	s, err := storage.NewStorageWithVFS(config, fs)
+	if err != nil {
+		t.Errorf("Could not mount storage on %s: %s", directory, err)
+		t.FailNow()
+	}
+	return s, fs, config
+}
+
+func TestStorageSyncFailure(t *testing.T) {
+	s, fs, config := initFaultyStorage(t, "")
+	defer s.Destroy()
+
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	fs.Inject(storage.Fault{Op: storage.FAULT_SYNC, Pattern: "files_*.tar", Nth: 3})
+	for i := 0; i < 4; i++ {
+		_, err := s.CreateRegularFile(fmt.Sprintf("%s/testFile%d", testDir, i), 0644, []byte("testData"))
+		if i == 2 && err == nil {
+			t.Error("Failed sync has not been reported to writer")
+		} else if i != 2 && err != nil {
+			t.Errorf("Could not create file %d: %s", i, err)
+		}
+	}
+	testReadFile(t, s, testDir, "testFile3", "testData")
+
+	// The file which could not be synced is never visible, even after a restart
+	if _, err := s.GetRegularFile(testDir + "/testFile2"); err == nil {
+		t.Error("File which could not be synced is visible")
+	}
+	s.Close()
+	s, err := storage.NewStorageWithVFS(config, fs)
+	if err != nil {
+		t.Fatalf("Could not reopen storage: %s", err)
+	}
+	if _, err := s.GetRegularFile(testDir + "/testFile2"); err == nil {
+		t.Error("File which could not be synced is visible after restart")
+	}
+	testReadFile(t, s, testDir, "testFile1", "testData")
+	testReadFile(t, s, testDir, "testFile3", "testData")
+}
+
+// Reader closing a channel once all its data has been read
+type signalingReader struct {
+	data []byte
+	done chan struct{}
+}
+
+func (r *signalingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		if r.done != nil {
+			close(r.done)
+			r.done = nil
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestStorageSyncFailureOfConcurrentWriters(t *testing.T) {
+	directory, err := ioutil.TempDir(os.TempDir(), "flocons-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(directory)
+	c, err := config.NewConfigFromJson([]byte(fmt.Sprintf(`{"node": {"name": "node-0"}, "storage": {"path": %q, "durability": "group", "group_commit_interval": "200ms"}}`, directory)))
+	if err != nil {
+		t.Fatalf("Could not parse config: %s", err)
+	}
+	fs := storage.NewFaultyFS(storage.OS)
+	container, err := storage.NewRegularFileContainerWithVFS(fs, directory, storage.NewRegularFileContainerName("shard-1", "node-0", 1), c, nil)
+	if err != nil {
+		t.Fatalf("Could not create container: %s", err)
+	}
+	defer container.Close()
+
+	// Both writers have written their file and wait for the group commit when the first sync fails
+	fs.Inject(storage.Fault{Op: storage.FAULT_SYNC, Pattern: "files_*.tar", Nth: 1})
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		reader := &signalingReader{data: []byte(fmt.Sprintf("testData%d", i)), done: make(chan struct{})}
+		done := reader.done
+		go func(id int) {
+			_, err := container.CopyRegularFile(fmt.Sprintf("testFile%d", id), 0644, time.Now(), reader, int64(len(reader.data)))
+			results <- err
+		}(i)
+		<-done
+	}
+	if err := container.Sync(); err == nil {
+		t.Error("Sync did not fail")
+	}
+
+	// The next commit succeeds as there is nothing left to sync, but the writers must not believe their data is durable
+	for i := 0; i < 2; i++ {
+		if err := <-results; err == nil {
+			t.Error("Writer of data discarded by a failed sync got no error")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := container.GetRegularFile(fmt.Sprintf("testFile%d", i)); err == nil {
+			t.Errorf("File %d which could not be synced is visible", i)
+		}
+	}
+}
+
+func TestStorageDiskFull(t *testing.T) {
+	s, fs, config := initFaultyStorage(t, "")
+	defer s.Destroy()
+
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	testCreateFile(t, s, testDir, "testFile0", "testData0")
+
+	// The disk gets full in the middle of the data of the next file
+	fs.Inject(storage.Fault{Op: storage.FAULT_WRITE, Pattern: "files_*.tar", AfterBytes: 1000, Err: syscall.ENOSPC})
+	if _, err := s.CreateRegularFile(testDir+"/bigFile", 0644, make([]byte, 10000)); err == nil {
+		t.Error("Write on full disk did not fail")
+	}
+	if _, err := s.GetRegularFile(testDir + "/bigFile"); err == nil {
+		t.Error("Partially written file is visible")
+	}
+
+	// Once space is freed, the container is still usable and readable after a restart
+	fs.Clear()
+	testCreateFile(t, s, testDir, "testFile1", "testData1")
+	testReadFile(t, s, testDir, "testFile0", "testData0")
+	testReadFile(t, s, testDir, "testFile1", "testData1")
+	s.Close()
+
+	s, err := storage.NewStorageWithVFS(config, fs)
+	if err != nil {
+		t.Errorf("Could not reopen storage: %s", err)
+		t.FailNow()
+	}
+	testReadFile(t, s, testDir, "testFile0", "testData0")
+	testReadFile(t, s, testDir, "testFile1", "testData1")
+	if files, err := s.ReadDir(testDir); err != nil || len(files) != 2 {
+		t.Errorf("Expected 2 files after restart, got %d: %v", len(files), err)
+	}
+}
+
+func TestStorageIndexWriteFailure(t *testing.T) {
+	s, fs, config := initFaultyStorage(t, "")
+	defer s.Destroy()
+
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	testCreateFile(t, s, testDir, "testFile0", "testData0")
+
+	// Data gets written to the container but never reaches the index, like a crash between both writes
+	fs.Inject(storage.Fault{Op: storage.FAULT_WRITE, Pattern: "index_*.csv", Nth: 1})
+	if _, err := s.CreateRegularFile(testDir+"/lostFile", 0644, []byte("lostData")); err == nil {
+		t.Error("Failed index write has not been reported to writer")
+	}
+	testCreateFile(t, s, testDir, "testFile1", "testData1")
+	s.Close()
+
+	s, err := storage.NewStorageWithVFS(config, fs)
+	if err != nil {
+		t.Errorf("Could not reopen storage: %s", err)
+		t.FailNow()
+	}
+	if _, err := s.GetRegularFile(testDir + "/lostFile"); err == nil {
+		t.Error("File missing from index is visible after restart")
+	}
+	testReadFile(t, s, testDir, "testFile0", "testData0")
+	testReadFile(t, s, testDir, "testFile1", "testData1")
+}
+
+func TestStorageIndexCreationFailure(t *testing.T) {
+	s, fs, _ := initFaultyStorage(t, "")
+	defer s.Destroy()
+
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	fs.Inject(storage.Fault{Op: storage.FAULT_OPEN, Pattern: "index_*"})
+	if _, err := s.CreateRegularFile(testDir+"/testFile", 0644, []byte("testData")); err == nil {
+		t.Error("Failed index creation has not been reported to writer")
+	}
+	if containers, _ := filepath.Glob(filepath.Join(s.MakeAbsolute(testDir), "files_*.tar")); len(containers) != 0 {
+		t.Errorf("Container without index has been left: %v", containers)
+	}
+
+	fs.Clear()
+	testCreateFile(t, s, testDir, "testFile", "testData")
+	testReadFile(t, s, testDir, "testFile", "testData")
+}
+
+func TestStorageReadFailure(t *testing.T) {
+	s, fs, _ := initFaultyStorage(t, "")
+	defer s.Destroy()
+
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	testCreateFile(t, s, testDir, "testFile", "testData")
+
+	fs.Inject(storage.Fault{Op: storage.FAULT_READ, Pattern: "files_*.tar"})
+	if f, err := s.GetRegularFile(testDir + "/testFile"); err == nil {
+		if _, err := f.(*file.FileInfo).Data(); err == nil {
+			t.Error("Read error has not been reported")
+		}
+	}
+	fs.Clear()
+	testReadFile(t, s, testDir, "testFile", "testData")
+}
+
+func TestStorageWatch(t *testing.T) {
+	ss := initStorages(t, 2)
+	defer ss[0].Destroy()
+
+	testDir := "/testDir"
+	testCreateDirectory(t, ss[0], testDir)
+	testCreateDirectory(t, ss[0], testDir+"/subDir")
+	testCreateFile(t, ss[0], testDir, "testFile", "testData")
+	testCreateFile(t, ss[0], testDir+"/subDir", "subFile", "testData")
+
+	events, _, err := ss[0].Watch(testDir, storage.WatchOptions{})
+	if err != nil {
+		t.Errorf("Could not watch %s: %s", testDir, err)
+		t.FailNow()
+	}
+	if len(events) != 3 || events[0].Type != storage.EVENT_MKDIR || events[1].Type != storage.EVENT_MKDIR ||
+		events[2].Type != storage.EVENT_CREATE || events[2].Path != testDir+"/testFile" || events[2].Node != "node-0" {
+		t.Errorf("Events of %s are different than expected: %+v", testDir, events)
+	}
+	events, _, _ = ss[0].Watch(testDir, storage.WatchOptions{Recursive: true, After: 2})
+	if len(events) != 2 || events[1].Path != testDir+"/subDir/subFile" || events[1].Sequence != 4 {
+		t.Errorf("Recursive events of %s are different than expected: %+v", testDir, events)
+	}
+
+	// Without matching events, watchers resume after the events already looked at
+	testCreateDirectory(t, ss[0], "/otherDir")
+	events, sequence, err := ss[0].Watch(testDir, storage.WatchOptions{After: 4})
+	if err != nil || len(events) != 0 || sequence != 5 {
+		t.Errorf("Watch without matching event returned %+v and sequence %d instead of 5: %v", events, sequence, err)
+	}
+
+	// Renamed files have a target
+	testCreateFile(t, ss[0], testDir, "renamedFile", "testData")
+	if _, err := ss[0].RenameFile(testDir+"/renamedFile", testDir+"/newName"); err != nil {
+		t.Fatalf("Could not rename file: %s", err)
+	}
+	events, _, _ = ss[0].Watch(testDir, storage.WatchOptions{After: 6})
+	if len(events) != 1 || events[0].Type != storage.EVENT_RENAME || events[0].Target != testDir+"/newName" {
+		t.Errorf("Rename event is different than expected: %+v", events)
+	}
+
+	// Files written by another node are found while waiting
+	after := ss[0].LastEventSequence()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		testCreateFile(t, ss[1], testDir, "otherFile1", "testData")
+		time.Sleep(2 * storage.WATCH_POLL_INTERVAL)
+		testCreateFile(t, ss[1], testDir, "otherFile2", "testData")
+	}()
+	for _, name := range []string{"otherFile1", "otherFile2"} {
+		events, _, err = ss[0].Watch(testDir, storage.WatchOptions{After: after, Timeout: 10 * time.Second})
+		if err != nil || len(events) != 1 || events[0].Path != testDir+"/"+name || events[0].Node != "node-1" {
+			t.Errorf("Event of the file %s written by another node is different than expected: %+v, %v", name, events, err)
+			t.FailNow()
+		}
+		after = events[0].Sequence
+	}
+
+	if _, _, err := ss[0].Watch(testDir, storage.WatchOptions{After: after + 10}); err == nil {
+		t.Error("Watch with a sequence number from the future did not fail")
+	}
+}
+
+func TestStorageJournal(t *testing.T) {
+	journalDirectory, err := ioutil.TempDir(os.TempDir(), "flocons-journal")
+	if err != nil {
+		panic(err)
+	}
+	directory, err := ioutil.TempDir(os.TempDir(), "flocons-test")
+	if err != nil {
+		panic(err)
+	}
+	config, err := config.NewConfigFromJson([]byte(fmt.Sprintf(`{"node": {"name": "node-0"}, "storage": {"path": %q, "journal_path": %q, "journal_segment_size": "200B", "journal_retention": "1h"}}`, directory, journalDirectory)))
+	if err != nil {
+		t.Fatalf("Could not parse config: %s", err)
+	}
+	s, err := storage.NewStorage(config)
+	if err != nil {
+		t.Fatalf("Could not mount storage: %s", err)
+	}
+	defer func() { s.Destroy() }()
+
+	testDir := "/testDir"
+	testCreateDirectory(t, s, testDir)
+	addresses := make(map[string]int64)
+	for i := 0; i < 10; i++ {
+		fi, err := s.CreateRegularFile(fmt.Sprintf("%s/testFile%d", testDir, i), 0644, []byte("testData"))
+		if err != nil {
+			t.Errorf("Could not create file %d: %s", i, err)
+			t.FailNow()
+		}
+		addresses[fi.Name()] = fi.(*file.FileInfo).Address()
+	}
+
+	records, err := s.ReadJournal(storage.JournalReadOptions{})
+	if err != nil || len(records) != 11 {
+		t.Errorf("Expected 11 journal records, got %d: %v", len(records), err)
+		t.FailNow()
+	}
+	if records[0].Type != storage.EVENT_MKDIR || records[0].Directory != "/" || records[0].Name != "testDir" {
+		t.Errorf("Directory creation record is different than expected: %+v", records[0])
+	}
+	for i, record := range records[1:] {
+		if record.Sequence != uint64(i+2) || record.Type != storage.EVENT_CREATE || record.Directory != testDir ||
+			record.Name != fmt.Sprintf("testFile%d", i) || record.Address != addresses[record.Name] || record.Container == "" {
+			t.Errorf("File creation record is different than expected: %+v", record)
+		}
+	}
+	if records, _ := s.ReadJournal(storage.JournalReadOptions{After: 5, Limit: 3}); len(records) != 3 || records[0].Sequence != 6 {
+		t.Errorf("Journal page is different than expected: %+v", records)
+	}
+	segments, _ := filepath.Glob(filepath.Join(journalDirectory, "journal_*"))
+	if len(segments) < 2 {
+		t.Errorf("Journal has not been rotated: %v", segments)
+	}
+
+	// Sequence numbers go on after a restart, and old segments are removed
+	s.Close()
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(segments[0], old, old)
+	s, err = storage.NewStorage(config)
+	if err != nil {
+		t.Errorf("Could not reopen storage: %s", err)
+		t.FailNow()
+	}
+	testCreateFile(t, s, testDir, "testFile10", "testData")
+	if records, err := s.ReadJournal(storage.JournalReadOptions{After: 11}); err != nil || len(records) != 1 || records[0].Sequence != 12 {
+		t.Errorf("Journal record after restart is different than expected: %+v, %v", records, err)
+	}
+	if _, err := s.ReadJournal(storage.JournalReadOptions{}); err == nil {
+		t.Error("Reading records removed by retention did not fail")
+	}
+}
+
+func TestStorageJournalTornRecord(t *testing.T) {
+	journalDirectory, err := ioutil.TempDir(os.TempDir(), "flocons-journal")
+	if err != nil {
+		panic(err)
+	}
+	s, _, config := initFaultyStorage(t, fmt.Sprintf(`, "journal_path": %q`, journalDirectory))
+	defer func() { s.Destroy() }()
+	testCreateDirectory(t, s, "/testDir")
+	testCreateFile(t, s, "/testDir", "testFile0", "testData")
+
+	// A crash while appending a record leaves it without its end
+	s.Close()
+	segments, _ := filepath.Glob(filepath.Join(journalDirectory, "journal_*"))
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Could not open journal segment: %s", err)
+	}
+	f.WriteString("3,1500000000000000000,create,/testDir,tornFile,,files_node-0_1.tar,1024,1")
+	f.Close()
+
+	if s, err = storage.NewStorageWithVFS(config, storage.OS); err != nil {
+		t.Fatalf("Could not reopen storage: %s", err)
+	}
+	testCreateFile(t, s, "/testDir", "testFile1", "testData")
+	records, err := s.ReadJournal(storage.JournalReadOptions{After: 1})
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Expected 2 journal records, got %+v: %v", records, err)
+	}
+	if records[0].Name != "testFile0" || records[1].Name != "testFile1" || records[1].Sequence != 3 || records[1].Size != 8 {
+		t.Errorf("Journal records after a torn record are different than expected: %+v", records)
+	}
+}
+
+func TestStorageJournalFailure(t *testing.T) {
+	journalDirectory, err := ioutil.TempDir(os.TempDir(), "flocons-journal")
+	if err != nil {
+		panic(err)
+	}
+	s, fs, _ := initFaultyStorage(t, fmt.Sprintf(`, "journal_path": %q`, journalDirectory))
+	defer s.Destroy()
+	testCreateDirectory(t, s, "/testDir")
+	testCreateFile(t, s, "/testDir", "testFile0", "testData")
+
+	// A change which could not be journaled is not visible
+	for _, fault := range []storage.Fault{
+		{Op: storage.FAULT_SYNC, Pattern: "journal_*"},
+		{Op: storage.FAULT_WRITE, Pattern: "journal_*", AfterBytes: 10},
+	} {
+		fs.Inject(fault)
+		if _, err := s.CreateRegularFile("/testDir/failedFile", 0644, []byte("failedData")); err == nil {
+			t.Errorf("Journal failure on %s has not been reported to writer", fault.Op)
+		}
+		if err := s.RemoveFile("/testDir/testFile0"); err == nil {
+			t.Errorf("Journal failure on %s has not been reported to remover", fault.Op)
+		}
+		fs.Clear()
+		if _, err := s.GetRegularFile("/testDir/failedFile"); !os.IsNotExist(err) {
+			t.Errorf("File is visible after journal failure on %s: %v", fault.Op, err)
+		}
+		testReadFile(t, s, "/testDir", "testFile0", "testData")
+	}
+
+	testCreateFile(t, s, "/testDir", "testFile1", "testData")
+	testReadFile(t, s, "/testDir", "testFile1", "testData")
+	records, err := s.ReadJournal(storage.JournalReadOptions{})
+	if err != nil || len(records) != 3 || records[2].Name != "testFile1" || records[2].Sequence != 3 {
+		t.Errorf("Journal records after failures are different than expected: %+v, %v", records, err)
+	}
+}
+
+func TestStorageJournalOffsets(t *testing.T) {
+	journalDirectory, err := ioutil.TempDir(os.TempDir(), "flocons-journal")
+	if err != nil {
+		panic(err)
+	}
+	s, _, config := initFaultyStorage(t, fmt.Sprintf(`, "journal_path": %q, "durability": "none"`, journalDirectory))
+	defer func() { s.Destroy() }()
+	testCreateDirectory(t, s, "/testDir")
+	for i := 0; i < 2500; i++ {
+		if _, err := s.CreateRegularFile(fmt.Sprintf("/testDir/testFile%d", i), 0644, []byte("testData")); err != nil {
+			t.Fatalf("Could not create file %d: %s", i, err)
+		}
+	}
+
+	for restart := 0; restart < 2; restart++ {
+		for _, after := range []uint64{0, 999, 1000, 1001, 2000, 2499} {
+			records, err := s.ReadJournal(storage.JournalReadOptions{After: after, Limit: 2})
+			if err != nil || len(records) != 2 || records[0].Sequence != after+1 || records[1].Sequence != after+2 {
+				t.Errorf("Journal page after %d is different than expected: %+v, %v", after, records, err)
+			} else if after > 0 && records[0].Name != fmt.Sprintf("testFile%d", after-1) {
+				t.Errorf("Journal record %d is different than expected: %+v", after+1, records[0])
+			}
+		}
+		// Offsets of the segment are rebuilt after a restart
+		s.Close()
+		if s, err = storage.NewStorageWithVFS(config, storage.OS); err != nil {
+			t.Fatalf("Could not reopen storage: %s", err)
+		}
+	}
+}
+
+func TestStorageFileChanges(t *testing.T) {
+	s := initStorages(t, 1)[0]
+	defer s.Destroy()
+	testFileChanges(t, s)
+
+	// Changes are kept in the indexes
+	s.Close()
+	if _, err := s.GetRegularFile("/testDir/removedFile"); !os.IsNotExist(err) {
+		t.Errorf("Removed file is back after reopening the storage: %v", err)
+	}
+	if fi, err := s.GetRegularFile("/testDir/renamedFile"); err != nil || fi.Mode() != 0600 {
+		t.Errorf("Renamed file changed after reopening the storage: %v, %v", fi, err)
+	}
+}
+
+func TestMemoryStorageFileChanges(t *testing.T) {
+	s := initMemoryStorage(t)
+	defer s.Destroy()
+	testFileChanges(t, s)
+}
+
+func testFileChanges(t *testing.T, s storage.Storage) {
+	testCreateDirectory(t, s, "/testDir")
+	testCreateDirectory(t, s, "/otherDir")
+	testCreateFile(t, s, "/testDir", "removedFile", "removedData")
+	testCreateFile(t, s, "/testDir", "testFile", "testData")
+
+	if err := s.RemoveFile("/testDir/removedFile"); err != nil {
+		t.Errorf("Could not remove file: %s", err)
+	}
+	if _, err := s.GetRegularFile("/testDir/removedFile"); !os.IsNotExist(err) {
+		t.Errorf("Removed file is still found: %v", err)
+	}
+	if err := s.RemoveFile("/testDir/removedFile"); !os.IsNotExist(err) {
+		t.Errorf("Removing a missing file should fail with not exist error: %v", err)
+	}
+
+	mode := os.FileMode(0600)
+	modTime := time.Unix(1500000000, 0)
+	fi, err := s.UpdateFile("/testDir/testFile", storage.FileChanges{Mode: &mode, ModTime: &modTime})
+	if err != nil || fi.Mode() != mode || !fi.ModTime().Equal(modTime) {
+		t.Errorf("Update of file returned %v, %v", fi, err)
+	}
+	testReadFile(t, s, "/testDir", "testFile", "testData")
+
+	if _, err := s.CopyFile("/testDir/testFile", "/otherDir/copiedFile"); err != nil {
+		t.Errorf("Could not copy file: %s", err)
+	}
+	testReadFile(t, s, "/otherDir", "copiedFile", "testData")
+	testReadFile(t, s, "/testDir", "testFile", "testData")
+
+	if fi, err := s.RenameFile("/testDir/testFile", "/testDir/renamedFile"); err != nil || fi.Name() != "renamedFile" || fi.Mode() != mode {
+		t.Errorf("Rename of file returned %v, %v", fi, err)
+	}
+	testReadFile(t, s, "/testDir", "renamedFile", "testData")
+	if _, err := s.GetRegularFile("/testDir/testFile"); !os.IsNotExist(err) {
+		t.Errorf("Renamed file is still found with its old name: %v", err)
+	}
+
+	copiedFileInfo, _ := s.GetRegularFile("/otherDir/copiedFile")
+	if fi, err := s.RenameFile("/otherDir/copiedFile", "/testDir/movedFile"); err != nil || fi.Name() != "movedFile" ||
+		copiedFileInfo == nil || !fi.ModTime().Equal(copiedFileInfo.ModTime()) {
+		t.Errorf("Move of file returned %v, %v", fi, err)
+	}
+	testReadFile(t, s, "/testDir", "movedFile", "testData")
+	if _, err := s.GetRegularFile("/otherDir/copiedFile"); !os.IsNotExist(err) {
+		t.Errorf("Moved file is still found at its old path: %v", err)
+	}
+	if err := s.RemoveFile("/testDir"); !IsNotEmptyError(err) {
+		t.Errorf("Removing a directory with files should fail with not empty error: %v", err)
+	}
+	if _, err := s.RenameFile("/testDir", "/testDir/sub"); err == nil {
+		t.Error("Directory has been moved into itself")
+	}
+
+	if fi, err := s.RenameFile("/otherDir", "/testDir/subDir"); err != nil || !fi.IsDir() {
+		t.Errorf("Rename of directory returned %v, %v", fi, err)
+	}
+	testGetDirectory(t, s, "/testDir/subDir")
+	if err := s.RemoveFile("/testDir/subDir"); err != nil {
+		t.Errorf("Could not remove empty directory: %s", err)
+	}
+	if _, err := s.GetDirectory("/testDir/subDir"); !os.IsNotExist(err) {
+		t.Errorf("Removed directory is still found: %v", err)
+	}
+	files, err := s.ReadDir("/testDir")
+	if err != nil || len(files) != 2 {
+		t.Errorf("Directory has %d entries instead of 2: %v", len(files), err)
+	}
+}
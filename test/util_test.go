@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/t-mind/flocons/file"
+	"github.com/t-mind/flocons/storage"
 )
 
 type FileService interface {
@@ -135,3 +136,61 @@ func testReadDir(t *testing.T, service FileService) {
 		}
 	}
 }
+
+type WalkService interface {
+	FileService
+	WalkWithOptions(string, storage.WalkOptions, storage.WalkFunc) error
+}
+
+func testWalk(t *testing.T, service WalkService) {
+	testDir := "/testDir"
+	service.CreateDirectory(testDir, 0755)
+	service.CreateDirectory(filepath.Join(testDir, "a"), 0755)
+	service.CreateDirectory(filepath.Join(testDir, "a", "aa"), 0755)
+	service.CreateDirectory(filepath.Join(testDir, "b"), 0755)
+	service.CreateRegularFile(filepath.Join(testDir, "a", "aa", "file-1"), 0644, []byte("testData"))
+	service.CreateRegularFile(filepath.Join(testDir, "a", "file-2"), 0644, []byte("testData"))
+	service.CreateRegularFile(filepath.Join(testDir, "b", "file-3"), 0644, []byte("testData"))
+	service.CreateRegularFile(filepath.Join(testDir, "file-4"), 0644, []byte("testData"))
+
+	walk := func(options storage.WalkOptions) []string {
+		paths := make([]string, 0)
+		err := service.WalkWithOptions(testDir, options, func(p string, fi os.FileInfo) error {
+			if filepath.Base(p) != fi.Name() {
+				t.Errorf("Name %s does not match path %s", fi.Name(), p)
+			}
+			paths = append(paths, p)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Could not walk directory %s: %s", testDir, err)
+		}
+		return paths
+	}
+	expected := []string{"a", "a/aa", "a/aa/file-1", "a/file-2", "b", "b/file-3", "file-4"}
+	if paths := walk(storage.WalkOptions{}); fmt.Sprint(paths) != fmt.Sprint(expected) {
+		t.Errorf("Walked paths %v are different than expected %v", paths, expected)
+	}
+	for i, after := range expected {
+		if paths := walk(storage.WalkOptions{After: after}); fmt.Sprint(paths) != fmt.Sprint(expected[i+1:]) {
+			t.Errorf("Walked paths after %s %v are different than expected %v", after, paths, expected[i+1:])
+		}
+	}
+	expectedDepth := []string{"a", "a/aa", "a/file-2", "b", "b/file-3", "file-4"}
+	if paths := walk(storage.WalkOptions{MaxDepth: 2}); fmt.Sprint(paths) != fmt.Sprint(expectedDepth) {
+		t.Errorf("Walked paths with depth 2 %v are different than expected %v", paths, expectedDepth)
+	}
+
+	paths := make([]string, 0)
+	service.WalkWithOptions(testDir, storage.WalkOptions{}, func(p string, fi os.FileInfo) error {
+		paths = append(paths, p)
+		if p == "a" {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	expectedSkip := []string{"a", "b", "b/file-3", "file-4"}
+	if fmt.Sprint(paths) != fmt.Sprint(expectedSkip) {
+		t.Errorf("Walked paths skipping a %v are different than expected %v", paths, expectedSkip)
+	}
+}